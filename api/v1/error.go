@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -34,3 +35,33 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrRecordDeleted is returned when reading a record that was deleted with a
+// tombstone.
+type ErrRecordDeleted struct {
+	Offset uint64
+}
+
+func (e ErrRecordDeleted) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("record deleted: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The requested record was deleted: %d",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrRecordDeleted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,28 @@
+package client
+
+import (
+	"context"
+
+	api "github.com/dati/api/v1"
+)
+
+// FetchAll reads every record in [start, end) from the log, paging through
+// ConsumeRange until the range is exhausted or the log runs out of records.
+func FetchAll(ctx context.Context, client api.LogClient, start, end uint64) ([]*api.Record, error) {
+	var records []*api.Record
+	for start < end {
+		res, err := client.ConsumeRange(ctx, &api.ConsumeRangeRequest{
+			StartOffset: start,
+			EndOffset:   end,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Records) == 0 {
+			break
+		}
+		records = append(records, res.Records...)
+		start = res.NextOffset
+	}
+	return records, nil
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	api "github.com/dati/api/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults used by RetryConfig fields left at zero.
+const (
+	DefaultRetryTimeout = 30 * time.Second
+	DefaultMinBackoff   = 50 * time.Millisecond
+	DefaultMaxBackoff   = 5 * time.Second
+)
+
+// RetryConfig controls how Dial and Client wait for an unavailable server.
+// Each wait doubles from MinBackoff up to MaxBackoff with random jitter, and
+// retrying stops once Timeout has elapsed.
+type RetryConfig struct {
+	Timeout    time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.Timeout == 0 {
+		c.Timeout = DefaultRetryTimeout
+	}
+	if c.MinBackoff == 0 {
+		c.MinBackoff = DefaultMinBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	return c
+}
+
+// backoff returns how long to wait before the given retry, counting from 0:
+// the exponential delay scaled by a random factor in [0.5, 1).
+func (c RetryConfig) backoff(retry int) time.Duration {
+	d := c.MaxBackoff
+	if retry < 32 && c.MinBackoff<<retry < c.MaxBackoff {
+		d = c.MinBackoff << retry
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Dial connects to target and waits until the connection is ready, letting
+// gRPC reconnect with the backoff from cfg. It fails if the server is still
+// unreachable after cfg.Timeout or when ctx is done.
+func Dial(ctx context.Context, target string, cfg RetryConfig, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	cfg = cfg.withDefaults()
+	opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+		Backoff: backoff.Config{
+			BaseDelay:  cfg.MinBackoff,
+			Multiplier: 2,
+			Jitter:     0.2,
+			MaxDelay:   cfg.MaxBackoff,
+		},
+		MinConnectTimeout: cfg.MaxBackoff,
+	}))
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return conn, nil
+		}
+		if state == connectivity.Idle {
+			conn.Connect()
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			conn.Close()
+			return nil, fmt.Errorf("client: %s not ready: %w", target, ctx.Err())
+		}
+	}
+}
+
+// Client is a LogClient whose Produce and Consume calls are retried while the
+// server answers codes.Unavailable, so they survive a server restart. A
+// retried Produce may append the record twice if the first attempt reached
+// the log; set ProducerId and SequenceNumber to make retries safe.
+type Client struct {
+	api.LogClient
+	conn  *grpc.ClientConn
+	retry RetryConfig
+}
+
+// New dials target with Dial and returns a Client on top of the connection.
+func New(ctx context.Context, target string, cfg RetryConfig, opts ...grpc.DialOption) (*Client, error) {
+	cfg = cfg.withDefaults()
+	conn, err := Dial(ctx, target, cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		LogClient: api.NewLogClient(conn),
+		conn:      conn,
+		retry:     cfg,
+	}, nil
+}
+
+// Produce calls LogClient.Produce, retrying while the server is unavailable.
+func (c *Client) Produce(ctx context.Context, req *api.ProduceRequest, opts ...grpc.CallOption) (res *api.ProduceResponse, err error) {
+	err = c.withRetry(ctx, func() error {
+		res, err = c.LogClient.Produce(ctx, req, opts...)
+		return err
+	})
+	return res, err
+}
+
+// Consume calls LogClient.Consume, retrying while the server is unavailable.
+func (c *Client) Consume(ctx context.Context, req *api.ConsumeRequest, opts ...grpc.CallOption) (res *api.ConsumeResponse, err error) {
+	err = c.withRetry(ctx, func() error {
+		res, err = c.LogClient.Consume(ctx, req, opts...)
+		return err
+	})
+	return res, err
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// withRetry runs call until it returns something other than
+// codes.Unavailable, waiting between attempts, and gives up with the last
+// error once the next wait would go past the retry timeout.
+func (c *Client) withRetry(ctx context.Context, call func() error) error {
+	deadline := time.Now().Add(c.retry.Timeout)
+	for retry := 0; ; retry++ {
+		err := call()
+		if status.Code(err) != codes.Unavailable {
+			return err
+		}
+		wait := c.retry.backoff(retry)
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/dati/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type echoServer struct {
+	api.UnimplementedLogServer
+}
+
+func (echoServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	return &api.ProduceResponse{Offset: 7}, nil
+}
+
+// serveLater starts a Log server on addr after delay and returns a function
+// that stops it.
+func serveLater(t *testing.T, addr string, delay time.Duration) func() {
+	t.Helper()
+	srv := grpc.NewServer()
+	api.RegisterLogServer(srv, echoServer{})
+	go func() {
+		time.Sleep(delay)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		srv.Serve(l)
+	}()
+	return srv.Stop
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+func TestClientWaitsForServer(t *testing.T) {
+	addr := freeAddr(t)
+	cfg := RetryConfig{
+		Timeout:    5 * time.Second,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 100 * time.Millisecond,
+	}
+	creds := grpc.WithTransportCredentials(insecure.NewCredentials())
+
+	// the client starts before the server
+	stop := serveLater(t, addr, 300*time.Millisecond)
+	c, err := New(context.Background(), addr, cfg, creds)
+	require.NoError(t, err)
+	defer c.Close()
+	res, err := c.Produce(context.Background(), &api.ProduceRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.Offset)
+
+	// Produce keeps retrying while the server restarts
+	stop()
+	stop = serveLater(t, addr, 300*time.Millisecond)
+	defer stop()
+	res, err = c.Produce(context.Background(), &api.ProduceRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.Offset)
+}
+
+func TestDialTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	start := time.Now()
+	_, err := Dial(context.Background(), addr, RetryConfig{
+		Timeout:    200 * time.Millisecond,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	}, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
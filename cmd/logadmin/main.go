@@ -0,0 +1,129 @@
+// Command logadmin calls the admin service of a running log server.
+//
+// Usage:
+//
+//	logadmin [flags] stats
+//	logadmin [flags] compact
+//	logadmin [flags] rotate
+//	logadmin [flags] truncate <offset>
+//	logadmin [flags] set-config [-max-store-bytes n] [-max-index-bytes n]
+//	logadmin [flags] diff <start-offset> [end-offset]
+//
+// The admin port requires mTLS, so -cert, -key and -ca must point at a client
+// certificate signed by the admin CA and at that CA.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"github.com/dati/config"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8081", "admin server address")
+	cert := flag.String("cert", "", "client certificate file")
+	key := flag.String("key", "", "client key file")
+	ca := flag.String("ca", "", "admin CA file")
+	serverName := flag.String("server-name", "", "name on the server certificate, if not the host in -addr")
+	timeout := flag.Duration("timeout", 30*time.Second, "time limit for the call")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"usage: %s [flags] stats|compact|rotate|truncate <offset>|set-config [flags]|diff <start> [end]\n",
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      *cert,
+		KeyFile:       *key,
+		CAFile:        *ca,
+		ServerAddress: *serverName,
+	})
+	if err != nil {
+		fatal(err)
+	}
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		fatal(err)
+	}
+	defer conn.Close()
+	client := api.NewAdminServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	res, err := run(ctx, client, flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fatal(err)
+	}
+	out, err := protojson.MarshalOptions{Multiline: true, EmitUnpopulated: true}.Marshal(res)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println(string(out))
+}
+
+// run calls the RPC for cmd with the remaining command line arguments.
+func run(ctx context.Context, client api.AdminServiceClient, cmd string, args []string) (proto.Message, error) {
+	switch cmd {
+	case "stats":
+		return client.GetStats(ctx, &api.GetStatsRequest{})
+	case "compact":
+		return client.TriggerCompaction(ctx, &api.CompactionRequest{})
+	case "rotate":
+		return client.RotateSegment(ctx, &api.RotateRequest{})
+	case "truncate":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("truncate takes one offset")
+		}
+		off, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q: %w", args[0], err)
+		}
+		return client.TruncateToOffset(ctx, &api.TruncateRequest{Offset: off})
+	case "set-config":
+		fs := flag.NewFlagSet("set-config", flag.ExitOnError)
+		maxStore := fs.Uint64("max-store-bytes", 0, "store limit for new segments; 0 keeps the current one")
+		maxIndex := fs.Uint64("max-index-bytes", 0, "index limit for new segments; 0 keeps the current one")
+		fs.Parse(args)
+		return client.SetConfig(ctx, &api.ConfigPatch{
+			MaxStoreBytes: *maxStore,
+			MaxIndexBytes: *maxIndex,
+		})
+	case "diff":
+		if len(args) != 1 && len(args) != 2 {
+			return nil, fmt.Errorf("diff takes a start offset and an optional end offset")
+		}
+		var offsets [2]uint64
+		for i, arg := range args {
+			off, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid offset %q: %w", arg, err)
+			}
+			offsets[i] = off
+		}
+		return client.DiffLogs(ctx, &api.DiffRequest{StartOffset: offsets[0], EndOffset: offsets[1]})
+	}
+	return nil, fmt.Errorf("unknown command %q", cmd)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "logadmin:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,223 @@
+// Command logserver runs the Log gRPC service over a commit log on disk.
+//
+// Usage:
+//
+//	logserver [-config file]
+//
+// The configuration file is YAML (or JSON) as read by config.LoadConfig.
+// Without -config every field takes its default. The Log service listens on
+// port, the admin service on admin.port and, if http.port is set, the HTTP
+// monitoring API on http.port. On SIGINT or SIGTERM the servers finish the
+// requests in flight and the log is closed before exiting.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dati/auth"
+	"github.com/dati/config"
+	"github.com/dati/log"
+	"github.com/dati/server"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func main() {
+	configFile := flag.String("config", "", "server configuration file")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fatal(err)
+	}
+	var ls listeners
+	if ls.grpc, err = net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port)); err != nil {
+		fatal(err)
+	}
+	if ls.admin, err = net.Listen("tcp", fmt.Sprintf(":%d", cfg.Admin.Port)); err != nil {
+		ls.close()
+		fatal(err)
+	}
+	if cfg.HTTP.Port != 0 {
+		if ls.http, err = net.Listen("tcp", fmt.Sprintf(":%d", cfg.HTTP.Port)); err != nil {
+			ls.close()
+			fatal(err)
+		}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	if err := run(cfg, ls, sigs); err != nil {
+		fatal(err)
+	}
+}
+
+// listeners are the sockets run serves on. main opens them on the configured
+// ports; tests pass their own.
+type listeners struct {
+	grpc  net.Listener // Log service
+	admin net.Listener // Admin service
+	http  net.Listener // HTTP monitoring API; nil when http.port is not set
+}
+
+func (ls listeners) close() {
+	for _, l := range []net.Listener{ls.grpc, ls.admin, ls.http} {
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+// run serves the log on ls until a signal arrives on sigs. It then stops the
+// servers gracefully, letting in-flight requests finish, and closes the log so
+// buffered records reach the disk.
+func run(cfg config.ServerConfig, ls listeners, sigs <-chan os.Signal) error {
+	var logConfig log.Config
+	logConfig.Segment.MaxStoreBytes = cfg.MaxStoreBytes
+	logConfig.Segment.MaxIndexBytes = cfg.MaxIndexBytes
+	clog, err := log.NewLog(cfg.DataDir, logConfig)
+	if err != nil {
+		ls.close()
+		return err
+	}
+
+	var creds grpc.ServerOption
+	if cfg.TLS.ReloadInterval > 0 {
+		creds = server.WithTLSCredentialsWatcher(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile, cfg.TLS.ReloadInterval)
+	} else {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile: cfg.TLS.CertFile,
+			KeyFile:  cfg.TLS.KeyFile,
+			CAFile:   cfg.TLS.CAFile,
+			Server:   true,
+		})
+		if err != nil {
+			ls.close()
+			return errors.Join(err, clog.Close())
+		}
+		creds = grpc.Creds(credentials.NewTLS(tlsConfig))
+	}
+	authorizer := auth.New(cfg.ACL.ModelFile, cfg.ACL.PolicyFile)
+	var commitLog server.CommitLog = clog
+	if cfg.CircuitBreaker.MaxFailures > 0 {
+		commitLog = log.NewCircuitBreaker(clog, log.CircuitBreakerConfig{
+			MaxFailures:          cfg.CircuitBreaker.MaxFailures,
+			HalfOpenWaitDuration: cfg.CircuitBreaker.HalfOpenWait,
+		})
+	}
+	metrics := server.NewMetrics(clog)
+	srv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:       commitLog,
+		Authorizer:      authorizer,
+		MaxMessageBytes: cfg.GRPC.MaxMessageBytes,
+		Metrics:         metrics,
+	}, creds)
+	if err != nil {
+		ls.close()
+		return errors.Join(err, clog.Close())
+	}
+	adminSrv, err := newAdminServer(cfg, clog, authorizer)
+	if err != nil {
+		ls.close()
+		return errors.Join(err, clog.Close())
+	}
+
+	// Canceled on shutdown to close the record streams, which
+	// http.Server.Shutdown doesn't track.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	httpSrv := &http.Server{
+		Handler: server.NewHTTPHandler(clog,
+			server.WithShutdown(ctx),
+			server.WithMetrics(metrics),
+			server.WithMaxBodyBytes(cfg.HTTP.MaxRequestBodyBytes),
+		),
+	}
+
+	serveErr := make(chan error, 3)
+	servers := 2
+	go func() { serveErr <- srv.Serve(ls.grpc) }()
+	go func() { serveErr <- adminSrv.Serve(ls.admin) }()
+	attrs := []any{
+		slog.String("addr", ls.grpc.Addr().String()),
+		slog.String("adminAddr", ls.admin.Addr().String()),
+		slog.String("dir", cfg.DataDir),
+	}
+	if ls.http != nil {
+		servers++
+		go func() {
+			if err := httpSrv.Serve(ls.http); err != http.ErrServerClosed {
+				serveErr <- err
+				return
+			}
+			serveErr <- nil
+		}()
+		attrs = append(attrs, slog.String("httpAddr", ls.http.Addr().String()))
+	}
+	slog.Info("serving", attrs...)
+
+	select {
+	case sig := <-sigs:
+		slog.Info("shutting down", slog.String("signal", sig.String()))
+		cancel()
+		err = httpSrv.Shutdown(context.Background())
+		srv.GracefulStop()
+		adminSrv.GracefulStop()
+	case err = <-serveErr:
+		servers--
+		cancel()
+		httpSrv.Close()
+		srv.Stop()
+		adminSrv.Stop()
+	}
+	for range servers {
+		err = errors.Join(err, <-serveErr)
+	}
+	return errors.Join(err, clog.Close())
+}
+
+// newAdminServer returns the admin gRPC server. Its clients need a
+// certificate signed by admin.ca_file; without one configured they need one
+// signed by tls.ca_file and the ACL's "admin" action. The certificates are
+// read once, even with tls.reload_interval.
+func newAdminServer(cfg config.ServerConfig, clog *log.Log, authorizer *auth.Authorizer) (*grpc.Server, error) {
+	adminConfig := &server.AdminConfig{Log: clog}
+	caFile := cfg.Admin.CAFile
+	if caFile == "" {
+		caFile = cfg.TLS.CAFile
+		adminConfig.Authorizer = authorizer
+	}
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: cfg.TLS.CertFile,
+		KeyFile:  cfg.TLS.KeyFile,
+		CAFile:   caFile,
+		Server:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server.NewAdminServer(adminConfig, grpc.Creds(credentials.NewTLS(tlsConfig)))
+}
+
+// loadConfig reads the configuration file, or returns the defaults when
+// there is none.
+func loadConfig(path string) (config.ServerConfig, error) {
+	if path == "" {
+		return config.DefaultServerConfig(), nil
+	}
+	return config.LoadConfig(path)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "logserver:", err)
+	os.Exit(1)
+}
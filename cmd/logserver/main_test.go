@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"github.com/dati/config"
+	"github.com/dati/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestRunGracefulShutdown(t *testing.T) {
+	cfg := config.DefaultServerConfig()
+	cfg.DataDir = t.TempDir()
+	cfg.Admin.CAFile = config.CAFile
+	cfg.HTTP.MaxRequestBodyBytes = 16
+	var ls listeners
+	var err error
+	ls.grpc, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ls.admin, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ls.http, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() { done <- run(cfg, ls, sigs) }()
+
+	tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.RootClientCertFile,
+		KeyFile:  config.RootClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	require.NoError(t, err)
+	creds := grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	conn, err := grpc.NewClient(ls.grpc.Addr().String(), creds)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var offsets []uint64
+	for _, value := range []string{"first", "second"} {
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+		offsets = append(offsets, res.Offset)
+	}
+
+	// the admin service answers on its own port
+	adminConn, err := grpc.NewClient(ls.admin.Addr().String(), creds)
+	require.NoError(t, err)
+	defer adminConn.Close()
+	stats, err := api.NewAdminServiceClient(adminConn).GetStats(ctx, &api.GetStatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), stats.RecordCount)
+
+	// and so does the HTTP API, with the metrics of the gRPC server
+	httpURL := "http://" + ls.http.Addr().String()
+	res, err := http.Get(httpURL + "/record/-1")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	record := &api.Record{}
+	require.NoError(t, protojson.Unmarshal(body, record))
+	require.Equal(t, "second", string(record.Value))
+	res, err = http.Get(httpURL + "/metrics")
+	require.NoError(t, err)
+	body, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Contains(t, string(body), "log_append_duration_seconds_count 2\n")
+	res, err = http.Post(httpURL+"/offsets", "text/plain", strings.NewReader(strings.Repeat("x", 17)))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	sigs <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+
+	_, err = http.Get(httpURL + "/health")
+	require.Error(t, err, "the HTTP server is still up")
+
+	// el log quedó cerrado y los registros siguen en disco
+	clog, err := log.NewLog(cfg.DataDir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	for i, value := range []string{"first", "second"} {
+		record, err := clog.Read(offsets[i])
+		require.NoError(t, err)
+		require.Equal(t, value, string(record.Value))
+	}
+}
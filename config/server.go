@@ -0,0 +1,168 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServerConfig is the configuration of a log server, read by LoadConfig.
+type ServerConfig struct {
+	// DataDir is where the commit log keeps its segments.
+	DataDir string `yaml:"data_dir"`
+	Port    int    `yaml:"port"`
+	// MaxStoreBytes and MaxIndexBytes are the segment limits of the log.
+	MaxStoreBytes uint64 `yaml:"max_store_bytes"`
+	MaxIndexBytes uint64 `yaml:"max_index_bytes"`
+	TLS           struct {
+		CertFile string `yaml:"cert_file"`
+		KeyFile  string `yaml:"key_file"`
+		CAFile   string `yaml:"ca_file"`
+		// ReloadInterval, if set, rereads the files at most this often so
+		// rotated certificates are used without a restart.
+		ReloadInterval time.Duration `yaml:"reload_interval"`
+	} `yaml:"tls"`
+	ACL struct {
+		ModelFile  string `yaml:"model_file"`
+		PolicyFile string `yaml:"policy_file"`
+	} `yaml:"acl"`
+	GRPC struct {
+		// MaxMessageBytes is the largest request the gRPC server accepts.
+		MaxMessageBytes int `yaml:"max_message_bytes"`
+	} `yaml:"grpc"`
+	// CircuitBreaker stops appends after MaxFailures consecutive failures
+	// until HalfOpenWait has passed. Zero MaxFailures leaves it off.
+	CircuitBreaker struct {
+		MaxFailures  int           `yaml:"max_failures"`
+		HalfOpenWait time.Duration `yaml:"half_open_wait"`
+	} `yaml:"circuit_breaker"`
+	// Admin is the admin service, served on its own port with the server's
+	// TLS certificate so it can be firewalled apart from the Log service.
+	Admin struct {
+		Port int `yaml:"port"`
+		// CAFile is the CA that signs admin client certificates; any client
+		// it signed is an admin. Left empty, the admin port trusts
+		// tls.ca_file instead and the ACL must also allow the client the
+		// "admin" action.
+		CAFile string `yaml:"ca_file"`
+	} `yaml:"admin"`
+	// HTTP is the monitoring API of server.NewHTTPHandler. It has no
+	// authentication and serves records to anyone who reaches it, so it is
+	// off unless Port is set.
+	HTTP struct {
+		Port int `yaml:"port"`
+		// MaxRequestBodyBytes is the largest request body the HTTP API
+		// accepts; larger ones get 413.
+		MaxRequestBodyBytes int64 `yaml:"max_request_body_bytes"`
+	} `yaml:"http"`
+}
+
+// Defaults used by LoadConfig for fields the file leaves out.
+const (
+	DefaultDataDir       = "/tmp/commitlog"
+	DefaultPort          = 8080
+	DefaultAdminPort     = 8081
+	DefaultMaxStoreBytes = 1024
+	DefaultMaxIndexBytes = 1024
+	// DefaultMaxMessageBytes matches gRPC's own receive limit.
+	DefaultMaxMessageBytes = 4 << 20
+	// DefaultMaxRequestBodyBytes matches server.DefaultMaxBodyBytes.
+	DefaultMaxRequestBodyBytes = 1 << 20
+)
+
+// LoadConfig reads a server configuration from the YAML file at path. JSON is
+// valid YAML, so a JSON file works too. Unknown fields are an error, and
+// missing ones get the defaults above; the TLS and ACL files default to the
+// ones under CONFIG_DIR.
+func LoadConfig(path string) (ServerConfig, error) {
+	var c ServerConfig
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return c, fmt.Errorf("config %s: %w", path, err)
+	}
+	c.setDefaults()
+	if c.Port < 1 || c.Port > 65535 {
+		return c, fmt.Errorf("config %s: port %d out of range", path, c.Port)
+	}
+	if c.Admin.Port < 1 || c.Admin.Port > 65535 {
+		return c, fmt.Errorf("config %s: admin.port %d out of range", path, c.Admin.Port)
+	}
+	if c.Admin.Port == c.Port {
+		return c, fmt.Errorf("config %s: admin.port is the same as port", path)
+	}
+	if c.HTTP.Port < 0 || c.HTTP.Port > 65535 {
+		return c, fmt.Errorf("config %s: http.port %d out of range", path, c.HTTP.Port)
+	}
+	if c.HTTP.Port != 0 && (c.HTTP.Port == c.Port || c.HTTP.Port == c.Admin.Port) {
+		return c, fmt.Errorf("config %s: http.port is already taken", path)
+	}
+	if c.HTTP.MaxRequestBodyBytes < 0 {
+		return c, fmt.Errorf("config %s: negative http.max_request_body_bytes", path)
+	}
+	if c.GRPC.MaxMessageBytes < 0 {
+		return c, fmt.Errorf("config %s: negative grpc.max_message_bytes", path)
+	}
+	if c.TLS.ReloadInterval < 0 {
+		return c, fmt.Errorf("config %s: negative tls.reload_interval", path)
+	}
+	if c.CircuitBreaker.MaxFailures < 0 || c.CircuitBreaker.HalfOpenWait < 0 {
+		return c, fmt.Errorf("config %s: negative circuit_breaker setting", path)
+	}
+	return c, nil
+}
+
+// DefaultServerConfig returns the configuration LoadConfig gives an empty file.
+func DefaultServerConfig() ServerConfig {
+	var c ServerConfig
+	c.setDefaults()
+	return c
+}
+
+func (c *ServerConfig) setDefaults() {
+	if c.DataDir == "" {
+		c.DataDir = DefaultDataDir
+	}
+	if c.Port == 0 {
+		c.Port = DefaultPort
+	}
+	if c.Admin.Port == 0 {
+		c.Admin.Port = DefaultAdminPort
+	}
+	if c.MaxStoreBytes == 0 {
+		c.MaxStoreBytes = DefaultMaxStoreBytes
+	}
+	if c.MaxIndexBytes == 0 {
+		c.MaxIndexBytes = DefaultMaxIndexBytes
+	}
+	if c.GRPC.MaxMessageBytes == 0 {
+		c.GRPC.MaxMessageBytes = DefaultMaxMessageBytes
+	}
+	if c.HTTP.MaxRequestBodyBytes == 0 {
+		c.HTTP.MaxRequestBodyBytes = DefaultMaxRequestBodyBytes
+	}
+	if c.TLS.CertFile == "" {
+		c.TLS.CertFile = ServerCertFile
+	}
+	if c.TLS.KeyFile == "" {
+		c.TLS.KeyFile = ServerKeyFile
+	}
+	if c.TLS.CAFile == "" {
+		c.TLS.CAFile = CAFile
+	}
+	if c.ACL.ModelFile == "" {
+		c.ACL.ModelFile = ACLModelFile
+	}
+	if c.ACL.PolicyFile == "" {
+		c.ACL.PolicyFile = ACLPolicyFile
+	}
+}
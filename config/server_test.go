@@ -0,0 +1,126 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, "server.yaml", `
+data_dir: /var/lib/commitlog
+port: 9090
+max_store_bytes: 4096
+tls:
+  cert_file: /etc/log/server.pem
+  key_file: /etc/log/server-key.pem
+  reload_interval: 1m
+`)
+	c, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, "/var/lib/commitlog", c.DataDir)
+	require.Equal(t, 9090, c.Port)
+	require.Equal(t, uint64(4096), c.MaxStoreBytes)
+	require.Equal(t, "/etc/log/server.pem", c.TLS.CertFile)
+	require.Equal(t, "/etc/log/server-key.pem", c.TLS.KeyFile)
+	require.Equal(t, time.Minute, c.TLS.ReloadInterval)
+
+	// the fields the file leaves out get their defaults
+	require.Equal(t, uint64(DefaultMaxIndexBytes), c.MaxIndexBytes)
+	require.Equal(t, CAFile, c.TLS.CAFile)
+	require.Equal(t, ACLModelFile, c.ACL.ModelFile)
+	require.Equal(t, ACLPolicyFile, c.ACL.PolicyFile)
+	require.Equal(t, DefaultMaxMessageBytes, c.GRPC.MaxMessageBytes)
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfig(t, "server.json", `{"port": 7070, "max_index_bytes": 2048}`)
+	c, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, 7070, c.Port)
+	require.Equal(t, uint64(2048), c.MaxIndexBytes)
+	require.Equal(t, DefaultDataDir, c.DataDir)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, "empty.yaml", ""))
+	require.NoError(t, err)
+	require.Equal(t, DefaultServerConfig(), c)
+	require.Equal(t, DefaultPort, c.Port)
+	require.Equal(t, DefaultDataDir, c.DataDir)
+}
+
+func TestLoadConfigCircuitBreaker(t *testing.T) {
+	path := writeConfig(t, "server.yaml", `
+circuit_breaker:
+  max_failures: 3
+  half_open_wait: 30s
+`)
+	c, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, 3, c.CircuitBreaker.MaxFailures)
+	require.Equal(t, 30*time.Second, c.CircuitBreaker.HalfOpenWait)
+}
+
+func TestLoadConfigAdmin(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, "server.yaml", `
+admin:
+  port: 9091
+  ca_file: /etc/log/admin-ca.pem
+`))
+	require.NoError(t, err)
+	require.Equal(t, 9091, c.Admin.Port)
+	require.Equal(t, "/etc/log/admin-ca.pem", c.Admin.CAFile)
+
+	// without an admin section the admin port is the default and trusts tls.ca_file
+	c = DefaultServerConfig()
+	require.Equal(t, DefaultAdminPort, c.Admin.Port)
+	require.Empty(t, c.Admin.CAFile)
+}
+
+func TestLoadConfigHTTP(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, "server.yaml", "http: {port: 8082, max_request_body_bytes: 4096}"))
+	require.NoError(t, err)
+	require.Equal(t, 8082, c.HTTP.Port)
+	require.Equal(t, int64(4096), c.HTTP.MaxRequestBodyBytes)
+
+	// the HTTP API is off by default, with a 1 MiB body limit once it's on
+	c = DefaultServerConfig()
+	require.Zero(t, c.HTTP.Port)
+	require.Equal(t, int64(DefaultMaxRequestBodyBytes), c.HTTP.MaxRequestBodyBytes)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"malformed":             "port: [8080",
+		"wrong type":            "port: eighty",
+		"negative size":         "max_store_bytes: -1",
+		"unknown field":         "prot: 8080",
+		"port too big":          "port: 70000",
+		"negative message size": "grpc: {max_message_bytes: -1}",
+		"negative breaker wait": "circuit_breaker: {half_open_wait: -1s}",
+		"admin port too big":    "admin: {port: 70000}",
+		"admin port taken":      "port: 8081",
+		"http port too big":     "http: {port: 70000}",
+		"http port taken":       "http: {port: 8080}",
+		"negative body limit":   "http: {max_request_body_bytes: -1}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfig(t, "server.yaml", content))
+			require.Error(t, err)
+		})
+	}
+
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,12 @@
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocate reserva los bloques del archivo hasta size con fallocate, así el
+// sistema de archivos puede asignarlos contiguos.
+func allocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, 0, size)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package log
+
+import (
+	"os"
+)
+
+// allocate agranda el archivo hasta size. Sin fallocate el archivo puede quedar
+// disperso, pero el tamaño queda fijo y no crece en cada escritura.
+func allocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
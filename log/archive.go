@@ -0,0 +1,222 @@
+package log
+
+// Este archivo mueve segmentos sellados a otro directorio, por ejemplo a un
+// disco más lento y barato, sin que dejen de poder leerse a través del log.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// linkFile crea el .tmp de destino de una mudanza sin copiar datos cuando los
+// directorios están en el mismo disco. Es una variable para que los tests
+// puedan simular una mudanza entre discos.
+var linkFile = os.Link
+
+// MoveTo mueve los archivos del segmento, que debe estar sellado, al directorio
+// dir y lo vuelve a abrir desde ahí. Las lecturas esperan mientras dura. Primero
+// deja en dir una copia .tmp de cada archivo, con un hard link o copiando y
+// sincronizando si dir está en otro disco; después escribe en el directorio de
+// origen un marcador .move con el destino, y recién entonces renombra las
+// copias y borra los originales. Si el proceso muere antes del marcador quedan
+// los originales; si muere después, el log termina la mudanza al abrirse.
+func (s *Segment) MoveTo(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sealed {
+		return fmt.Errorf("log: segment %d is not sealed", s.baseOffset)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if dir == s.dir {
+		return nil // Ya está ahí
+	}
+	if err := s.close(); err != nil {
+		return err
+	}
+	names := []string{path.Base(s.store.Name()), path.Base(s.index.Name())}
+	for _, extra := range []string{s.metaPath(), s.integrityPath()} {
+		if _, err := os.Stat(extra); err == nil {
+			names = append(names, path.Base(extra)) // Close ya escribió la integridad
+		}
+	}
+	reopen := func(dir string) error {
+		moved, err := openSealedSegment(dir, s.baseOffset, s.config)
+		if err != nil {
+			return err
+		}
+		s.store, s.index, s.dir, s.meta = moved.store, moved.index, moved.dir, moved.meta
+		s.closed = false
+		return nil
+	}
+	if err := stageMove(s.dir, dir, names); err != nil {
+		removeStaged(dir, names)
+		return errors.Join(err, reopen(s.dir)) // El segmento sigue donde estaba
+	}
+	marker := path.Join(s.dir, strings.TrimSuffix(names[0], ".store")+".move")
+	if err := writeFileAtomic(marker, []byte(strings.Join(append([]string{dir}, names...), "\n")), 0644); err != nil {
+		removeStaged(dir, names)
+		return errors.Join(err, reopen(s.dir))
+	}
+	if err := finishMove(s.dir, marker); err != nil {
+		// El marcador queda y el log termina la mudanza al abrirse; mientras
+		// tanto el segmento se abre donde estén los archivos completos.
+		if rerr := reopen(dir); rerr != nil {
+			return errors.Join(err, reopen(s.dir))
+		}
+		return err
+	}
+	return reopen(dir)
+}
+
+// stageMove deja en dst una copia name.tmp de cada archivo de src, sincronizada
+// a disco.
+func stageMove(src, dst string, names []string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, name := range names {
+		from, to := path.Join(src, name), path.Join(dst, name+".tmp")
+		if err := linkFile(from, to); err != nil {
+			if err = copyFile(from, to); err != nil { // Otro disco: no se puede enlazar
+				return err
+			}
+		}
+	}
+	return syncDir(dst)
+}
+
+// removeStaged borra las copias .tmp de una mudanza que no llegó al marcador.
+func removeStaged(dst string, names []string) {
+	for _, name := range names {
+		os.Remove(path.Join(dst, name+".tmp"))
+	}
+}
+
+// finishMove completa la mudanza que describe el marcador de src: renombra las
+// copias del destino a su nombre definitivo, borra los originales y después el
+// marcador. Es idempotente, así que sirve para terminar una mudanza a medias.
+func finishMove(src, marker string) error {
+	b, err := os.ReadFile(marker)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(b), "\n")
+	dst, names := lines[0], lines[1:]
+	for _, name := range names {
+		err := os.Rename(path.Join(dst, name+".tmp"), path.Join(dst, name))
+		if err != nil && !os.IsNotExist(err) { // Si no existe, ya se había renombrado
+			return err
+		}
+	}
+	if err := syncDir(dst); err != nil {
+		return err // Los nombres nuevos tienen que estar en disco antes de borrar los originales
+	}
+	for _, name := range names {
+		if err := os.Remove(path.Join(src, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Remove(marker)
+}
+
+// recoverMoves completa las mudanzas de segmentos que salen de dir y quedaron
+// a medias por una caída.
+func recoverMoves(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if path.Ext(file.Name()) == ".move" {
+			if err = finishMove(dir, path.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyFile copia src en dst y lo sincroniza a disco.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm()) // Conserva los permisos del original
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir sincroniza las entradas del directorio dir, para que un archivo
+// recién creado o renombrado sobreviva a una caída.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// ArchiveBefore mueve con Segment.MoveTo a dir todos los segmentos sellados
+// cuyos registros son anteriores a offset, y retorna cuántos movió. Los
+// registros se siguen leyendo a través del log. Si dir no es un directorio del
+// log lo agrega a Config.ArchiveDirs; para que los segmentos se encuentren al
+// reabrir el log, dir también tiene que estar en su configuración.
+func (l *Log) ArchiveBefore(offset uint64, dir string) (int, error) {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.Lock()
+	defer l.unlock()
+	if !slices.Contains(l.dirs(), filepath.Clean(dir)) {
+		if err := prepareDir(dir); err != nil {
+			return 0, err
+		}
+		lock, err := LockDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		l.locks = append(l.locks, lock)
+		l.Config.ArchiveDirs = append(l.Config.ArchiveDirs, dir)
+	}
+	moved := 0
+	for _, s := range l.segments {
+		if s == l.activeSegment || s.nextOffset > offset {
+			break // Los segmentos están ordenados; el resto tiene registros desde offset
+		}
+		from := s.dir
+		if err := s.MoveTo(dir); err != nil {
+			return moved, err
+		}
+		if s.dir != from {
+			moved++
+			l.logger.Info("segment archived", append(s.logAttrs(), slog.String("dir", s.dir))...)
+		}
+	}
+	return moved, nil
+}
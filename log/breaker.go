@@ -0,0 +1,182 @@
+package log
+
+// Este archivo implementa CircuitBreaker, que envuelve un Log para dejar de
+// intentar escrituras mientras el disco falla, por ejemplo cuando está lleno.
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	api "github.com/dati/api/v1"
+)
+
+// ErrCircuitOpen indica que CircuitBreaker rechazó la escritura sin intentarla
+// porque las últimas fallaron.
+var ErrCircuitOpen = errors.New("log: circuit breaker is open")
+
+// BreakerState es el estado de un CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed deja pasar todas las escrituras.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rechaza las escrituras con ErrCircuitOpen.
+	BreakerOpen
+	// BreakerHalfOpen deja pasar una única escritura de prueba.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Valores por defecto de los campos de CircuitBreakerConfig en cero.
+const (
+	DefaultBreakerMaxFailures   = 5
+	DefaultHalfOpenWaitDuration = 10 * time.Second
+)
+
+// CircuitBreakerConfig configura un CircuitBreaker.
+type CircuitBreakerConfig struct {
+	// MaxFailures es la cantidad de escrituras fallidas seguidas que abren el
+	// circuito; en cero se usa DefaultBreakerMaxFailures.
+	MaxFailures int
+	// HalfOpenWaitDuration es cuánto tiempo queda abierto el circuito antes de
+	// permitir una escritura de prueba; en cero se usa
+	// DefaultHalfOpenWaitDuration.
+	HalfOpenWaitDuration time.Duration
+}
+
+// CircuitBreaker envuelve un Log y corta sus escrituras después de
+// MaxFailures errores seguidos en Append o AppendBatch: mientras está abierto
+// retorna ErrCircuitOpen sin tocar el disco. Pasado HalfOpenWaitDuration deja
+// pasar una escritura de prueba; si funciona el circuito se cierra y si falla
+// vuelve a abrirse. Las lecturas y el resto de los métodos van directo al Log.
+//
+// Un reintento de un productor con un sequence desconocido
+// (ErrUnknownSequence) es un error del cliente, no del disco, así que no
+// cuenta como falla.
+type CircuitBreaker struct {
+	*Log
+
+	config CircuitBreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int       // Escrituras fallidas seguidas
+	openedAt time.Time // Cuándo se abrió el circuito por última vez
+	trial    bool      // Hay una escritura de prueba en curso
+}
+
+// NewCircuitBreaker envuelve l con un circuit breaker cerrado.
+func NewCircuitBreaker(l *Log, c CircuitBreakerConfig) *CircuitBreaker {
+	if c.MaxFailures <= 0 {
+		c.MaxFailures = DefaultBreakerMaxFailures
+	}
+	if c.HalfOpenWaitDuration <= 0 {
+		c.HalfOpenWaitDuration = DefaultHalfOpenWaitDuration
+	}
+	return &CircuitBreaker{Log: l, config: c}
+}
+
+// Append agrega el registro al Log si el circuito lo permite.
+func (b *CircuitBreaker) Append(record *api.Record) (uint64, error) {
+	if err := b.allow(); err != nil {
+		return 0, err
+	}
+	off, err := b.Log.Append(record)
+	b.done(err)
+	return off, err
+}
+
+// AppendBatch agrega los registros al Log si el circuito lo permite. El lote
+// cuenta como una sola escritura.
+func (b *CircuitBreaker) AppendBatch(records []*api.Record) ([]uint64, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	offsets, err := b.Log.AppendBatch(records)
+	b.done(err)
+	return offsets, err
+}
+
+// State retorna el estado del circuito y cuántas escrituras seguidas fallaron.
+func (b *CircuitBreaker) State() (BreakerState, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.config.HalfOpenWaitDuration {
+		return BreakerHalfOpen, b.failures // La próxima escritura será la de prueba
+	}
+	return b.state, b.failures
+}
+
+// allow decide si una escritura puede intentarse. Con el circuito abierto
+// pasado HalfOpenWaitDuration, la primera escritura pasa como prueba y las
+// demás se rechazan hasta que termine.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		return nil
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.HalfOpenWaitDuration {
+			return ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+	}
+	if b.trial {
+		return ErrCircuitOpen // Ya hay una escritura de prueba en curso
+	}
+	b.trial = true
+	return nil
+}
+
+// done registra el resultado de una escritura que allow dejó pasar.
+func (b *CircuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil || errors.Is(err, ErrUnknownSequence) {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == BreakerOpen {
+		return // Una escritura que empezó antes de abrirse
+	}
+	if b.state == BreakerHalfOpen || b.failures >= b.config.MaxFailures {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// setState cambia el estado del circuito y lo registra. Quien lo llama debe
+// tener b.mu.
+func (b *CircuitBreaker) setState(s BreakerState) {
+	prev := b.state
+	b.state = s
+	attrs := []any{
+		slog.String("from", prev.String()),
+		slog.String("to", s.String()),
+		slog.Int("failures", b.failures),
+	}
+	if s == BreakerOpen {
+		b.logger.Warn("circuit breaker opened", attrs...)
+		return
+	}
+	b.logger.Info("circuit breaker state changed", attrs...)
+}
@@ -0,0 +1,152 @@
+package log
+
+// Este archivo publica los cambios del log, no sólo los registros agregados
+// sino también los segmentos rotados y eliminados, para consumers que mantienen
+// proyecciones del log y necesitan enterarse de lo que desaparece.
+
+import (
+	"context"
+	"sync"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// CDCEvent es un cambio del log publicado por CDCStream. Es uno de
+// AppendEvent, TruncateEvent, SegmentRolledEvent o SegmentRemovedEvent.
+type CDCEvent interface {
+	cdcEvent()
+}
+
+// AppendEvent es un registro agregado en Offset. Record es una copia.
+type AppendEvent struct {
+	Offset uint64
+	Record *api.Record
+}
+
+// TruncateEvent indica que Truncate o TruncateOlderThan eliminó los registros
+// con offset menor a BelowOffset. Llega después de los SegmentRemovedEvent de
+// los segmentos eliminados.
+type TruncateEvent struct {
+	BelowOffset uint64
+}
+
+// SegmentRolledEvent indica que se selló el segmento activo, con los registros
+// desde BaseOffset hasta NextOffset sin incluirlo, y se creó otro.
+type SegmentRolledEvent struct {
+	BaseOffset uint64
+	NextOffset uint64
+}
+
+// SegmentRemovedEvent indica que se eliminó el segmento con el offset base
+// BaseOffset, por Truncate o porque la compactación lo dejó vacío.
+type SegmentRemovedEvent struct {
+	BaseOffset uint64
+}
+
+func (AppendEvent) cdcEvent()         {}
+func (TruncateEvent) cdcEvent()       {}
+func (SegmentRolledEvent) cdcEvent()  {}
+func (SegmentRemovedEvent) cdcEvent() {}
+
+// CDCStream publica en el canal retornado, en el orden en que ocurren, los
+// cambios del log desde este momento. Los eventos se encolan por consumer, así
+// que uno lento no frena las escrituras ni pierde eventos, pero acumula memoria
+// hasta leerlos. El canal se cierra cuando ctx termina. Cada llamada tiene su
+// propio canal.
+func (l *Log) CDCStream(ctx context.Context) <-chan CDCEvent {
+	events := make(chan CDCEvent)
+	sub := &cdcSubscriber{wake: make(chan struct{}, 1)}
+	l.cdc.add(sub)
+	go func() {
+		defer close(events)
+		defer l.cdc.remove(sub)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.wake:
+			}
+			for _, event := range sub.take() {
+				select {
+				case <-ctx.Done():
+					return
+				case events <- event:
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// publishAppend publica el registro agregado en off si alguien sigue los
+// cambios. Quien lo llama debe tener el lock de escritura.
+func (l *Log) publishAppend(record *api.Record, off uint64) {
+	if !l.cdc.active() {
+		return // Sin consumers no vale la pena copiar el registro
+	}
+	l.cdc.publish(AppendEvent{Offset: off, Record: proto.Clone(record).(*api.Record)})
+}
+
+// cdcBroadcaster reparte cada evento a todos los consumers de CDCStream.
+// Se publica con el lock de escritura del log, así los eventos llegan en el
+// orden de los cambios.
+type cdcBroadcaster struct {
+	mu   sync.Mutex
+	subs map[*cdcSubscriber]struct{}
+}
+
+func (b *cdcBroadcaster) add(sub *cdcSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[*cdcSubscriber]struct{})
+	}
+	b.subs[sub] = struct{}{}
+}
+
+func (b *cdcBroadcaster) remove(sub *cdcSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, sub)
+}
+
+func (b *cdcBroadcaster) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs) > 0
+}
+
+func (b *cdcBroadcaster) publish(event CDCEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		sub.push(event)
+	}
+}
+
+// cdcSubscriber es la cola de eventos de un consumer de CDCStream.
+type cdcSubscriber struct {
+	mu      sync.Mutex
+	pending []CDCEvent
+	wake    chan struct{} // Avisa que hay eventos pendientes
+}
+
+func (s *cdcSubscriber) push(event CDCEvent) {
+	s.mu.Lock()
+	s.pending = append(s.pending, event)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default: // Ya tenía un aviso sin atender
+	}
+}
+
+// take retorna los eventos pendientes y vacía la cola.
+func (s *cdcSubscriber) take() []CDCEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
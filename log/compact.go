@@ -0,0 +1,329 @@
+package log
+
+// Este archivo compacta el log por key: de los registros que comparten key sólo
+// conserva el más reciente, como la compactación de logs de Kafka.
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	api "github.com/dati/api/v1"
+)
+
+// CompactByKey reescribe los segmentos sellados dejando, de cada key, sólo el
+// registro con el offset más alto del log, incluido el segmento activo. Un
+// registro con key y value vacío es un tombstone de esa key: al ser el último,
+// descarta todos los anteriores. Los registros sin key se conservan siempre,
+// salvo los que borró Delete, cuyos bytes se liberan aquí.
+//
+// Los offsets no cambian, así que los registros descartados dejan huecos y Read
+// de esos offsets retorna api.ErrRecordDeleted. Un segmento que queda vacío se
+// elimina; si era el primero, el log empieza en el siguiente, como tras Truncate.
+// Cada segmento se reemplaza con archivos .tmp confirmados por un
+// manifest, así una caída deja el segmento viejo o el nuevo, nunca una mezcla. El
+// segmento activo no se reescribe porque sigue recibiendo escrituras.
+func (l *Log) CompactByKey() error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.Lock()
+	defer l.unlock()
+	latest := make(map[string]uint64) // Offset más alto de cada key
+	for _, s := range l.segments {
+		if err := s.Scan(func(record *api.Record) error {
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	segments := make([]*Segment, 0, len(l.segments))
+	for i, s := range l.segments {
+		if !s.IsSealed() {
+			segments = append(segments, s)
+			continue
+		}
+		cs, err := l.compactSegment(s, latest)
+		if cs != nil {
+			segments = append(segments, cs)
+		}
+		if err != nil {
+			l.segments = append(segments, l.segments[i+1:]...) // Los que faltan quedan sin compactar
+			return err
+		}
+	}
+	l.segments = segments
+	return nil
+}
+
+// compactSegment reescribe s sin los registros que CompactByKey descarta y
+// devuelve el segmento reabierto, o nil si quedó vacío y se eliminó. Si no hay
+// nada que descartar, devuelve s sin tocar sus archivos. Si falla, devuelve lo
+// que debe quedar en lugar de s, como replaceCompacted.
+func (l *Log) compactSegment(s *Segment, latest map[string]uint64) (*Segment, error) {
+	total := s.RecordCount()
+	kept, err := s.rewrite(func(off uint64, value []byte) ([]byte, bool, error) {
+		if _, ok := l.deleted[off]; ok {
+			return nil, false, nil // Registro borrado con Delete
+		}
+		record, err := s.decode(off, value)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(record.Key) == 0 {
+			return value, true, nil // Los registros sin key se conservan siempre
+		}
+		return value, latest[string(record.Key)] == off, nil // Se copia tal cual, ya cifrado
+	})
+	if err != nil {
+		s.removeRewrite()
+		return s, err
+	}
+	return l.replaceCompacted(s, total, kept)
+}
+
+// replaceCompacted confirma la reescritura de s que dejó kept de sus total
+// registros y devuelve el segmento reabierto, o nil si quedó vacío y se
+// eliminó. Quien lo llama debe tener el lock de escritura y poner el resultado
+// en l.segments, también si hay error: s puede haber quedado cerrado.
+func (l *Log) replaceCompacted(s *Segment, total uint64, kept int) (*Segment, error) {
+	if uint64(kept) == total {
+		s.removeRewrite()
+		return s, nil
+	}
+	dropped := total - uint64(kept)
+	if l.dirty != nil {
+		l.dirty[s.baseOffset] -= min(l.dirty[s.baseOffset], dropped)
+	}
+	if kept == 0 {
+		s.removeRewrite()
+		if err := l.removeSegment(s); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	cs, err := l.reopenRewritten(s, l.Config)
+	if err != nil {
+		return cs, err
+	}
+	l.logger.Info("segment compacted",
+		append(cs.logAttrs(), slog.Uint64("dropped", dropped))...,
+	)
+	return cs, nil
+}
+
+// reopenRewritten cierra s, confirma los archivos que escribió rewrite y reabre
+// el segmento con c, sellado salvo que s sea el activo. Si algo falla después de
+// cerrarlo, reabre el segmento con los archivos viejos o los nuevos según hasta
+// dónde llegó el cambio y lo devuelve junto con el error, o devuelve nil si
+// tampoco así se puede abrir. En todos los casos quien lo llama pone el
+// resultado en lugar de s en l.segments, así ninguna lectura se queda con un
+// segmento cerrado. Quien lo llama debe tener el lock de escritura.
+func (l *Log) reopenRewritten(s *Segment, c Config) (*Segment, error) {
+	open := openSealedSegment
+	if s == l.activeSegment {
+		open = NewSegment
+	}
+	err := s.Close()
+	if err == nil {
+		err = s.commitRewrite()
+	}
+	if err == nil {
+		var rs *Segment
+		if rs, err = open(s.dir, s.baseOffset, c); err == nil {
+			return rs, nil
+		}
+	}
+	committed, rerr := s.recoverRewrite()
+	if !committed {
+		c = s.config // La copia se descartó; el segmento sigue con su configuración
+	}
+	var rs *Segment
+	if rerr == nil {
+		rs, rerr = open(s.dir, s.baseOffset, c)
+	}
+	if rerr != nil {
+		l.logger.Error("segment unavailable after failed rewrite",
+			append(s.logAttrs(), slog.Any("error", rerr))...,
+		)
+	}
+	return rs, err
+}
+
+// Valores por defecto de los campos de Config.Compaction en cero.
+const (
+	DefaultMinDirtyRatio      = 0.5
+	DefaultCompactionInterval = time.Minute
+)
+
+// errCompactionStopped corta la reescritura de un segmento cuando Close detiene
+// la compactación en background.
+var errCompactionStopped = errors.New("log: compaction stopped")
+
+// compactor es la goroutine de compactación en background de un log abierto.
+type compactor struct {
+	stop    chan struct{} // Se cierra para pedirle que termine
+	stopped chan struct{} // Se cierra cuando terminó
+}
+
+// startCompactor arranca la compactación en background si Compaction.Enabled.
+func (l *Log) startCompactor() {
+	if !l.Config.Compaction.Enabled {
+		return
+	}
+	interval := l.Config.Compaction.Interval
+	if interval <= 0 {
+		interval = DefaultCompactionInterval
+	}
+	c := &compactor{stop: make(chan struct{}), stopped: make(chan struct{})}
+	l.compactor.Store(c)
+	go func() {
+		defer close(c.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+			if err := l.compactDirtiest(c.stop); err != nil && err != errCompactionStopped {
+				l.logger.Error("background compaction failed", slog.Any("error", err))
+			}
+		}
+	}()
+}
+
+// stopCompactor detiene la compactación en background y espera a que termine.
+// Una reescritura a medias se descarta.
+func (l *Log) stopCompactor() {
+	if c := l.compactor.Swap(nil); c != nil {
+		close(c.stop)
+		<-c.stopped
+	}
+}
+
+// trackKey lleva el último offset de cada key y cuenta los registros que record
+// vuelve obsoletos, para que la compactación en background elija qué segmento
+// reescribir. No hace nada sin Compaction.Enabled. Quien lo llama debe tener el
+// lock de escritura.
+func (l *Log) trackKey(record *api.Record, off uint64) {
+	if l.latest == nil {
+		return
+	}
+	if record.Tombstone {
+		l.markDirty(record.DeletedOffset)
+	}
+	if len(record.Key) == 0 {
+		return
+	}
+	if prev, ok := l.latest[string(record.Key)]; ok {
+		l.markDirty(prev)
+	}
+	l.latest[string(record.Key)] = off
+}
+
+// markDirty suma un registro obsoleto al segmento que contiene off.
+func (l *Log) markDirty(off uint64) {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].nextOffset > off
+	})
+	if i < len(l.segments) && l.segments[i].baseOffset <= off {
+		l.dirty[l.segments[i].baseOffset]++
+	}
+}
+
+// compactDirtiest compacta el segmento sellado con la mayor fracción de
+// registros obsoletos, si llega a MinDirtyRatio. El lock del log sólo se toma
+// para elegirlo y para reemplazarlo: la reescritura, que lee el segmento
+// sellado y escribe archivos .tmp, corre sin él, así que Append sigue
+// escribiendo en el segmento activo mientras tanto.
+func (l *Log) compactDirtiest(stop <-chan struct{}) error {
+	l.maintMu.Lock() // Nadie más elimina ni reemplaza el segmento mientras se reescribe
+	defer l.maintMu.Unlock()
+	l.mu.RLock()
+	s := l.dirtiestSegment()
+	keep := make(map[uint64]struct{})    // Offsets de s que son el último de su key
+	deleted := make(map[uint64]struct{}) // Offsets de s borrados con Delete
+	if s != nil {
+		for _, off := range l.latest {
+			if off >= s.baseOffset && off < s.nextOffset {
+				keep[off] = struct{}{}
+			}
+		}
+		for off := range l.deleted {
+			if off >= s.baseOffset && off < s.nextOffset {
+				deleted[off] = struct{}{}
+			}
+		}
+	}
+	l.mu.RUnlock()
+	if s == nil {
+		return nil
+	}
+	total := s.RecordCount()
+	kept, err := s.rewrite(func(off uint64, value []byte) ([]byte, bool, error) {
+		select {
+		case <-stop:
+			return nil, false, errCompactionStopped
+		default:
+		}
+		if _, ok := deleted[off]; ok {
+			return nil, false, nil
+		}
+		record, err := s.decode(off, value)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(record.Key) == 0 {
+			return value, true, nil
+		}
+		_, ok := keep[off]
+		return value, ok, nil
+	})
+	if err != nil {
+		s.removeRewrite()
+		return err
+	}
+	l.mu.Lock()
+	defer l.unlock()
+	i := slices.Index(l.segments, s)
+	if i < 0 {
+		s.removeRewrite() // No debería pasar con maintMu, pero no se toca un segmento ajeno
+		return nil
+	}
+	cs, err := l.replaceCompacted(s, total, kept)
+	if cs == nil {
+		l.segments = slices.Delete(l.segments, i, i+1)
+	} else {
+		l.segments[i] = cs
+	}
+	return err
+}
+
+// dirtiestSegment devuelve el segmento sellado con la mayor fracción de
+// registros obsoletos, o nil si ninguno llega a MinDirtyRatio. Quien lo llama
+// debe tener el lock de lectura.
+func (l *Log) dirtiestSegment() *Segment {
+	minRatio := l.Config.Compaction.MinDirtyRatio
+	if minRatio <= 0 {
+		minRatio = DefaultMinDirtyRatio
+	}
+	var dirtiest *Segment
+	var dirtiestRatio float64
+	for _, s := range l.segments {
+		total := s.RecordCount()
+		if !s.IsSealed() || total == 0 || l.dirty[s.baseOffset] == 0 {
+			continue
+		}
+		ratio := float64(l.dirty[s.baseOffset]) / float64(total)
+		if ratio >= minRatio && ratio > dirtiestRatio {
+			dirtiest, dirtiestRatio = s, ratio
+		}
+	}
+	return dirtiest
+}
@@ -0,0 +1,191 @@
+package log
+
+// Este archivo comprime los registros de los segmentos sellados. Cada registro
+// comprimido empieza con un byte que identifica el codec, igual que los cifrados,
+// así que un log puede mezclar segmentos comprimidos y sin comprimir.
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+)
+
+// Codec es el algoritmo con que CompressSealed comprime los registros.
+type Codec string
+
+const (
+	CodecGzip  Codec = "gzip"  // compress/gzip, el codec por defecto
+	CodecFlate Codec = "flate" // compress/flate, sin el header y el CRC de gzip
+)
+
+// Identificadores del codec, guardados en el primer byte del registro. Comparten
+// el rango de los de cifrado (menores a 0x08), que un proto nunca usa como
+// primer byte. Si el registro además está cifrado, se comprime antes de cifrar y
+// el identificador queda dentro del texto cifrado.
+const (
+	compressionGzip  byte = 0x02
+	compressionFlate byte = 0x03
+)
+
+// compressRecord comprime el proto serializado p con codec. Si el resultado no
+// es más chico que p devuelve p, así un registro que no se comprime bien no crece.
+func compressRecord(codec Codec, p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch codec {
+	case CodecGzip, "":
+		buf.WriteByte(compressionGzip)
+		w = gzip.NewWriter(&buf)
+	case CodecFlate:
+		buf.WriteByte(compressionFlate)
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	default:
+		return nil, checkCodec(codec)
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(p) {
+		return p, nil // No vale la pena guardarlo comprimido
+	}
+	return buf.Bytes(), nil
+}
+
+// checkCodec retorna un error si codec no es uno de los soportados.
+func checkCodec(codec Codec) error {
+	switch codec {
+	case "", CodecGzip, CodecFlate:
+		return nil
+	}
+	return fmt.Errorf("log: unknown compression codec %q", codec)
+}
+
+// isCompressed indica si p empieza con el identificador de un codec.
+func isCompressed(p []byte) bool {
+	return len(p) > 0 && (p[0] == compressionGzip || p[0] == compressionFlate)
+}
+
+// decompressRecord descomprime lo que guardó compressRecord para el offset off.
+// Los registros sin comprimir se devuelven tal cual.
+func decompressRecord(off uint64, p []byte) ([]byte, error) {
+	if !isCompressed(p) {
+		return p, nil
+	}
+	var r io.ReadCloser
+	if p[0] == compressionGzip {
+		gr, err := gzip.NewReader(bytes.NewReader(p[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("log: decompress record %d: %w", off, err)
+		}
+		r = gr
+	} else {
+		r = flate.NewReader(bytes.NewReader(p[1:]))
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("log: decompress record %d: %w", off, err)
+	}
+	return out, nil
+}
+
+// writeCompressed escribe la copia comprimida del segmento en los archivos
+// temporales de rewrite. Los registros ya comprimidos se copian tal cual. Si
+// stop se cierra, corta la copia y retorna ErrLogClosed.
+func (s *Segment) writeCompressed(codec Codec, stop <-chan struct{}) error {
+	_, err := s.rewrite(func(off uint64, value []byte) ([]byte, bool, error) {
+		select {
+		case <-stop:
+			return nil, false, ErrLogClosed
+		default:
+		}
+		plain, err := openRecord(s.aead, off, value)
+		if err != nil {
+			return nil, false, err
+		}
+		if isCompressed(plain) {
+			return value, true, nil // Ya estaba comprimido
+		}
+		compressed, err := compressRecord(codec, plain)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(compressed) == len(plain) {
+			return value, true, nil // No se comprimió, se conserva el original
+		}
+		value, err = sealRecord(s.aead, off, compressed)
+		return value, true, err
+	})
+	return err
+}
+
+// startCompression comprime en background el segmento recién sellado s. Quien
+// lo llama debe tener el lock de escritura; con el log cerrado no hace nada.
+func (l *Log) startCompression(s *Segment) {
+	if l.closed {
+		return
+	}
+	done := l.done // El de este log abierto; Reset crea otro
+	l.compressing.Add(1)
+	go func() {
+		defer l.compressing.Done()
+		if err := l.compressSegment(s, done); err != nil && err != ErrLogClosed {
+			l.logger.Error("segment compression failed",
+				append(s.logAttrs(), slog.Any("error", err))...,
+			)
+		}
+	}()
+}
+
+// compressSegment reemplaza el segmento sellado s por una copia con los
+// registros comprimidos con el codec de la configuración. Como
+// compactDirtiest, la copia se escribe sin el lock del log, que sólo se toma
+// para reemplazar el segmento, así Append y las lecturas no esperan la
+// reescritura. Si la copia falla, s queda en la lista sin comprimir.
+func (l *Log) compressSegment(s *Segment, stop <-chan struct{}) error {
+	l.maintMu.Lock() // Nadie más elimina ni reemplaza el segmento mientras se reescribe
+	defer l.maintMu.Unlock()
+	l.mu.RLock()
+	ok := slices.Contains(l.segments, s)
+	codec := l.Config.Segment.CompressionCodec
+	l.mu.RUnlock()
+	if !ok {
+		return nil // Truncate lo borró antes de empezar
+	}
+	before := s.store.size
+	if err := s.writeCompressed(codec, stop); err != nil {
+		s.removeRewrite()
+		return err
+	}
+	l.mu.Lock()
+	defer l.unlock()
+	i := slices.Index(l.segments, s)
+	if i < 0 {
+		s.removeRewrite() // No debería pasar con maintMu, pero no se toca un segmento ajeno
+		return nil
+	}
+	cs, err := l.reopenRewritten(s, l.Config)
+	if cs == nil {
+		l.segments = slices.Delete(l.segments, i, i+1)
+	} else {
+		l.segments[i] = cs
+	}
+	if err != nil {
+		return err
+	}
+	l.logger.Info("segment compressed",
+		append(cs.logAttrs(), slog.Uint64("storeSizeBefore", before))...,
+	)
+	return nil
+}
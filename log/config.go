@@ -1,11 +1,166 @@
 package log
 
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
 // Config es la estructura que contiene configuraciones específicas para el índice,
 // incluyendo el tamaño máximo permitido para el store y el índice.
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64 // Tamaño máximo permitido para el store
-		MaxIndexBytes uint64 // Tamaño máximo permitido para el índice
+		// MaxIndexBytes es el tamaño máximo permitido para el índice. Como el
+		// offset relativo de cada entrada ocupa 4 bytes, un segmento no pasa de
+		// 2^32 registros aunque MaxIndexBytes dé para más.
+		MaxIndexBytes uint64
 		InitialOffset uint64 // Offset inicial
+		// RebuildIndexOnError reconstruye el índice a partir del store cuando
+		// falta o está corrupto, en vez de fallar al abrir el segmento.
+		RebuildIndexOnError bool
+		// EncryptionKey, si no está vacía, cifra cada registro con AES-256-GCM
+		// antes de guardarlo. Debe tener 32 bytes.
+		EncryptionKey []byte
+		// PreallocateStore reserva MaxStoreBytes para el archivo del store al
+		// abrir el segmento, para que no se fragmente creciendo de a poco. El
+		// archivo se recorta a los datos reales al cerrar el segmento.
+		PreallocateStore bool
+		// VerifyOnOpen recorre el store de cada segmento al abrirlo con
+		// Segment.Verify y falla si encuentra un registro corrupto.
+		VerifyOnOpen bool
+		// CompressSealed comprime cada registro de un segmento en background
+		// después de sellarlo, con CompressionCodec. Las lecturas descomprimen según el primer byte del
+		// registro, así que el log puede mezclar segmentos comprimidos y no.
+		CompressSealed bool
+		// CompressionCodec es el codec de CompressSealed; vacío usa CodecGzip.
+		CompressionCodec Codec
+		// MmapSealed mapea en memoria el store de cada segmento sellado y lo
+		// lee desde el mapeo, sin una llamada al sistema por registro, lo que
+		// acelera recorrer el log completo. El segmento activo se sigue leyendo
+		// del archivo. Si el mapeo falla, el segmento se lee del archivo.
+		MmapSealed bool
+		// Options son los flags y permisos con los que se abren los archivos de
+		// los segmentos; en cero se usan los de siempre.
+		Options SegmentOptions
+		// SyncOnAppend es el modo de durabilidad fuerte: cada Append hace fsync
+		// del store antes de escribir la entrada del índice y msync del índice
+		// después, así el índice nunca apunta a bytes que no están en disco.
+		SyncOnAppend bool
+		// MaxSegmentAge, si no es cero, rota el segmento activo cuando pasó
+		// este tiempo desde Segment.CreatedAt, aunque no esté lleno, para que
+		// la retención por tiempo pueda borrar segmentos completos.
+		MaxSegmentAge time.Duration
+		// EnableWAL guarda cada registro, con fdatasync, en el archivo .wal del
+		// segmento activo antes de escribirlo en el store y el índice, y lo
+		// marca como confirmado después. Al abrir el segmento, un registro sin
+		// confirmar se rehace si no llegó completo al store o al índice, así
+		// una caída del proceso entre las dos escrituras no los desincroniza.
+		// El WAL se vacía en cada Sync y se borra al sellar o cerrar el segmento.
+		EnableWAL bool
+	}
+	// DataDirs, si no está vacío, reparte los segmentos nuevos en round-robin
+	// entre estos directorios, por ejemplo uno por disco. El directorio del log
+	// sigue guardando el lock y también se revisa al abrir el log.
+	DataDirs []string
+	// ArchiveDirs son los directorios a los que ArchiveBefore movió segmentos
+	// sellados, por ejemplo en un disco más lento. Se leen al abrir el log como
+	// DataDirs, pero no reciben segmentos nuevos. Un directorio usado con
+	// ArchiveBefore debe figurar acá para que sus segmentos se encuentren al
+	// reabrir el log.
+	ArchiveDirs []string
+	// MaxConcurrentReads limita cuántas lecturas pueden estar en curso a la vez.
+	// Las que exceden el límite esperan un lugar. Cero significa sin límite.
+	MaxConcurrentReads int
+	// OnNewSegment se invoca con el offset base de cada segmento nuevo, después
+	// de crearlo y fuera del lock del log. Puede ser nil.
+	OnNewSegment func(baseOffset uint64)
+	// OnSegmentRemoved se invoca con el offset base de cada segmento que elimina
+	// Truncate, fuera del lock del log. Puede ser nil.
+	OnSegmentRemoved func(baseOffset uint64)
+	// MaxDiffEntries es cuántas diferencias retorna Diff como máximo; en cero
+	// se usa DefaultMaxDiffEntries.
+	MaxDiffEntries int
+	// Webhooks reciben un POST con un WebhookEvent por cada registro que agrega
+	// Append, AppendBatch o AppendFrom, desde una goroutine que se detiene en
+	// Close. Si los endpoints no dan abasto los eventos se descartan, así que
+	// sirven para avisar, no para replicar.
+	Webhooks []WebhookConfig
+	// Compaction configura la compactación por key en background.
+	Compaction struct {
+		// Enabled arranca, al abrir el log, una goroutine que cada Interval
+		// compacta con las reglas de CompactByKey el segmento sellado con más
+		// registros obsoletos, uno por vez, sin frenar las escrituras al
+		// segmento activo. Se detiene en Close.
+		Enabled bool
+		// MinDirtyRatio es la fracción de registros obsoletos de un segmento,
+		// entre 0 y 1, desde la que vale la pena compactarlo; en cero se usa
+		// DefaultMinDirtyRatio. Un registro es obsoleto si otro más nuevo tiene
+		// su key o si lo borró Delete.
+		MinDirtyRatio float64
+		// Interval es el tiempo entre una revisión y la siguiente; en cero se
+		// usa DefaultCompactionInterval.
+		Interval time.Duration
+	}
+}
+
+// SegmentOptions configura cómo se abren los archivos de un segmento. Los flags
+// van a os.OpenFile; en cero se usan os.O_RDWR|os.O_CREATE|os.O_APPEND para el
+// store y os.O_RDWR|os.O_CREATE para el índice, y FileMode en cero es 0644.
+// Sirve por ejemplo para agregar os.O_SYNC o restringir los permisos a 0600.
+type SegmentOptions struct {
+	StoreFlags int
+	IndexFlags int
+	FileMode   os.FileMode
+}
+
+// storeFlags retorna los flags con los que se abre el store.
+func (o SegmentOptions) storeFlags() int {
+	if o.StoreFlags == 0 {
+		return os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+	return o.StoreFlags
+}
+
+// indexFlags retorna los flags con los que se abre el índice.
+func (o SegmentOptions) indexFlags() int {
+	if o.IndexFlags == 0 {
+		return os.O_RDWR | os.O_CREATE
+	}
+	return o.IndexFlags
+}
+
+// fileMode retorna los permisos de los archivos del segmento.
+func (o SegmentOptions) fileMode() os.FileMode {
+	if o.FileMode == 0 {
+		return 0644
+	}
+	return o.FileMode
+}
+
+// ErrInvalidSegmentOptions indica una combinación de flags con la que el
+// segmento no podría funcionar.
+var ErrInvalidSegmentOptions = errors.New("log: invalid segment options")
+
+// validate rechaza los flags con los que el segmento no funcionaría: el
+// segmento activo se lee y se escribe, así que los dos archivos se abren
+// os.O_RDWR; el store agrega al final, así que necesita os.O_APPEND; y
+// os.O_TRUNC u os.O_EXCL borrarían o impedirían reabrir un segmento existente.
+func (o SegmentOptions) validate() error {
+	for name, flags := range map[string]int{"store": o.storeFlags(), "index": o.indexFlags()} {
+		if flags&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR) != os.O_RDWR {
+			return fmt.Errorf("%w: %s flags must include os.O_RDWR", ErrInvalidSegmentOptions, name)
+		}
+		if flags&(os.O_TRUNC|os.O_EXCL) != 0 {
+			return fmt.Errorf("%w: %s flags must not include os.O_TRUNC or os.O_EXCL", ErrInvalidSegmentOptions, name)
+		}
+	}
+	if o.storeFlags()&os.O_APPEND == 0 {
+		return fmt.Errorf("%w: store flags must include os.O_APPEND", ErrInvalidSegmentOptions)
+	}
+	if o.FileMode&^os.ModePerm != 0 {
+		return fmt.Errorf("%w: file mode %v has more than permission bits", ErrInvalidSegmentOptions, o.FileMode)
 	}
+	return nil
 }
@@ -0,0 +1,102 @@
+package log
+
+// Este archivo compara dos logs registro por registro, para encontrar dónde
+// diverge la copia de un follower de la del líder.
+
+import (
+	"errors"
+	"hash/crc32"
+	"math"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultMaxDiffEntries es el máximo de diferencias de Diff con
+// Config.MaxDiffEntries en cero.
+const DefaultMaxDiffEntries = 1000
+
+// ErrDiffLimit indica que Diff encontró más diferencias que
+// Config.MaxDiffEntries. Se retorna junto con las primeras.
+var ErrDiffLimit = errors.New("log: too many differences")
+
+// DiffEntry es un offset en el que dos logs no tienen el mismo registro. Los
+// CRC son CRC32C del registro serializado; un registro que falta, porque está
+// fuera del log, se borró o se compactó, tiene CRC cero.
+type DiffEntry struct {
+	Offset      uint64
+	LeaderCRC   uint32 // CRC del registro en el log de Diff
+	FollowerCRC uint32 // CRC del registro en other
+	Diverges    bool
+}
+
+// Diff compara los registros de l y other desde startOffset hasta el final del
+// más largo y retorna los offsets en los que difieren, en orden. Un offset que
+// falta en los dos logs no es una diferencia. Si hay más de MaxDiffEntries
+// diferencias retorna las primeras y ErrDiffLimit.
+func (l *Log) Diff(other *Log, startOffset uint64) ([]DiffEntry, error) {
+	return l.DiffRange(other, startOffset, math.MaxUint64)
+}
+
+// DiffRange es Diff entre startOffset y endOffset, inclusive.
+func (l *Log) DiffRange(other *Log, startOffset, endOffset uint64) ([]DiffEntry, error) {
+	maxEntries := l.Config.MaxDiffEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxDiffEntries
+	}
+	next := max(l.nextOffset(), other.nextOffset())
+	if next == 0 {
+		return nil, nil // Los dos logs están vacíos
+	}
+	endOffset = min(endOffset, next-1)
+	var entries []DiffEntry
+	for off := startOffset; off <= endOffset; off++ {
+		leader, err := recordCRC(l, off)
+		if err != nil {
+			return entries, err
+		}
+		follower, err := recordCRC(other, off)
+		if err != nil {
+			return entries, err
+		}
+		if leader == follower {
+			continue
+		}
+		if len(entries) == maxEntries {
+			return entries, ErrDiffLimit
+		}
+		entries = append(entries, DiffEntry{
+			Offset:      off,
+			LeaderCRC:   leader,
+			FollowerCRC: follower,
+			Diverges:    true,
+		})
+	}
+	return entries, nil
+}
+
+// nextOffset retorna el offset que recibiría el próximo registro.
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
+// recordCRC retorna el CRC32C del registro en off serializado, o cero si l no
+// lo tiene.
+func recordCRC(l *Log, off uint64) (uint32, error) {
+	record, err := l.Read(off)
+	var outOfRange api.ErrOffsetOutOfRange
+	var deleted api.ErrRecordDeleted
+	if errors.As(err, &outOfRange) || errors.As(err, &deleted) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(b, crcTable), nil
+}
@@ -0,0 +1,158 @@
+package log
+
+// Este archivo cifra los registros con AES-GCM antes de guardarlos en el store y
+// los descifra al leerlos, para que los datos queden cifrados en disco.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// Identificadores del algoritmo con que se cifró un registro, guardados en su
+// primer byte. Un proto válido nunca empieza con un byte menor a 0x08 (sería el
+// campo 0), así que estos valores no se confunden con registros sin cifrar.
+const (
+	encryptionAESGCM byte = 0x01 // AES-256-GCM con nonce aleatorio de nonceSize bytes
+	maxEncryptionID  byte = 0x07 // Último identificador disponible; 0x02 y 0x03 son de compresión
+)
+
+// nonceSize es el tamaño del nonce de AES-GCM que precede al texto cifrado.
+const nonceSize = 12
+
+// ErrMissingKey indica que un registro está cifrado y el log no tiene clave.
+var ErrMissingKey = errors.New("log: record is encrypted and no key is configured")
+
+// newSegmentAEAD deriva de key una clave propia del segmento con HMAC-SHA256 y
+// crea el AES-GCM con ella. Así cada segmento usa una clave distinta y los nonces
+// aleatorios no se comparten entre segmentos. Retorna nil si key está vacía.
+func newSegmentAEAD(key []byte, baseOffset uint64) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil // Sin clave los registros se guardan sin cifrar
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("log: encryption key must be 32 bytes, got %d", len(key))
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dati/log segment key"))
+	var off [8]byte
+	enc.PutUint64(off[:], baseOffset)
+	mac.Write(off[:])
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealRecord cifra el registro serializado p del offset off. El resultado es el
+// identificador del algoritmo, el nonce y el texto cifrado; el offset se autentica
+// para que un registro no pueda moverse a otra posición. Con aead nil devuelve p.
+func sealRecord(aead cipher.AEAD, off uint64, p []byte) ([]byte, error) {
+	if aead == nil {
+		return p, nil
+	}
+	out := make([]byte, 1+nonceSize, 1+nonceSize+len(p)+aead.Overhead())
+	out[0] = encryptionAESGCM
+	nonce := out[1 : 1+nonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var ad [8]byte
+	enc.PutUint64(ad[:], off)
+	return aead.Seal(out, nonce, p, ad[:]), nil
+}
+
+// openRecord descifra lo que guardó sealRecord para el offset off. Los registros
+// sin cifrar se devuelven tal cual.
+func openRecord(aead cipher.AEAD, off uint64, p []byte) ([]byte, error) {
+	if len(p) == 0 || p[0] > maxEncryptionID || isCompressed(p) {
+		return p, nil // Proto sin cifrar, comprimido o no
+	}
+	if p[0] != encryptionAESGCM {
+		return nil, fmt.Errorf("log: unknown encryption algorithm %d at offset %d", p[0], off)
+	}
+	if aead == nil {
+		return nil, ErrMissingKey
+	}
+	if len(p) < 1+nonceSize {
+		return nil, fmt.Errorf("log: encrypted record at offset %d is too short", off)
+	}
+	var ad [8]byte
+	enc.PutUint64(ad[:], off)
+	return aead.Open(nil, p[1:1+nonceSize], p[1+nonceSize:], ad[:])
+}
+
+// ReEncrypt reescribe todos los segmentos para que sus registros queden cifrados
+// con newKey en vez de oldKey, y desde ese momento el log usa newKey. Una clave
+// vacía significa sin cifrado, así que también sirve para cifrar o descifrar un log
+// existente. Con el lock tomado no hay escrituras, por lo que también se reescribe
+// el segmento activo y ningún segmento queda con las dos claves. Si algún registro
+// no se puede descifrar con oldKey no se cambia nada.
+func (l *Log) ReEncrypt(oldKey, newKey []byte) error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.Lock()
+	defer l.unlock()
+	// Primero se escriben todas las copias, para no dejar el log a medias si falla
+	for _, s := range l.segments {
+		from, err := newSegmentAEAD(oldKey, s.baseOffset)
+		if err != nil {
+			return err
+		}
+		to, err := newSegmentAEAD(newKey, s.baseOffset)
+		if err != nil {
+			return err
+		}
+		if err = s.writeReencrypted(from, to); err != nil {
+			for _, s := range l.segments {
+				s.removeRewrite()
+			}
+			return err
+		}
+	}
+	l.Config.Segment.EncryptionKey = newKey
+	for i, s := range l.segments {
+		ns, err := l.reopenRewritten(s, l.Config) // Reabre el segmento con la clave nueva
+		if err != nil {
+			for _, s := range l.segments[i+1:] {
+				s.removeRewrite() // Siguen con la clave vieja
+			}
+			return l.replaceFailed(i, ns, err)
+		}
+		l.segments[i] = ns
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.logger.Info("log re-encrypted", slog.Int("segments", len(l.segments)))
+	return nil
+}
+
+// replaceFailed pone ns, lo que devolvió reopenRewritten al fallar, en lugar del
+// segmento i de l.segments, o lo saca si es nil. Si era el activo y no se pudo
+// reabrir, crea uno nuevo a continuación para que el log siga teniendo dónde
+// escribir. Retorna err.
+func (l *Log) replaceFailed(i int, ns *Segment, err error) error {
+	s := l.segments[i]
+	if ns == nil {
+		l.segments = slices.Delete(l.segments, i, i+1)
+	} else {
+		l.segments[i] = ns
+	}
+	if s != l.activeSegment {
+		return err
+	}
+	if ns != nil {
+		l.activeSegment = ns
+		return err
+	}
+	if nerr := l.NewSegment(s.nextOffset); nerr != nil {
+		return errors.Join(err, nerr)
+	}
+	return err
+}
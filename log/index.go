@@ -4,8 +4,11 @@ package log
 // El índice facilita la búsqueda rápida de registros en el almacenamiento.
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -19,48 +22,262 @@ var (
 	entWidth        = offWidth + posWidth // Tamaño total de una entrada en el índice
 )
 
+// ErrCorruptIndex indica que el archivo de índice no es consistente con su store.
+var ErrCorruptIndex = errors.New("log: corrupt index")
+
+// ErrReadOnlyIndex indica que se intentó escribir en el índice de un segmento
+// sellado, que está mapeado como solo lectura.
+var ErrReadOnlyIndex = errors.New("log: index is read-only")
+
+// ErrIndexVersion indica que el índice fue escrito con una versión de formato que
+// este código no sabe leer.
+var ErrIndexVersion = errors.New("log: unsupported index version")
+
+// El archivo de índice empieza con un header de indexHeaderWidth bytes: el magic
+// number seguido de la versión del formato, ambos uint32. Las entradas van después.
+const (
+	indexMagic       uint32 = 0x44494458 // "DIDX"
+	indexVersion     uint32 = 1          // Versión que escribe este código
+	indexHeaderWidth uint64 = 8          // Tamaño del header en bytes
+)
+
+// indexInitialBytes es el lugar para entradas con el que se mapea un índice
+// nuevo; crece duplicándose hasta MaxIndexBytes.
+var indexInitialBytes = 64 * entWidth
+
+// indexHeader devuelve el header que se escribe al inicio de un índice nuevo.
+func indexHeader() []byte {
+	header := make([]byte, indexHeaderWidth)
+	enc.PutUint32(header[:4], indexMagic)
+	enc.PutUint32(header[4:], indexVersion)
+	return header
+}
+
 // index representa el índice de un segmento, que mapea offsets a posiciones en el store.
 type index struct {
-	file *os.File    // Archivo en el cual se almacena el índice
-	mmap gommap.MMap // Mapeo de memoria para acceder al archivo del índice
-	size uint64      // Tamaño actual del índice en bytes
+	file     *os.File    // Archivo en el cual se almacena el índice
+	mmap     gommap.MMap // Mapeo de memoria para acceder al archivo del índice
+	size     uint64      // Tamaño de las entradas del índice en bytes, sin el header
+	maxBytes uint64      // Tamaño máximo de las entradas, hasta el que crece el mapeo
+	readOnly bool        // Indica que el mapeo es de solo lectura
 }
 
 // Newindex crea un nuevo índice a partir de un archivo dado y configura el mapeo a memoria.
 // Devuelve una instancia de index o un error si falla.
 func newIndex(f *os.File, c Config) (*index, error) {
+	size, err := loadIndex(f)
+	if err != nil {
+		return nil, err // Retorna error si el archivo no es un índice válido
+	}
 	idx := &index{
-		file: f, // Asigna el archivo al índice
+		file: f,    // Asigna el archivo al índice
+		size: size, // Asigna el tamaño de las entradas al índice
 	}
-	fi, err := os.Stat(f.Name()) // Obtiene información del archivo
+	if err = idx.mapWritable(c.Segment.MaxIndexBytes); err != nil {
+		return nil, err // Retorna error si falla
+	}
+	return idx, nil // Retorna la instancia de index
+}
+
+// newReadOnlyIndex abre el índice de un segmento que ya no recibe escrituras. Lo
+// mapea con PROT_READ al tamaño que tiene el archivo, sin agrandarlo hasta
+// MaxIndexBytes, así un log con muchos segmentos no reserva memoria ni deja
+// páginas sucias por índices que sólo se leen. Write retorna ErrReadOnlyIndex.
+func newReadOnlyIndex(f *os.File) (*index, error) {
+	size, err := loadIndex(f)
 	if err != nil {
+		return nil, err // Retorna error si el archivo no es un índice válido
+	}
+	idx := &index{
+		file:     f,
+		size:     size,
+		readOnly: true,
+	}
+	if idx.mmap, err = gommap.Map(f.Fd(), gommap.PROT_READ, gommap.MAP_SHARED); err != nil {
 		return nil, err // Retorna error si falla
 	}
-	idx.size = uint64(fi.Size()) // Asigna el tamaño del archivo al índice
-	if err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes), // Trunca el archivo al tamaño máximo permitido
+	return idx, nil
+}
+
+// loadIndex valida el header del archivo, migra los índices escritos sin él y
+// devuelve el tamaño de las entradas.
+func loadIndex(f *os.File) (uint64, error) {
+	fi, err := os.Stat(f.Name()) // Obtiene información del archivo
+	if err != nil {
+		return 0, err // Retorna error si falla
+	}
+	size := uint64(fi.Size())
+	headered, err := hasIndexHeader(f, size)
+	if err != nil {
+		return 0, err
+	}
+	if headered {
+		if err = checkIndexHeader(f); err != nil {
+			return 0, err
+		}
+		size -= indexHeaderWidth
+	}
+	if size%entWidth != 0 { // Un índice válido solo contiene entradas completas
+		return 0, fmt.Errorf("%w: entries take %d bytes, not a multiple of %d", ErrCorruptIndex, size, entWidth)
+	}
+	if !headered {
+		if err = migrateIndex(f, size); err != nil { // Índice vacío o escrito sin header
+			return 0, err
+		}
+	}
+	return usedEntries(f, size)
+}
+
+// usedEntries descarta las entradas en cero del final del índice y devuelve el
+// tamaño de las que quedan. Son lugar reservado sin usar: el archivo crece antes
+// de que se escriban, y si el proceso cae antes de que Close lo recorte quedan en
+// el archivo. Una entrada en cero sólo es válida como la primera (offset relativo
+// 0 en la posición 0), porque los offsets y las posiciones crecen.
+func usedEntries(f *os.File, size uint64) (uint64, error) {
+	const chunkEntries = 4096 // Entradas que se leen por vez, desde el final
+	buf := make([]byte, chunkEntries*entWidth)
+	for size > entWidth {
+		n := min(size-entWidth, uint64(len(buf))) // La primera entrada nunca se descarta
+		chunk := buf[:n]
+		if _, err := f.ReadAt(chunk, int64(indexHeaderWidth+size-n)); err != nil {
+			return 0, err
+		}
+		for end := n; end > 0; end -= entWidth {
+			for _, b := range chunk[end-entWidth : end] {
+				if b != 0 {
+					return size, nil // Última entrada escrita
+				}
+			}
+			size -= entWidth
+		}
+	}
+	return size, nil
+}
+
+// mapWritable mapea el índice con permisos de escritura. El archivo no se
+// agranda de entrada hasta maxBytes: empieza con lugar para indexInitialBytes de
+// entradas, o las que ya tiene, y Write lo duplica cada vez que se llena.
+func (i *index) mapWritable(maxBytes uint64) error {
+	// Nunca recorta entradas existentes aunque MaxIndexBytes haya bajado
+	// desde que se escribió el índice.
+	i.maxBytes = max(maxBytes, i.size)
+	return i.remap(min(max(i.size, indexInitialBytes), i.maxBytes))
+}
+
+// remap agranda el archivo a capacity bytes de entradas, redondeado a entradas
+// completas, y lo vuelve a mapear con permisos de escritura. Las entradas
+// escritas se conservan: el mapeo es compartido, así que ya están en el archivo.
+func (i *index) remap(capacity uint64) error {
+	capacity -= capacity % entWidth // Un índice que queda así tras una caída sigue siendo válido
+	if i.mmap != nil {
+		if err := i.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		i.mmap = nil
+	}
+	if err := os.Truncate(
+		i.file.Name(), int64(indexHeaderWidth+capacity), // Agranda el archivo a la nueva capacidad
 	); err != nil {
-		return nil, err // Retorna error si falla
+		return err // Retorna error si falla
 	}
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),                      // Mapea el archivo a memoria
+	mmap, err := gommap.Map(
+		i.file.Fd(),                        // Mapea el archivo a memoria
 		gommap.PROT_READ|gommap.PROT_WRITE, // Permisos de lectura y escritura
 		gommap.MAP_SHARED,                  // Mapeo compartido
-	); err != nil {
-		return nil, err // Retorna error si falla
+	)
+	if err != nil {
+		return err // Retorna error si falla
 	}
-	return idx, nil // Retorna la instancia de index
+	i.mmap = mmap
+	i.readOnly = false
+	return nil
+}
+
+// grow duplica la capacidad del índice sin pasar de maxBytes. Retorna io.EOF si
+// ya no puede crecer.
+func (i *index) grow() error {
+	capacity := uint64(len(i.mmap)) - indexHeaderWidth
+	next := min(max(2*capacity, entWidth), i.maxBytes)
+	if next-next%entWidth <= capacity {
+		return io.EOF // El índice llegó a MaxIndexBytes
+	}
+	return i.remap(next)
+}
+
+// unseal vuelve a mapear con permisos de escritura un índice de solo lectura,
+// para reconstruirlo.
+func (i *index) unseal(maxBytes uint64) error {
+	if !i.readOnly {
+		return nil
+	}
+	return i.mapWritable(maxBytes) // remap deshace el mapeo de solo lectura
+}
+
+// hasIndexHeader indica si el archivo empieza con el magic number del header. Los
+// índices anteriores a la versión 1 empiezan con el offset relativo 0 de su primera
+// entrada, así que nunca se confunden con el magic.
+func hasIndexHeader(f *os.File, size uint64) (bool, error) {
+	if size < indexHeaderWidth {
+		return false, nil
+	}
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return false, err
+	}
+	return enc.Uint32(magic) == indexMagic, nil
+}
+
+// checkIndexHeader valida la versión del header del índice.
+func checkIndexHeader(f *os.File) error {
+	header := make([]byte, indexHeaderWidth)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if version := enc.Uint32(header[4:]); version != indexVersion {
+		return fmt.Errorf("%w: %s has version %d, want %d", ErrIndexVersion, f.Name(), version, indexVersion)
+	}
+	return nil
+}
+
+// migrateIndex agrega el header a un índice vacío o escrito sin él, corriendo las
+// entradas existentes. Primero se copian las entradas y después se escribe el
+// header; si el proceso cae en medio, el archivo queda con un tamaño inválido y se
+// detecta como ErrCorruptIndex.
+func migrateIndex(f *os.File, size uint64) error {
+	if size > 0 {
+		entries := make([]byte, size)
+		if _, err := f.ReadAt(entries, 0); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(entries, int64(indexHeaderWidth)); err != nil {
+			return err
+		}
+	}
+	_, err := f.WriteAt(indexHeader(), 0)
+	return err
+}
+
+// hasRoom indica si el índice puede recibir una entrada más sin pasar de
+// maxBytes, creciendo si hace falta.
+func (i *index) hasRoom() bool {
+	return i.size+entWidth <= i.maxBytes
 }
 
 // Write escribe un offset y una posición en el índice.
 func (i *index) Write(off uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entWidth { // Verifica si hay espacio suficiente en el mapeo
-		return io.EOF // Retorna error si no hay espacio
+	if i.readOnly {
+		return ErrReadOnlyIndex // Escribir en el mapeo de solo lectura daría SIGSEGV
 	}
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)          // Escribe el offset en el mapeo
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos) // Escribe la posición en el mapeo
-	i.size += uint64(entWidth)                                  // Incrementa el tamaño del índice
-	return nil                                                  // Retorna nil si no hay errores
+	if uint64(len(i.mmap)) < indexHeaderWidth+i.size+entWidth { // Verifica si hay espacio suficiente en el mapeo
+		if err := i.grow(); err != nil {
+			return err // Retorna io.EOF si el índice ya tiene su tamaño máximo
+		}
+	}
+	at := indexHeaderWidth + i.size                     // Las entradas empiezan después del header
+	enc.PutUint32(i.mmap[at:at+offWidth], off)          // Escribe el offset en el mapeo
+	enc.PutUint64(i.mmap[at+offWidth:at+entWidth], pos) // Escribe la posición en el mapeo
+	i.size += uint64(entWidth)                          // Incrementa el tamaño del índice
+	return nil                                          // Retorna nil si no hay errores
 }
 
 // Lee el índice y retorna el offset y la posición en el archivo.
@@ -77,11 +294,80 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	if i.size < pos+entWidth {   // Verifica si la posición está fuera de rango
 		return 0, 0, io.EOF // Retorna error si está fuera de rango
 	}
+	pos += indexHeaderWidth                               // Salta el header
 	out = enc.Uint32(i.mmap[pos : pos+offWidth])          // Lee el offset desde el mapeo
 	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth]) // Lee la posición desde el mapeo
 	return out, pos, nil                                  // Retorna el offset y la posición
 }
 
+// IndexEntry es una entrada del índice: el offset relativo de un registro y su
+// posición en el store.
+type IndexEntry struct {
+	RelativeOffset uint32
+	Pos            uint64
+}
+
+// SearchRange retorna las entradas con offset relativo en [start, end). Ubica
+// start por bisección, porque las entradas están ordenadas aunque una
+// compactación haya dejado huecos, y desde ahí copia las entradas de corrido,
+// así se recorre el mmap una sola vez en vez de una búsqueda por offset.
+func (i *index) SearchRange(start, end uint32) ([]IndexEntry, error) {
+	if end < start {
+		return nil, fmt.Errorf("log: index range end %d is before start %d", end, start)
+	}
+	n := int(i.size / entWidth)
+	first := sort.Search(n, func(j int) bool {
+		return i.relAt(j) >= start
+	})
+	// Sin huecos la entrada de end está a end-start de la primera, así que el
+	// resultado cabe en esa capacidad; con huecos sobra espacio.
+	size := min(n-first, int(end-start))
+	entries := make([]IndexEntry, 0, size)
+	for j := first; j < n; j++ {
+		at := indexHeaderWidth + uint64(j)*entWidth
+		rel := enc.Uint32(i.mmap[at : at+offWidth])
+		if rel >= end {
+			break
+		}
+		entries = append(entries, IndexEntry{
+			RelativeOffset: rel,
+			Pos:            enc.Uint64(i.mmap[at+offWidth : at+entWidth]),
+		})
+	}
+	return entries, nil
+}
+
+// relAt retorna el offset relativo de la entrada j, que debe existir.
+func (i *index) relAt(j int) uint32 {
+	at := indexHeaderWidth + uint64(j)*entWidth
+	return enc.Uint32(i.mmap[at : at+offWidth])
+}
+
+// seal deja el índice de solo lectura: lo sincroniza, recorta el archivo a las
+// entradas usadas y lo vuelve a mapear sin permiso de escritura, así un Write
+// por error falla en vez de escribir en un segmento cerrado a escrituras.
+func (i *index) seal() error {
+	if i.readOnly {
+		return nil // Ya se abrió de solo lectura
+	}
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	if err := i.mmap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	if err := i.file.Truncate(int64(indexHeaderWidth + i.size)); err != nil {
+		return err
+	}
+	mmap, err := gommap.Map(i.file.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	i.mmap = mmap
+	i.readOnly = true
+	return i.file.Sync()
+}
+
 // Close cierra el archivo del índice, asegurando que todos los cambios se escriban en el disco.
 func (i *index) Close() error {
 	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil { // Sincroniza el mapeo con el disco
@@ -90,7 +376,7 @@ func (i *index) Close() error {
 	if err := i.file.Sync(); err != nil { // Sincroniza el archivo con el disco
 		return err // Retorna error si falla
 	}
-	if err := i.file.Truncate(int64(i.size)); err != nil { // Trunca el archivo al tamaño actual del índice
+	if err := i.file.Truncate(int64(indexHeaderWidth + i.size)); err != nil { // Trunca el archivo al header más las entradas
 		return err // Retorna error si falla
 	}
 	return i.file.Close() // Cierra el archivo y retorna nil si no hay errores
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tysonmote/gommap"
 )
 
 func TestIndex(t *testing.T) {
@@ -50,3 +51,251 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexReadOnly(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_read_only_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	for i := uint32(0); i < 3; i++ {
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+	}
+	require.NoError(t, idx.Close())
+	want := int64(indexHeaderWidth + 3*entWidth)
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newReadOnlyIndex(f)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	// the file isn't grown to MaxIndexBytes and only its entries are mapped
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, want, fi.Size())
+	require.Len(t, idx.mmap, int(want))
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), off)
+	require.Equal(t, uint64(20), pos)
+
+	// writing fails with an error instead of faulting on the mapping
+	require.ErrorIs(t, idx.Write(3, 30), ErrReadOnlyIndex)
+
+	// unseal maps it writable again for a rebuild
+	require.NoError(t, idx.unseal(c.Segment.MaxIndexBytes))
+	require.NoError(t, idx.Write(3, 30))
+	off, _, err = idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), off)
+}
+
+func TestIndexGrowth(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_growth_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	fileSize := func() uint64 {
+		fi, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		return uint64(fi.Size())
+	}
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1000 * entWidth
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	// a new index only takes room for a few entries, not MaxIndexBytes
+	require.Equal(t, indexHeaderWidth+indexInitialBytes, fileSize())
+
+	// writing past the mapping grows it, keeping the entries already written
+	var grown []uint64
+	for i := uint32(0); i < 1000; i++ {
+		before := len(idx.mmap)
+		require.NoError(t, idx.Write(i, uint64(i)*10))
+		if len(idx.mmap) != before {
+			grown = append(grown, uint64(len(idx.mmap))-indexHeaderWidth)
+		}
+		for _, j := range []uint32{0, i / 2, i} {
+			off, pos, err := idx.Read(int64(j))
+			require.NoError(t, err)
+			require.Equal(t, j, off)
+			require.Equal(t, uint64(j)*10, pos)
+		}
+	}
+	// it doubles each time and stops at MaxIndexBytes
+	require.Equal(t, []uint64{
+		2 * indexInitialBytes,
+		4 * indexInitialBytes,
+		8 * indexInitialBytes,
+		c.Segment.MaxIndexBytes,
+	}, grown)
+	require.Equal(t, io.EOF, idx.Write(1000, 10000))
+
+	// a crash before Close leaves the unused room in the file; reopening
+	// counts only the entries written
+	f2, err := os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	crashed, err := newIndex(f2, c)
+	require.NoError(t, err)
+	require.Equal(t, 1000*entWidth, crashed.size)
+	require.NoError(t, crashed.Close())
+
+	require.NoError(t, idx.Close())
+	require.Equal(t, indexHeaderWidth+1000*entWidth, fileSize())
+}
+
+func TestIndexUnusedRoom(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_unused_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Write(0, 0))
+	require.NoError(t, idx.Write(1, 10))
+	require.NoError(t, idx.mmap.Sync(gommap.MS_SYNC))
+
+	// the file still has the zeroed room after the two entries
+	f2, err := os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	size, err := loadIndex(f2)
+	require.NoError(t, err)
+	require.Equal(t, 2*entWidth, size)
+	f2.Close()
+	require.NoError(t, idx.Close())
+}
+
+func TestIndexZeroMaxBytes(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_zero_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// without room for entries the index opens and reports it is full
+	idx, err := newIndex(f, Config{})
+	require.NoError(t, err)
+	require.Equal(t, io.EOF, idx.Write(0, 0))
+	require.NoError(t, idx.Close())
+}
+
+func TestIndexHeader(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "index_header_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+
+	// a new index starts with the magic number and the current version
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Write(0, 0))
+	require.NoError(t, idx.Close())
+	b, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, indexHeaderWidth+entWidth, uint64(len(b)))
+	require.Equal(t, indexMagic, enc.Uint32(b[:4]))
+	require.Equal(t, indexVersion, enc.Uint32(b[4:8]))
+
+	// an index written by a future version is rejected, not misread
+	enc.PutUint32(b[4:8], indexVersion+1)
+	require.NoError(t, os.WriteFile(f.Name(), b, 0600))
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	_, err = newIndex(f, c)
+	require.ErrorIs(t, err, ErrIndexVersion)
+	f.Close()
+
+	// an index without header gets one and keeps its entries
+	legacy := make([]byte, 2*entWidth)
+	enc.PutUint32(legacy[entWidth:], 1)
+	enc.PutUint64(legacy[entWidth+offWidth:], 10)
+	require.NoError(t, os.WriteFile(f.Name(), legacy, 0600))
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newIndex(f, c)
+	require.NoError(t, err)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(10), pos)
+	require.NoError(t, idx.Close())
+	b, err = os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, indexMagic, enc.Uint32(b[:4]))
+	require.Equal(t, legacy, b[indexHeaderWidth:])
+}
+
+func TestIndexSearchRange(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "index_range_test")
+	require.NoError(t, err)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+
+	entries, err := idx.SearchRange(0, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// offsets 0..9 sin el 3 ni el 4, como tras una compactación
+	for off := uint32(0); off < 10; off++ {
+		if off == 3 || off == 4 {
+			continue
+		}
+		require.NoError(t, idx.Write(off, uint64(off)*100))
+	}
+
+	entries, err = idx.SearchRange(2, 6)
+	require.NoError(t, err)
+	require.Equal(t, []IndexEntry{
+		{RelativeOffset: 2, Pos: 200},
+		{RelativeOffset: 5, Pos: 500},
+	}, entries)
+
+	entries, err = idx.SearchRange(3, 5)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	entries, err = idx.SearchRange(8, 100)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	_, err = idx.SearchRange(5, 2)
+	require.Error(t, err)
+}
+
+func BenchmarkIndexSearchRange(b *testing.B) {
+	f, err := os.CreateTemp(b.TempDir(), "index_range_bench")
+	require.NoError(b, err)
+	const n = 100
+	c := Config{}
+	c.Segment.MaxIndexBytes = n * entWidth
+	idx, err := newIndex(f, c)
+	require.NoError(b, err)
+	defer idx.Close()
+	for off := uint32(0); off < n; off++ {
+		require.NoError(b, idx.Write(off, uint64(off)*100))
+	}
+
+	b.Run("Read", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for off := int64(0); off < n; off++ {
+				if _, _, err := idx.Read(off); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("SearchRange", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := idx.SearchRange(0, n); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
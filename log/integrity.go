@@ -0,0 +1,198 @@
+package log
+
+// Integridad de los segmentos sellados en un archivo <base>.integrity: el tamaño
+// y el SHA-256 del store y del índice al cerrar el segmento. Al abrirlo se
+// comprueba que los dos archivos sigan siendo los mismos. Si el log tiene
+// EncryptionKey, el archivo lleva además un HMAC que impide reescribirlo.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrSegmentCorrupt indica que los archivos de un segmento no coinciden con su
+// archivo .integrity.
+type ErrSegmentCorrupt struct {
+	BaseOffset uint64
+	Reason     string
+
+	index bool // Sólo el índice no coincide; RebuildIndexOnError puede repararlo
+}
+
+func (e ErrSegmentCorrupt) Error() string {
+	return fmt.Sprintf("log: segment %d is corrupt: %s", e.BaseOffset, e.Reason)
+}
+
+// segmentIntegrity es el contenido del archivo .integrity de un segmento, en JSON.
+type segmentIntegrity struct {
+	StoreSize   uint64    `json:"storeSize"`
+	IndexSize   uint64    `json:"indexSize"`
+	StoreSHA256 string    `json:"storeSha256"`
+	IndexSHA256 string    `json:"indexSha256"`
+	SealedAt    time.Time `json:"sealedAt"`
+	MAC         string    `json:"mac,omitempty"` // HMAC-SHA256 del resto con EncryptionKey
+}
+
+// SegmentVerifyResult es el resultado de comprobar la integridad de un segmento
+// con Log.VerifyIntegrity. Checked es false si el segmento todavía no tiene
+// archivo .integrity, porque no se cerró desde que se selló.
+type SegmentVerifyResult struct {
+	BaseOffset uint64
+	Checked    bool
+	Err        error // ErrSegmentCorrupt si los archivos no coinciden
+}
+
+// hashFile retorna el tamaño y el SHA-256 del archivo name.
+func hashFile(name string) (uint64, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return uint64(n), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newSegmentIntegrity calcula la integridad de los archivos del segmento name en dir.
+func newSegmentIntegrity(dir, name string) (*segmentIntegrity, error) {
+	m := &segmentIntegrity{SealedAt: time.Now().UTC()}
+	var err error
+	if m.StoreSize, m.StoreSHA256, err = hashFile(path.Join(dir, name+".store")); err != nil {
+		return nil, err
+	}
+	if m.IndexSize, m.IndexSHA256, err = hashFile(path.Join(dir, name+".index")); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mac calcula el HMAC de m, sin contar su propio campo MAC.
+func (m segmentIntegrity) mac(key []byte) (string, error) {
+	m.MAC = ""
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeSegmentIntegrity guarda la integridad actual del segmento name en dir,
+// firmada con key si no está vacía, en un archivo con permisos perm.
+func writeSegmentIntegrity(dir, name string, key []byte, perm os.FileMode) error {
+	m, err := newSegmentIntegrity(dir, name)
+	if err != nil {
+		return err
+	}
+	if len(key) > 0 {
+		if m.MAC, err = m.mac(key); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path.Join(dir, name+".integrity"), b, perm)
+}
+
+// checkSegmentIntegrity compara los archivos del segmento name en dir con su
+// archivo .integrity. Retorna false sin error si el segmento no lo tiene.
+func checkSegmentIntegrity(dir, name string, baseOffset uint64, key []byte) (bool, error) {
+	b, err := os.ReadFile(path.Join(dir, name+".integrity"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	corrupt := func(format string, args ...any) ErrSegmentCorrupt {
+		return ErrSegmentCorrupt{BaseOffset: baseOffset, Reason: fmt.Sprintf(format, args...)}
+	}
+	want := &segmentIntegrity{}
+	if err = json.Unmarshal(b, want); err != nil {
+		return true, corrupt("integrity file: %v", err)
+	}
+	if len(key) > 0 {
+		mac, err := want.mac(key)
+		if err != nil {
+			return true, err
+		}
+		if !hmac.Equal([]byte(mac), []byte(want.MAC)) {
+			return true, corrupt("integrity file has an invalid MAC")
+		}
+	}
+	got, err := newSegmentIntegrity(dir, name)
+	if err != nil {
+		return true, err
+	}
+	switch {
+	case got.StoreSize != want.StoreSize:
+		return true, corrupt("store has %d bytes, want %d", got.StoreSize, want.StoreSize)
+	case got.StoreSHA256 != want.StoreSHA256:
+		return true, corrupt("store checksum mismatch")
+	case got.IndexSize != want.IndexSize:
+		err := corrupt("index has %d bytes, want %d", got.IndexSize, want.IndexSize)
+		err.index = true
+		return true, err
+	case got.IndexSHA256 != want.IndexSHA256:
+		err := corrupt("index checksum mismatch")
+		err.index = true
+		return true, err
+	}
+	return true, nil
+}
+
+// fileName devuelve el nombre base de los archivos del segmento, sin extensión.
+func (s *Segment) fileName() string {
+	return strings.TrimSuffix(path.Base(s.store.Name()), ".store")
+}
+
+// integrityPath devuelve la ruta del archivo .integrity del segmento.
+func (s *Segment) integrityPath() string {
+	return path.Join(s.dir, s.fileName()+".integrity")
+}
+
+// writeIntegrity guarda el archivo .integrity de un segmento sellado ya
+// cerrado, salvo que ya lo tenga: sus archivos no cambian después de sellarlo.
+func (s *Segment) writeIntegrity() error {
+	if !s.sealed {
+		return nil // El segmento activo sigue cambiando
+	}
+	if _, err := os.Stat(s.integrityPath()); err == nil {
+		return nil
+	}
+	return writeSegmentIntegrity(s.dir, s.fileName(), s.config.Segment.EncryptionKey, s.config.Segment.Options.fileMode())
+}
+
+// VerifyIntegrity comprueba cada segmento salvo el activo contra su archivo
+// .integrity y retorna un resultado por segmento. Los segmentos sellados desde
+// que se abrió el log no tienen ese archivo hasta que se cierran.
+func (l *Log) VerifyIntegrity() []SegmentVerifyResult {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var results []SegmentVerifyResult
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			continue
+		}
+		s.mu.RLock()
+		checked, err := checkSegmentIntegrity(s.dir, s.fileName(), s.baseOffset, s.config.Segment.EncryptionKey)
+		s.mu.RUnlock()
+		results = append(results, SegmentVerifyResult{BaseOffset: s.baseOffset, Checked: checked, Err: err})
+	}
+	return results
+}
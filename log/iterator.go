@@ -0,0 +1,151 @@
+package log
+
+// Este archivo permite recorrer el log desde un offset o desde un instante,
+// buscando por bisección el primer registro con timestamp mayor o igual.
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	api "github.com/dati/api/v1"
+)
+
+// ErrNoRecordAfterTime indica que ningún registro del log tiene un timestamp
+// mayor o igual al buscado.
+var ErrNoRecordAfterTime = errors.New("log: no record at or after the given time")
+
+// OffsetAtTime retorna el offset del primer registro con timestamp mayor o igual
+// a t. Primero busca por bisección el segmento usando el timestamp de su primer
+// registro y después, dentro del segmento, la entrada del índice. Supone que los
+// timestamps no decrecen con el offset, como pasa cuando los asigna Append.
+func (l *Log) OffsetAtTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	want := t.UnixNano()
+	var segments []*Segment // Segmentos con al menos un registro
+	for _, s := range l.segments {
+		if s.RecordCount() > 0 {
+			segments = append(segments, s)
+		}
+	}
+	var err error
+	j := sort.Search(len(segments), func(i int) bool {
+		ts, _, rerr := segments[i].entryTimestamp(0)
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+		return ts > want
+	})
+	if err != nil {
+		return 0, err
+	}
+	if j > 0 {
+		// El segmento anterior empieza antes de t; el registro buscado está en él
+		// o es el primero del segmento j.
+		off, found, err := segments[j-1].offsetAtTime(want)
+		if err != nil || found {
+			return off, err
+		}
+	}
+	if j == len(segments) {
+		return 0, ErrNoRecordAfterTime
+	}
+	_, off, err := segments[j].entryTimestamp(0)
+	return off, err
+}
+
+// offsetAtTime busca por bisección en el índice del segmento el primer registro
+// con timestamp mayor o igual a want.
+func (s *Segment) offsetAtTime(want int64) (uint64, bool, error) {
+	n := int(s.RecordCount())
+	var err error
+	i := sort.Search(n, func(i int) bool {
+		ts, _, rerr := s.entryTimestamp(i)
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+		return ts >= want
+	})
+	if err != nil || i == n {
+		return 0, false, err
+	}
+	_, off, err := s.entryTimestamp(i)
+	return off, err == nil, err
+}
+
+// entryTimestamp lee el registro de la entrada i del índice y retorna su
+// timestamp y su offset.
+func (s *Segment) entryTimestamp(i int) (int64, uint64, error) {
+	rel, pos, err := s.index.Read(int64(i))
+	if err != nil {
+		return 0, 0, err
+	}
+	value, err := s.store.Read(pos)
+	if err != nil {
+		return 0, 0, err
+	}
+	off := s.baseOffset + uint64(rel)
+	record, err := s.decode(off, value)
+	if err != nil {
+		return 0, 0, err
+	}
+	return record.Timestamp, off, nil
+}
+
+// Iterator recorre los registros del log en orden a partir de un offset,
+// saltando los borrados. Lee con Read, así que puede usarse mientras el log
+// recibe escrituras.
+type Iterator struct {
+	log *Log
+	off uint64 // Offset que leerá el próximo Next
+}
+
+// NewIterator crea un Iterator que empieza en off.
+func (l *Log) NewIterator(off uint64) *Iterator {
+	return &Iterator{log: l, off: off}
+}
+
+// NewIteratorAt crea un Iterator que empieza en el primer registro con
+// timestamp mayor o igual a t. Retorna ErrNoRecordAfterTime si no hay ninguno.
+func (l *Log) NewIteratorAt(t time.Time) (*Iterator, error) {
+	off, err := l.OffsetAtTime(t)
+	if err != nil {
+		return nil, err
+	}
+	return l.NewIterator(off), nil
+}
+
+// Next retorna el siguiente registro, o io.EOF cuando llega al final del log.
+// Si el offset del iterador ya fue truncado, continúa desde el más bajo.
+func (it *Iterator) Next() (*api.Record, error) {
+	for {
+		record, err := it.log.Read(it.off)
+		if errors.As(err, &api.ErrRecordDeleted{}) {
+			it.off++ // Registro borrado o quitado por una compactación
+			continue
+		}
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			lowest, lerr := it.log.LowestOffset()
+			if lerr != nil {
+				return nil, lerr
+			}
+			if it.off < lowest {
+				it.off = lowest // El offset ya fue truncado
+				continue
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		it.off++
+		return record, nil
+	}
+}
+
+// Offset retorna el offset que leerá el próximo Next.
+func (it *Iterator) Offset() uint64 {
+	return it.off
+}
@@ -0,0 +1,41 @@
+package log
+
+// Este archivo evita que dos procesos abran el mismo directorio de log a la vez,
+// lo que corrompería los índices mapeados en memoria.
+
+import (
+	"errors"
+	"os"
+	"path"
+)
+
+// lockFileName es el archivo del directorio del log que se bloquea.
+const lockFileName = ".lock"
+
+// ErrDirectoryLocked indica que otro Log ya tiene abierto el directorio.
+var ErrDirectoryLocked = errors.New("log: directory is locked")
+
+// DirLock es un lock exclusivo sobre un directorio de log.
+type DirLock struct {
+	file *os.File // Archivo de lock que se mantiene abierto mientras dure el lock
+}
+
+// LockDir toma un lock exclusivo sobre <dir>/.lock. Si otro proceso, u otro Log
+// del mismo proceso, ya lo tiene, retorna ErrDirectoryLocked.
+func LockDir(dir string) (*DirLock, error) {
+	f, err := lockFile(path.Join(dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+	return &DirLock{file: f}, nil
+}
+
+// Release libera el lock. Llamarlo más de una vez no tiene efecto.
+func (d *DirLock) Release() error {
+	if d == nil || d.file == nil {
+		return nil
+	}
+	f := d.file
+	d.file = nil
+	return unlockFile(f)
+}
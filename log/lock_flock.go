@@ -0,0 +1,35 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package log
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile abre el archivo de lock y toma un flock exclusivo sin bloquear.
+// El kernel libera el flock si el proceso muere, así que no quedan locks huérfanos.
+func lockFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrDirectoryLocked // Otro descriptor ya tiene el lock
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockFile suelta el flock y cierra el archivo; el archivo queda en el directorio.
+func unlockFile(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package log
+
+import (
+	"os"
+)
+
+// lockFile crea el archivo de lock de forma exclusiva y lo mantiene abierto.
+// Sin flock, si el proceso muere el archivo queda y hay que borrarlo a mano.
+func lockFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, ErrDirectoryLocked // Otro Log creó el archivo antes
+	}
+	return f, err
+}
+
+// unlockFile cierra el archivo de lock y lo borra para que otro Log pueda tomarlo.
+func unlockFile(f *os.File) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
@@ -4,13 +4,19 @@ package log
 // y maneja la configuración general.
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/dati/api/v1"
 )
@@ -22,103 +28,850 @@ type Log struct {
 	Dir    string // Directorio donde se almacenan los segmentos
 	Config Config // Configuración del log
 
-	activeSegment *segment   // Segmento activo actual
-	segments      []*segment // Lista de todos los segmentos
+	activeSegment *Segment   // Segmento activo actual
+	segments      []*Segment // Lista de todos los segmentos
+
+	logger *slog.Logger  // Logger estructurado para eventos del log
+	hooks  []func()      // Callbacks pendientes de ejecutar al soltar el lock
+	notify chan struct{} // Se cierra en cada Append para despertar a los consumers
+	done   chan struct{} // Se cierra en Close para terminar las suscripciones
+	closed bool          // Indica que Close ya cerró los segmentos
+	locks  []*DirLock    // Locks exclusivos sobre los directorios del log
+	dirIdx int           // Próximo directorio de DataDirs para un segmento nuevo
+
+	deleted   map[uint64]struct{}      // Offsets borrados por un tombstone
+	producers map[string][]producerSeq // Últimos producerWindow sequence de cada productor
+
+	// Sólo con Compaction.Enabled; si no, quedan en nil.
+	latest    map[string]uint64         // Offset más alto de cada key
+	dirty     map[uint64]uint64         // Registros obsoletos por offset base del segmento
+	compactor atomic.Pointer[compactor] // Goroutine de compactación en curso
+	maintMu   sync.Mutex                // Serializa a quienes reemplazan o eliminan segmentos sellados
+
+	compressing sync.WaitGroup // Compresiones de CompressSealed en background
+
+	webhooks atomic.Pointer[webhookDispatcher] // Entrega de Config.Webhooks; nil si no hay
+	cdc      cdcBroadcaster                    // Consumers de CDCStream
+
+	readSem  chan struct{} // Semáforo de lecturas en curso; nil si no hay límite
+	readHook func()        // Se ejecuta dentro de cada lectura; sólo lo usan los tests
+}
+
+// ErrLogClosed indica que se intentó leer de un log cerrado.
+var ErrLogClosed = errors.New("log: log is closed")
+
+// Option permite personalizar el Log al momento de crearlo con NewLog.
+type Option func(*Log)
+
+// WithLogger asigna el logger que usará el Log. Por defecto se usa slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(l *Log) {
+		l.logger = logger
+	}
 }
 
-// NewLog crea una nueva instancia de Log y recibe la Configuración.
-func NewLog(dir string, c Config) (*Log, error) {
+// NewLog crea una nueva instancia de Log y recibe la Configuración. Crea el
+// directorio y los DataDirs que no existan.
+func NewLog(dir string, c Config, opts ...Option) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024 // Valor por defecto para MaxStoreBytes
 	}
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024 // Valor por defecto para MaxIndexBytes
 	}
+	if err := checkCodec(c.Segment.CompressionCodec); err != nil {
+		return nil, err
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		logger: slog.Default(),
+		notify: make(chan struct{}),
+	}
+	if c.MaxConcurrentReads > 0 {
+		l.readSem = make(chan struct{}, c.MaxConcurrentReads)
+	}
+	for _, opt := range opts {
+		opt(l) // Aplica cada opción al log
+	}
+	for _, dir := range l.dirs() {
+		if err := prepareDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.lockDirs(); err != nil { // Evita que otro Log use los mismos directorios
+		return nil, err
+	}
+	err := l.setup() // Configura el log
+	l.runHooks()
+	if err == nil {
+		l.startCompactor()
+		l.startWebhooks()
+	}
+	return l, err
+}
+
+// unlock libera el lock de escritura y después ejecuta los callbacks pendientes,
+// así un callback puede volver a usar el log sin bloquearse.
+func (l *Log) unlock() {
+	hooks := l.hooks
+	l.hooks = nil
+	l.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
 	}
+}
 
-	return l, l.setup() // Configura el log y retorna la instancia
+// runHooks ejecuta los callbacks pendientes cuando no se tomó el lock, como en setup.
+func (l *Log) runHooks() {
+	l.mu.Lock()
+	l.unlock()
 }
 
 // setup inicializa el log configurando los segmentos existentes.
 func (l *Log) setup() error {
-	files, err := os.ReadDir(l.Dir) // Lee los archivos en el directorio
-	if err != nil {
-		return err
+	l.segments, l.activeSegment = nil, nil // Reset vuelve a leer los segmentos del disco
+	l.done, l.closed = make(chan struct{}), false
+	for _, dir := range l.dirs() {
+		// Antes de limpiar los .tmp de cualquier directorio, porque una mudanza
+		// confirmada tiene sus copias como .tmp en el directorio de destino.
+		if err := recoverMoves(dir); err != nil {
+			return err
+		}
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
-		off, _ := strconv.ParseUint(offStr, 10, 0) // Convierte el nombre del archivo a uint64
-		baseOffsets = append(baseOffsets, off)     // Agrega el offset a la lista
+	segmentDirs := make(map[uint64]string) // Directorio de cada segmento por su offset base
+	for _, dir := range l.dirs() {
+		if err := recoverSegmentFiles(dir); err != nil { // Limpia segmentos creados a medias
+			return err
+		}
+		files, err := os.ReadDir(dir) // Lee los archivos en el directorio
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if ext := path.Ext(file.Name()); file.Name() == lockFileName || ext == ".meta" || ext == ".integrity" || ext == ".wal" {
+				// El lock no pertenece a ningún segmento y un .meta, un
+				// .integrity o un .wal sin su store no alcanza para abrir uno.
+				continue
+			}
+			off, err := parseBaseOffset(file.Name()) // Convierte el nombre del archivo a uint64
+			if err != nil {
+				// No es un archivo de segmento; con offset 0 abriría uno espurio.
+				l.logger.Warn("skipping file that is not a segment",
+					slog.String("file", path.Join(dir, file.Name())))
+				continue
+			}
+			segmentDirs[off] = dir // El store y el índice comparten offset y directorio
+		}
+	}
+	baseOffsets := make([]uint64, 0, len(segmentDirs))
+	for off := range segmentDirs {
+		baseOffsets = append(baseOffsets, off)
 	}
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j] // Ordena los offsets
 	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.NewSegment(baseOffsets[i]); err != nil {
+	l.deleted = make(map[uint64]struct{})
+	l.producers = make(map[string][]producerSeq)
+	l.latest, l.dirty = nil, nil
+	if l.Config.Compaction.Enabled {
+		l.latest = make(map[string]uint64)
+		l.dirty = make(map[uint64]uint64)
+	}
+	for i, off := range baseOffsets {
+		// Sólo el último segmento recibe escrituras; los demás se abren sellados.
+		sealed := i < len(baseOffsets)-1
+		if err := l.openSegment(segmentDirs[off], off, sealed); err != nil {
 			return err
 		}
-		// baseOffset contiene duplicados para índice y store, así que los saltamos
-		i++
+		for _, off := range l.activeSegment.deletedOffsets() {
+			l.deleted[off] = struct{}{}
+		}
 	}
 	if l.segments == nil {
-		if err = l.NewSegment(l.Config.Segment.InitialOffset); err != nil {
+		if err := l.NewSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
 	}
+	return l.replay()
+}
+
+// prepareDir crea dir si no existe y comprueba que se pueda escribir en él
+// creando y borrando un archivo temporal, para fallar al abrir el log con un
+// error claro y no en el primer Append. El archivo termina en .tmp, así que si
+// quedara por una caída lo borra recoverSegmentFiles.
+func prepareDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("log: create directory %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, "write-check-*.tmp")
+	if err != nil {
+		return fmt.Errorf("log: directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("log: directory %s is not writable: %w", dir, err)
+	}
 	return nil
 }
 
-// Append agrega un nuevo registro al segmento activo.
+// dirs retorna el directorio del log seguido de los DataDirs y los ArchiveDirs,
+// sin repetidos.
+func (l *Log) dirs() []string {
+	dirs := []string{filepath.Clean(l.Dir)}
+	for _, dir := range slices.Concat(l.Config.DataDirs, l.Config.ArchiveDirs) {
+		if dir = filepath.Clean(dir); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// lockDirs toma el lock de cada directorio del log. Si alguno falla, suelta los
+// que ya había tomado.
+func (l *Log) lockDirs() error {
+	for _, dir := range l.dirs() {
+		lock, err := LockDir(dir)
+		if err != nil {
+			l.releaseDirs()
+			return err
+		}
+		l.locks = append(l.locks, lock)
+	}
+	return nil
+}
+
+// releaseDirs suelta los locks de los directorios del log.
+func (l *Log) releaseDirs() error {
+	var err error
+	for _, lock := range l.locks {
+		if lerr := lock.Release(); lerr != nil && err == nil {
+			err = lerr
+		}
+	}
+	l.locks = nil
+	return err
+}
+
+// Append agrega un nuevo registro al segmento activo. Si el registro trae
+// ProducerId y su SequenceNumber no es mayor al último de ese productor, es un
+// reintento: devuelve el offset que se le asignó la primera vez sin escribirlo.
 func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	defer l.unlock()
+	return l.append(record)
+}
+
+// AppendBatch agrega varios registros tomando el lock una sola vez y devuelve el
+// offset asignado a cada uno. Si un registro falla, se devuelven los offsets de
+// los registros que sí se agregaron junto con el error.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.unlock()
+	offsets := make([]uint64, 0, len(records))
+	for _, record := range records {
+		off, err := l.append(record)
+		if err != nil {
+			return offsets, err
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets, nil
+}
+
+// appendFromChunk es la cantidad de registros que AppendFrom agrega por cada vez
+// que toma el lock.
+const appendFromChunk = 256
+
+// AppendFrom importa los registros de r, con el formato de Log.Reader, asignándoles
+// offsets nuevos en este log. Lee los registros sin el lock y los agrega por bloques
+// de appendFromChunk, rotando segmentos cuando hace falta. Devuelve el primer y el
+// último offset asignados; si el flujo está vacío retorna io.EOF. Si el flujo termina
+// a mitad de un registro, el error envuelve io.ErrUnexpectedEOF e indica cuántos
+// registros se importaron.
+func (l *Log) AppendFrom(r io.Reader) (first, last uint64, err error) {
+	first, last, imported, err := l.appendFrom(r)
+	if err == nil && imported == 0 {
+		return 0, 0, io.EOF
+	}
+	return first, last, err
+}
+
+// ImportFrom agrega al log los registros de r, con el formato de Log.Reader, y
+// retorna cuántos importó. Un flujo vacío importa cero registros sin error. Si
+// el flujo termina a mitad de un registro, retorna un error que envuelve
+// io.ErrUnexpectedEOF junto con los registros completos que ya agregó; el
+// registro cortado no llega al log.
+func (l *Log) ImportFrom(r io.Reader) (uint64, error) {
+	_, _, imported, err := l.appendFrom(r)
+	return imported, err
+}
+
+// appendFrom hace el trabajo de AppendFrom e ImportFrom, y además retorna
+// cuántos registros importó.
+func (l *Log) appendFrom(r io.Reader) (first, last, imported uint64, err error) {
+	rr := NewRecordReader(r)
+	chunk := make([]*api.Record, 0, appendFromChunk)
+	for {
+		chunk = chunk[:0]
+		var readErr error
+		for len(chunk) < appendFromChunk {
+			record, err := rr.Read()
+			if err != nil {
+				readErr = err
+				break
+			}
+			chunk = append(chunk, record)
+		}
+		if len(chunk) > 0 {
+			offsets, err := l.AppendBatch(chunk)
+			if len(offsets) > 0 {
+				if imported == 0 {
+					first = offsets[0]
+				}
+				last = offsets[len(offsets)-1]
+				imported += uint64(len(offsets))
+			}
+			if err != nil {
+				return first, last, imported, fmt.Errorf("log: imported %d records: %w", imported, err)
+			}
+		}
+		switch {
+		case readErr == io.EOF:
+			return first, last, imported, nil
+		case readErr != nil:
+			return first, last, imported, fmt.Errorf("log: imported %d records: %w", imported, readErr)
+		}
+	}
+}
+
+// append agrega un registro al segmento activo y rota el segmento cuando se
+// llena. Quien lo llama debe tener el lock de escritura.
+func (l *Log) append(record *api.Record) (uint64, error) {
+	if off, ok, err := l.duplicate(record); ok || err != nil {
+		return off, err // Reintento de un productor: no se vuelve a escribir
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano() // Hora en que se agregó
+	}
+	if err := l.rollIfOld(); err != nil {
+		return 0, err
+	}
 	off, err := l.activeSegment.Append(record) // Agrega el registro al segmento activo
+	if err == ErrSegmentFull {
+		if err = l.roll(); err == nil { // El registro va al principio de un segmento nuevo
+			off, err = l.activeSegment.Append(record)
+		}
+	}
 	if err != nil {
+		l.logger.Error("append failed", slog.Any("error", err))
 		return 0, err
 	}
+	l.trackProducer(record, off)
+	l.trackKey(record, off)
+	l.enqueueWebhook(record, off)
+	l.publishAppend(record, off)
+	return off, l.appended(off)
+}
+
+// AppendAt agrega un registro conservando su offset, para replicar registros de
+// otro nodo en las mismas posiciones. El offset debe ser el siguiente del log; si
+// no, retorna ErrOffsetGap o ErrDuplicateOffset sin escribir nada.
+func (l *Log) AppendAt(record *api.Record) error {
+	l.mu.Lock()
+	defer l.unlock()
+	if err := l.rollIfOld(); err != nil {
+		return err
+	}
+	err := l.activeSegment.AppendWithOffset(record)
+	if err == ErrSegmentFull {
+		if err = l.roll(); err == nil {
+			err = l.activeSegment.AppendWithOffset(record)
+		}
+	}
+	if err != nil {
+		l.logger.Error("append failed", slog.Any("error", err))
+		return err
+	}
+	l.trackProducer(record, record.Offset)
+	l.trackKey(record, record.Offset)
+	l.publishAppend(record, record.Offset)
+	return l.appended(record.Offset)
+}
+
+// appended avisa a los consumers del registro nuevo en off y rota el segmento
+// activo si se llenó. Quien lo llama debe tener el lock de escritura.
+func (l *Log) appended(off uint64) error {
+	l.logger.Debug("record appended", slog.Uint64("offset", off))
+	close(l.notify) // Avisa a los consumers que esperan un registro nuevo
+	l.notify = make(chan struct{})
 	if l.activeSegment.IsMaxed() { // Verifica si el segmento ha alcanzado su tamaño máximo
-		err = l.NewSegment(off + 1) // Crea un nuevo segmento
+		return l.roll()
+	}
+	return nil
+}
+
+// rollIfOld rota el segmento activo si pasó MaxSegmentAge desde que se creó,
+// antes de agregarle otro registro. Quien lo llama debe tener el lock de
+// escritura.
+func (l *Log) rollIfOld() error {
+	if !l.activeSegment.tooOld(l.Config.Segment.MaxSegmentAge, time.Now()) {
+		return nil
+	}
+	l.logger.Info("segment reached max age", l.activeSegment.logAttrs()...)
+	return l.roll()
+}
+
+// roll sella el segmento activo y crea uno nuevo a continuación. Con
+// CompressSealed además comprime en background el segmento recién sellado.
+// Quien lo llama debe tener el lock de escritura.
+func (l *Log) roll() error {
+	sealed := l.activeSegment
+	if err := sealed.Seal(); err != nil {
+		return err // Retorna error si no puede sellar el segmento lleno
+	}
+	if err := l.NewSegment(sealed.nextOffset); err != nil { // Crea un nuevo segmento
+		return err
+	}
+	if err := sealed.saveProducers(l.producers); err != nil {
+		// Sin la foto, el próximo NewLog recorre también este segmento.
+		l.logger.Warn("failed to save producer snapshot", append(sealed.logAttrs(), slog.Any("error", err))...)
+	}
+	l.cdc.publish(SegmentRolledEvent{BaseOffset: sealed.baseOffset, NextOffset: sealed.nextOffset})
+	if !l.Config.Segment.CompressSealed {
+		return nil
 	}
-	return off, err
+	l.startCompression(sealed)
+	return nil
+}
+
+// Rotate sella el segmento activo aunque no esté lleno y abre uno nuevo a
+// continuación. Retorna el offset base del segmento activo resultante; si el
+// activo está vacío no rota y retorna su propio offset base.
+func (l *Log) Rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.unlock()
+	if l.activeSegment.nextOffset == l.activeSegment.baseOffset {
+		return l.activeSegment.baseOffset, nil // Un segmento vacío no se rota
+	}
+	if err := l.roll(); err != nil {
+		return 0, err
+	}
+	return l.activeSegment.baseOffset, nil
+}
+
+// SetSegmentLimits cambia MaxStoreBytes y MaxIndexBytes para los segmentos que
+// se creen de aquí en adelante; el segmento activo conserva sus límites hasta
+// rotar. Un valor en cero deja el límite como estaba. Retorna los límites
+// vigentes.
+func (l *Log) SetSegmentLimits(maxStoreBytes, maxIndexBytes uint64) (uint64, uint64) {
+	l.mu.Lock()
+	defer l.unlock()
+	if maxStoreBytes > 0 {
+		l.Config.Segment.MaxStoreBytes = maxStoreBytes
+	}
+	if maxIndexBytes > 0 {
+		l.Config.Segment.MaxIndexBytes = maxIndexBytes
+	}
+	return l.Config.Segment.MaxStoreBytes, l.Config.Segment.MaxIndexBytes
 }
 
 // Read lee un registro del log basado en el offset.
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.ReadContext(context.Background(), off)
+}
+
+// ReadContext lee un registro como Read, pero si el log ya tiene
+// MaxConcurrentReads lecturas en curso y ctx termina antes de que se libere un
+// lugar, retorna el error de ctx, por ejemplo context.DeadlineExceeded.
+func (l *Log) ReadContext(ctx context.Context, off uint64) (*api.Record, error) {
+	release, err := l.acquireRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	var closed *Segment // Segmento que se encontró cerrado en la búsqueda anterior
+	for {
+		// El lock del log sólo cubre la búsqueda del segmento; la lectura toma
+		// el lock del segmento, así las lecturas de segmentos distintos no se
+		// esperan entre sí ni esperan a un Append en el segmento activo.
+		l.mu.RLock()
+		s, err := l.segmentFor(off)
+		l.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		if s == closed {
+			return nil, errSegmentClosed // Nadie lo reemplazó, así que volver a leerlo no sirve
+		}
+		record, err := s.Read(off)
+		if err == errSegmentClosed {
+			closed = s // Se truncó o compactó mientras tanto; se busca de nuevo
+			continue
+		}
+		if err == nil {
+			l.logger.Debug("record read", slog.Uint64("offset", off))
+		}
+		return record, err
+	}
+}
+
+// acquireRead ocupa un lugar de MaxConcurrentReads, esperando hasta que ctx
+// termine, y retorna la función que lo libera.
+func (l *Log) acquireRead(ctx context.Context) (func(), error) {
+	release := func() {}
+	if l.readSem != nil {
+		select {
+		case l.readSem <- struct{}{}: // Ocupa un lugar del semáforo
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		release = func() { <-l.readSem }
+	}
+	if l.readHook != nil {
+		l.readHook()
+	}
+	return release, nil
+}
+
+// ReadRange lee hasta limit registros con offset en [start, end) y retorna el
+// offset desde el que sigue la próxima página. Salta los registros borrados y
+// los que quitó una compactación; si start ya fue truncado empieza en el
+// segmento siguiente. Cada segmento resuelve sus posiciones con un solo
+// recorrido del índice.
+func (l *Log) ReadRange(start, end uint64, limit int) ([]*api.Record, uint64, error) {
+	release, err := l.acquireRead(context.Background())
+	if err != nil {
+		return nil, start, err
+	}
+	defer release()
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
+	var records []*api.Record
+	off := start
+	for off < end && len(records) < limit {
+		var s *Segment
+		for _, segment := range l.segments {
+			if off < segment.nextOffset {
+				s = segment // Primer segmento que todavía tiene offsets desde off
+				break
+			}
+		}
+		if s == nil {
+			break // No hay registros desde off
+		}
+		off = max(off, s.baseOffset)
+		batch, err := s.ReadRange(off, end, limit-len(records))
+		if err != nil {
+			return records, off, err
+		}
+		if len(batch) == 0 {
+			off = min(end, s.nextOffset) // Lo que queda del segmento fue compactado
+			continue
+		}
+		for _, record := range batch {
+			off = record.Offset + 1
+			if _, ok := l.deleted[record.Offset]; ok {
+				continue // Borrado con un tombstone
+			}
+			records = append(records, record)
+		}
+	}
+	return records, off, nil
+}
+
+// read lee el registro en off. Si fue borrado con Delete retorna ErrRecordDeleted.
+// Quien lo llama debe tener el lock del log.
+func (l *Log) read(off uint64) (*api.Record, error) {
+	s, err := l.segmentFor(off)
+	if err != nil {
+		return nil, err
+	}
+	l.logger.Debug("record read", slog.Uint64("offset", off))
+	return s.Read(off) // Lee el registro del segmento
+}
+
+// segmentFor busca el segmento que contiene off. Si off fue borrado con Delete
+// retorna ErrRecordDeleted. Quien lo llama debe tener el lock del log.
+func (l *Log) segmentFor(off uint64) (*Segment, error) {
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	var s *Segment
 	for _, segment := range l.segments {
 		if segment.baseOffset <= off && off < segment.nextOffset {
 			s = segment // Encuentra el segmento que contiene el offset
 			break
 		}
 	}
-	if s == nil || s.nextOffset <= off {
+	if s == nil {
+		if l.segments[0].baseOffset <= off && off < l.activeSegment.nextOffset {
+			return nil, api.ErrRecordDeleted{Offset: off} // Hueco que dejó CompactByKey entre segmentos
+		}
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
-	return s.Read(off) // Lee el registro del segmento
+	if _, ok := l.deleted[off]; ok {
+		return nil, api.ErrRecordDeleted{Offset: off}
+	}
+	return s, nil
 }
 
-// NewSegment crea un nuevo segmento y lo agrega a la lista de segmentos.
+// Delete borra el registro en off agregando un tombstone que lo referencia. Desde
+// ese momento Read de off retorna ErrRecordDeleted. Los bytes originales siguen en
+// el store hasta que una compactación reescriba el segmento. El offset se guarda
+// además en el .meta de su segmento, así al abrir el log no hace falta buscar
+// los tombstones.
+func (l *Log) Delete(off uint64) error {
+	l.mu.Lock()
+	defer l.unlock()
+	record, err := l.read(off)
+	if err != nil {
+		return err // Incluye offsets inexistentes y registros ya borrados
+	}
+	if record.Tombstone {
+		return fmt.Errorf("log: record %d is a tombstone", off)
+	}
+	s, err := l.segmentFor(off)
+	if err != nil {
+		return err
+	}
+	// Primero el .meta: si el proceso muere antes del tombstone, el registro
+	// queda borrado igual.
+	if err = s.setDeleted(off, true); err != nil {
+		return err
+	}
+	if _, err = l.append(&api.Record{Tombstone: true, DeletedOffset: off}); err != nil {
+		return errors.Join(err, s.setDeleted(off, false))
+	}
+	l.deleted[off] = struct{}{}
+	l.logger.Info("record deleted", slog.Uint64("offset", off))
+	return nil
+}
+
+// replay reconstruye al abrir el log lo que no está en los .meta. Los productores
+// salen de la última foto que guardó roll y sólo se recorren los segmentos
+// posteriores; sin foto, como en un log restaurado o anterior a ellas, se
+// recorren todos y se guarda la foto del último segmento sellado. Con
+// Compaction.Enabled se recorren todos igual para contar las keys.
+func (l *Log) replay() error {
+	from := 0 // Primer segmento sin foto de productores
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		if producers := l.segments[i].loadProducers(); producers != nil {
+			l.producers, from = producers, i+1
+			break
+		}
+	}
+	for i, s := range l.segments {
+		if i < from && l.latest == nil {
+			continue
+		}
+		err := s.Scan(func(record *api.Record) error {
+			if record.Tombstone {
+				// Ya está en el .meta, salvo que el tombstone venga de antes de que se guardara ahí
+				if err := l.markDeleted(record.DeletedOffset); err != nil {
+					l.logger.Warn("failed to save deleted offset",
+						slog.Uint64("offset", record.DeletedOffset), slog.Any("error", err))
+					l.deleted[record.DeletedOffset] = struct{}{} // Al menos hasta cerrar el log
+				}
+			}
+			if i >= from {
+				l.trackProducer(record, record.Offset)
+			}
+			l.trackKey(record, record.Offset)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if i >= from && i == len(l.segments)-2 { // Último sellado: el próximo NewLog parte de su foto
+			if err := s.saveProducers(l.producers); err != nil {
+				l.logger.Warn("failed to save producer snapshot", append(s.logAttrs(), slog.Any("error", err))...)
+			}
+		}
+	}
+	return nil
+}
+
+// markDeleted marca off como borrado y lo guarda en el .meta del segmento que lo
+// contiene. Quien lo llama debe tener el lock de escritura.
+func (l *Log) markDeleted(off uint64) error {
+	if _, ok := l.deleted[off]; ok {
+		return nil
+	}
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			if err := s.setDeleted(off, true); err != nil {
+				return err
+			}
+			l.deleted[off] = struct{}{}
+			return nil
+		}
+	}
+	return nil // El segmento ya no existe
+}
+
+// ReadReverse devuelve los últimos count registros del log, del más reciente al
+// más antiguo, sin los borrados con Delete. Recorre los segmentos hacia atrás
+// usando el índice de cada uno, así que no escanea el store completo. Si se piden
+// más registros de los que existen, devuelve todos los disponibles.
+func (l *Log) ReadReverse(count int) ([]*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var records []*api.Record
+	for i := len(l.segments) - 1; i >= 0 && len(records) < count; i-- {
+		s := l.segments[i]
+		for off := s.nextOffset; off > s.baseOffset && len(records) < count; off-- {
+			if _, ok := l.deleted[off-1]; ok {
+				continue // Borrado con un tombstone
+			}
+			record, err := s.Read(off - 1) // Lee el registro desde el índice del segmento
+			if errors.As(err, &api.ErrRecordDeleted{}) {
+				continue // Offset que quitó la compactación
+			}
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// ForEach llama a fn con cada registro desde startOffset hasta el offset más alto
+// que existía al empezar, salteando los borrados con Delete. Se detiene en cuanto
+// fn devuelve un error o se cancela ctx, y devuelve ese error. El RLock se toma
+// una vez por segmento, no por registro, así que fn no debe escribir en el log.
+func (l *Log) ForEach(ctx context.Context, startOffset uint64, fn func(record *api.Record) error) error {
+	l.mu.RLock()
+	highWater := l.segments[len(l.segments)-1].nextOffset // Marca de agua al empezar
+	l.mu.RUnlock()
+	var err error
+	for off := startOffset; off < highWater; {
+		if off, err = l.forEachInSegment(ctx, off, highWater, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachFrom es un atajo de ForEach que empieza en el offset más bajo del log.
+func (l *Log) ForEachFrom(ctx context.Context, fn func(record *api.Record) error) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	return l.ForEach(ctx, lowest, fn)
+}
+
+// forEachInSegment recorre los registros del segmento que contiene off sin
+// pasar de highWater y devuelve el offset donde debe continuar ForEach.
+func (l *Log) forEachInSegment(ctx context.Context, off, highWater uint64, fn func(*api.Record) error) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var s *Segment
+	for _, segment := range l.segments {
+		if segment.baseOffset > off {
+			off = segment.baseOffset // El offset pedido ya fue truncado, salta al siguiente segmento
+		}
+		if off < segment.nextOffset {
+			s = segment
+			break
+		}
+	}
+	if s == nil {
+		return highWater, nil // No quedan segmentos con registros
+	}
+	end := s.nextOffset
+	if highWater < end {
+		end = highWater
+	}
+	for ; off < end; off++ {
+		if err := ctx.Err(); err != nil {
+			return off, err
+		}
+		if _, ok := l.deleted[off]; ok {
+			continue // Borrado con un tombstone
+		}
+		record, err := s.Read(off)
+		if errors.As(err, &api.ErrRecordDeleted{}) {
+			continue // Offset que quitó la compactación
+		}
+		if err != nil {
+			return off, err
+		}
+		if err := fn(record); err != nil {
+			return off, err
+		}
+	}
+	return off, nil
+}
+
+// Watch devuelve un canal que se cierra con el siguiente Append. Un consumer que
+// llegó al final del log puede esperar en él en vez de reintentar en un bucle;
+// debe pedir el canal antes de leer para no perderse un Append intermedio.
+func (l *Log) Watch() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.notify
+}
+
+// NewSegment crea un nuevo segmento y lo agrega a la lista de segmentos. Si hay
+// DataDirs, cada segmento nuevo va al siguiente directorio en round-robin.
 func (l *Log) NewSegment(off uint64) error {
-	s, err := NewSegment(l.Dir, off, l.Config) // Crea un nuevo segmento
+	dir := l.Dir
+	if n := len(l.Config.DataDirs); n > 0 {
+		dir = l.Config.DataDirs[l.dirIdx%n]
+		l.dirIdx++
+	}
+	return l.openSegment(dir, off, false)
+}
+
+// openSegment abre o crea el segmento con offset base off en dir y lo deja como
+// activo. Con sealed lo abre sellado, para los segmentos viejos que lee setup.
+func (l *Log) openSegment(dir string, off uint64, sealed bool) error {
+	open := NewSegment
+	if sealed {
+		open = openSealedSegment
+	}
+	s, err := open(dir, off, l.Config) // Crea un nuevo segmento
 	if err != nil {
 		return err
 	}
 	l.segments = append(l.segments, s) // Agrega el nuevo segmento a la lista
 	l.activeSegment = s                // Establece el nuevo segmento como el activo
+	l.logger.Info("segment created", s.logAttrs()...)
+	if hook := l.Config.OnNewSegment; hook != nil {
+		l.hooks = append(l.hooks, func() { hook(off) })
+	}
 	return nil
 }
 
-// Close cierra todos los segmentos del log.
+// Sync fuerza a disco todo lo escrito sin cerrar el log: vacía el buffer del
+// store, hace fsync del archivo store y msync del índice de cada segmento. Sirve
+// como punto de durabilidad, por ejemplo antes de tomar un snapshot del disco.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.unlock()
+	for _, s := range l.segments {
+		if err := s.Sync(); err != nil {
+			return err // Retorna error si no puede sincronizar el segmento
+		}
+	}
+	return nil
+}
+
+// Close detiene la compactación y las compresiones en background y la entrega
+// de webhooks, y cierra todos los segmentos del log.
 func (l *Log) Close() error {
+	l.stopCompactor() // Antes del lock, que la compactación necesita para terminar
+	l.stopWebhooks()
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.done) // Las suscripciones terminan con io.EOF y las compresiones se cortan
+	}
+	l.mu.Unlock()
+	l.compressing.Wait() // Con el log cerrado no empiezan otras
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	for _, segment := range l.segments {
@@ -126,14 +879,30 @@ func (l *Log) Close() error {
 			return err
 		}
 	}
-	return nil
+	return l.releaseDirs() // Deja los directorios libres para otro Log
 }
 
-// Remove elimina todos los archivos del log.
+// Remove elimina todos los archivos del log. De los DataDirs sólo borra los
+// archivos del log, no los directorios.
 func (l *Log) Remove() error {
+	l.mu.RLock()
+	var files []string // Los segmentos pueden estar en DataDirs, fuera de l.Dir
+	for _, s := range l.segments {
+		files = append(files, s.store.Name(), s.index.Name(), s.metaPath(), s.integrityPath())
+	}
+	l.mu.RUnlock()
+	for _, dir := range l.dirs()[1:] {
+		files = append(files, path.Join(dir, lockFileName))
+	}
 	if err := l.Close(); err != nil {
 		return err
 	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.logger.Info("log removed", slog.String("dir", l.Dir))
 	return os.RemoveAll(l.Dir) // Elimina el directorio del log
 }
 
@@ -142,7 +911,16 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup() // Configura nuevamente el log
+	if err := l.lockDirs(); err != nil { // Remove soltó los locks junto con los segmentos
+		return err
+	}
+	err := l.setup() // Configura nuevamente el log
+	l.runHooks()
+	if err == nil {
+		l.startCompactor()
+		l.startWebhooks()
+	}
+	return err
 }
 
 // LowestOffset retorna el offset más bajo en el log.
@@ -163,31 +941,203 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil // Retorna el offset más alto
 }
 
-// Truncate elimina los segmentos cuyo offset es menor al especificado.
+// Count retorna cuántos registros hay en el log sumando los de cada segmento.
+func (l *Log) Count() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var count uint64
+	for _, s := range l.segments {
+		count += s.RecordCount() // Registros del segmento, sin los que quitó la compactación
+	}
+	return count, nil
+}
+
+// SizeBytes retorna cuántos bytes ocupan en disco los stores e índices del log.
+func (l *Log) SizeBytes() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var size uint64
+	for _, s := range l.segments {
+		storeBytes, indexBytes := s.Size()
+		size += storeBytes + indexBytes // Bytes usados por el segmento
+	}
+	return size, nil
+}
+
+// LogStats resume el estado del log para tableros operativos.
+type LogStats struct {
+	RecordCount    uint64 `json:"recordCount"`    // Registros en el log
+	StoreSizeBytes uint64 `json:"storeSizeBytes"` // Bytes usados por los stores
+	IndexSizeBytes uint64 `json:"indexSizeBytes"` // Bytes usados por los índices
+	SegmentCount   uint64 `json:"segmentCount"`   // Segmentos abiertos
+	LowestOffset   uint64 `json:"lowestOffset"`   // Offset más bajo
+	HighestOffset  uint64 `json:"highestOffset"`  // Offset más alto
+
+	// DirBytes son los bytes de stores e índices por directorio, útil con DataDirs.
+	DirBytes map[string]uint64 `json:"dirBytes"`
+
+	// OldestTimestamp y NewestTimestamp son los timestamps del primer y del
+	// último registro. Quedan en cero si el log está vacío.
+	OldestTimestamp time.Time `json:"oldestTimestamp"`
+	NewestTimestamp time.Time `json:"newestTimestamp"`
+}
+
+// Stats retorna una foto del estado del log tomada bajo un solo RLock.
+func (l *Log) Stats() LogStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := LogStats{
+		SegmentCount: uint64(len(l.segments)),
+		LowestOffset: l.segments[0].baseOffset,
+		DirBytes:     make(map[string]uint64),
+	}
+	if next := l.segments[len(l.segments)-1].nextOffset; next > 0 {
+		stats.HighestOffset = next - 1
+	}
+	var newest *Segment // Último segmento con registros
+	for _, s := range l.segments {
+		storeBytes, indexBytes := s.Size()
+		stats.RecordCount += s.RecordCount()
+		stats.StoreSizeBytes += storeBytes
+		stats.IndexSizeBytes += indexBytes
+		stats.DirBytes[s.dir] += storeBytes + indexBytes
+		if s.RecordCount() > 0 {
+			if newest == nil {
+				if ts, _, err := s.entryTimestamp(0); err == nil {
+					stats.OldestTimestamp = time.Unix(0, ts) // Primer registro del log
+				}
+			}
+			newest = s
+		}
+	}
+	if newest != nil {
+		if ts, _, err := newest.entryTimestamp(int(newest.RecordCount()) - 1); err == nil {
+			stats.NewestTimestamp = time.Unix(0, ts) // Último registro del log
+		}
+	}
+	return stats
+}
+
+// SegmentInfo describe los archivos y el rango de offsets de un segmento.
+type SegmentInfo struct {
+	BaseOffset  uint64    // Primer offset del segmento
+	NextOffset  uint64    // Offset que recibirá el próximo registro
+	StorePath   string    // Ruta del archivo de store
+	IndexPath   string    // Ruta del archivo de índice
+	StoreBytes  uint64    // Bytes usados por el store
+	IndexBytes  uint64    // Bytes usados por el índice
+	RecordCount uint64    // Registros del segmento, según las entradas del índice
+	Active      bool      // Indica si es el segmento activo
+	CreatedAt   time.Time // Cuándo se creó, como Segment.CreatedAt
+}
+
+// Segments retorna una copia de la información de cada segmento, ordenada por offset.
+// La copia puede conservarse después de que el log cambie.
+func (l *Log) Segments() []SegmentInfo {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	infos := make([]SegmentInfo, 0, len(l.segments))
+	for _, s := range l.segments {
+		info := s.Info()
+		info.Active = s == l.activeSegment
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Truncate elimina los segmentos cuyo offset es menor al especificado. El
+// segmento activo nunca se elimina, para que el log siga teniendo dónde escribir.
 func (l *Log) Truncate(lowest uint64) error {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
 	l.mu.Lock()
-	defer l.mu.Unlock()
-	var segments []*segment
-	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
+	defer l.unlock()
+	var segments []*Segment
+	for i, s := range l.segments {
+		if s != l.activeSegment && s.nextOffset <= lowest+1 {
+			if err := l.removeSegment(s); err != nil {
+				l.segments = append(segments, l.segments[i+1:]...) // s ya quedó cerrado
 				return err
 			}
 			continue
 		}
 		segments = append(segments, s) // Mantiene los segmentos que no se eliminan
 	}
+	if len(segments) < len(l.segments) {
+		l.cdc.publish(TruncateEvent{BelowOffset: segments[0].baseOffset})
+	}
 	l.segments = segments
 	return nil
 }
 
-// Reader retorna un lector que permite leer todos los registros en el log.
+// TruncateOlderThan elimina, desde el más viejo, los segmentos salvo el activo
+// cuyo último registro es anterior a t, y retorna cuántos eliminó. Se detiene en
+// el primer segmento con registros desde t, así el log no queda con huecos. Un
+// segmento sellado vacío se juzga por Segment.CreatedAt.
+func (l *Log) TruncateOlderThan(t time.Time) (int, error) {
+	l.maintMu.Lock()
+	defer l.maintMu.Unlock()
+	l.mu.Lock()
+	defer l.unlock()
+	removed := 0
+	defer func() { // También si falla a mitad de camino
+		l.segments = l.segments[removed:]
+		if removed > 0 {
+			l.cdc.publish(TruncateEvent{BelowOffset: l.segments[0].baseOffset})
+		}
+	}()
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+		newest, err := s.NewestRecordTime()
+		if err != nil {
+			return removed, err
+		}
+		if newest.IsZero() {
+			newest = s.CreatedAt()
+		}
+		if !newest.Before(t) {
+			break // Los segmentos siguientes son más nuevos
+		}
+		if err := l.removeSegment(s); err != nil {
+			l.segments = slices.Delete(l.segments, removed, removed+1) // s ya quedó cerrado
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// removeSegment borra los archivos de s y agenda OnSegmentRemoved. Quien lo
+// llama debe tener el lock de escritura y sacar a s de l.segments, también si
+// falla, porque s queda cerrado igual.
+func (l *Log) removeSegment(s *Segment) error {
+	if err := s.Remove(); err != nil {
+		return err
+	}
+	delete(l.dirty, s.baseOffset)
+	for _, off := range s.deletedOffsets() {
+		delete(l.deleted, off)
+	}
+	l.cdc.publish(SegmentRemovedEvent{BaseOffset: s.baseOffset})
+	l.logger.Info("segment removed", s.logAttrs()...)
+	if hook := l.Config.OnSegmentRemoved; hook != nil {
+		baseOffset := s.baseOffset
+		l.hooks = append(l.hooks, func() { hook(baseOffset) })
+	}
+	return nil
+}
+
+// Reader retorna un lector que permite leer todos los registros en el log, cada
+// uno como prefijo de longitud y valor, sin el encabezado ni los checksums del
+// store, el formato que lee RecordReader.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0} // Crea un lector para cada segmento
+		readers[i] = &originReader{Store: segment.store, off: int64(segment.store.start), end: int64(segment.store.size)} // Crea un lector para cada segmento
 	}
 	return io.MultiReader(readers...) // Combina todos los lectores en uno solo
 }
@@ -195,12 +1145,44 @@ func (l *Log) Reader() io.Reader {
 // originReader es un lector que lee desde el inicio del store.
 type originReader struct {
 	*Store
-	off int64 // Offset actual del lector
+	off int64  // Offset actual del lector
+	end int64  // Tamaño del store al crear el lector; no se lee la cola reservada
+	buf []byte // Resto del registro actual, reescrito sin checksum
 }
 
-// Read lee datos desde el store en el offset actual.
+// Read lee datos desde el store en el offset actual. Los stores sin checksums ya
+// tienen el formato de Reader y se copian tal cual; en los demás se verifica y
+// se reescribe cada registro.
 func (o *originReader) Read(p []byte) (int, error) {
+	if o.version != storeVersionLegacy {
+		return o.readFramed(p)
+	}
+	if o.off >= o.end {
+		return 0, io.EOF
+	}
+	if rest := o.end - o.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
 	n, err := o.ReadAt(p, o.off) // Lee datos desde el offset actual
 	o.off += int64(n)            // Actualiza el offset
 	return n, err
 }
+
+// readFramed lee el registro siguiente con Store.Read, que comprueba su
+// checksum, y entrega su prefijo de longitud y su valor.
+func (o *originReader) readFramed(p []byte) (int, error) {
+	if len(o.buf) == 0 {
+		if o.off >= o.end {
+			return 0, io.EOF
+		}
+		value, err := o.Store.ReadInto(uint64(o.off), nil)
+		if err != nil {
+			return 0, err
+		}
+		o.off += int64(o.frameWidth()) + int64(len(value))
+		o.buf = append(enc.AppendUint64(o.buf[:0], uint64(len(value))), value...)
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
@@ -1,9 +1,29 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	api "github.com/dati/api/v1"
 	"github.com/stretchr/testify/require"
@@ -19,6 +39,20 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"read reverse":                      testReadReverse,
+		"append batch":                      testAppendBatch,
+		"for each":                          testForEach,
+		"sync":                              testSync,
+		"watch":                             testWatch,
+		"count and stats":                   testStats,
+		"segments":                          testSegments,
+		"append from":                       testAppendFrom,
+		"import from":                       testImportFrom,
+		"delete":                            testDelete,
+		"append at":                         testAppendAt,
+		"producer dedup":                    testProducerDedup,
+		"read range":                        testReadRange,
+		"headers":                           testHeaders,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -26,7 +60,7 @@ func TestLog(t *testing.T) {
 			defer os.RemoveAll(dir)
 
 			c := Config{}
-			c.Segment.MaxStoreBytes = 32
+			c.Segment.MaxIndexBytes = entWidth * 2
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
 			fn(t, log)
@@ -46,6 +80,31 @@ func testAppendRead(t *testing.T, log *Log) {
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testHeaders(t *testing.T, o *Log) {
+	headers := map[string]string{
+		"event-type": "order.created",
+		"trace-id":   "4bf92f3577b34da6a3ce929d0e0e4736",
+		"empty":      "",
+	}
+	off, err := o.Append(&api.Record{Value: []byte("hello world"), Headers: headers})
+	require.NoError(t, err)
+	// un registro sin headers sigue sin headers
+	_, err = o.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	// los headers sobreviven a reabrir el log desde el disco
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	read, err := n.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, headers, read.Headers)
+	read, err = n.Read(off + 1)
+	require.NoError(t, err)
+	require.Empty(t, read.Headers)
+}
+
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
@@ -106,3 +165,2462 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testReadReverse(t *testing.T, log *Log) {
+	records, err := log.ReadReverse(3)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	// el log de prueba rota cada dos registros, así que hay varios segmentos
+	require.Greater(t, len(log.segments), 1)
+
+	records, err = log.ReadReverse(3)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	for i, record := range records {
+		want := uint64(4 - i)
+		require.Equal(t, want, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", want)), record.Value)
+	}
+
+	records, err = log.ReadReverse(10)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	require.Equal(t, uint64(0), records[4].Offset)
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	records := make([]*api.Record, 5)
+	for i := range records {
+		records[i] = &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+	}
+	offsets, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4}, offsets)
+	require.Greater(t, len(log.segments), 1)
+	for i, off := range offsets {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, read.Value)
+	}
+}
+
+func testForEach(t *testing.T, log *Log) {
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+
+	// filtrar y contar
+	var even int
+	err := log.ForEachFrom(context.Background(), func(record *api.Record) error {
+		if record.Offset%2 == 0 {
+			even++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, even)
+
+	var offsets []uint64
+	err = log.ForEach(context.Background(), 3, func(record *api.Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4, 5}, offsets)
+
+	// cancelar el contexto detiene la iteración antes de terminar
+	ctx, cancel := context.WithCancel(context.Background())
+	var seen int
+	err = log.ForEachFrom(ctx, func(record *api.Record) error {
+		seen++
+		if seen == 2 {
+			cancel()
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 2, seen)
+}
+
+func testSync(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	// el registro sigue en el buffer del store hasta que se sincroniza; en el
+	// archivo sólo está el encabezado
+	store := log.activeSegment.store.Name()
+	b, err := os.ReadFile(store)
+	require.NoError(t, err)
+	require.Len(t, b, storeHeaderWidth)
+	require.Equal(t, storeMagic[:], b[:len(storeMagic)])
+
+	require.NoError(t, log.Sync())
+
+	b, err = os.ReadFile(store)
+	require.NoError(t, err)
+	read := &api.Record{}
+	require.NoError(t, proto.Unmarshal(b[storeHeaderWidth+lenWidth+crcWidth:], read))
+	require.Equal(t, append.Value, read.Value)
+	require.Equal(t, off, read.Offset)
+
+	b, err = os.ReadFile(log.activeSegment.index.Name())
+	require.NoError(t, err)
+	b = b[indexHeaderWidth:]
+	require.Equal(t, uint32(0), enc.Uint32(b[:offWidth]))
+	require.Equal(t, uint64(storeHeaderWidth), enc.Uint64(b[offWidth:entWidth]))
+}
+
+func TestLogSyncRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-sync-restart-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	require.NoError(t, os.Mkdir(path.Join(dir, "running"), 0755))
+	log, err := NewLog(path.Join(dir, "running"), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Sync())
+
+	// copiar los archivos sin cerrar el log equivale a lo que vería un proceso
+	// nuevo si este muriera ahora
+	restarted := path.Join(dir, "restarted")
+	require.NoError(t, os.Mkdir(restarted, 0755))
+	files, err := os.ReadDir(log.Dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		if file.Name() == lockFileName {
+			continue
+		}
+		b, err := os.ReadFile(path.Join(log.Dir, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path.Join(restarted, file.Name()), b, 0644))
+	}
+
+	reopened, err := NewLog(restarted, c)
+	require.NoError(t, err)
+	defer reopened.Close()
+	for off := uint64(0); off < 3; off++ {
+		read, err := reopened.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+	}
+}
+
+func testWatch(t *testing.T, log *Log) {
+	watch := log.Watch()
+	select {
+	case <-watch:
+		t.Fatal("watch fired without an append")
+	default:
+	}
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	select {
+	case <-watch:
+	default:
+		t.Fatal("watch did not fire after append")
+	}
+
+	// cada Append entrega un canal nuevo
+	select {
+	case <-log.Watch():
+		t.Fatal("new watch fired without an append")
+	default:
+	}
+}
+
+func testStats(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	count, err := log.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), count)
+
+	// cada store tiene su encabezado y cada registro ocupa su prefijo de
+	// longitud, su checksum y el proto, y una entrada de índice
+	storeBytes := uint64(2 * storeHeaderWidth)
+	for i := uint64(0); i < 3; i++ {
+		append.Offset = i
+		storeBytes += lenWidth + crcWidth + uint64(proto.Size(append))
+	}
+	size, err := log.SizeBytes()
+	require.NoError(t, err)
+	require.Equal(t, storeBytes+3*entWidth, size)
+
+	stats := log.Stats()
+	require.Equal(t, LogStats{
+		RecordCount:    3,
+		StoreSizeBytes: storeBytes,
+		IndexSizeBytes: 3 * entWidth,
+		SegmentCount:   2,
+		LowestOffset:   0,
+		HighestOffset:  2,
+		DirBytes:       map[string]uint64{log.Dir: storeBytes + 3*entWidth},
+		// Append le puso la hora al registro y las otras dos copias la conservan
+		OldestTimestamp: time.Unix(0, append.Timestamp),
+		NewestTimestamp: time.Unix(0, append.Timestamp),
+	}, stats)
+
+	require.NoError(t, log.Truncate(1))
+	stats = log.Stats()
+	require.Equal(t, uint64(1), stats.RecordCount)
+	require.Equal(t, uint64(2), stats.LowestOffset)
+}
+
+func testSegments(t *testing.T, log *Log) {
+	infos := log.Segments()
+	require.Len(t, infos, 1)
+	require.True(t, infos[0].Active)
+	require.Equal(t, uint64(0), infos[0].NextOffset)
+
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	infos = log.Segments()
+	require.Len(t, infos, 2)
+	require.Equal(t, uint64(0), infos[0].BaseOffset)
+	require.Equal(t, uint64(2), infos[0].NextOffset)
+	require.False(t, infos[0].Active)
+	require.Equal(t, 2*entWidth, infos[0].IndexBytes)
+	require.NotZero(t, infos[0].StoreBytes)
+	require.Equal(t, uint64(2), infos[1].BaseOffset)
+	require.True(t, infos[1].Active)
+	// al rotar, el segmento anterior queda sellado
+	require.True(t, log.segments[0].IsSealed())
+	require.False(t, log.segments[1].IsSealed())
+
+	for _, info := range infos {
+		require.FileExists(t, info.StorePath)
+		require.FileExists(t, info.IndexPath)
+		require.Equal(t, log.Dir, path.Dir(info.IndexPath))
+		require.Equal(t, ".index", path.Ext(info.IndexPath))
+	}
+
+	// la copia no cambia cuando el log se trunca
+	require.NoError(t, log.Truncate(1))
+	require.Len(t, infos, 2)
+	after := log.Segments()
+	require.Len(t, after, 1)
+	require.Equal(t, infos[1].StorePath, after[0].StorePath)
+	_, err := os.Stat(infos[0].StorePath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func testAppendFrom(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	exported, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "append-from-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	imported, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer imported.Close()
+
+	_, err = imported.Append(&api.Record{Value: []byte("existing")})
+	require.NoError(t, err)
+
+	// los offsets se reasignan a continuación de los que ya tiene el log
+	first, last, err := imported.AppendFrom(bytes.NewReader(exported))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(3), last)
+	for i := uint64(0); i < 3; i++ {
+		read, err := imported.Read(first + i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+
+	// un registro cortado al final se reporta junto con lo ya importado
+	first, last, err = imported.AppendFrom(bytes.NewReader(exported[:len(exported)-3]))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Contains(t, err.Error(), "imported 2 records")
+	require.Equal(t, uint64(4), first)
+	require.Equal(t, uint64(5), last)
+
+	_, _, err = imported.AppendFrom(bytes.NewReader(nil))
+	require.Equal(t, io.EOF, err)
+}
+
+func testImportFrom(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	exported, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+
+	imported, err := NewLog(t.TempDir(), log.Config)
+	require.NoError(t, err)
+	defer imported.Close()
+
+	n, err := imported.ImportFrom(bytes.NewReader(exported))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), n)
+	for off := uint64(0); off < 3; off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := imported.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+
+	// un flujo cortado agrega los registros completos y nada más
+	n, err = imported.ImportFrom(bytes.NewReader(exported[:len(exported)-3]))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, uint64(2), n)
+	off, err := imported.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	for _, s := range imported.segments {
+		require.NoError(t, s.Verify())
+	}
+
+	n, err = imported.ImportFrom(bytes.NewReader(nil))
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func testDelete(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Delete(1))
+
+	_, err := log.Read(1)
+	require.Equal(t, api.ErrRecordDeleted{Offset: 1}, err)
+	read, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), read.Value)
+
+	// el tombstone queda como un registro más del log
+	tombstone, err := log.Read(3)
+	require.NoError(t, err)
+	require.True(t, tombstone.Tombstone)
+	require.Equal(t, uint64(1), tombstone.DeletedOffset)
+
+	// ReadReverse y ForEach tampoco lo devuelven
+	reversed, err := log.ReadReverse(10)
+	require.NoError(t, err)
+	var offsets []uint64
+	for _, record := range reversed {
+		offsets = append(offsets, record.Offset)
+	}
+	require.Equal(t, []uint64{3, 2, 0}, offsets)
+	offsets = nil
+	require.NoError(t, log.ForEach(context.Background(), 0, func(record *api.Record) error {
+		offsets = append(offsets, record.Offset)
+		return nil
+	}))
+	require.Equal(t, []uint64{0, 2, 3}, offsets)
+
+	require.Equal(t, api.ErrRecordDeleted{Offset: 1}, log.Delete(1))
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 10}, log.Delete(10))
+	require.Error(t, log.Delete(3))
+
+	// el borrado sobrevive a reabrir el log
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	_, err = n.Read(1)
+	require.Equal(t, api.ErrRecordDeleted{Offset: 1}, err)
+	_, err = n.Read(0)
+	require.NoError(t, err)
+}
+
+func testReadRange(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Delete(1)) // El tombstone queda en el offset 5
+
+	// la página cruza segmentos y salta el registro borrado
+	records, next, err := log.ReadRange(0, 10, 3)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	for i, off := range []uint64{0, 2, 3} {
+		require.Equal(t, off, records[i].Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), records[i].Value)
+	}
+	require.Equal(t, uint64(4), next)
+
+	records, next, err = log.ReadRange(next, 10, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.True(t, records[1].Tombstone)
+	require.Equal(t, uint64(6), next)
+
+	// más allá del final no hay registros y la página no avanza
+	records, next, err = log.ReadRange(20, 30, 5)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(20), next)
+}
+
+func TestLogMaxConcurrentReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-reads-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const limit = 3
+	log, err := NewLog(dir, Config{MaxConcurrentReads: limit})
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// el hook cuenta las lecturas en vuelo y guarda el máximo observado
+	var inFlight, max atomic.Int64
+	log.readHook = func() {
+		n := inFlight.Add(1)
+		for m := max.Load(); n > m && !max.CompareAndSwap(m, n); m = max.Load() {
+		}
+		time.Sleep(time.Millisecond)
+		inFlight.Add(-1)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := log.Read(off)
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, max.Load(), int64(limit))
+	require.NotZero(t, max.Load())
+
+	// con el semáforo lleno, una lectura con contexto vence en vez de esperar
+	release := make(chan struct{})
+	log.readHook = func() { <-release }
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := log.Read(off)
+			require.NoError(t, err)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return len(log.readSem) == limit
+	}, time.Second, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = log.ReadContext(ctx, off)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	close(release)
+	wg.Wait()
+}
+
+func TestLogReEncrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-reencrypt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	requireRecords := func(log *Log, n uint64) {
+		t.Helper()
+		for off := uint64(0); off < n; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+		}
+	}
+
+	// cifra un log que estaba en claro
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	require.NoError(t, log.ReEncrypt(nil, key1))
+	requireRecords(log, 3)
+	for _, info := range log.Segments() {
+		raw, err := os.ReadFile(info.StorePath)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(raw, []byte("record")))
+	}
+
+	// con la clave anterior equivocada no cambia nada
+	require.Error(t, log.ReEncrypt(key2, key2))
+	requireRecords(log, 3)
+
+	require.NoError(t, log.ReEncrypt(key1, key2))
+	off, err := log.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	requireRecords(log, 4)
+	require.NoError(t, log.Close())
+
+	c.Segment.EncryptionKey = key2
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	requireRecords(log, 4)
+}
+
+func testAppendAt(t *testing.T, log *Log) {
+	// un follower replica los registros del líder en los mismos offsets
+	for off := uint64(0); off < 3; off++ {
+		require.NoError(t, log.AppendAt(&api.Record{
+			Value:  []byte(fmt.Sprintf("record %d", off)),
+			Offset: off,
+		}))
+	}
+	for off := uint64(0); off < 3; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+	}
+
+	err := log.AppendAt(&api.Record{Offset: 5})
+	require.Equal(t, ErrOffsetGap{Want: 3, Got: 5}, err)
+	err = log.AppendAt(&api.Record{Offset: 1})
+	require.Equal(t, ErrDuplicateOffset{Want: 3, Got: 1}, err)
+
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+}
+
+func testProducerDedup(t *testing.T, log *Log) {
+	// cada productor envía cada sequence dos veces, como si reintentara
+	const producers, sequences = 4, 5
+	offsets := make([][]uint64, producers)
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		offsets[p] = make([]uint64, sequences)
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for seq := 0; seq < sequences; seq++ {
+				for retry := 0; retry < 2; retry++ {
+					off, err := log.Append(&api.Record{
+						Value:          []byte(fmt.Sprintf("p%d-%d", p, seq)),
+						ProducerId:     fmt.Sprintf("producer-%d", p),
+						SequenceNumber: int64(seq),
+					})
+					require.NoError(t, err)
+					if retry == 0 {
+						offsets[p][seq] = off
+					}
+					require.Equal(t, offsets[p][seq], off)
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	count, err := log.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(producers*sequences), count)
+
+	// un reintento tardío de un sequence viejo devuelve su offset original
+	for p := 0; p < producers; p++ {
+		for seq := 0; seq < sequences; seq++ {
+			off, err := log.Append(&api.Record{
+				ProducerId:     fmt.Sprintf("producer-%d", p),
+				SequenceNumber: int64(seq),
+			})
+			require.NoError(t, err)
+			require.Equal(t, offsets[p][seq], off)
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("p%d-%d", p, seq)), read.Value)
+		}
+	}
+	count, err = log.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(producers*sequences), count)
+
+	// un sequence saltado no se puede confundir con un reintento
+	_, err = log.Append(&api.Record{ProducerId: "gaps", SequenceNumber: 0})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{ProducerId: "gaps", SequenceNumber: 2})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{ProducerId: "gaps", SequenceNumber: 1})
+	require.ErrorIs(t, err, ErrUnknownSequence)
+
+	// sólo se recuerdan los últimos producerWindow sequence; los anteriores no se buscan en el log
+	var window []uint64
+	for seq := 0; seq <= producerWindow; seq++ {
+		off, err := log.Append(&api.Record{ProducerId: "window", SequenceNumber: int64(seq)})
+		require.NoError(t, err)
+		window = append(window, off)
+	}
+	for _, seq := range []int64{0, -1, math.MinInt64} {
+		_, err = log.Append(&api.Record{ProducerId: "window", SequenceNumber: seq})
+		require.ErrorIs(t, err, ErrUnknownSequence, seq)
+	}
+	off, err := log.Append(&api.Record{ProducerId: "window", SequenceNumber: 1})
+	require.NoError(t, err)
+	require.Equal(t, window[1], off)
+}
+
+func TestLogProducerDedupRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-producer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	record := &api.Record{
+		Value:          []byte("hello world"),
+		ProducerId:     "producer",
+		SequenceNumber: 7,
+	}
+	want, err := log.Append(record)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// el último sequence se reconstruye al abrir, así que el reintento no duplica
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, want, off)
+	count, err := log.Count()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), count)
+
+	off, err = log.Append(&api.Record{ProducerId: "producer", SequenceNumber: 8})
+	require.NoError(t, err)
+	require.Equal(t, want+1, off)
+}
+
+func TestLogReplayFromMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-replay-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	record := &api.Record{Value: []byte("hello world"), ProducerId: "producer", SequenceNumber: 1}
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("x")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Delete(0)) // El tombstone queda en el offset 4, otro segmento
+	require.NoError(t, log.Close())
+
+	// el offset borrado queda en el .meta de su segmento y la foto de los
+	// productores en el del último segmento sellado
+	metaPath := func(base uint64) string { return path.Join(dir, fmt.Sprintf("%020d.meta", base)) }
+	meta, err := readSegmentMeta(metaPath(0))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, meta.Deleted)
+	meta, err = readSegmentMeta(metaPath(2))
+	require.NoError(t, err)
+	require.Equal(t, &producerSnapshot{
+		NextOffset: 4,
+		Producers:  map[string][]producerSeq{"producer": {{Seq: 1, Off: 0}}},
+	}, meta.Producers)
+
+	// sin nada en los .meta, como un log anterior, se recorren todos los segmentos
+	for _, base := range []uint64{0, 2, 4} {
+		meta, err := readSegmentMeta(metaPath(base))
+		require.NoError(t, err)
+		meta.Deleted, meta.Producers = nil, nil
+		require.NoError(t, writeSegmentMeta(metaPath(base), meta, 0644))
+	}
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrRecordDeleted{Offset: 0}, err)
+	require.NoError(t, log.Close())
+	meta, err = readSegmentMeta(metaPath(0))
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, meta.Deleted)
+	meta, err = readSegmentMeta(metaPath(2))
+	require.NoError(t, err)
+	require.NotNil(t, meta.Producers)
+
+	// con la foto no se recorren los segmentos anteriores: uno ilegible no impide abrir
+	require.NoError(t, os.Remove(path.Join(dir, fmt.Sprintf("%020d.integrity", 0))))
+	storePath := path.Join(dir, fmt.Sprintf("%020d.store", 0))
+	fi, err := os.Stat(storePath)
+	require.NoError(t, err)
+	f, err := os.OpenFile(storePath, os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, fi.Size()-1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrRecordDeleted{Offset: 0}, err)
+	off, err := log.Append(record) // Reintento del productor
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// al eliminar el segmento se olvidan sus offsets borrados
+	require.NoError(t, log.Truncate(2))
+	require.NotContains(t, log.deleted, uint64(0))
+}
+
+func TestLogCompactByKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = entWidth * 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// 1000 registros con 200 keys, más algunos sin key intercalados
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string][]byte) // Último value de cada key
+	var unkeyed []uint64
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%03d", rng.Intn(200))
+		value := []byte(fmt.Sprintf("value-%d", i))
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: value})
+		require.NoError(t, err)
+		want[key] = value
+		if i%100 == 0 {
+			off, err := log.Append(&api.Record{Value: []byte("unkeyed")})
+			require.NoError(t, err)
+			unkeyed = append(unkeyed, off)
+		}
+	}
+	// un value vacío borra las versiones anteriores de la key
+	for key := range want {
+		_, err = log.Append(&api.Record{Key: []byte(key)})
+		require.NoError(t, err)
+		want[key] = nil
+		break
+	}
+	require.NoError(t, log.Delete(unkeyed[0]))
+	// el segmento activo no se compacta, así que se completa hasta que rote
+	for log.activeSegment.nextOffset > log.activeSegment.baseOffset {
+		off, err := log.Append(&api.Record{Value: []byte("unkeyed")})
+		require.NoError(t, err)
+		unkeyed = append(unkeyed, off)
+	}
+	before, err := log.Count()
+	require.NoError(t, err)
+
+	require.NoError(t, log.CompactByKey())
+
+	check := func(log *Log) {
+		keys := make(map[string]int)
+		var n, plain int
+		require.NoError(t, log.ForEachFrom(context.Background(), func(record *api.Record) error {
+			n++
+			if len(record.Key) == 0 {
+				plain++
+				return nil
+			}
+			keys[string(record.Key)]++
+			require.Equal(t, string(want[string(record.Key)]), string(record.Value))
+			return nil
+		}))
+		require.Len(t, keys, len(want))
+		for key, count := range keys {
+			require.Equal(t, 1, count, key)
+		}
+		// los registros sin key se conservan, salvo el borrado; queda su tombstone
+		require.Equal(t, len(unkeyed), plain)
+		count, err := log.Count()
+		require.NoError(t, err)
+		require.Equal(t, uint64(n), count)
+		require.Less(t, count, before)
+
+		// los offsets descartados quedan como huecos dentro de los segmentos
+		_, err = log.Read(unkeyed[0])
+		require.Error(t, err)
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		holes := 0
+		for off := lowest; off < lowest+100; off++ {
+			if _, err := log.Read(off); err != nil {
+				require.Equal(t, api.ErrRecordDeleted{Offset: off}, err)
+				holes++
+			}
+		}
+		require.NotZero(t, holes)
+		read, err := log.Read(unkeyed[len(unkeyed)-1])
+		require.NoError(t, err)
+		require.Equal(t, []byte("unkeyed"), read.Value)
+	}
+	check(log)
+
+	// los huecos y los segmentos reescritos sobreviven al reabrir el log
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+	_, err = log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+}
+
+func TestLogFailedRewrite(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 7; i++ {
+		record := &api.Record{Key: []byte("key"), Value: []byte(fmt.Sprintf("value-%d", i))}
+		if i == 0 {
+			record.Key = nil // Se conserva, así el primer segmento se reescribe en vez de borrarse
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	requireOpen := func() {
+		for _, s := range log.segments {
+			require.False(t, s.closed, s.baseOffset)
+		}
+	}
+
+	// si el manifest no llega a escribirse el segmento vuelve con sus archivos viejos
+	name := strings.TrimSuffix(log.segments[0].store.Name(), ".store")
+	require.NoError(t, os.Mkdir(name+".manifest.tmp", 0755))
+	require.Error(t, log.CompactByKey())
+	requireOpen()
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-0"), record.Value)
+	require.NoError(t, os.Remove(name+".manifest.tmp"))
+
+	// si tampoco se puede reabrir el segmento sale de la lista
+	require.NoError(t, os.Mkdir(name+".manifest", 0755))
+	require.Error(t, log.CompactByKey())
+	requireOpen()
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+	record, err = log.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-6"), record.Value)
+}
+
+func TestLogReadClosedSegment(t *testing.T) {
+	log, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+
+	// un segmento cerrado que nadie reemplaza no deja la lectura buscándolo para siempre
+	require.NoError(t, log.segments[0].Close())
+	done := make(chan error, 1)
+	go func() {
+		_, err := log.Read(0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.Equal(t, errSegmentClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read kept retrying a closed segment")
+	}
+}
+
+func TestLogBackgroundCompaction(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = entWidth * 50
+	c.Compaction.Enabled = true
+	c.Compaction.MinDirtyRatio = 0.5
+	c.Compaction.Interval = 10 * time.Millisecond
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+
+	// 10 keys escritas muchas veces: casi todos los registros quedan obsoletos
+	write := func(round int) map[string]string {
+		want := make(map[string]string)
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key-%d", i%10)
+			want[key] = fmt.Sprintf("value-%d-%d", round, i)
+			_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte(want[key])})
+			require.NoError(t, err)
+		}
+		return want
+	}
+	want := write(0)
+	full, err := log.SizeBytes()
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		size, err := log.SizeBytes()
+		require.NoError(t, err)
+		return size < full/2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// las escrituras siguen mientras compacta y las keys conservan su último value
+	want = write(1)
+	require.Eventually(t, func() bool {
+		count, err := log.Count()
+		require.NoError(t, err)
+		return count < 100
+	}, 5*time.Second, 10*time.Millisecond)
+	check := func(log *Log) {
+		got := make(map[string]string)
+		require.NoError(t, log.ForEachFrom(context.Background(), func(record *api.Record) error {
+			got[string(record.Key)] = string(record.Value)
+			return nil
+		}))
+		require.Equal(t, want, got)
+	}
+	check(log)
+
+	// Close detiene la compactación y el log se reabre con los segmentos compactados
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+}
+
+func TestLogRollBeforeWrite(t *testing.T) {
+	size := func(off uint64) uint64 {
+		return lenWidth + crcWidth + uint64(proto.Size(&api.Record{
+			Value:     []byte("hello world"),
+			Offset:    off,
+			Timestamp: time.Now().UnixNano(), // Append le asigna la hora
+		}))
+	}
+	for name, limits := range map[string]struct{ store, index uint64 }{
+		// el store alcanza justo para los tres primeros registros
+		"store sized to three records": {storeHeaderWidth + size(0) + size(1) + size(2), 1024},
+		// el índice no es múltiplo de entWidth, así que la cuarta entrada no cabe
+		"index sized past three entries": {1024, entWidth*3 + 5},
+		"both tight":                     {100, entWidth*2 + 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log-roll-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = limits.store
+			c.Segment.MaxIndexBytes = limits.index
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := uint64(0); i < 50; i++ {
+				off, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err) // nunca io.EOF del índice
+				require.Equal(t, i, off)
+			}
+
+			infos := log.Segments()
+			for i, info := range infos {
+				require.LessOrEqual(t, info.StoreBytes, limits.store)
+				require.LessOrEqual(t, info.IndexBytes, limits.index)
+				if i+1 < len(infos) {
+					// el primer registro del segmento siguiente no cabía en este
+					next := info.StoreBytes + size(info.NextOffset)
+					require.True(t, next > limits.store || info.IndexBytes+entWidth > limits.index)
+				}
+			}
+			if name == "store sized to three records" {
+				require.Equal(t, uint64(3), infos[0].NextOffset)
+			}
+			for off := uint64(0); off < 50; off++ {
+				_, err := log.Read(off)
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLogMixedSegmentNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-names-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 24; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// los segmentos anteriores a 12 pasan al nombre antiguo sin padding, con
+	// el que el orden lexicográfico ya no es el numérico (10 < 2)
+	for off := uint64(0); off < 12; off += 2 {
+		for _, ext := range []string{".store", ".index"} {
+			require.NoError(t, os.Rename(
+				path.Join(dir, fmt.Sprintf("%020d%s", off, ext)),
+				path.Join(dir, fmt.Sprintf("%d%s", off, ext)),
+			))
+		}
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	var bases []uint64
+	for _, info := range log.Segments() {
+		bases = append(bases, info.BaseOffset)
+	}
+	require.Equal(t, []uint64{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24}, bases)
+	for off := uint64(0); off < 24; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+	}
+	off, err := log.Append(&api.Record{Value: []byte("new")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(24), off)
+	_, err = os.Stat(path.Join(dir, fmt.Sprintf("%020d.store", 24)))
+	require.NoError(t, err)
+}
+
+func TestLogDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// dos goroutines abren el mismo directorio y sólo una lo consigue
+	var wg sync.WaitGroup
+	logs := make([]*Log, 2)
+	errs := make([]error, 2)
+	for i := range logs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			logs[i], errs[i] = NewLog(dir, Config{})
+		}(i)
+	}
+	wg.Wait()
+
+	var opened *Log
+	locked := 0
+	for i, err := range errs {
+		if err != nil {
+			require.ErrorIs(t, err, ErrDirectoryLocked)
+			locked++
+			continue
+		}
+		opened = logs[i]
+	}
+	require.Equal(t, 1, locked)
+	require.NotNil(t, opened)
+
+	// al cerrar el log el directorio queda libre
+	require.NoError(t, opened.Close())
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func TestLogDataDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-datadirs-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	disks := []string{path.Join(dir, "disk0"), path.Join(dir, "disk1")}
+	logDir := path.Join(dir, "log")
+	for _, d := range append(disks, logDir) {
+		require.NoError(t, os.Mkdir(d, 0755))
+	}
+
+	c := Config{DataDirs: disks}
+	c.Segment.MaxIndexBytes = entWidth // un registro por segmento
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	// los segmentos se reparten en round-robin entre los discos
+	infos := log.Segments()
+	require.Len(t, infos, 5)
+	for i, info := range infos {
+		require.Equal(t, disks[i%2], path.Dir(info.StorePath))
+	}
+	stats := log.Stats()
+	require.Len(t, stats.DirBytes, 2)
+	require.NotZero(t, stats.DirBytes[disks[0]])
+	require.NotZero(t, stats.DirBytes[disks[1]])
+	require.NoError(t, log.Close())
+
+	// al reabrir se encuentran los segmentos de todos los directorios
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.Segments(), 5)
+	for i := uint64(0); i < 4; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+}
+
+func TestLogSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	require.NoError(t, os.Mkdir(path.Join(dir, "source"), 0755))
+	log, err := NewLog(path.Join(dir, "source"), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{
+			Value: []byte(fmt.Sprintf("record %d", i)),
+		})
+		require.NoError(t, err)
+	}
+	// con el primer segmento truncado el log ya no empieza en cero
+	require.NoError(t, log.Truncate(1))
+
+	// los Append concurrentes esperan a que termine el snapshot
+	var snapshot bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 5; i < 10; i++ {
+			_, err := log.Append(&api.Record{
+				Value: []byte(fmt.Sprintf("record %d", i)),
+			})
+			require.NoError(t, err)
+		}
+	}()
+	require.NoError(t, log.Snapshot(&snapshot))
+	wg.Wait()
+
+	restored, err := RestoreLog(path.Join(dir, "restored"), &snapshot, Config{})
+	require.NoError(t, err)
+	defer restored.Close()
+
+	lowest, err := restored.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	highest, err := restored.HighestOffset()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, highest, uint64(4))
+	for off := lowest; off <= highest; off++ {
+		read, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+	}
+
+	// el log restaurado sigue asignando offsets a continuación
+	off, err := restored.Append(&api.Record{Value: []byte("after restore")})
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+
+	_, err = RestoreLog(path.Join(dir, "invalid"), bytes.NewReader([]byte("not a snapshot")), Config{})
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+
+	// un encabezado que anuncia más segmentos de los que trae no reserva memoria para todos
+	var truncated bytes.Buffer
+	require.NoError(t, binary.Write(&truncated, enc, snapshotHeader{
+		Magic:    snapshotMagic,
+		Version:  snapshotVersion,
+		Segments: math.MaxUint32,
+	}))
+	_, err = RestoreLog(path.Join(dir, "truncated"), &truncated, Config{})
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+}
+
+func TestLogSnapshotEncrypted(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.EncryptionKey = bytes.Repeat([]byte{1}, 32)
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	var snapshot bytes.Buffer
+	require.NoError(t, log.Snapshot(&snapshot))
+
+	// sin la clave no se puede abrir, con la clave del log original sí
+	_, err = RestoreLog(t.TempDir(), bytes.NewReader(snapshot.Bytes()), Config{})
+	require.ErrorIs(t, err, ErrMissingKey)
+	restored, err := RestoreLog(t.TempDir(), &snapshot, c)
+	require.NoError(t, err)
+	defer restored.Close()
+	for off := uint64(0); off < 5; off++ {
+		read, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+	}
+	off, err := restored.Append(&api.Record{Value: []byte("after restore")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func TestLogRecoverPartialSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-recover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// simula una caída tras crear solo el primer archivo del segmento 2
+	require.NoError(t, os.Remove(path.Join(dir, "00000000000000000002.store")))
+	require.NoError(t, os.Remove(path.Join(dir, "00000000000000000002.index")))
+	require.NoError(t, os.WriteFile(path.Join(dir, "00000000000000000002.store.tmp"), nil, 0644))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 1)
+	require.NoFileExists(t, path.Join(dir, "00000000000000000002.store.tmp"))
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.NoError(t, log.Close())
+
+	// simula una caída después de escribir el manifest y renombrar un archivo
+	require.NoError(t, os.WriteFile(path.Join(dir, "00000000000000000002.store"), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "00000000000000000002.index.tmp"), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, "00000000000000000002.manifest"), []byte("00000000000000000002.store\n2.index"), 0644))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 2)
+	require.FileExists(t, path.Join(dir, "00000000000000000002.index"))
+	require.NoFileExists(t, path.Join(dir, "00000000000000000002.manifest"))
+	off, err = log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+}
+
+func TestLogSegmentHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-hooks-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var created, removed []uint64
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.OnNewSegment = func(baseOffset uint64) {
+		created = append(created, baseOffset)
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	log.Config.OnSegmentRemoved = func(baseOffset uint64) {
+		removed = append(removed, baseOffset)
+		// los callbacks corren fuera del lock, así que pueden usar el log
+		_, err := log.LowestOffset()
+		require.NoError(t, err)
+	}
+
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	// el segmento inicial más una rotación cada dos registros
+	require.Equal(t, []uint64{0, 2, 4, 6}, created)
+
+	require.NoError(t, log.Truncate(3))
+	require.Equal(t, []uint64{0, 2}, removed)
+}
+
+func TestLogLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-logger-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c, WithLogger(logger))
+	require.NoError(t, err)
+
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	require.NoError(t, log.Truncate(1))
+
+	out := buf.String()
+	require.Contains(t, out, "msg=\"segment created\" baseOffset=0 nextOffset=0 storeSize=8 indexSize=0")
+	require.Contains(t, out, "msg=\"segment created\" baseOffset=2")
+	require.Contains(t, out, "msg=\"record appended\" offset=1")
+	require.Contains(t, out, "msg=\"record read\" offset=0")
+	require.Contains(t, out, "msg=\"segment removed\" baseOffset=0 nextOffset=2")
+}
+
+// jsonRecord arma un valor parecido a un payload JSON, que se comprime bien.
+func jsonRecord(i int) *api.Record {
+	return &api.Record{Value: []byte(fmt.Sprintf(
+		`{"id":%d,"type":"order","status":"created","items":[{"sku":"A-1","qty":1},{"sku":"A-2","qty":2}],"note":"%s"}`,
+		i, strings.Repeat("lorem ipsum ", 10),
+	))}
+}
+
+func TestLogCompressSealed(t *testing.T) {
+	for _, codec := range []Codec{CodecGzip, CodecFlate} {
+		t.Run(string(codec), func(t *testing.T) {
+			dir := t.TempDir()
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+
+			// los primeros segmentos se sellan sin comprimir
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 4; i++ {
+				_, err := log.Append(jsonRecord(i))
+				require.NoError(t, err)
+			}
+			plainSize := log.segments[0].store.size
+			require.NoError(t, log.Close())
+
+			c.Segment.CompressSealed = true
+			c.Segment.CompressionCodec = codec
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 4; i < 10; i++ {
+				_, err := log.Append(jsonRecord(i))
+				require.NoError(t, err)
+			}
+			log.compressing.Wait() // Los segmentos sellados se comprimen en background
+			require.Len(t, log.segments, 4)
+
+			// el segmento 0 quedó como estaba y los que se sellaron después están comprimidos
+			raw, err := os.ReadFile(log.segments[0].store.Name())
+			require.NoError(t, err)
+			require.False(t, isCompressed(raw[lenWidth:]))
+			for _, s := range log.segments[1:3] {
+				require.True(t, s.IsSealed())
+				require.Less(t, s.store.size, plainSize)
+				require.NoError(t, s.Verify())
+			}
+
+			for i := 0; i < 10; i++ {
+				record, err := log.Read(uint64(i))
+				require.NoError(t, err)
+				require.Equal(t, jsonRecord(i).Value, record.Value)
+				require.Equal(t, uint64(i), record.Offset)
+			}
+
+			// al reabrir el log los registros comprimidos se siguen leyendo
+			require.NoError(t, log.Close())
+			c.Segment.VerifyOnOpen = true
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			record, err := log.Read(5)
+			require.NoError(t, err)
+			require.Equal(t, jsonRecord(5).Value, record.Value)
+		})
+	}
+}
+
+func TestLogCompressSealedEncrypted(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Segment.CompressSealed = true
+	c.Segment.EncryptionKey = bytes.Repeat([]byte{1}, 32)
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(jsonRecord(i))
+		require.NoError(t, err)
+	}
+	log.compressing.Wait()
+
+	// se comprime antes de cifrar, así que en disco sigue viéndose cifrado
+	raw, err := os.ReadFile(log.segments[0].store.Name())
+	require.NoError(t, err)
+	require.Equal(t, encryptionAESGCM, raw[storeHeaderWidth+lenWidth+crcWidth])
+	for i := 0; i < 3; i++ {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, jsonRecord(i).Value, record.Value)
+	}
+}
+
+func TestLogCompressSealedBackground(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.CompressSealed = true
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// mientras la compresión espera, Append y las lecturas del segmento sellado siguen
+	log.maintMu.Lock()
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(jsonRecord(i))
+		require.NoError(t, err)
+	}
+	plainSize := log.segments[0].store.size
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, jsonRecord(0).Value, record.Value)
+	log.maintMu.Unlock()
+	log.compressing.Wait()
+	require.Less(t, log.segments[0].store.size, plainSize)
+
+	// si la copia falla, el segmento queda abierto y sin comprimir, y el Append que lo selló no falla
+	active := log.segments[1]
+	name := strings.TrimSuffix(active.store.Name(), ".store")
+	require.NoError(t, os.Mkdir(name+".store.tmp", 0755))
+	for i := 4; i < 6; i++ {
+		_, err := log.Append(jsonRecord(i))
+		require.NoError(t, err)
+	}
+	log.compressing.Wait()
+	require.Len(t, log.segments, 3)
+	require.Same(t, active, log.segments[1])
+	require.True(t, active.IsSealed())
+	require.False(t, active.closed)
+	for i := 0; i < 6; i++ {
+		record, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, jsonRecord(i).Value, record.Value)
+	}
+}
+
+func TestLogUnknownCodec(t *testing.T) {
+	c := Config{}
+	c.Segment.CompressSealed = true
+	c.Segment.CompressionCodec = "zstd"
+	_, err := NewLog(t.TempDir(), c)
+	require.Error(t, err)
+}
+
+func BenchmarkCompressSealed(b *testing.B) {
+	for _, codec := range []Codec{CodecGzip, CodecFlate} {
+		b.Run(string(codec), func(b *testing.B) {
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 100
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.CompressSealed = true
+			c.Segment.CompressionCodec = codec
+			var plain, compressed uint64
+			for i := 0; i < b.N; i++ {
+				log, err := NewLog(b.TempDir(), c)
+				require.NoError(b, err)
+				for j := 0; j < 100; j++ {
+					record := jsonRecord(j)
+					_, err := log.Append(record)
+					require.NoError(b, err)
+					plain += lenWidth + uint64(proto.Size(record))
+				}
+				log.compressing.Wait()
+				compressed += log.segments[0].store.size
+				require.NoError(b, log.Close())
+			}
+			b.ReportMetric(float64(plain)/float64(compressed), "ratio")
+		})
+	}
+}
+
+func TestLogMmapSealed(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.MmapSealed = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(jsonRecord(i))
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+
+	check := func() {
+		// los sellados se leen del mapeo y el activo del archivo
+		for _, s := range log.segments[:3] {
+			require.NotNil(t, s.store.mapping)
+		}
+		require.Nil(t, log.activeSegment.store.mapping)
+		for i := 0; i < 10; i++ {
+			record, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, jsonRecord(i).Value, record.Value)
+		}
+	}
+	check()
+
+	// al reabrir el log se mapean los segmentos que se abren sellados
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check()
+
+	// sin mapeo la lectura vuelve al archivo
+	require.NoError(t, log.segments[0].store.unmap())
+	record, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, jsonRecord(1).Value, record.Value)
+}
+
+// BenchmarkLogReplay lee en orden todos los registros de segmentos sellados,
+// como un consumer que recorre el log desde el principio.
+func BenchmarkLogReplay(b *testing.B) {
+	const records = 10000
+	for _, mmap := range []bool{false, true} {
+		name := "syscall"
+		if mmap {
+			name = "mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 1000
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.MmapSealed = mmap
+			log, err := NewLog(b.TempDir(), c)
+			require.NoError(b, err)
+			defer log.Close()
+			for i := 0; i < records; i++ {
+				_, err := log.Append(jsonRecord(i))
+				require.NoError(b, err)
+			}
+			n := log.activeSegment.baseOffset // Sólo los sellados
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(uint64(i) % n); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLogOffsetAtTime(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 50
+	c.Segment.MaxStoreBytes = 1 << 20
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// un registro por milisegundo
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte(fmt.Sprintf("record %d", i)),
+			Timestamp: base.Add(time.Duration(i) * time.Millisecond).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 21)
+
+	for at, want := range map[time.Duration]uint64{
+		500 * time.Millisecond:      500,
+		500*time.Millisecond + 1:    501, // entre dos registros
+		0:                           0,
+		-time.Hour:                  0,
+		999 * time.Millisecond:      999,
+		50 * time.Millisecond:       50, // primer registro de un segmento
+		49*time.Millisecond + 1:     50,
+		100*time.Millisecond - 1000: 100,
+	} {
+		off, err := log.OffsetAtTime(base.Add(at))
+		require.NoError(t, err, at)
+		require.Equal(t, want, off, at)
+	}
+	_, err = log.OffsetAtTime(base.Add(time.Second))
+	require.Equal(t, ErrNoRecordAfterTime, err)
+
+	it, err := log.NewIteratorAt(base.Add(500 * time.Millisecond))
+	require.NoError(t, err)
+	for i := 500; i < 1000; i++ {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+		require.Equal(t, base.Add(time.Duration(i)*time.Millisecond).UnixNano(), record.Timestamp)
+	}
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+
+	_, err = log.NewIteratorAt(base.Add(time.Hour))
+	require.Equal(t, ErrNoRecordAfterTime, err)
+
+	// tras truncar, un instante anterior lleva al registro más viejo que queda
+	require.NoError(t, log.Truncate(149))
+	off, err := log.OffsetAtTime(base)
+	require.NoError(t, err)
+	require.Equal(t, uint64(150), off)
+	stats := log.Stats()
+	require.Equal(t, base.Add(150*time.Millisecond), stats.OldestTimestamp.UTC())
+	require.Equal(t, base.Add(999*time.Millisecond), stats.NewestTimestamp.UTC())
+}
+
+func TestLogSegmentAge(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 10
+	c.Segment.MaxStoreBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// diez registros por segmento, uno por minuto
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		_, err := log.Append(&api.Record{
+			Value:     []byte(fmt.Sprintf("record %d", i)),
+			Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+	created := make([]time.Time, len(log.segments))
+	for i, s := range log.segments {
+		created[i] = s.CreatedAt()
+		require.False(t, created[i].IsZero())
+	}
+
+	// los tiempos sobreviven a cerrar y reabrir el log
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 4)
+	for i, s := range log.segments[:3] {
+		require.True(t, created[i].Equal(s.CreatedAt()), i)
+		oldest, err := s.OldestRecordTime()
+		require.NoError(t, err)
+		require.Equal(t, base.Add(time.Duration(i*10)*time.Minute), oldest.UTC())
+		newest, err := s.NewestRecordTime()
+		require.NoError(t, err)
+		require.Equal(t, base.Add(time.Duration(i*10+9)*time.Minute), newest.UTC())
+	}
+	oldest, err := log.activeSegment.OldestRecordTime()
+	require.NoError(t, err)
+	require.True(t, oldest.IsZero())
+
+	// sólo se borran los segmentos cuyo último registro es anterior al corte
+	removed, err := log.TruncateOlderThan(base.Add(19 * time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	removed, err = log.TruncateOlderThan(base.Add(19*time.Minute + 1))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), lowest)
+
+	// el segmento activo no se borra aunque todo sea más viejo
+	removed, err = log.TruncateOlderThan(base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.Len(t, log.segments, 1)
+	_, err = log.Read(29)
+	require.Error(t, err)
+}
+
+func TestLogMaxSegmentAge(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxSegmentAge = time.Hour
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 1)
+
+	// el segmento activo se creó hace más de MaxSegmentAge: el próximo
+	// registro va a un segmento nuevo
+	log.activeSegment.meta.CreatedAt = time.Now().Add(-2 * time.Hour)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(3), log.activeSegment.baseOffset)
+
+	// un segmento vacío no rota por viejo
+	_, err = log.Rotate()
+	require.NoError(t, err)
+	log.activeSegment.meta.CreatedAt = time.Now().Add(-2 * time.Hour)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Len(t, log.segments, 3)
+}
+
+func TestIteratorSkipsDeletedAndTruncated(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	it := log.NewIterator(0)
+	require.NoError(t, log.Truncate(1))
+	require.NoError(t, log.Delete(3)) // El tombstone queda en el offset 5
+
+	var offsets []uint64
+	for {
+		record, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		offsets = append(offsets, record.Offset)
+	}
+	require.Equal(t, []uint64{2, 4, 5}, offsets)
+	require.Equal(t, uint64(6), it.Offset())
+}
+
+func TestNewLogCreatesDir(t *testing.T) {
+	dir := path.Join(t.TempDir(), "a", "b", "log")
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// no queda el archivo con el que se comprobó el permiso de escritura
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		require.False(t, strings.HasPrefix(file.Name(), "write-check"), file.Name())
+	}
+}
+
+func TestNewLogUnusableDir(t *testing.T) {
+	// un archivo en el camino impide crear el directorio
+	file := path.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	_, err := NewLog(path.Join(file, "log"), Config{})
+	require.ErrorContains(t, err, "create directory")
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(dir, 0555))
+	defer os.Chmod(dir, 0755)
+	_, err = NewLog(dir, Config{})
+	require.ErrorContains(t, err, "is not writable")
+}
+
+func TestNewLogIgnoresStrayFiles(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	// sin offset 0 en el log, un archivo tomado por el segmento 0 se nota
+	c.Segment.InitialOffset = 16
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	segments := len(log.Segments())
+	require.NoError(t, log.Close())
+
+	// restos de una compactación y una reescritura que no terminaron, más
+	// archivos cuyo nombre no es un offset
+	temp := []string{"00000000000000000016.store.swap", "00000000000000000018.index.tmp"}
+	stray := []string{"notes.txt", "backup.store"}
+	for _, name := range append(temp, stray...) {
+		require.NoError(t, os.WriteFile(path.Join(dir, name), []byte("garbage"), 0644))
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.Segments(), segments)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), lowest)
+	for off := uint64(16); off < 19; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+
+	// los temporales se borran y el resto se deja como está
+	for _, name := range temp {
+		require.NoFileExists(t, path.Join(dir, name))
+	}
+	for _, name := range stray {
+		require.FileExists(t, path.Join(dir, name))
+	}
+}
+
+func TestLogReopenSealsOldSegments(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 3)
+	for i, s := range log.segments {
+		active := i == len(log.segments)-1
+		require.Equal(t, !active, s.IsSealed())
+		require.Equal(t, !active, s.index.readOnly)
+		if !active {
+			// el índice queda del tamaño de sus entradas, no de MaxIndexBytes
+			require.Len(t, s.index.mmap, int(indexHeaderWidth+2*entWidth))
+		}
+	}
+	for off := uint64(0); off < 5; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+	_, err = log.segments[0].Append(&api.Record{Value: []byte("late")})
+	require.ErrorIs(t, err, ErrSealed)
+	require.ErrorIs(t, log.segments[0].index.Write(2, 0), ErrReadOnlyIndex)
+
+	// el segmento activo sigue aceptando escrituras
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// un índice viejo sin entradas se reconstruye aunque se abra sellado
+	index := log.segments[0].index.Name()
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Truncate(index, int64(indexHeaderWidth)))
+	c.Segment.RebuildIndexOnError = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.True(t, log.segments[0].index.readOnly)
+	for off := uint64(0); off < 6; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+}
+
+func TestNewLogSkipsNonSegmentFiles(t *testing.T) {
+	dir := t.TempDir()
+	readme := path.Join(dir, "README.txt")
+	require.NoError(t, os.WriteFile(readme, []byte("segmentos del log\n"), 0644))
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	c := Config{}
+	c.Segment.InitialOffset = 16
+	log, err := NewLog(dir, c, WithLogger(logger))
+	require.NoError(t, err)
+	defer log.Close()
+
+	// el README no abre un segmento en el offset 0
+	require.Len(t, log.Segments(), 1)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), off)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), lowest)
+
+	require.FileExists(t, readme)
+	require.Contains(t, buf.String(), `msg="skipping file that is not a segment" file=`+readme)
+}
+
+func BenchmarkLogParallelRead(b *testing.B) {
+	const perSegment = 100
+	for _, writer := range []bool{false, true} {
+		name := "readers"
+		if writer {
+			name = "readers+writer" // Un Append continuo en el segmento activo
+		}
+		b.Run(name, func(b *testing.B) {
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * perSegment
+			c.Segment.MaxStoreBytes = 1 << 20
+			log, err := NewLog(b.TempDir(), c)
+			require.NoError(b, err)
+			defer log.Close()
+			// 3 segmentos sellados y el activo
+			for i := 0; i < 3*perSegment+perSegment/2; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(b, err)
+			}
+			require.Len(b, log.segments, 4)
+			n := log.activeSegment.nextOffset
+
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for writer {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, err := log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			// 8 goroutines, dos por segmento, cada una empezando en otro lugar
+			const readers = 8
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for r := uint64(0); r < readers; r++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					off := r * n / readers
+					for i := r; i < uint64(b.N); i += readers {
+						if _, err := log.Read(off); err != nil {
+							b.Error(err)
+							return
+						}
+						off = (off + 1) % n
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
+
+func TestLogRollsBeforeRelativeOffsetOverflow(t *testing.T) {
+	log, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	log.activeSegment.nextOffset = maxRelativeOffset
+
+	first, err := log.Append(&api.Record{Value: []byte("last")})
+	require.NoError(t, err)
+	second, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, first+1, second)
+	require.Len(t, log.segments, 2)
+	require.Equal(t, second, log.activeSegment.baseOffset)
+
+	for off, want := range map[uint64]string{first: "last", second: "next"} {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want, string(got.Value))
+	}
+}
+
+func TestLogSubscribe(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+
+	receive := func(records <-chan *api.Record, want uint64) {
+		t.Helper()
+		select {
+		case record := <-records:
+			require.Equal(t, want, record.Offset)
+			require.Equal(t, fmt.Sprint(want), string(record.Value))
+		case <-time.After(time.Second):
+			t.Fatalf("record %d not published", want)
+		}
+	}
+
+	// dos suscripciones independientes desde offsets distintos
+	ctx, cancel := context.WithCancel(context.Background())
+	first, firstErrs := log.Subscribe(ctx, 1, 1)
+	second, secondErrs := log.Subscribe(context.Background(), 0, 0)
+	receive(first, 1)
+	receive(first, 2)
+	receive(second, 0)
+
+	// los registros agregados después también se publican
+	for i := 3; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	receive(first, 3)
+	for off := uint64(1); off < 5; off++ {
+		receive(second, off)
+	}
+
+	// cancelar el contexto cierra los canales sin error
+	cancel()
+	for range first {
+	}
+	_, ok := <-firstErrs
+	require.False(t, ok)
+
+	// cerrar el log termina la suscripción con io.EOF
+	require.NoError(t, log.Close())
+	for range second {
+	}
+	require.Equal(t, io.EOF, <-secondErrs)
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrLogClosed)
+}
+
+func TestLogCDCStream(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	events := log.CDCStream(ctx)
+
+	appendValue := func(value string) {
+		_, err := log.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+	appendValue("a")
+	appendValue("b") // llena el segmento, que rota
+	require.NoError(t, log.Truncate(1))
+	appendValue("c")
+	appendValue("d")
+	appendValue("e")
+	require.NoError(t, log.Truncate(3))
+
+	want := []CDCEvent{
+		AppendEvent{Offset: 0},
+		AppendEvent{Offset: 1},
+		SegmentRolledEvent{BaseOffset: 0, NextOffset: 2},
+		SegmentRemovedEvent{BaseOffset: 0},
+		TruncateEvent{BelowOffset: 2},
+		AppendEvent{Offset: 2},
+		AppendEvent{Offset: 3},
+		SegmentRolledEvent{BaseOffset: 2, NextOffset: 4},
+		AppendEvent{Offset: 4},
+		SegmentRemovedEvent{BaseOffset: 2},
+		TruncateEvent{BelowOffset: 4},
+	}
+	values := []string{"a", "b", "c", "d", "e"}
+	for _, w := range want {
+		select {
+		case event := <-events:
+			if got, ok := event.(AppendEvent); ok {
+				require.Equal(t, values[got.Offset], string(got.Record.Value))
+				got.Record = nil
+				event = got
+			}
+			require.Equal(t, w, event)
+		case <-time.After(time.Second):
+			t.Fatalf("event %#v not published", w)
+		}
+	}
+
+	// cancelar el contexto cierra el canal
+	cancel()
+	for range events {
+	}
+}
+
+func TestLogArchiveBefore(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	setup := func(t *testing.T) (*Log, string, string) {
+		dir, archive := t.TempDir(), t.TempDir()
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			_, err := log.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+			require.NoError(t, err)
+		}
+		require.Len(t, log.segments, 3)
+		return log, dir, archive
+	}
+	readAll := func(t *testing.T, log *Log) {
+		t.Helper()
+		for off := uint64(0); off < 5; off++ {
+			got, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprint(off), string(got.Value))
+		}
+	}
+	segmentFiles := func(t *testing.T, dir string) []string {
+		t.Helper()
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, file := range files {
+			if file.Name() != lockFileName {
+				names = append(names, file.Name())
+			}
+		}
+		return names
+	}
+
+	for name, link := range map[string]func(string, string) error{
+		"same disk": os.Link,
+		// os.Link falla entre discos; los archivos se copian
+		"other disk": func(string, string) error { return &os.LinkError{Err: syscall.EXDEV} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func(link func(string, string) error) { linkFile = link }(linkFile)
+			linkFile = link
+			log, dir, archive := setup(t)
+
+			moved, err := log.ArchiveBefore(4, archive)
+			require.NoError(t, err)
+			require.Equal(t, 2, moved)
+			require.Len(t, segmentFiles(t, archive), 8) // store, index, meta e integrity de cada segmento
+			require.Len(t, segmentFiles(t, dir), 3)     // el segmento activo
+			readAll(t, log)
+
+			// mover otra vez no cambia nada
+			moved, err = log.ArchiveBefore(4, archive)
+			require.NoError(t, err)
+			require.Equal(t, 0, moved)
+			require.NoError(t, log.Close())
+
+			c := c
+			c.ArchiveDirs = []string{archive}
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			readAll(t, log)
+			off, err := log.Append(&api.Record{Value: []byte("5")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(5), off)
+		})
+	}
+
+	t.Run("crash before marker", func(t *testing.T) {
+		log, dir, archive := setup(t)
+		names := []string{"00000000000000000000.store", "00000000000000000000.index"}
+		require.NoError(t, log.Close())
+		require.NoError(t, stageMove(dir, archive, names))
+
+		// sin marcador la mudanza no cuenta: quedan los originales
+		c := c
+		c.ArchiveDirs = []string{archive}
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+		require.Empty(t, segmentFiles(t, archive))
+		require.Equal(t, dir, log.segments[0].dir)
+		readAll(t, log)
+	})
+
+	t.Run("crash after marker", func(t *testing.T) {
+		log, dir, archive := setup(t)
+		names := []string{"00000000000000000000.store", "00000000000000000000.index", "00000000000000000000.meta"}
+		require.NoError(t, log.Close())
+		require.NoError(t, stageMove(dir, archive, names))
+		marker := path.Join(dir, "00000000000000000000.move")
+		require.NoError(t, writeFileAtomic(marker, []byte(strings.Join(append([]string{archive}, names...), "\n")), 0644))
+
+		// al abrir el log termina la mudanza
+		c := c
+		c.ArchiveDirs = []string{archive}
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		defer log.Close()
+		require.ElementsMatch(t, names, segmentFiles(t, archive))
+		require.NoFileExists(t, marker)
+		require.Equal(t, archive, log.segments[0].dir)
+		readAll(t, log)
+	})
+}
+
+func TestLogVerifyIntegrity(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// los segmentos sellados en esta apertura todavía no tienen integridad
+	for _, result := range log.VerifyIntegrity() {
+		require.False(t, result.Checked)
+	}
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	results := log.VerifyIntegrity()
+	require.Equal(t, []SegmentVerifyResult{
+		{BaseOffset: 0, Checked: true},
+		{BaseOffset: 2, Checked: true},
+	}, results)
+
+	// un byte cambiado en el store se reporta
+	f, err := os.OpenFile(log.segments[0].store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, lenWidth+1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	results = log.VerifyIntegrity()
+	var corrupt ErrSegmentCorrupt
+	require.ErrorAs(t, results[0].Err, &corrupt)
+	require.Equal(t, uint64(0), corrupt.BaseOffset)
+	require.Contains(t, corrupt.Reason, "store checksum")
+	require.NoError(t, results[1].Err)
+	require.NoError(t, log.Close())
+
+	// y el segmento ya no se abre
+	_, err = NewLog(dir, c)
+	require.ErrorAs(t, err, &corrupt)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	log, err := NewLog(t.TempDir(), Config{}, WithLogger(logger))
+	require.NoError(t, err)
+	defer log.Close()
+	b := NewCircuitBreaker(log, CircuitBreakerConfig{
+		MaxFailures:          2,
+		HalfOpenWaitDuration: 50 * time.Millisecond,
+	})
+
+	_, err = b.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	// un segmento activo sellado hace fallar cada escritura, como un disco lleno
+	require.NoError(t, log.activeSegment.Seal())
+	for i := 1; i <= 2; i++ {
+		_, err = b.Append(&api.Record{Value: []byte("fails")})
+		require.ErrorIs(t, err, ErrSealed)
+		_, failures := b.State()
+		require.Equal(t, i, failures)
+	}
+	state, _ := b.State()
+	require.Equal(t, BreakerOpen, state)
+	require.Contains(t, buf.String(), `msg="circuit breaker opened" from=closed to=open failures=2`)
+
+	// abierto no intenta escribir
+	_, err = b.AppendBatch([]*api.Record{{Value: []byte("rejected")}})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	_, failures := b.State()
+	require.Equal(t, 2, failures)
+
+	// la escritura de prueba falla y el circuito vuelve a abrirse
+	time.Sleep(50 * time.Millisecond)
+	state, _ = b.State()
+	require.Equal(t, BreakerHalfOpen, state)
+	_, err = b.Append(&api.Record{Value: []byte("trial")})
+	require.ErrorIs(t, err, ErrSealed)
+	state, _ = b.State()
+	require.Equal(t, BreakerOpen, state)
+	_, err = b.Append(&api.Record{Value: []byte("rejected")})
+	require.ErrorIs(t, err, ErrCircuitOpen)
+
+	// con el disco recuperado la escritura de prueba cierra el circuito
+	_, err = log.Rotate()
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	off, err := b.Append(&api.Record{Value: []byte("trial")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	state, failures = b.State()
+	require.Equal(t, BreakerClosed, state)
+	require.Equal(t, 0, failures)
+	require.Contains(t, buf.String(), `msg="circuit breaker state changed" from=open to=half-open failures=3`)
+	require.Contains(t, buf.String(), `msg="circuit breaker state changed" from=half-open to=closed failures=0`)
+}
+
+func TestLogWebhooks(t *testing.T) {
+	const secret = "s3cret"
+	var requests atomic.Int32
+	events := make(chan WebhookEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError) // el primer POST se reintenta
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Signature-256"))
+		var event WebhookEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		events <- event
+	}))
+	defer srv.Close()
+
+	c := Config{}
+	c.Webhooks = []WebhookConfig{{URL: srv.URL, Secret: secret, MaxRetries: 2, TimeoutSeconds: 1}}
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	var want []*api.Record
+	for i := 0; i < 3; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+		want = append(want, record)
+	}
+	for _, record := range want {
+		select {
+		case event := <-events:
+			require.Equal(t, record.Offset, event.Offset)
+			require.Equal(t, proto.Size(record), event.RecordSize)
+			require.Equal(t, record.Timestamp, event.Timestamp.UnixNano())
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not delivered")
+		}
+	}
+	require.EqualValues(t, 4, requests.Load())
+}
+
+func TestLogDiff(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	leader, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer leader.Close()
+	follower, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer follower.Close()
+
+	entries, err := leader.Diff(follower, 0)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// el follower replica los registros del líder con sus offsets
+	for i := 0; i < 10; i++ {
+		off, err := leader.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+		record, err := leader.Read(off)
+		require.NoError(t, err)
+		if i == 4 {
+			record.Value = []byte("diverged")
+		}
+		if i < 8 {
+			require.NoError(t, follower.AppendAt(record))
+		}
+	}
+	require.NoError(t, leader.Delete(6)) // borrado sólo en el líder
+
+	entries, err = leader.Diff(follower, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	offsets := make([]uint64, len(entries))
+	for i, e := range entries {
+		offsets[i] = e.Offset
+		require.True(t, e.Diverges)
+		require.NotEqual(t, e.LeaderCRC, e.FollowerCRC)
+	}
+	// 10 es el tombstone de Delete, que el follower no tiene
+	require.Equal(t, []uint64{4, 6, 8, 9, 10}, offsets)
+	require.Zero(t, entries[1].LeaderCRC)
+	require.Zero(t, entries[2].FollowerCRC)
+
+	entries, err = leader.DiffRange(follower, 5, 8)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// con más diferencias que MaxDiffEntries retorna las primeras
+	leader.Config.MaxDiffEntries = 2
+	entries, err = leader.Diff(follower, 0)
+	require.ErrorIs(t, err, ErrDiffLimit)
+	require.Len(t, entries, 2)
+	require.Equal(t, uint64(6), entries[1].Offset)
+}
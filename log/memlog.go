@@ -0,0 +1,251 @@
+package log
+
+// Este archivo implementa MemLog, un log con la misma estructura de segmentos
+// que Log pero guardado en memoria, para tests que no necesitan el disco.
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// MemLog es un log en memoria con la misma API básica que Log. Cada segmento
+// guarda sus registros en un bytes.Buffer con el formato de Log.Reader y sus
+// entradas en otro con el formato del índice, y rota con los mismos límites de
+// Config.Segment, así los tests pueden ejercitar los bordes entre segmentos.
+//
+// No implementa cifrado, compresión, tombstones, deduplicación por productor
+// ni compactación.
+type MemLog struct {
+	mu sync.RWMutex
+
+	Config Config // Configuración del log
+
+	segments []*memSegment // Segmentos ordenados; el último es el activo
+	closed   bool          // Indica que Close ya se llamó
+}
+
+// memSegment es un segmento de MemLog.
+type memSegment struct {
+	store, index           bytes.Buffer // Registros en el formato de Log.Reader y entradas del índice
+	baseOffset, nextOffset uint64       // Offsets base y siguiente del segmento
+	size                   uint64       // Bytes que ocuparía el store en disco, con encabezado y checksums
+}
+
+// newMemSegment crea un segmento vacío que empieza en off.
+func newMemSegment(off uint64) *memSegment {
+	return &memSegment{baseOffset: off, nextOffset: off, size: storeHeaderWidth}
+}
+
+// NewMemLog crea un MemLog vacío que empieza en Config.Segment.InitialOffset.
+// Los límites en cero toman los mismos valores por defecto que NewLog.
+func NewMemLog(c Config) (*MemLog, error) {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1024
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	l := &MemLog{Config: c}
+	l.reset()
+	return l, nil
+}
+
+// reset deja el log con un único segmento vacío. Quien lo llama debe tener el
+// lock de escritura.
+func (l *MemLog) reset() {
+	off := l.Config.Segment.InitialOffset
+	l.segments = []*memSegment{newMemSegment(off)}
+	l.closed = false
+}
+
+// Append agrega el registro al segmento activo, rotando si no cabe, y retorna
+// su offset, que también queda en record.Offset.
+func (l *MemLog) Append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.append(record)
+}
+
+// AppendBatch agrega varios registros tomando el lock una sola vez.
+func (l *MemLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offsets := make([]uint64, 0, len(records))
+	for _, record := range records {
+		off, err := l.append(record)
+		if err != nil {
+			return offsets, err
+		}
+		offsets = append(offsets, off)
+	}
+	return offsets, nil
+}
+
+// append agrega un registro. Quien lo llama debe tener el lock de escritura.
+func (l *MemLog) append(record *api.Record) (uint64, error) {
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	s := l.segments[len(l.segments)-1]
+	record.Offset = s.nextOffset
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano() // Igual que Log
+	}
+	value, err := proto.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	if !s.fits(uint64(len(value)), l.Config) {
+		s = newMemSegment(s.nextOffset)
+		l.segments = append(l.segments, s)
+	}
+	pos := uint64(s.store.Len())
+	s.store.Write(enc.AppendUint64(nil, uint64(len(value))))
+	s.store.Write(value)
+	s.size += lenWidth + crcWidth + uint64(len(value))
+	entry := make([]byte, entWidth)
+	enc.PutUint32(entry[:offWidth], uint32(s.nextOffset-s.baseOffset))
+	enc.PutUint64(entry[offWidth:], pos)
+	s.index.Write(entry)
+	s.nextOffset++
+	if s.maxed(l.Config) {
+		l.segments = append(l.segments, newMemSegment(s.nextOffset)) // Como Log, rota apenas se llena
+	}
+	return record.Offset, nil
+}
+
+// fits aplica la misma regla que Segment.fits: un segmento vacío acepta
+// cualquier registro y uno con registros no pasa de los límites de c.
+func (s *memSegment) fits(n uint64, c Config) bool {
+	if s.index.Len() == 0 {
+		return true
+	}
+	return s.size+lenWidth+crcWidth+n <= c.Segment.MaxStoreBytes &&
+		uint64(s.index.Len())+entWidth <= c.Segment.MaxIndexBytes &&
+		s.nextOffset-s.baseOffset <= maxRelativeOffset
+}
+
+// maxed aplica la misma regla que Segment.IsMaxed: no cabe ni un registro vacío
+// o ni una entrada más en el índice.
+func (s *memSegment) maxed(c Config) bool {
+	return s.nextOffset-s.baseOffset > maxRelativeOffset ||
+		s.size+lenWidth+crcWidth > c.Segment.MaxStoreBytes ||
+		uint64(s.index.Len())+entWidth > c.Segment.MaxIndexBytes
+}
+
+// Read retorna el registro en off, o ErrOffsetOutOfRange si no está en el log.
+func (l *MemLog) Read(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			entry := s.index.Bytes()[(off-s.baseOffset)*entWidth:]
+			pos := enc.Uint64(entry[offWidth:entWidth])
+			store := s.store.Bytes()
+			n := enc.Uint64(store[pos : pos+lenWidth])
+			record := &api.Record{}
+			if err := proto.Unmarshal(store[pos+lenWidth:pos+lenWidth+n], record); err != nil {
+				return nil, err
+			}
+			return record, nil
+		}
+	}
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// LowestOffset retorna el offset base del primer segmento.
+func (l *MemLog) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[0].baseOffset, nil
+}
+
+// HighestOffset retorna el offset del último registro, o cero si no hay ninguno.
+func (l *MemLog) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	off := l.segments[len(l.segments)-1].nextOffset
+	if off == 0 {
+		return 0, nil
+	}
+	return off - 1, nil
+}
+
+// Truncate elimina, como Log.Truncate, los segmentos salvo el activo cuyo
+// offset más alto no pasa de lowest.
+func (l *MemLog) Truncate(lowest uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active := l.segments[len(l.segments)-1]
+	var segments []*memSegment
+	for _, s := range l.segments {
+		if s != active && s.nextOffset <= lowest+1 {
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	return nil
+}
+
+// Reader retorna un lector con los registros de todos los segmentos en el
+// formato de Log.Reader. Ve los registros que había al llamarlo.
+func (l *MemLog) Reader() io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	readers := make([]io.Reader, len(l.segments))
+	for i, s := range l.segments {
+		readers[i] = bytes.NewReader(bytes.Clone(s.store.Bytes()))
+	}
+	return io.MultiReader(readers...)
+}
+
+// Close cierra el log; después Append y Read retornan ErrLogClosed.
+func (l *MemLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return nil
+}
+
+// Remove cierra el log y descarta todos sus registros.
+func (l *MemLog) Remove() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.segments = []*memSegment{newMemSegment(0)}
+	l.closed = true
+	return nil
+}
+
+// Reset descarta todos los registros y deja el log abierto y vacío.
+func (l *MemLog) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reset()
+	return nil
+}
+
+// NewTestLog crea un Log en t.TempDir() con segmentos diminutos, de unos pocos
+// registros cada uno, para que los tests crucen bordes entre segmentos. El log
+// se cierra al terminar el test.
+func NewTestLog(t testing.TB) *Log {
+	t.Helper()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	c.Segment.MaxIndexBytes = entWidth * 4
+	l, err := NewLog(t.TempDir(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
@@ -0,0 +1,104 @@
+// Package memlog implementa un CommitLog que guarda los registros en memoria.
+// Sirve para tests y para despliegues efímeros donde no importa perder los
+// registros al reiniciar.
+package memlog
+
+import (
+	"sync"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// InMemoryLog guarda los registros en un slice protegido por un mutex. Asigna
+// offsets igual que log.Log: consecutivos desde cero. Si tiene capacidad, al
+// llenarse desaloja el registro más viejo y el offset más bajo avanza.
+//
+// No implementa tombstones, deduplicación por productor ni compactación.
+type InMemoryLog struct {
+	mu       sync.RWMutex
+	records  []*api.Record // Registros desde el offset base
+	base     uint64        // Offset del primer registro de records
+	capacity int           // Máximo de registros guardados; cero es sin límite
+}
+
+// NewInMemoryLog crea un log vacío. capacity limita cuántos registros guarda;
+// con cero no hay límite.
+func NewInMemoryLog(capacity int) *InMemoryLog {
+	return &InMemoryLog{capacity: capacity}
+}
+
+// Append agrega una copia del registro y le asigna el siguiente offset, que
+// también queda en record.Offset. Si el registro no trae timestamp, le asigna
+// la hora actual.
+func (l *InMemoryLog) Append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.append(record), nil
+}
+
+// AppendBatch agrega varios registros tomando el lock una sola vez.
+func (l *InMemoryLog) AppendBatch(records []*api.Record) ([]uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offsets := make([]uint64, 0, len(records))
+	for _, record := range records {
+		offsets = append(offsets, l.append(record))
+	}
+	return offsets, nil
+}
+
+// append agrega el registro y desaloja el más viejo si se excede la capacidad.
+// Quien lo llama debe tener el lock de escritura.
+func (l *InMemoryLog) append(record *api.Record) uint64 {
+	record.Offset = l.base + uint64(len(l.records))
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano() // Igual que log.Log
+	}
+	l.records = append(l.records, proto.Clone(record).(*api.Record))
+	if l.capacity > 0 && len(l.records) > l.capacity {
+		l.records[0] = nil // Suelta el registro para el recolector de basura
+		l.records = l.records[1:]
+		l.base++
+	}
+	return record.Offset
+}
+
+// Read retorna una copia del registro en off, o ErrOffsetOutOfRange si off
+// todavía no se escribió o ya fue desalojado.
+func (l *InMemoryLog) Read(off uint64) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if off < l.base || off-l.base >= uint64(len(l.records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return proto.Clone(l.records[off-l.base]).(*api.Record), nil
+}
+
+// LowestOffset retorna el offset del registro más viejo que se conserva.
+func (l *InMemoryLog) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.base, nil
+}
+
+// HighestOffset retorna el offset del último registro, o cero si está vacío.
+func (l *InMemoryLog) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	next := l.base + uint64(len(l.records))
+	if next == 0 {
+		return 0, nil
+	}
+	return next - 1, nil
+}
+
+// Reset descarta todos los registros y vuelve a empezar desde el offset cero.
+func (l *InMemoryLog) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = nil
+	l.base = 0
+	return nil
+}
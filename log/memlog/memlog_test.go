@@ -0,0 +1,97 @@
+package memlog
+
+import (
+	"testing"
+
+	api "github.com/dati/api/v1"
+	"github.com/dati/log"
+
+	"github.com/stretchr/testify/require"
+)
+
+// commitLog son las operaciones que InMemoryLog comparte con log.Log.
+type commitLog interface {
+	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) ([]uint64, error)
+	Read(uint64) (*api.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+func TestParity(t *testing.T) {
+	disk, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer disk.Close()
+
+	for name, l := range map[string]commitLog{
+		"disk":   disk,
+		"memory": NewInMemoryLog(0),
+	} {
+		t.Run(name, func(t *testing.T) {
+			highest, err := l.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), highest)
+
+			record := &api.Record{Value: []byte("hello world")}
+			off, err := l.Append(record)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), off)
+			require.Equal(t, off, record.Offset)
+			require.NotZero(t, record.Timestamp)
+
+			offsets, err := l.AppendBatch([]*api.Record{
+				{Value: []byte("first")},
+				{Value: []byte("second")},
+			})
+			require.NoError(t, err)
+			require.Equal(t, []uint64{1, 2}, offsets)
+
+			read, err := l.Read(2)
+			require.NoError(t, err)
+			require.Equal(t, []byte("second"), read.Value)
+			require.Equal(t, uint64(2), read.Offset)
+
+			// el registro leído es una copia
+			read.Value = []byte("changed")
+			read, err = l.Read(2)
+			require.NoError(t, err)
+			require.Equal(t, []byte("second"), read.Value)
+
+			_, err = l.Read(3)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+
+			lowest, err := l.LowestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), lowest)
+			highest, err = l.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), highest)
+		})
+	}
+}
+
+func TestEviction(t *testing.T) {
+	l := NewInMemoryLog(2)
+	for i := 0; i < 5; i++ {
+		off, err := l.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+
+	_, err = l.Read(2)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 2}, err)
+	read, err := l.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, read.Value)
+
+	require.NoError(t, l.Reset())
+	off, err := l.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	api "github.com/dati/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMemLog(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.InitialOffset = 4
+	mem, err := NewMemLog(c)
+	require.NoError(t, err)
+	disk, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer disk.Close()
+
+	for i := 0; i < 10; i++ {
+		value := bytes.Repeat([]byte{'a'}, i*5)
+		memOff, err := mem.Append(&api.Record{Value: value, Timestamp: 1})
+		require.NoError(t, err)
+		diskOff, err := disk.Append(&api.Record{Value: value, Timestamp: 1})
+		require.NoError(t, err)
+		require.Equal(t, diskOff, memOff)
+	}
+
+	// rota en los mismos offsets que el log en disco
+	require.Len(t, mem.segments, len(disk.segments))
+	for i, s := range disk.segments {
+		require.Equal(t, s.baseOffset, mem.segments[i].baseOffset)
+		require.Equal(t, s.nextOffset, mem.segments[i].nextOffset)
+	}
+	lowest, err := mem.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), lowest)
+	highest, err := mem.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(13), highest)
+	for off := uint64(4); off < 14; off++ {
+		want, err := disk.Read(off)
+		require.NoError(t, err)
+		got, err := mem.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got))
+	}
+	_, err = mem.Read(14)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	// Reader produce los mismos bytes que el log en disco
+	memBytes, err := io.ReadAll(mem.Reader())
+	require.NoError(t, err)
+	diskBytes, err := io.ReadAll(disk.Reader())
+	require.NoError(t, err)
+	require.Equal(t, diskBytes, memBytes)
+
+	require.NoError(t, mem.Truncate(8))
+	require.NoError(t, disk.Truncate(8))
+	lowest, err = mem.LowestOffset()
+	require.NoError(t, err)
+	diskLowest, err := disk.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, diskLowest, lowest)
+
+	require.NoError(t, mem.Close())
+	_, err = mem.Read(lowest)
+	require.ErrorIs(t, err, ErrLogClosed)
+	_, err = mem.Append(&api.Record{})
+	require.ErrorIs(t, err, ErrLogClosed)
+
+	require.NoError(t, mem.Reset())
+	off, err := mem.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
+
+func TestNewTestLog(t *testing.T) {
+	log := NewTestLog(t)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	// los segmentos diminutos rotan cada pocos registros
+	require.Greater(t, len(log.segments), 2)
+}
@@ -0,0 +1,187 @@
+package log
+
+// Metadatos de cada segmento en un archivo <base>.meta: cuándo se creó, su offset
+// base, cuántos registros tiene y la configuración con la que se creó. Sirven para
+// retención por tiempo y monitoreo sin recorrer el segmento. También guardan los
+// offsets borrados con Delete y la foto de los productores, para no tener que
+// recorrer todo el log al abrirlo.
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// segmentMeta es el contenido del archivo .meta de un segmento, en JSON.
+type segmentMeta struct {
+	CreatedAt   time.Time         `json:"createdAt"`
+	BaseOffset  uint64            `json:"baseOffset"`
+	RecordCount uint64            `json:"recordCount"`         // Se actualiza al sellar o cerrar el segmento
+	Deleted     []uint64          `json:"deleted,omitempty"`   // Offsets del segmento borrados con Delete, ordenados
+	Producers   *producerSnapshot `json:"producers,omitempty"` // Foto de los productores al sellarlo
+	Config      struct {
+		MaxStoreBytes    uint64 `json:"maxStoreBytes"`
+		MaxIndexBytes    uint64 `json:"maxIndexBytes"`
+		Encrypted        bool   `json:"encrypted"` // La clave nunca se escribe en el disco
+		CompressSealed   bool   `json:"compressSealed"`
+		CompressionCodec Codec  `json:"compressionCodec,omitempty"`
+	} `json:"config"`
+}
+
+// newSegmentMeta arma los metadatos de un segmento que se está creando.
+func newSegmentMeta(baseOffset uint64, c Config) *segmentMeta {
+	m := &segmentMeta{
+		CreatedAt:  time.Now().UTC(),
+		BaseOffset: baseOffset,
+	}
+	m.Config.MaxStoreBytes = c.Segment.MaxStoreBytes
+	m.Config.MaxIndexBytes = c.Segment.MaxIndexBytes
+	m.Config.Encrypted = len(c.Segment.EncryptionKey) > 0
+	m.Config.CompressSealed = c.Segment.CompressSealed
+	m.Config.CompressionCodec = c.Segment.CompressionCodec
+	return m
+}
+
+// readSegmentMeta lee el archivo .meta. Los segmentos creados antes de que
+// existiera no lo tienen; en ese caso retorna nil sin error.
+func readSegmentMeta(name string) (*segmentMeta, error) {
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &segmentMeta{}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeSegmentMeta guarda m de forma atómica, así una caída nunca deja un
+// archivo .meta escrito a medias.
+func writeSegmentMeta(name string, m *segmentMeta, perm os.FileMode) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, b, perm)
+}
+
+// metaPath devuelve la ruta del archivo .meta del segmento.
+func (s *Segment) metaPath() string {
+	return strings.TrimSuffix(s.store.Name(), ".store") + ".meta"
+}
+
+// updateMeta guarda la cantidad de registros en el archivo .meta si cambió. Los
+// segmentos sin .meta se dejan así: no se sabe cuándo se crearon.
+func (s *Segment) updateMeta() error {
+	if s.meta == nil || s.meta.RecordCount == s.RecordCount() {
+		return nil
+	}
+	s.meta.RecordCount = s.RecordCount()
+	return writeSegmentMeta(s.metaPath(), s.meta, s.config.Segment.Options.fileMode())
+}
+
+// setDeleted agrega off a los offsets borrados que guarda el archivo .meta, o lo
+// quita si deleted es false. Un segmento anterior a que existiera ese archivo
+// recibe uno con el timestamp de su primer registro como fecha de creación, la
+// misma que ya devolvía CreatedAt.
+func (s *Segment) setDeleted(off uint64, deleted bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSegmentClosed
+	}
+	meta := s.meta
+	if meta == nil {
+		ts, _, err := s.entryTimestamp(0)
+		if err != nil {
+			return err
+		}
+		meta = newSegmentMeta(s.baseOffset, s.config)
+		meta.CreatedAt = time.Unix(0, ts).UTC()
+		meta.RecordCount = s.RecordCount()
+	}
+	prev := meta.Deleted
+	i, found := slices.BinarySearch(prev, off)
+	switch {
+	case deleted && !found:
+		meta.Deleted = slices.Insert(slices.Clone(prev), i, off)
+	case !deleted && found:
+		meta.Deleted = slices.Delete(slices.Clone(prev), i, i+1)
+	default:
+		return nil // Ya estaba como se pide
+	}
+	if err := writeSegmentMeta(s.metaPath(), meta, s.config.Segment.Options.fileMode()); err != nil {
+		meta.Deleted = prev
+		return err
+	}
+	s.meta = meta
+	return nil
+}
+
+// deletedOffsets devuelve los offsets del segmento borrados con Delete.
+func (s *Segment) deletedOffsets() []uint64 {
+	if s.meta == nil {
+		return nil
+	}
+	return s.meta.Deleted
+}
+
+// CreatedAt devuelve cuándo se creó el segmento, según su archivo .meta, que no
+// cambia al cerrar y reabrir el segmento como el mtime de sus archivos. Los
+// segmentos creados antes de que existiera ese archivo usan el timestamp de su
+// primer registro, o el tiempo cero si están vacíos.
+func (s *Segment) CreatedAt() time.Time {
+	if s.meta == nil {
+		t, _ := s.OldestRecordTime()
+		return t
+	}
+	return s.meta.CreatedAt
+}
+
+// OldestRecordTime devuelve el timestamp del primer registro del segmento, o el
+// tiempo cero si está vacío.
+func (s *Segment) OldestRecordTime() (time.Time, error) {
+	return s.recordTime(0)
+}
+
+// NewestRecordTime devuelve el timestamp del último registro del segmento, o el
+// tiempo cero si está vacío.
+func (s *Segment) NewestRecordTime() (time.Time, error) {
+	return s.recordTime(-1)
+}
+
+// recordTime devuelve el timestamp del registro de la entrada i del índice;
+// con i negativo, el del último.
+func (s *Segment) recordTime(i int) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return time.Time{}, errSegmentClosed
+	}
+	n := int(s.RecordCount())
+	if n == 0 {
+		return time.Time{}, nil
+	}
+	if i < 0 {
+		i = n - 1
+	}
+	ts, _, err := s.entryTimestamp(i)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ts), nil
+}
+
+// tooOld indica si el segmento tiene registros y pasó maxAge desde que se creó.
+func (s *Segment) tooOld(maxAge time.Duration, now time.Time) bool {
+	if maxAge <= 0 || s.RecordCount() == 0 {
+		return false
+	}
+	return now.Sub(s.CreatedAt()) >= maxAge
+}
@@ -0,0 +1,119 @@
+package log
+
+// Este archivo deduplica los reintentos de los productores. Cada registro con
+// ProducerId lleva un SequenceNumber creciente y el log recuerda los últimos de
+// cada productor, así un reintento no escribe el registro dos veces.
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	api "github.com/dati/api/v1"
+)
+
+// ErrUnknownSequence indica que un productor reintentó un sequence anterior al
+// último que el log no recuerda: lo saltó o quedó fuera de producerWindow.
+var ErrUnknownSequence = errors.New("log: producer sequence not found")
+
+// producerWindow es cuántos de sus últimos sequence recuerda el log de cada
+// productor. Un reintento más viejo retorna ErrUnknownSequence en vez de buscar
+// el registro en el log, que con el lock de escritura tomado frenaría a todos
+// los Append.
+const producerWindow = 32
+
+// producerSeq es un sequence escrito por un productor y su offset.
+type producerSeq struct {
+	Seq int64  `json:"seq"`
+	Off uint64 `json:"off"`
+}
+
+// producerSnapshot es la foto de los últimos sequence de cada productor al final
+// de un segmento sellado, que roll guarda en su archivo .meta. Al abrir el log
+// se parte de la última foto en vez de recorrer todos los segmentos.
+type producerSnapshot struct {
+	NextOffset uint64                   `json:"nextOffset"` // Offset siguiente al último registro del segmento
+	Producers  map[string][]producerSeq `json:"producers"`
+}
+
+// trackProducer registra que el registro de un productor quedó en off. Quien lo
+// llama debe tener el lock de escritura.
+func (l *Log) trackProducer(record *api.Record, off uint64) {
+	if record.ProducerId == "" {
+		return // Registro sin productor, no se deduplica
+	}
+	window := l.producers[record.ProducerId]
+	if n := len(window); n > 0 && record.SequenceNumber <= window[n-1].Seq {
+		return
+	}
+	if len(window) == producerWindow {
+		window = append(window[:0], window[1:]...) // Olvida el más viejo
+	}
+	l.producers[record.ProducerId] = append(window, producerSeq{Seq: record.SequenceNumber, Off: off})
+}
+
+// duplicate indica si record es un reintento de un sequence ya escrito y, si lo
+// es, devuelve el offset donde quedó. Quien lo llama debe tener el lock de escritura.
+func (l *Log) duplicate(record *api.Record) (uint64, bool, error) {
+	if record.ProducerId == "" {
+		return 0, false, nil
+	}
+	window := l.producers[record.ProducerId]
+	if len(window) == 0 || record.SequenceNumber > window[len(window)-1].Seq {
+		return 0, false, nil // Sequence nuevo
+	}
+	i, found := slices.BinarySearchFunc(window, record.SequenceNumber, func(p producerSeq, seq int64) int {
+		return cmp.Compare(p.Seq, seq)
+	})
+	if !found {
+		return 0, true, fmt.Errorf("%w: producer %q sequence %d", ErrUnknownSequence, record.ProducerId, record.SequenceNumber)
+	}
+	off := window[i].Off
+	record.Offset = off
+	l.logger.Debug("duplicate record skipped",
+		slog.String("producer", record.ProducerId),
+		slog.Uint64("offset", off),
+	)
+	return off, true, nil
+}
+
+// cloneProducers copia las ventanas de cada productor, que trackProducer
+// modifica en el lugar.
+func cloneProducers(producers map[string][]producerSeq) map[string][]producerSeq {
+	c := make(map[string][]producerSeq, len(producers))
+	for id, window := range producers {
+		c[id] = slices.Clone(window)
+	}
+	return c
+}
+
+// saveProducers guarda en el archivo .meta del segmento la foto de producers al
+// final del segmento. Los segmentos sin .meta se dejan así y se recorren al abrir.
+func (s *Segment) saveProducers(producers map[string][]producerSeq) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSegmentClosed
+	}
+	if s.meta == nil {
+		return nil
+	}
+	prev := s.meta.Producers
+	s.meta.Producers = &producerSnapshot{NextOffset: s.nextOffset, Producers: cloneProducers(producers)}
+	if err := writeSegmentMeta(s.metaPath(), s.meta, s.config.Segment.Options.fileMode()); err != nil {
+		s.meta.Producers = prev
+		return err
+	}
+	return nil
+}
+
+// loadProducers devuelve una copia de la foto de productores del segmento, o nil
+// si no tiene o si no corresponde a sus registros actuales.
+func (s *Segment) loadProducers() map[string][]producerSeq {
+	if s.meta == nil || s.meta.Producers == nil || s.meta.Producers.NextOffset != s.nextOffset {
+		return nil
+	}
+	return cloneProducers(s.meta.Producers.Producers)
+}
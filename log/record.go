@@ -0,0 +1,49 @@
+package log
+
+// Este archivo decodifica flujos de registros con el formato de Log.Reader,
+// para poder importar en un log lo que otro log exporta con Reader.
+
+import (
+	"bufio"
+	"io"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// RecordReader lee registros de un flujo con prefijos de longitud de lenWidth bytes
+// seguidos del registro serializado con proto, el formato que produce Log.Reader.
+type RecordReader struct {
+	r   *bufio.Reader // Lector con buffer sobre el flujo de origen
+	buf []byte        // Buffer reutilizado para los registros serializados
+}
+
+// NewRecordReader crea un RecordReader que lee del flujo dado.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReader(r)}
+}
+
+// Read devuelve el siguiente registro del flujo. Retorna io.EOF cuando el flujo
+// termina justo entre dos registros e io.ErrUnexpectedEOF si termina a mitad de uno.
+func (rr *RecordReader) Read() (*api.Record, error) {
+	var size [lenWidth]byte
+	if _, err := io.ReadFull(rr.r, size[:]); err != nil {
+		return nil, err // io.EOF si no había más datos, io.ErrUnexpectedEOF si el prefijo está incompleto
+	}
+	n := enc.Uint64(size[:])
+	if uint64(cap(rr.buf)) < n {
+		rr.buf = make([]byte, n) // Agranda el buffer sólo cuando el registro no cabe
+	}
+	rr.buf = rr.buf[:n]
+	if _, err := io.ReadFull(rr.r, rr.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // El prefijo prometía más bytes de los que llegaron
+		}
+		return nil, err
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(rr.buf, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
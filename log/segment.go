@@ -4,34 +4,163 @@ package log
 // registros) y un Index (índice de posiciones).
 
 import (
+	"bufio"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	api "github.com/dati/api/v1"
+	"github.com/tysonmote/gommap"
 
 	"google.golang.org/protobuf/proto"
 )
 
-// segment representa un segmento del log, que contiene un store y un índice.
-type segment struct {
+// Segment representa un segmento del log, que contiene un store y un índice.
+type Segment struct {
+	// mu protege el mapeo del índice y nextOffset: Append y los cambios de
+	// estado lo toman para escribir y las lecturas para leer, así leer un
+	// segmento no espera a los demás.
+	mu sync.RWMutex
+
 	store                  *Store // Almacena los registros
 	index                  *index // Índice para buscar registros en el store
 	baseOffset, nextOffset uint64 // Offsets base y siguiente del segmento
 	config                 Config // Configuración del segmento
+	dir                    string // Ruta absoluta del directorio de los archivos
+
+	aead   cipher.AEAD  // Cifra los registros si el segmento tiene clave; nil si no
+	sealed bool         // Indica que el segmento ya no acepta escrituras
+	meta   *segmentMeta // Contenido del archivo .meta; nil si el segmento no lo tiene
+	closed bool         // Indica que Close o Remove ya cerraron los archivos
+	wal    *wal         // WAL de las escrituras con Config.Segment.EnableWAL; nil si no
 }
 
+// ErrSealed indica que se intentó escribir en un segmento sellado.
+var ErrSealed = errors.New("log: segment is sealed")
+
+// ErrSegmentSealed es otro nombre de ErrSealed; los dos son el mismo error.
+var ErrSegmentSealed = ErrSealed
+
+// maxRelativeOffset es el mayor offset relativo que guarda una entrada del
+// índice, así que un segmento tiene a lo sumo 2^32 registros sin importar
+// MaxIndexBytes y MaxStoreBytes.
+const maxRelativeOffset = math.MaxUint32
+
+// ErrSegmentFull indica que el registro no cabe en el segmento sin pasar de
+// MaxStoreBytes o MaxIndexBytes; el log lo escribe en un segmento nuevo.
+var ErrSegmentFull = errors.New("log: segment is full")
+
+// errSegmentClosed indica que el segmento se cerró entre que el log lo eligió y
+// la lectura, porque Truncate lo borró o una compactación lo reemplazó. El log
+// vuelve a buscar el segmento del offset y, si encuentra el mismo, retorna este
+// error.
+var errSegmentClosed = errors.New("log: segment is closed")
+
+// ErrIndexFull indica que el índice de un segmento vacío no tiene lugar ni para
+// una entrada, porque MaxIndexBytes es menor que el tamaño de una entrada.
+var ErrIndexFull = errors.New("log: index is full")
+
+// ErrCorruptStore indica que el store de un segmento tiene un registro que no se
+// puede leer.
+var ErrCorruptStore = errors.New("log: corrupt store")
+
+// StopScan es el error que fn puede retornar para que Scan termine antes de
+// recorrer todo el segmento; Scan lo descarta y retorna nil.
+var StopScan = errors.New("log: stop scan")
+
 // Newsegment crea un nuevo segmento en el directorio especificado con el offset base y configuración dados.
-func NewSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
-	s := &segment{
+func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
+	return newSegment(dir, baseOffset, c, false)
+}
+
+// openSealedSegment abre desde el disco un segmento que ya no va a recibir
+// escrituras. El índice se mapea de solo lectura a su tamaño real y el store no
+// se reserva, y el segmento queda sellado.
+func openSealedSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
+	return newSegment(dir, baseOffset, c, true)
+}
+
+func newSegment(dir string, baseOffset uint64, c Config, sealed bool) (_ *Segment, err error) {
+	dir, err = filepath.Abs(dir) // Guarda la ruta absoluta para ubicar el segmento entre varios discos
+	if err != nil {
+		return nil, err
+	}
+	s := &Segment{
 		baseOffset: baseOffset, // Asigna el offset base
 		config:     c,          // Asigna la configuración
+		dir:        dir,
+	}
+	var storeFile, indexFile *os.File
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Cierra lo que se abrió; el índice se recorta a sus entradas, así no
+		// queda agrandado con lugar sin usar para la próxima apertura.
+		if s.index != nil {
+			s.index.Close()
+		} else if indexFile != nil {
+			indexFile.Close()
+		}
+		if s.store != nil {
+			s.store.Close()
+		} else if storeFile != nil {
+			storeFile.Close()
+		}
+	}()
+	opts := c.Segment.Options
+	if err = opts.validate(); err != nil {
+		return nil, err
+	}
+	if s.aead, err = newSegmentAEAD(c.Segment.EncryptionKey, baseOffset); err != nil {
+		return nil, err // Retorna error si la clave no es válida
+	}
+	name := segmentName(dir, baseOffset) // Nombre base de los archivos del segmento
+	metaPath := path.Join(dir, name+".meta")
+	if _, err = os.Stat(path.Join(dir, name+".store")); os.IsNotExist(err) {
+		if err = createSegmentFiles(dir, name, opts.fileMode()); err != nil {
+			return nil, err // Retorna error si no puede crear los archivos del segmento
+		}
+		s.meta = newSegmentMeta(baseOffset, c)
+		if err = writeSegmentMeta(metaPath, s.meta, opts.fileMode()); err != nil {
+			return nil, err // Retorna error si no puede escribir los metadatos
+		}
+	} else {
+		if s.meta, err = readSegmentMeta(metaPath); err != nil {
+			return nil, err // Retorna error si los metadatos están corruptos
+		}
+		_, err = checkSegmentIntegrity(dir, name, baseOffset, c.Segment.EncryptionKey)
+		var corrupt ErrSegmentCorrupt
+		rebuild := errors.As(err, &corrupt) && corrupt.index && c.Segment.RebuildIndexOnError
+		if err != nil && !rebuild {
+			return nil, err // Retorna error si el store o el índice cambiaron desde que se cerró
+		}
+		if !sealed || rebuild {
+			// El segmento va a recibir escrituras o se le reconstruye el índice;
+			// al cerrarlo sellado se vuelve a escribir.
+			if err = os.Remove(path.Join(dir, name+".integrity")); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	flags := opts.storeFlags() // Por defecto lectura/escritura, creación y al final
+	if c.Segment.PreallocateStore {
+		flags &^= os.O_APPEND // Con la cola reservada se escribe en la posición lógica, no al final
 	}
-	var err error
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), // Crea el archivo store
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,                         // Abre el archivo con permisos de lectura/escritura y creación
-		0644,                                                      // Permisos del archivo
+	storeFile, err = os.OpenFile(
+		path.Join(dir, name+".store"), // Crea el archivo store
+		flags,
+		opts.fileMode(), // Permisos del archivo
 	)
 	if err != nil {
 		return nil, err // Retorna error si falla
@@ -39,80 +168,917 @@ func NewSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err // Retorna error si falla al crear el store
 	}
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), // Crea el archivo índice
-		os.O_RDWR|os.O_CREATE,                                     // Abre el archivo con permisos de lectura/escritura y creación
-		0644,                                                      // Permisos del archivo
+	s.store.flags = flags
+	indexFile, err = os.OpenFile(
+		path.Join(dir, name+".index"), // Crea el archivo índice
+		opts.indexFlags(),             // Por defecto lectura/escritura y creación
+		opts.fileMode(),               // Permisos del archivo
 	)
 	if err != nil {
 		return nil, err // Retorna error si falla
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
-		return nil, err // Retorna error si falla al crear el índice
+	openIndex := func(f *os.File) (*index, error) { return newIndex(f, c) }
+	if sealed {
+		openIndex = newReadOnlyIndex
+	}
+	if s.index, err = openIndex(indexFile); err != nil {
+		if !errors.Is(err, ErrCorruptIndex) || !c.Segment.RebuildIndexOnError {
+			return nil, err // Retorna error si falla al crear el índice
+		}
+		if err = indexFile.Truncate(0); err != nil { // Descarta el índice corrupto
+			return nil, err
+		}
+		if s.index, err = newIndex(indexFile, c); err != nil {
+			return nil, err
+		}
+	}
+	if c.Segment.PreallocateStore {
+		if err = s.recoverStoreSize(); err != nil {
+			return nil, err // Retorna error si no puede encontrar el fin de los datos
+		}
+	}
+	if !sealed {
+		// Aunque EnableWAL esté apagado: el WAL puede ser de cuando estaba prendido
+		if err = s.recoverWAL(); err != nil {
+			return nil, err // Retorna error si no puede rehacer el registro sin confirmar
+		}
+	}
+	if err = s.checkIndex(); err != nil {
+		if !c.Segment.RebuildIndexOnError {
+			return nil, err // Retorna error si el índice no coincide con el store
+		}
+		if err = s.index.unseal(c.Segment.MaxIndexBytes); err != nil {
+			return nil, err // Retorna error si no puede mapear el índice para reescribirlo
+		}
+		if err = s.RebuildIndex(); err != nil {
+			return nil, err // Retorna error si falla la reconstrucción
+		}
+	}
+	if err = s.recoverTail(); err != nil {
+		return nil, err // Retorna error si no puede descartar un registro huérfano
 	}
 	if off, _, err := s.index.Read(-1); err != nil {
 		s.nextOffset = baseOffset // Asigna el offset base si falla la lectura del índice
 	} else {
 		s.nextOffset = baseOffset + uint64(off) + 1 // Calcula el siguiente offset
 	}
+	if c.Segment.VerifyOnOpen {
+		if err = s.Verify(); err != nil {
+			return nil, fmt.Errorf("segment %s: %w", path.Join(dir, name), err)
+		}
+	}
+	if sealed || !c.Segment.EnableWAL {
+		// El WAL ya se recuperó o, si el segmento se selló, sólo tiene
+		// registros confirmados.
+		if err = os.Remove(s.walPath()); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if sealed {
+		if err = s.Seal(); err != nil {
+			return nil, err // Retorna error si no puede sellar el segmento
+		}
+		return s, nil
+	}
+	if c.Segment.PreallocateStore {
+		if err = s.store.preallocate(c.Segment.MaxStoreBytes); err != nil {
+			return nil, err // Retorna error si no puede reservar el archivo
+		}
+	}
+	if c.Segment.EnableWAL {
+		if s.wal, err = openWAL(s.walPath(), opts.fileMode()); err != nil {
+			return nil, err // Retorna error si no puede crear el WAL
+		}
+	}
 
 	return s, nil // Retorna el segmento creado
 }
 
+// segmentName devuelve el nombre base (sin extensión) de los archivos del segmento.
+// Los segmentos nuevos usan el offset con ceros a la izquierda hasta 20 dígitos,
+// como Kafka, para que el orden lexicográfico coincida con el numérico. Si ya
+// existe un store con el nombre antiguo sin padding, se sigue usando ese.
+func segmentName(dir string, baseOffset uint64) string {
+	legacy := strconv.FormatUint(baseOffset, 10)
+	if _, err := os.Stat(path.Join(dir, legacy+".store")); err == nil {
+		return legacy
+	}
+	return fmt.Sprintf("%020d", baseOffset)
+}
+
+// parseBaseOffset obtiene el offset base a partir del nombre de un archivo de
+// segmento, con o sin padding de ceros.
+func parseBaseOffset(file string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSuffix(file, path.Ext(file)), 10, 64)
+}
+
+// createSegmentFiles crea los archivos vacíos de un segmento nuevo de forma
+// atómica: primero los crea con sufijo .tmp, luego escribe un manifest que los
+// lista y al final los renombra a su nombre definitivo. Si el proceso muere antes
+// de escribir el manifest, recoverSegmentFiles descarta los .tmp; si muere
+// después, termina los renombrados.
+func createSegmentFiles(dir, name string, perm os.FileMode) error {
+	names := []string{name + ".store", name + ".index"}
+	for _, name := range names {
+		f, err := os.OpenFile(path.Join(dir, name+".tmp"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+	manifest := path.Join(dir, name+".manifest")
+	if err := writeFileAtomic(manifest, []byte(strings.Join(names, "\n")), 0644); err != nil {
+		return err // Sin manifest la creación no cuenta como hecha
+	}
+	return commitManifest(dir, manifest)
+}
+
+// commitManifest renombra a su nombre definitivo los archivos .tmp que lista el
+// manifest y después lo elimina. Es idempotente, así que sirve para terminar una
+// creación que quedó a medias.
+func commitManifest(dir, manifest string) error {
+	b, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(string(b), "\n") {
+		err := os.Rename(path.Join(dir, name+".tmp"), path.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) { // Si no existe, ya se había renombrado
+			return err
+		}
+	}
+	return os.Remove(manifest)
+}
+
+// recoverSegmentFiles deja el directorio consistente tras una caída durante la
+// creación de un segmento: completa los manifests pendientes y borra los
+// archivos .tmp que no alcanzaron a confirmarse.
+func recoverSegmentFiles(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if path.Ext(file.Name()) == ".manifest" {
+			if err = commitManifest(dir, path.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	files, err = os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if isTempFile(file.Name()) {
+			if err = os.Remove(path.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tempSuffixes son las extensiones de los archivos intermedios que escriben la
+// creación de segmentos, las compactaciones y las reescrituras antes de
+// renombrarlos. Uno que sigue en el directorio al arrancar quedó de una caída.
+var tempSuffixes = []string{".tmp", ".swap"}
+
+// isTempFile indica si name es un archivo intermedio según tempSuffixes.
+func isTempFile(name string) bool {
+	for _, suffix := range tempSuffixes {
+		if path.Ext(name) == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileAtomic escribe data en un archivo .tmp con permisos perm, lo
+// sincroniza a disco y lo renombra a name, así nunca queda un archivo escrito a
+// medias.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// recoverStoreSize calcula el tamaño lógico de un store reservado de antemano,
+// cuyo archivo termina en una cola de ceros. Recorre los prefijos de longitud desde
+// el último registro del índice, o desde el inicio si el índice está vacío, hasta
+// encontrar un prefijo en cero o un registro que no cabe en el archivo. Por eso un
+// registro serializado en cero bytes no puede ser el último de un store reservado.
+func (s *Segment) recoverStoreSize() error {
+	fileSize := s.store.size
+	pos := s.store.start
+	if _, last, err := s.index.Read(-1); err == nil && last < fileSize {
+		pos = last // Los registros anteriores ya están en el índice
+	}
+	frame := s.store.frameWidth()
+	size := make([]byte, lenWidth)
+	for pos+frame <= fileSize {
+		if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+			return err
+		}
+		n := enc.Uint64(size)
+		if n == 0 || pos+frame+n > fileSize {
+			break // Empieza la cola reservada o un registro escrito a medias
+		}
+		pos += frame + n
+	}
+	s.store.size = pos
+	return nil
+}
+
+// recoverTail descarta los bytes del store que siguen al último registro del
+// índice. Quedan ahí si el proceso cayó después de escribir un registro en el
+// store y antes de registrarlo en el índice; sin descartarlos, el siguiente
+// Append escribiría detrás de ellos y Reader y Verify verían un registro que el
+// índice no conoce. Un índice vacío lo valida checkIndex.
+func (s *Segment) recoverTail() error {
+	_, pos, err := s.index.Read(-1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+		return err
+	}
+	end := pos + s.store.frameWidth() + enc.Uint64(size) // Fin del último registro indexado
+	if end >= s.store.size {
+		return nil // No hay bytes huérfanos; si falta parte del registro lo detecta Verify
+	}
+	return s.store.Truncate(end)
+}
+
+// checkIndex verifica que el índice sea consistente con el store: un índice vacío
+// solo es válido si el store también lo está, y la última entrada debe apuntar
+// dentro del store.
+func (s *Segment) checkIndex() error {
+	rel, pos, err := s.index.Read(-1)
+	if err == nil && s.index.size == entWidth && rel == 0 && pos == 0 && s.store.size == s.store.start {
+		// Con el store vacío, la primera entrada en cero es lugar sin usar
+		// de un índice que no se recortó al cerrarlo.
+		s.index.size = 0
+		err = io.EOF
+	}
+	if err == io.EOF {
+		if s.store.size > s.store.start {
+			return fmt.Errorf("%w: empty index for a store of %d bytes", ErrCorruptIndex, s.store.size)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pos < s.store.start || pos+s.store.frameWidth() > s.store.size {
+		return fmt.Errorf("%w: position %d is past the end of the store", ErrCorruptIndex, pos)
+	}
+	return nil
+}
+
+// RebuildIndex regenera el índice recorriendo el store de forma secuencial con
+// los prefijos de longitud de cada registro. Los datos del store no se modifican.
+// El índice de un segmento sellado está mapeado de solo lectura, así que en ese
+// caso retorna ErrSealed. Si falla, el índice queda como estaba.
+func (s *Segment) RebuildIndex() error {
+	s.mu.Lock() // Cambia las entradas del índice y nextOffset
+	defer s.mu.Unlock()
+	switch {
+	case s.closed:
+		return errSegmentClosed
+	case s.sealed:
+		return ErrSealed
+	case s.index.readOnly:
+		return ErrReadOnlyIndex
+	}
+	var positions []uint64 // Posición de cada registro completo del store
+	size := make([]byte, lenWidth)
+	for pos := s.store.start; pos < s.store.size; {
+		if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+			return err // Retorna error si no puede leer el prefijo de longitud
+		}
+		next := pos + s.store.frameWidth() + enc.Uint64(size) // Posición del siguiente registro
+		if next > s.store.size {
+			break // Ignora un último registro escrito a medias
+		}
+		positions = append(positions, pos)
+		pos = next
+	}
+	// Se hace lugar antes de tocar las entradas, así un error no las deja a medias.
+	need := uint64(len(positions)) * entWidth
+	if need > s.index.maxBytes {
+		return io.EOF // El índice no tiene espacio para todos los registros
+	}
+	for uint64(len(s.index.mmap)) < indexHeaderWidth+need {
+		if err := s.index.grow(); err != nil {
+			return err
+		}
+	}
+	s.index.size = 0 // Descarta las entradas existentes
+	for off, pos := range positions {
+		if err := s.index.Write(uint32(off), pos); err != nil {
+			return err // No pasa: el mapeo ya tiene lugar para todas
+		}
+	}
+	s.nextOffset = s.baseOffset + uint64(len(positions))
+	return s.index.mmap.Sync(gommap.MS_SYNC) // Persiste el índice reconstruido
+}
+
+// ErrOffsetGap indica que un registro replicado trae un offset mayor al siguiente
+// del segmento, así que faltan registros intermedios.
+type ErrOffsetGap struct {
+	Want, Got uint64 // Offset esperado y offset recibido
+}
+
+func (e ErrOffsetGap) Error() string {
+	return fmt.Sprintf("log: offset gap: got %d, want %d", e.Got, e.Want)
+}
+
+// ErrDuplicateOffset indica que un registro replicado trae un offset que el
+// segmento ya tiene.
+type ErrDuplicateOffset struct {
+	Want, Got uint64 // Offset esperado y offset recibido
+}
+
+func (e ErrDuplicateOffset) Error() string {
+	return fmt.Sprintf("log: duplicate offset: got %d, want %d", e.Got, e.Want)
+}
+
 // Append agrega un nuevo registro al segmento.
-func (s *segment) Append(record *api.Record) (uint64, error) {
+func (s *Segment) Append(record *api.Record) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	current_offset := s.nextOffset // Asigna el offset actual
 	record.Offset = current_offset // Asigna el offset al registro
+	if err := s.write(record); err != nil {
+		return 0, err // Retorna error si falla
+	}
+	return current_offset, nil // Retorna el offset actual
+}
 
+// AppendWithOffset agrega un registro conservando el offset que ya trae, como
+// hace un follower al replicar los registros del líder. El offset debe ser el
+// siguiente del segmento; si no, retorna ErrOffsetGap o ErrDuplicateOffset.
+func (s *Segment) AppendWithOffset(record *api.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case record.Offset > s.nextOffset:
+		return ErrOffsetGap{Want: s.nextOffset, Got: record.Offset}
+	case record.Offset < s.nextOffset:
+		return ErrDuplicateOffset{Want: s.nextOffset, Got: record.Offset}
+	}
+	return s.write(record)
+}
+
+// write guarda el registro, que ya tiene el offset s.nextOffset, en el store y
+// el índice. Con el WAL lo guarda antes ahí y, si falla, lo quita.
+func (s *Segment) write(record *api.Record) (err error) {
+	if s.sealed {
+		return ErrSealed // Los segmentos sellados son de solo lectura
+	}
 	value, err := proto.Marshal(record) // Serializa el registro
 	if err != nil {
-		return 0, err // Retorna error si falla
+		return err // Retorna error si falla
+	}
+	if value, err = sealRecord(s.aead, record.Offset, value); err != nil {
+		return err // Retorna error si falla el cifrado
+	}
+	if s.nextOffset-s.baseOffset > maxRelativeOffset {
+		return ErrSegmentFull // El offset relativo no entra en los 4 bytes de la entrada; el log rota
+	}
+	if !s.fits(uint64(len(value))) {
+		return ErrSegmentFull // Se revisa antes de escribir para no pasar de los límites
+	}
+	if !s.index.hasRoom() {
+		// Un segmento vacío acepta cualquier registro, pero su índice igual
+		// necesita lugar para la entrada; con otro segmento pasaría lo mismo.
+		return fmt.Errorf("%w: MaxIndexBytes is %d, an entry takes %d bytes",
+			ErrIndexFull, s.index.maxBytes, entWidth)
+	}
+
+	rel := uint32(s.nextOffset - s.baseOffset) // Calcula el offset relativo
+	if s.wal != nil {
+		if err = s.wal.begin(rel, value); err != nil {
+			return err // Sin el registro en el WAL no se escribe
+		}
+		defer func() {
+			if err != nil {
+				if rerr := s.wal.rollback(); rerr != nil {
+					err = errors.Join(err, fmt.Errorf("roll back WAL: %w", rerr))
+				}
+				return
+			}
+			// Si la marca no llega al WAL, al reabrir se encuentra el registro
+			// escrito y no se rehace, así que su error no importa.
+			s.wal.commit(rel)
+		}()
 	}
 
 	_, pos, err := s.store.Append(value) // Agrega el valor serializado al store
 	if err != nil {
-		return 0, err // Retorna error si falla
+		return err // Retorna error si falla
 	}
-	if err = s.index.Write(
-		uint32(s.nextOffset-uint64(s.baseOffset)), // Calcula el offset relativo
-		pos, // Posición en el store
-	); err != nil {
-		return 0, err // Retorna error si falla
+	if s.config.Segment.SyncOnAppend {
+		// El registro llega a disco antes que su entrada: si el proceso cae
+		// entre las dos escrituras queda un registro sin indexar, que
+		// recoverTail descarta al reabrir, y nunca una entrada sin registro.
+		if err = s.store.Sync(); err != nil {
+			if rerr := s.store.Truncate(pos); rerr != nil {
+				return errors.Join(err, fmt.Errorf("roll back store: %w", rerr))
+			}
+			return err
+		}
+	} else if s.wal != nil {
+		// El registro llega al archivo antes que su entrada, así una caída del
+		// proceso nunca deja una entrada sin registro en el store.
+		if err = s.store.Flush(); err != nil {
+			if rerr := s.store.Truncate(pos); rerr != nil {
+				return errors.Join(err, fmt.Errorf("roll back store: %w", rerr))
+			}
+			return err
+		}
+	}
+	if err = s.index.Write(rel, pos); err != nil {
+		// Sin la entrada del índice el registro no existe: se saca del store
+		// para que el próximo Append no quede detrás de bytes huérfanos.
+		if rerr := s.store.Truncate(pos); rerr != nil {
+			return errors.Join(err, fmt.Errorf("roll back store: %w", rerr))
+		}
+		return err // Retorna error si falla
 	}
 
-	s.nextOffset++             // Incrementa el siguiente offset
-	return current_offset, nil // Retorna el offset actual
+	s.nextOffset++ // Incrementa el siguiente offset
+	if s.config.Segment.SyncOnAppend {
+		return s.index.mmap.Sync(gommap.MS_SYNC) // El registro ya está escrito; sólo falta llevar la entrada a disco
+	}
+	return nil
 }
 
-// Read lee un registro del segmento basado en el offset.
-func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset)) // Lee la posición desde el índice
+// Read lee un registro del segmento basado en el offset. Si el offset está en
+// el rango del segmento pero una compactación quitó su registro, retorna
+// api.ErrRecordDeleted; si está fuera del rango [baseOffset, nextOffset),
+// retorna api.ErrOffsetOutOfRange.
+func (s *Segment) Read(off uint64) (*api.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, errSegmentClosed
+	}
+	pos, err := s.position(off) // Lee la posición desde el índice
 	if err != nil {
 		return nil, err // Retorna error si falla
 	}
-	record := &api.Record{}              // Crea un nuevo registro
-	record.Offset = off                  // Asigna el offset al registro
 	temp_value, err := s.store.Read(pos) // Lee el valor desde el store
-
 	if err != nil {
 		return nil, err // Retorna error si falla
 	}
+	return s.decodeIndexed(off, pos, temp_value)
+}
+
+// ReadRange lee hasta limit registros con offset en [start, end), resolviendo
+// sus posiciones con una sola llamada a index.SearchRange. Los offsets que quitó
+// una compactación no aparecen en el resultado.
+func (s *Segment) ReadRange(start, end uint64, limit int) ([]*api.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, errSegmentClosed
+	}
+	start = min(max(start, s.baseOffset), s.nextOffset) // Recorta el rango al del segmento
+	end = min(max(end, start), s.nextOffset)
+	entries, err := s.index.SearchRange(uint32(start-s.baseOffset), uint32(end-s.baseOffset))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	records := make([]*api.Record, 0, len(entries))
+	for _, entry := range entries {
+		value, err := s.store.Read(entry.Pos)
+		if err != nil {
+			return nil, err
+		}
+		record, err := s.decodeIndexed(s.baseOffset+uint64(entry.RelativeOffset), entry.Pos, value)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// position busca en el índice la posición en el store del registro en off. Sin
+// compactar, la entrada del offset relativo n es la n-ésima; si no coincide, el
+// segmento tiene huecos y se busca por bisección, porque las entradas siguen
+// ordenadas por offset.
+func (s *Segment) position(off uint64) (uint64, error) {
+	if off < s.baseOffset || s.nextOffset <= off {
+		return 0, api.ErrOffsetOutOfRange{Offset: off} // Fuera del segmento; off - baseOffset daría la vuelta
+	}
+	rel := int64(off - s.baseOffset)
+	out, pos, err := s.index.Read(rel)
+	if err == nil && int64(out) == rel {
+		return pos, nil
+	}
+	n := int(s.index.size / entWidth)
+	i := sort.Search(n, func(i int) bool {
+		out, _, _ := s.index.Read(int64(i))
+		return int64(out) >= rel
+	})
+	if i < n {
+		if out, pos, _ = s.index.Read(int64(i)); int64(out) == rel {
+			return pos, nil
+		}
+	}
+	return 0, api.ErrRecordDeleted{Offset: off} // La compactación quitó el registro
+}
+
+// decode descifra y deserializa el valor que el store guarda para off.
+func (s *Segment) decode(off uint64, value []byte) (*api.Record, error) {
+	record, err := s.unmarshal(off, value)
+	if err != nil {
+		return nil, err
+	}
+	record.Offset = off // Asigna el offset al registro
+	return record, nil
+}
+
+// decodeIndexed decodifica el valor que el índice ubicó en pos para off y
+// comprueba que el registro sea ese: cada registro guarda su offset, así una
+// entrada del índice que apunta a otro registro retorna ErrCorruptIndex en vez
+// del registro equivocado.
+func (s *Segment) decodeIndexed(off, pos uint64, value []byte) (*api.Record, error) {
+	record, err := s.unmarshal(off, value)
+	if err != nil {
+		return nil, err
+	}
+	if record.Offset != off {
+		return nil, fmt.Errorf("%w: offset %d: index points at position %d, which holds offset %d",
+			ErrCorruptIndex, off, pos, record.Offset)
+	}
+	return record, nil
+}
 
-	if err = proto.Unmarshal(temp_value, record); err != nil {
+// unmarshal descifra, descomprime y deserializa el valor que el store guarda
+// para off, dejando en el registro el offset con el que se escribió.
+func (s *Segment) unmarshal(off uint64, value []byte) (*api.Record, error) {
+	value, err := openRecord(s.aead, off, value)
+	if err != nil {
+		return nil, err // Retorna error si el registro no se puede descifrar
+	}
+	if value, err = decompressRecord(off, value); err != nil {
+		return nil, err // Retorna error si el registro no se puede descomprimir
+	}
+	record := &api.Record{}
+	if err = proto.Unmarshal(value, record); err != nil {
 		return nil, err // Retorna error si falla la deserialización
 	}
+	return record, nil
+}
+
+// Scan recorre los registros del segmento en orden leyendo el store de forma
+// secuencial desde el inicio, y llama a fn con cada uno. Del índice sólo toma los
+// offsets, que pueden tener huecos si el segmento se compactó.
+// Vacía primero el buffer del store para ver todo lo escrito. Se detiene en el
+// primer error de fn y lo retorna, salvo StopScan, con el que retorna nil.
+func (s *Segment) Scan(fn func(record *api.Record) error) error {
+	// Los registros en el buffer también se recorren y los agregados durante
+	// el recorrido se ignoran.
+	size, err := s.store.flushedSize()
+	if err != nil {
+		return err
+	}
+	start := s.store.start
+	r := bufio.NewReader(io.NewSectionReader(s.store.File, int64(start), int64(size-start)))
+	prefix := make([]byte, s.store.frameWidth())
+	var value []byte
+	for i, off, pos := int64(0), s.baseOffset, start; ; i, off = i+1, off+1 {
+		if rel, _, err := s.index.Read(i); err == nil {
+			off = s.baseOffset + uint64(rel) // En un segmento compactado los offsets tienen huecos
+		}
+		if _, err := io.ReadFull(r, prefix); err == io.EOF {
+			return nil // Terminó justo al final del último registro
+		} else if err != nil {
+			return fmt.Errorf("log: scan record %d: %w", off, err)
+		}
+		n := enc.Uint64(prefix)
+		if uint64(cap(value)) < n {
+			value = make([]byte, n) // Reutiliza el buffer mientras el registro quepa
+		}
+		value = value[:n]
+		if _, err := io.ReadFull(r, value); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF // El prefijo prometía más bytes de los que hay
+			}
+			return fmt.Errorf("log: scan record %d: %w", off, err)
+		}
+		if err := s.store.checkRecord(pos, prefix, value); err != nil {
+			return fmt.Errorf("log: scan record %d: %w", off, err)
+		}
+		pos += uint64(len(prefix)) + n
+		record, err := s.decode(off, value)
+		if err != nil {
+			return fmt.Errorf("log: scan record %d: %w", off, err)
+		}
+		if err := fn(record); err == StopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Verify recorre el store completo y comprueba que cada prefijo de longitud
+// quede dentro del archivo, que cada registro se descifre y deserialice, que su
+// offset sea el que indica el índice y que la entrada del índice apunte a la
+// posición donde empieza. El error nombra el offset del primer registro corrupto
+// y envuelve ErrCorruptStore o ErrCorruptIndex.
+func (s *Segment) Verify() error {
+	size, err := s.store.flushedSize()
+	if err != nil {
+		return err
+	}
+	entries := int64(s.index.size / entWidth)
+	frame := s.store.frameWidth()
+	prefix := make([]byte, frame)
+	pos := s.store.start
+	var i int64
+	for ; pos < size; i++ {
+		off := s.baseOffset + uint64(i) // Offset esperado si el segmento no tiene huecos
+		rel, indexPos, err := s.index.Read(i)
+		if err == nil {
+			off = s.baseOffset + uint64(rel)
+		}
+		if pos+frame > size {
+			return fmt.Errorf("%w: offset %d: length prefix at position %d is past the end of the store", ErrCorruptStore, off, pos)
+		}
+		if _, err := s.store.ReadAt(prefix, int64(pos)); err != nil {
+			return err
+		}
+		n := enc.Uint64(prefix)
+		if n > size-pos-frame {
+			return fmt.Errorf("%w: offset %d: record at position %d has length %d, past the end of the store", ErrCorruptStore, off, pos, n)
+		}
+		if i >= entries {
+			return fmt.Errorf("%w: offset %d: record at position %d has no index entry", ErrCorruptIndex, off, pos)
+		}
+		if indexPos != pos {
+			return fmt.Errorf("%w: offset %d: index points at position %d, record starts at %d", ErrCorruptIndex, off, indexPos, pos)
+		}
+		if i > 0 {
+			if prev, _, _ := s.index.Read(i - 1); prev >= rel {
+				return fmt.Errorf("%w: offset %d: index offsets are not increasing", ErrCorruptIndex, off)
+			}
+		}
+		value := make([]byte, n)
+		if _, err := s.store.ReadAt(value, int64(pos+frame)); err != nil {
+			return err
+		}
+		if err := s.store.checkRecord(pos, prefix, value); err != nil {
+			return fmt.Errorf("%w: offset %d: %v", ErrCorruptStore, off, err)
+		}
+		if value, err = openRecord(s.aead, off, value); err != nil {
+			return fmt.Errorf("%w: offset %d: %v", ErrCorruptStore, off, err)
+		}
+		if value, err = decompressRecord(off, value); err != nil {
+			return fmt.Errorf("%w: offset %d: %v", ErrCorruptStore, off, err)
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(value, record); err != nil {
+			return fmt.Errorf("%w: offset %d: %v", ErrCorruptStore, off, err)
+		}
+		if record.Offset != off { // Append guarda el offset dentro del registro
+			return fmt.Errorf("%w: offset %d: record says offset %d", ErrCorruptStore, off, record.Offset)
+		}
+		pos += frame + n
+	}
+	if i < entries {
+		return fmt.Errorf("%w: %d index entries for %d records", ErrCorruptIndex, entries, i)
+	}
+	return nil
+}
+
+// rewrite escribe en archivos .tmp una copia del segmento pasando el valor
+// guardado de cada registro por fn, que devuelve el valor a escribir o false para
+// descartar el registro. Los offsets se conservan, así que descartar deja huecos.
+// Retorna cuántos registros quedaron; los archivos se confirman con commitRewrite.
+func (s *Segment) rewrite(fn func(off uint64, value []byte) ([]byte, bool, error)) (kept int, err error) {
+	name := strings.TrimSuffix(s.store.Name(), ".store")
+	perm := s.config.Segment.Options.fileMode() // La copia reemplaza a los archivos; conserva sus permisos
+	storeFile, err := os.OpenFile(name+".store.tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return 0, err
+	}
+	store, err := newStore(storeFile)
+	if err != nil {
+		storeFile.Close()
+		return 0, err
+	}
+	defer func() {
+		if cerr := store.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	indexFile, err := os.OpenFile(name+".index.tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return 0, err
+	}
+	index, err := newIndex(indexFile, s.config)
+	if err != nil {
+		indexFile.Close()
+		return 0, err
+	}
+	defer func() {
+		if cerr := index.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for i := int64(0); uint64(i)*entWidth < s.index.size; i++ {
+		rel, pos, err := s.index.Read(i)
+		if err != nil {
+			return 0, err
+		}
+		value, err := s.store.Read(pos)
+		if err != nil {
+			return 0, err
+		}
+		value, keep, err := fn(s.baseOffset+uint64(rel), value)
+		if err != nil {
+			return 0, err
+		}
+		if !keep {
+			continue
+		}
+		if _, pos, err = store.Append(value); err != nil {
+			return 0, err
+		}
+		if err = index.Write(rel, pos); err != nil {
+			return 0, err
+		}
+		kept++
+	}
+	if err = store.Flush(); err != nil {
+		return 0, err
+	}
+	return kept, store.File.Sync() // El índice se sincroniza al cerrarlo
+}
+
+// writeReencrypted escribe con rewrite una copia del segmento con cada registro
+// descifrado con from y cifrado con to.
+func (s *Segment) writeReencrypted(from, to cipher.AEAD) error {
+	_, err := s.rewrite(func(off uint64, value []byte) ([]byte, bool, error) {
+		value, err := openRecord(from, off, value)
+		if err != nil {
+			return nil, false, err // Retorna error si la clave anterior no es la correcta
+		}
+		value, err = sealRecord(to, off, value)
+		return value, true, err
+	})
+	return err
+}
+
+// commitRewrite reemplaza los archivos del segmento por los que escribió rewrite
+// usando un manifest, así una caída a mitad del cambio se completa al abrir el
+// log. El segmento debe estar cerrado.
+func (s *Segment) commitRewrite() error {
+	// La integridad es de los archivos que se reemplazan; se borra antes, así
+	// una caída a mitad del cambio no deja una que no coincide.
+	if err := os.Remove(s.integrityPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	name := path.Base(strings.TrimSuffix(s.store.Name(), ".store"))
+	manifest := path.Join(s.dir, name+".manifest")
+	names := []string{name + ".store", name + ".index"}
+	if err := writeFileAtomic(manifest, []byte(strings.Join(names, "\n")), 0644); err != nil {
+		return err
+	}
+	return commitManifest(s.dir, manifest)
+}
+
+// removeRewrite borra los archivos .tmp que dejó rewrite.
+func (s *Segment) removeRewrite() {
+	name := strings.TrimSuffix(s.store.Name(), ".store")
+	os.Remove(name + ".store.tmp")
+	os.Remove(name + ".index.tmp")
+}
+
+// recoverRewrite deja consistentes los archivos del segmento, ya cerrado,
+// cuando falló commitRewrite o la reapertura posterior: termina el cambio si el
+// manifest llegó a escribirse o descarta la copia si no. Retorna si quedaron los
+// archivos que escribió rewrite.
+func (s *Segment) recoverRewrite() (committed bool, err error) {
+	name := strings.TrimSuffix(s.store.Name(), ".store")
+	if _, err := os.Stat(name + ".manifest"); err == nil {
+		return true, commitManifest(s.dir, name+".manifest")
+	}
+	if _, err := os.Stat(name + ".store.tmp"); err == nil {
+		s.removeRewrite()
+		return false, nil
+	}
+	return true, nil // commitRewrite ya había terminado
+}
+
+// Seal cierra el segmento a escrituras cuando el log rota a uno nuevo: vacía el
+// buffer del store y lo sincroniza a disco, y deja el índice recortado y mapeado
+// en solo lectura, y con Config.Segment.MmapSealed mapea el store. Después
+// Append y AppendWithOffset retornan ErrSealed; las lecturas siguen
+// funcionando. Sellar un segmento ya sellado no hace nada.
+func (s *Segment) Seal() error {
+	s.mu.Lock() // Cambia el mapeo del índice
+	defer s.mu.Unlock()
+	if s.sealed {
+		return nil
+	}
+	if err := s.store.Sync(); err != nil {
+		return err // Retorna error si no puede llevar el store a disco
+	}
+	if err := s.index.seal(); err != nil {
+		return err // Retorna error si no puede dejar el índice de solo lectura
+	}
+	if err := s.updateMeta(); err != nil {
+		return err // Retorna error si no puede guardar la cantidad de registros
+	}
+	if s.wal != nil {
+		if err := s.wal.remove(); err != nil {
+			return err // Retorna error si no puede borrar el WAL, que ya no hace falta
+		}
+		s.wal = nil
+	}
+	if s.config.Segment.MmapSealed {
+		s.store.mapFile() // Ya no crece, así que el mapeo no queda corto
+	}
+	s.sealed = true
+	return nil
+}
+
+// Sync lleva a disco todo lo escrito en el segmento sin cerrarlo: vacía el
+// buffer del store, hace fsync del archivo y después msync del índice, en ese
+// orden, para que el índice nunca apunte a datos que no están en disco.
+func (s *Segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err // Retorna error si no puede llevar el store a disco
+	}
+	if err := s.index.mmap.Sync(gommap.MS_SYNC); err != nil { // Sincroniza el índice con el disco
+		return err
+	}
+	if s.wal != nil {
+		return s.wal.reset() // Lo que tenía ya está en disco
+	}
+	return nil
+}
 
-	return record, err // Retorna el registro leído
+// IsSealed indica si el segmento ya no acepta escrituras.
+func (s *Segment) IsSealed() bool {
+	return s.sealed
 }
 
-// IsMaxed verifica si el segmento ha alcanzado su tamaño máximo.
-func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
+// IsMaxed verifica si el segmento ha alcanzado su tamaño máximo, es decir, si
+// ya no cabe ni un registro vacío o ni una entrada más en el índice.
+func (s *Segment) IsMaxed() bool {
+	storeBytes, indexBytes := s.Size()
+	return s.nextOffset-s.baseOffset > maxRelativeOffset ||
+		storeBytes+s.store.frameWidth() > s.config.Segment.MaxStoreBytes ||
+		indexBytes+entWidth > s.config.Segment.MaxIndexBytes
+}
+
+// fits indica si un registro que ocupa n bytes en el store cabe en el segmento
+// junto con su entrada del índice. Un segmento vacío acepta cualquier registro,
+// para que uno más grande que MaxStoreBytes no quede sin lugar.
+func (s *Segment) fits(n uint64) bool {
+	if s.RecordCount() == 0 {
+		return true
+	}
+	storeBytes, indexBytes := s.Size()
+	return storeBytes+s.store.frameWidth()+n <= s.config.Segment.MaxStoreBytes &&
+		indexBytes+entWidth <= s.config.Segment.MaxIndexBytes
 }
 
 // Remove elimina el segmento cerrando y eliminando sus archivos.
-func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+func (s *Segment) Remove() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.close(); err != nil {
 		return err // Retorna error si falla al cerrar
 	}
 	if err := os.Remove(s.index.Name()); err != nil {
@@ -121,21 +1087,93 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err // Retorna error si falla al eliminar el store
 	}
+	if err := os.Remove(s.metaPath()); err != nil && !os.IsNotExist(err) {
+		return err // Retorna error si falla al eliminar los metadatos
+	}
+	if err := os.Remove(s.integrityPath()); err != nil && !os.IsNotExist(err) {
+		return err // Retorna error si falla al eliminar la integridad
+	}
 	return nil // Retorna nil si no hay errores
 }
 
-// Close cierra el segmento cerrando el índice y el store.
-func (s *segment) Close() error {
+// Close cierra el segmento cerrando el índice y el store. Las lecturas que
+// lleguen después retornan errSegmentClosed.
+func (s *Segment) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.close()
+}
+
+// close cierra el segmento; quien lo llama debe tener s.mu.
+func (s *Segment) close() error {
+	s.closed = true // Aunque falle, los archivos ya no se pueden leer
+	if err := s.updateMeta(); err != nil {
+		return err // Retorna error si no puede guardar la cantidad de registros
+	}
 	if err := s.index.Close(); err != nil {
 		return err // Retorna error si falla al cerrar el índice
 	}
 	if err := s.store.Close(); err != nil {
 		return err // Retorna error si falla al cerrar el store
 	}
-	return nil // Retorna nil si no hay errores
+	if s.wal != nil {
+		if err := s.wal.remove(); err != nil {
+			return err // Retorna error si falla al borrar el WAL
+		}
+		s.wal = nil
+	}
+	return s.writeIntegrity() // Con los archivos ya cerrados y recortados
+}
+
+// BaseOffset devuelve el primer offset del segmento.
+func (s *Segment) BaseOffset() uint64 {
+	return s.baseOffset
+}
+
+// NextOffset devuelve el offset que recibirá el próximo registro del segmento.
+func (s *Segment) NextOffset() uint64 {
+	return s.nextOffset
+}
+
+// Size retorna los bytes usados por el store, incluidos los que siguen en el
+// buffer, y por las entradas del índice, sin contar su header.
+func (s *Segment) Size() (storeBytes, indexBytes uint64) {
+	return s.store.size, s.index.size
+}
+
+// RecordCount retorna cuántos registros guarda el segmento, uno por entrada del
+// índice. Es nextOffset-baseOffset salvo que una compactación haya dejado huecos.
+func (s *Segment) RecordCount() uint64 {
+	return s.index.size / entWidth
+}
+
+// Info devuelve los offsets, los archivos y el tamaño del segmento. Active
+// queda en false porque sólo el log sabe cuál es su segmento activo.
+func (s *Segment) Info() SegmentInfo {
+	storeBytes, indexBytes := s.Size()
+	return SegmentInfo{
+		BaseOffset:  s.baseOffset,
+		NextOffset:  s.nextOffset,
+		StorePath:   s.store.Name(),
+		IndexPath:   s.index.file.Name(),
+		StoreBytes:  storeBytes,
+		IndexBytes:  indexBytes,
+		RecordCount: s.RecordCount(),
+		CreatedAt:   s.CreatedAt(),
+	}
 }
 
 // Name devuelve el nombre del segmento basado en sus offsets.
-func (s *segment) Name() string {
+func (s *Segment) Name() string {
 	return fmt.Sprintf("%d-%d", s.baseOffset, s.nextOffset) // Formatea y retorna el nombre del segmento
 }
+
+// logAttrs devuelve los atributos del segmento que se adjuntan a los mensajes de log.
+func (s *Segment) logAttrs() []any {
+	return []any{
+		slog.Uint64("baseOffset", s.baseOffset),
+		slog.Uint64("nextOffset", s.nextOffset),
+		slog.Uint64("storeSize", s.store.size),
+		slog.Uint64("indexSize", s.index.size),
+	}
+}
@@ -1,12 +1,21 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	log_v1 "github.com/dati/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSegment(t *testing.T) {
@@ -21,21 +30,24 @@ func TestSegment(t *testing.T) {
 
 	s, err := NewSegment(dir, 16, c)
 	require.NoError(t, err)
-	require.Equal(t, uint64(16), s.nextOffset, s.nextOffset)
+	require.Equal(t, uint64(16), s.BaseOffset())
+	require.Equal(t, uint64(16), s.NextOffset())
 	require.False(t, s.IsMaxed())
 
 	for i := uint64(0); i < 3; i++ {
 		off, err := s.Append(want)
 		require.NoError(t, err)
 		require.Equal(t, 16+i, off)
+		require.Equal(t, off+1, s.NextOffset())
 
 		got, err := s.Read(off)
 		require.NoError(t, err)
 		require.Equal(t, want.Value, got.Value)
 	}
+	require.Equal(t, uint64(16), s.BaseOffset())
 
 	_, err = s.Append(want)
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, ErrSegmentFull, err)
 
 	// maxed index
 	require.True(t, s.IsMaxed())
@@ -54,3 +66,1141 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentReadOutOfRange(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	for _, off := range []uint64{0, 15, 19, 1 << 40, math.MaxUint64} {
+		_, err := s.Read(off)
+		require.Equal(t, log_v1.ErrOffsetOutOfRange{Offset: off}, err, off)
+	}
+	_, err = s.Read(18)
+	require.NoError(t, err)
+}
+
+func TestSegmentPublicAPI(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-api-test")
+	defer os.RemoveAll(dir)
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = uint64(entWidth * 2)
+
+	s, err := NewSegment(dir, 5, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), s.BaseOffset())
+	require.Equal(t, uint64(5), s.NextOffset())
+	require.Equal(t, "5-5", s.Name())
+
+	for i := uint64(0); i < 2; i++ {
+		off, err := s.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, 5+i, off)
+	}
+	require.Equal(t, uint64(5), s.BaseOffset())
+	require.Equal(t, uint64(7), s.NextOffset())
+	require.Equal(t, "5-7", s.Name())
+	require.True(t, s.IsMaxed())
+
+	got, err := s.Read(6)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.Equal(t, uint64(6), got.Offset)
+
+	// al reabrirlo los offsets se recuperan de los archivos
+	require.NoError(t, s.Close())
+	s, err = NewSegment(dir, 5, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), s.NextOffset())
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentInfo(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-info-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 10, c)
+	require.NoError(t, err)
+	require.Equal(t, SegmentInfo{
+		BaseOffset: 10,
+		NextOffset: 10,
+		StorePath:  s.store.Name(),
+		IndexPath:  s.index.file.Name(),
+		StoreBytes: storeHeaderWidth,
+		CreatedAt:  s.CreatedAt(),
+	}, s.Info())
+
+	storeBytes := uint64(storeHeaderWidth)
+	for i := 1; i <= 5; i++ {
+		record := &log_v1.Record{Value: bytes.Repeat([]byte("a"), i)}
+		_, err := s.Append(record)
+		require.NoError(t, err)
+		storeBytes += lenWidth + crcWidth + uint64(proto.Size(record))
+
+		info := s.Info()
+		require.Equal(t, uint64(i), info.RecordCount)
+		require.Equal(t, uint64(10+i), info.NextOffset)
+		require.Equal(t, storeBytes, info.StoreBytes)
+		require.Equal(t, uint64(i)*entWidth, info.IndexBytes)
+	}
+
+	// al reabrirlo el conteo se recupera del índice
+	require.NoError(t, s.Close())
+	s, err = NewSegment(dir, 10, c)
+	require.NoError(t, err)
+	defer s.Close()
+	info := s.Info()
+	require.Equal(t, uint64(5), info.RecordCount)
+	require.Equal(t, storeBytes, info.StoreBytes)
+	require.False(t, info.Active)
+}
+
+func TestSegmentMeta(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+
+	before := time.Now()
+	s, err := NewSegment(dir, 10, c)
+	require.NoError(t, err)
+	metaPath := s.metaPath()
+	require.Equal(t, path.Join(dir, "00000000000000000010.meta"), metaPath)
+	readMeta := func() map[string]any {
+		b, err := os.ReadFile(metaPath)
+		require.NoError(t, err)
+		// la clave de cifrado no se guarda en los metadatos
+		require.NotContains(t, string(b), "kkkk")
+		var meta map[string]any
+		require.NoError(t, json.Unmarshal(b, &meta))
+		return meta
+	}
+
+	// el segmento nuevo escribe su .meta al crearse
+	meta := readMeta()
+	require.Equal(t, 10.0, meta["baseOffset"])
+	require.Equal(t, 0.0, meta["recordCount"])
+	require.Equal(t, map[string]any{
+		"maxStoreBytes":  1024.0,
+		"maxIndexBytes":  1024.0,
+		"encrypted":      true,
+		"compressSealed": false,
+	}, meta["config"])
+	createdAt := s.CreatedAt()
+	require.WithinRange(t, createdAt, before, time.Now())
+
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+	require.Equal(t, 3.0, readMeta()["recordCount"])
+
+	// al reabrirlo conserva la fecha de creación y sellarlo guarda el conteo
+	s, err = NewSegment(dir, 10, c)
+	require.NoError(t, err)
+	require.True(t, createdAt.Equal(s.CreatedAt()))
+	require.True(t, createdAt.Equal(s.Info().CreatedAt))
+	_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.Seal())
+	require.Equal(t, 4.0, readMeta()["recordCount"])
+	require.NoError(t, s.Close())
+
+	// un segmento sin .meta, como los anteriores a este archivo, abre igual
+	require.NoError(t, os.Remove(metaPath))
+	s, err = NewSegment(dir, 10, c)
+	require.NoError(t, err)
+	oldest, err := s.OldestRecordTime()
+	require.NoError(t, err)
+	require.False(t, oldest.IsZero())
+	require.True(t, oldest.Equal(s.CreatedAt())) // Sin .meta, la fecha del primer registro
+	require.Equal(t, uint64(4), s.RecordCount())
+	require.NoError(t, s.Close())
+	require.NoFileExists(t, metaPath)
+
+	// Remove borra el .meta junto con el store y el índice
+	s, err = NewSegment(dir, 20, c)
+	require.NoError(t, err)
+	metaPath = s.metaPath()
+	require.FileExists(t, metaPath)
+	require.NoError(t, s.Remove())
+	require.NoFileExists(t, metaPath)
+}
+
+func TestSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+	record := func(i int) *log_v1.Record {
+		return &log_v1.Record{Value: bytes.Repeat([]byte("a"), 10*i)}
+	}
+	// el store alcanza justo para los registros 1, 2 y 3
+	limit := uint64(storeHeaderWidth)
+	for i := 1; i <= 3; i++ {
+		r := record(i)
+		r.Offset = uint64(i - 1)
+		limit += lenWidth + crcWidth + uint64(proto.Size(r))
+	}
+	c := Config{}
+	c.Segment.MaxStoreBytes = limit
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	storeBytes, indexBytes := s.Size()
+	require.Equal(t, uint64(storeHeaderWidth), storeBytes) // Sólo el encabezado
+	require.Zero(t, indexBytes)
+	require.Zero(t, s.RecordCount())
+
+	want := uint64(storeHeaderWidth)
+	for i := 1; i <= 3; i++ {
+		require.False(t, s.IsMaxed())
+		r := record(i)
+		_, err := s.Append(r)
+		require.NoError(t, err)
+		want += lenWidth + crcWidth + uint64(proto.Size(r))
+
+		storeBytes, indexBytes = s.Size()
+		require.Equal(t, want, storeBytes)
+		require.Equal(t, uint64(i)*entWidth, indexBytes)
+		require.Equal(t, uint64(i), s.RecordCount())
+	}
+	// con el store justo en el límite no cabe ni un registro vacío
+	require.Equal(t, limit, storeBytes)
+	require.True(t, s.IsMaxed())
+	_, err = s.Append(record(1))
+	require.Equal(t, ErrSegmentFull, err)
+	require.Equal(t, uint64(3), s.RecordCount())
+}
+
+func TestSegmentEncryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-encryption-test")
+	defer os.RemoveAll(dir)
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.EncryptionKey = bytes.Repeat([]byte{1}, 32)
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	got, err := s.Read(17)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.NoError(t, s.Close())
+
+	// el valor no aparece en claro en el store y cada registro empieza con el algoritmo
+	raw, err := os.ReadFile(path.Join(dir, "00000000000000000016.store"))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, want.Value))
+	require.Equal(t, encryptionAESGCM, raw[storeHeaderWidth+lenWidth+crcWidth])
+
+	// sin clave o con otra clave el registro no se puede leer
+	c.Segment.EncryptionKey = nil
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, err = s.Read(16)
+	require.ErrorIs(t, err, ErrMissingKey)
+	require.NoError(t, s.Close())
+
+	c.Segment.EncryptionKey = bytes.Repeat([]byte{2}, 32)
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, err = s.Read(16)
+	require.Error(t, err)
+	require.NoError(t, s.Close())
+
+	c.Segment.EncryptionKey = []byte("too short")
+	_, err = NewSegment(dir, 16, c)
+	require.Error(t, err)
+}
+
+func TestSegmentPreallocateStore(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-prealloc-test")
+	defer os.RemoveAll(dir)
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.PreallocateStore = true
+	storePath := path.Join(dir, "00000000000000000016.store")
+	fileSize := func() int64 {
+		fi, err := os.Stat(storePath)
+		require.NoError(t, err)
+		return fi.Size()
+	}
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), fileSize())
+	require.False(t, s.IsMaxed())
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	size := s.store.size
+	require.NoError(t, s.Close())
+	// al cerrar, el archivo se recorta a los datos
+	require.Equal(t, int64(size), fileSize())
+
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), fileSize())
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(19), s.NextOffset())
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+	for off := uint64(16); off < 20; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// si el store no se recorta, como tras una caída, el tamaño se recupera de los prefijos
+	size = s.store.size
+	require.NoError(t, s.index.Close())
+	require.NoError(t, s.store.Flush())
+	require.NoError(t, s.store.File.Close())
+	require.Equal(t, int64(1024), fileSize())
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(20), s.NextOffset())
+	got, err := s.Read(19)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentAppendIndexFull(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-index-full-test")
+	defer os.RemoveAll(dir)
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+
+	// el índice no tiene lugar ni para una entrada
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = uint64(entWidth - 1)
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, err = s.Append(want)
+	require.ErrorIs(t, err, ErrIndexFull)
+	require.Contains(t, err.Error(), "MaxIndexBytes")
+	require.Equal(t, uint64(storeHeaderWidth), s.store.size)
+	require.Equal(t, uint64(16), s.NextOffset())
+	require.NoError(t, s.Verify())
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentAppendRollsBackStore(t *testing.T) {
+	for name, prealloc := range map[string]bool{
+		"plain":       false,
+		"preallocate": true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "segment-rollback-test")
+			defer os.RemoveAll(dir)
+
+			want := &log_v1.Record{Value: []byte("hello world")}
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.PreallocateStore = prealloc
+
+			s, err := NewSegment(dir, 16, c)
+			require.NoError(t, err)
+			_, err = s.Append(want)
+			require.NoError(t, err)
+			size := s.store.size
+
+			// el índice falla después de escribir el store
+			s.index.readOnly = true
+			_, err = s.Append(want)
+			require.ErrorIs(t, err, ErrReadOnlyIndex)
+			require.Equal(t, size, s.store.size)
+			require.Equal(t, uint64(17), s.NextOffset())
+			s.index.readOnly = false
+
+			off, err := s.Append(&log_v1.Record{Value: []byte("after")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(17), off)
+			require.NoError(t, s.Verify())
+			require.NoError(t, s.Close())
+
+			s, err = NewSegment(dir, 16, c)
+			require.NoError(t, err)
+			require.Equal(t, uint64(18), s.NextOffset())
+			got, err := s.Read(17)
+			require.NoError(t, err)
+			require.Equal(t, []byte("after"), got.Value)
+			require.NoError(t, s.Close())
+		})
+	}
+}
+
+func TestSegmentAppendWithOffset(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-append-offset-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for off := uint64(16); off < 18; off++ {
+		require.NoError(t, s.AppendWithOffset(&log_v1.Record{
+			Value:  []byte("hello world"),
+			Offset: off,
+		}))
+	}
+	got, err := s.Read(17)
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), got.Offset)
+
+	err = s.AppendWithOffset(&log_v1.Record{Offset: 20})
+	require.Equal(t, ErrOffsetGap{Want: 18, Got: 20}, err)
+	err = s.AppendWithOffset(&log_v1.Record{Offset: 17})
+	require.Equal(t, ErrDuplicateOffset{Want: 18, Got: 17}, err)
+	require.Equal(t, uint64(18), s.NextOffset())
+}
+
+func TestSegmentSync(t *testing.T) {
+	dir := t.TempDir()
+	want := &log_v1.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+
+	// antes de Sync el último registro sigue en el buffer del store
+	b, err := os.ReadFile(s.store.Name())
+	require.NoError(t, err)
+	require.Less(t, uint64(len(b)), s.store.size)
+
+	require.NoError(t, s.Sync())
+
+	// otro descriptor ve el store y el índice completos sin cerrar el segmento
+	b, err = os.ReadFile(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, s.store.size, uint64(len(b)))
+	idx, err := os.ReadFile(s.index.Name())
+	require.NoError(t, err)
+	idx = idx[indexHeaderWidth:]
+	for i := uint64(0); i < 2; i++ {
+		entry := idx[i*entWidth : (i+1)*entWidth]
+		require.Equal(t, uint32(i), enc.Uint32(entry[:offWidth]))
+		pos := enc.Uint64(entry[offWidth:])
+		size := enc.Uint64(b[pos : pos+lenWidth])
+		value := b[pos+lenWidth+crcWidth : pos+lenWidth+crcWidth+size]
+		require.Equal(t, crc32.Checksum(value, crcTable), enc.Uint32(b[pos+lenWidth:]))
+		got := &log_v1.Record{}
+		require.NoError(t, proto.Unmarshal(value, got))
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, 16+i, got.Offset)
+	}
+}
+
+func TestSegmentSeal(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-seal-test")
+	defer os.RemoveAll(dir)
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	require.False(t, s.IsSealed())
+	require.NoError(t, s.Seal())
+	require.True(t, s.IsSealed())
+	require.NoError(t, s.Seal())
+
+	// el store ya está en disco y el índice recortado a sus entradas
+	fi, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(s.store.size), fi.Size())
+	fi, err = os.Stat(s.index.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(indexHeaderWidth+2*entWidth), fi.Size())
+
+	for off := uint64(16); off < 18; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	_, err = s.Append(want)
+	require.Equal(t, ErrSealed, err)
+	require.Equal(t, ErrSealed, s.AppendWithOffset(&log_v1.Record{Offset: 18}))
+	require.ErrorIs(t, err, ErrSegmentSealed)
+	require.Equal(t, uint64(18), s.NextOffset())
+	require.NoError(t, s.Close())
+
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(18), s.NextOffset())
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentScan(t *testing.T) {
+	for name, key := range map[string][]byte{
+		"plain":     nil,
+		"encrypted": bytes.Repeat([]byte{7}, 32),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "segment-scan-test")
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1 << 20
+			c.Segment.MaxIndexBytes = 1 << 20
+			c.Segment.EncryptionKey = key
+
+			s, err := NewSegment(dir, 100, c)
+			require.NoError(t, err)
+			defer s.Close()
+			const records = 300
+			for i := 0; i < records; i++ {
+				_, err = s.Append(&log_v1.Record{Value: bytes.Repeat([]byte{byte(i)}, i%50+1)})
+				require.NoError(t, err)
+			}
+
+			// el último registro sigue en el buffer del store y Scan también lo ve
+			var n int
+			err = s.Scan(func(record *log_v1.Record) error {
+				require.Equal(t, uint64(100+n), record.Offset)
+				require.Equal(t, bytes.Repeat([]byte{byte(n)}, n%50+1), record.Value)
+				n++
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, records, n)
+
+			n = 0
+			err = s.Scan(func(record *log_v1.Record) error {
+				if n++; n == 10 {
+					return StopScan
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, 10, n)
+
+			want := errors.New("boom")
+			err = s.Scan(func(record *log_v1.Record) error {
+				return want
+			})
+			require.Equal(t, want, err)
+		})
+	}
+}
+
+func TestSegmentVerify(t *testing.T) {
+	for name, corrupt := range map[string]func(pos, n uint64) uint64{
+		// el byte más alto del prefijo vuelve enorme la longitud
+		"length prefix": func(pos, n uint64) uint64 { return pos },
+		// el último byte del registro es su offset serializado
+		"record bytes": func(pos, n uint64) uint64 { return pos + lenWidth + n - 1 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "segment-verify-test")
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+
+			s, err := NewSegment(dir, 10, c)
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, s.Verify())
+			_, pos, err := s.index.Read(5)
+			require.NoError(t, err)
+			_, next, err := s.index.Read(6)
+			require.NoError(t, err)
+			storeName := s.store.Name()
+			require.NoError(t, s.Close())
+
+			b, err := os.ReadFile(storeName)
+			require.NoError(t, err)
+			b[corrupt(pos, next-pos-lenWidth)] ^= 0xff
+			require.NoError(t, os.WriteFile(storeName, b, 0644))
+
+			// sin VerifyOnOpen el segmento abre y Verify encuentra el registro
+			s, err = NewSegment(dir, 10, c)
+			require.NoError(t, err)
+			err = s.Verify()
+			require.ErrorIs(t, err, ErrCorruptStore)
+			require.Contains(t, err.Error(), "offset 15")
+			_, err = s.Read(14)
+			require.NoError(t, err)
+			require.NoError(t, s.Close())
+
+			c.Segment.VerifyOnOpen = true
+			_, err = NewSegment(dir, 10, c)
+			require.ErrorIs(t, err, ErrCorruptStore)
+			require.Contains(t, err.Error(), "offset 15")
+		})
+	}
+}
+
+func TestSegmentSyncOnAppend(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.SyncOnAppend = true
+
+	s, err := NewSegment(dir, 10, c)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		// el registro ya está en el archivo, no sólo en el buffer
+		storeBytes, _ := s.Size()
+		fi, err := os.Stat(s.store.Name())
+		require.NoError(t, err)
+		require.Equal(t, int64(storeBytes), fi.Size())
+	}
+	storeBytes, _ := s.Size()
+
+	// la caída llega después de escribir el store y antes de escribir el índice
+	orphan, err := proto.Marshal(&log_v1.Record{Value: []byte("orphan"), Offset: 12})
+	require.NoError(t, err)
+	_, _, err = s.store.Append(orphan)
+	require.NoError(t, err)
+	require.NoError(t, s.store.Sync())
+	require.NoError(t, s.index.mmap.UnsafeUnmap())
+	require.NoError(t, s.index.file.Close())
+	require.NoError(t, s.store.File.Close())
+
+	s, err = NewSegment(dir, 10, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Verify())
+	require.Equal(t, uint64(12), s.NextOffset())
+	size, _ := s.Size()
+	require.Equal(t, storeBytes, size)
+	for off := uint64(10); off < 12; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+}
+
+func TestSegmentRelativeOffsetLimit(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	// como si el segmento ya tuviera 2^32-1 registros
+	s.nextOffset = 16 + maxRelativeOffset
+
+	off, err := s.Append(&log_v1.Record{Value: []byte("last")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(16+maxRelativeOffset), off)
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("last"), got.Value)
+	require.True(t, s.IsMaxed())
+
+	// el próximo offset relativo no entra en la entrada del índice
+	_, err = s.Append(&log_v1.Record{Value: []byte("overflow")})
+	require.ErrorIs(t, err, ErrSegmentFull)
+	require.Equal(t, uint64(16+maxRelativeOffset+1), s.NextOffset())
+}
+
+func TestSegmentRecoverTail(t *testing.T) {
+	orphan, err := proto.Marshal(&log_v1.Record{Value: []byte("orphan"), Offset: 12})
+	require.NoError(t, err)
+	for name, tail := range map[string][]byte{
+		// el registro llegó completo al store pero no al índice
+		"whole record": append(enc.AppendUint64(nil, uint64(len(orphan))), orphan...),
+		// la caída cortó el prefijo de longitud
+		"partial length": {0, 0, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+
+			s, err := NewSegment(dir, 10, c)
+			require.NoError(t, err)
+			for i := 0; i < 2; i++ {
+				_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			storeBytes, _ := s.Size()
+			storeName := s.store.Name()
+			require.NoError(t, s.Close())
+
+			f, err := os.OpenFile(storeName, os.O_WRONLY|os.O_APPEND, 0644)
+			require.NoError(t, err)
+			_, err = f.Write(tail)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			// al reabrir el store vuelve al final del último registro indexado
+			s, err = NewSegment(dir, 10, c)
+			require.NoError(t, err)
+			defer s.Close()
+			size, _ := s.Size()
+			require.Equal(t, storeBytes, size)
+			fi, err := os.Stat(storeName)
+			require.NoError(t, err)
+			require.Equal(t, int64(storeBytes), fi.Size())
+
+			off, err := s.Append(&log_v1.Record{Value: []byte("after crash")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(12), off)
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte("after crash"), got.Value)
+			require.NoError(t, s.Verify())
+		})
+	}
+}
+
+func TestSegmentWAL(t *testing.T) {
+	// cada caso corta el Append del tercer registro en otro punto
+	for name, stage := range map[string]int{
+		"torn WAL entry":          0,
+		"before store write":      1,
+		"after store write":       2,
+		"after index write":       3,
+		"after store was flushed": 4,
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.EnableWAL = true
+
+			s, err := NewSegment(dir, 10, c)
+			require.NoError(t, err)
+			for i := 0; i < 2; i++ {
+				_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NotZero(t, s.wal.size)
+
+			record := &log_v1.Record{Value: []byte("in flight"), Offset: 12}
+			value, err := proto.Marshal(record)
+			require.NoError(t, err)
+			require.NoError(t, s.wal.begin(2, value))
+			if stage == 0 {
+				// el proceso cayó escribiendo la entrada del WAL
+				require.NoError(t, s.wal.file.Truncate(s.wal.size-3))
+			}
+			if stage >= 2 {
+				_, pos, err := s.store.Append(value)
+				require.NoError(t, err)
+				if stage >= 3 {
+					require.NoError(t, s.index.Write(2, pos))
+				}
+				if stage == 4 {
+					require.NoError(t, s.store.Flush())
+				}
+			}
+			// sin Close: lo que sigue en el buffer del store se pierde
+			require.NoError(t, s.index.mmap.UnsafeUnmap())
+			require.NoError(t, s.index.file.Close())
+			require.NoError(t, s.store.File.Close())
+			require.NoError(t, s.wal.file.Close())
+
+			s, err = NewSegment(dir, 10, c)
+			require.NoError(t, err)
+			defer s.Close()
+			require.NoError(t, s.Verify())
+			want := uint64(13)
+			if stage == 0 {
+				want = 12 // La entrada no llegó entera al WAL, así que el registro no existe
+			}
+			require.Equal(t, want, s.NextOffset())
+			for off := uint64(10); off < 12; off++ {
+				got, err := s.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, []byte("hello world"), got.Value)
+			}
+			if stage > 0 {
+				got, err := s.Read(12)
+				require.NoError(t, err)
+				require.Equal(t, []byte("in flight"), got.Value)
+			}
+
+			// el WAL recuperado se reemplaza por uno vacío y se siguen agregando registros
+			require.Zero(t, s.wal.size)
+			off, err := s.Append(&log_v1.Record{Value: []byte("after crash")})
+			require.NoError(t, err)
+			require.Equal(t, want, off)
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte("after crash"), got.Value)
+			require.NoError(t, s.Verify())
+
+			// Sync vacía el WAL y Close lo borra
+			require.NoError(t, s.Sync())
+			require.Zero(t, s.wal.size)
+			walPath := s.walPath()
+			require.FileExists(t, walPath)
+			require.NoError(t, s.Close())
+			require.NoFileExists(t, walPath)
+		})
+	}
+}
+
+func TestSegmentRebuildIndex(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-rebuild-test")
+	defer os.RemoveAll(dir)
+
+	want := &log_v1.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// sin índice el segmento no se puede abrir a menos que se pida reconstruirlo
+	indexPath := path.Join(dir, "00000000000000000016.index")
+	require.NoError(t, os.Remove(indexPath))
+	_, err = NewSegment(dir, 16, c)
+	require.ErrorIs(t, err, ErrCorruptIndex)
+
+	c.Segment.RebuildIndexOnError = true
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	for off := uint64(16); off < 19; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	require.NoError(t, s.Close())
+
+	// un índice con entradas incompletas también se reconstruye
+	require.NoError(t, os.Truncate(indexPath, int64(entWidth+5)))
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	got, err := s.Read(18)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+
+	// si no hay lugar para todas las entradas, el índice queda como estaba
+	s.index.maxBytes = 2 * entWidth
+	require.ErrorIs(t, s.RebuildIndex(), io.EOF)
+	s.index.maxBytes = c.Segment.MaxIndexBytes
+	require.Equal(t, uint64(20), s.nextOffset)
+	got, err = s.Read(19)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+
+	// el índice de un segmento sellado es de solo lectura: se rechaza sin tocarlo
+	require.NoError(t, s.Seal())
+	require.ErrorIs(t, s.RebuildIndex(), ErrSealed)
+	for off := uint64(16); off < 20; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	require.NoError(t, s.Close())
+}
+
+func TestSegmentFileNames(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "segment-names-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	// los segmentos nuevos usan nombres con padding de ceros
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, path.Join(dir, "00000000000000000016.store"), s.store.Name())
+	require.Equal(t, path.Join(dir, "00000000000000000016.index"), s.index.Name())
+	require.NoError(t, s.Close())
+
+	// los segmentos con nombre antiguo se siguen abriendo con ese nombre
+	require.NoError(t, os.WriteFile(path.Join(dir, "7.store"), nil, 0644))
+	s, err = NewSegment(dir, 7, c)
+	require.NoError(t, err)
+	require.Equal(t, path.Join(dir, "7.store"), s.store.Name())
+	require.Equal(t, path.Join(dir, "7.index"), s.index.Name())
+	require.NoError(t, s.Close())
+
+	for name, want := range map[string]uint64{
+		"00000000000000000016.store": 16,
+		"00000000000000000016.index": 16,
+		"7.store":                    7,
+		"12345.index":                12345,
+		"18446744073709551615.store": 18446744073709551615,
+	} {
+		off, err := parseBaseOffset(name)
+		require.NoError(t, err)
+		require.Equal(t, want, off, name)
+	}
+	_, err = parseBaseOffset("README.txt")
+	require.Error(t, err)
+}
+
+func TestSegmentIntegrityMAC(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.EncryptionKey = bytes.Repeat([]byte{1}, 32)
+
+	s, err := NewSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, s.Seal())
+	require.NoError(t, s.Close())
+	_, err = checkSegmentIntegrity(s.dir, s.fileName(), 0, c.Segment.EncryptionKey)
+	require.NoError(t, err)
+
+	// reescribir la integridad sin la clave no alcanza para tapar un cambio
+	require.NoError(t, writeSegmentIntegrity(s.dir, s.fileName(), nil, 0644))
+	_, err = NewSegment(dir, 0, c)
+	var corrupt ErrSegmentCorrupt
+	require.ErrorAs(t, err, &corrupt)
+	require.Contains(t, corrupt.Reason, "MAC")
+}
+
+func TestSegmentOptions(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	t.Run("file mode", func(t *testing.T) {
+		dir := t.TempDir()
+		c := c
+		c.Segment.Options.FileMode = 0600
+		s, err := NewSegment(dir, 0, c)
+		require.NoError(t, err)
+		_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.NoError(t, s.Seal())
+		require.NoError(t, s.Close())
+
+		// store, índice, meta e integridad quedan con los permisos pedidos
+		for _, ext := range []string{".store", ".index", ".meta", ".integrity"} {
+			fi, err := os.Stat(path.Join(dir, "00000000000000000000"+ext))
+			require.NoError(t, err, ext)
+			require.Equal(t, os.FileMode(0600), fi.Mode().Perm(), ext)
+		}
+	})
+
+	t.Run("O_SYNC", func(t *testing.T) {
+		dir := t.TempDir()
+		c := c
+		c.Segment.Options.StoreFlags = os.O_RDWR | os.O_CREATE | os.O_APPEND | os.O_SYNC
+		c.Segment.Options.IndexFlags = os.O_RDWR | os.O_CREATE | os.O_SYNC
+		s, err := NewSegment(dir, 0, c)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = s.Append(&log_v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+		require.NoError(t, s.Close())
+
+		// los registros se leen igual después de reabrir
+		s, err = NewSegment(dir, 0, c)
+		require.NoError(t, err)
+		defer s.Close()
+		require.Equal(t, uint64(3), s.nextOffset)
+		for i := uint64(0); i < 3; i++ {
+			got, err := s.Read(i)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("record %d", i), string(got.Value))
+		}
+	})
+
+	t.Run("invalid flags", func(t *testing.T) {
+		for name, opts := range map[string]SegmentOptions{
+			"read-only store":      {StoreFlags: os.O_RDONLY | os.O_CREATE | os.O_APPEND},
+			"write-only index":     {IndexFlags: os.O_WRONLY | os.O_CREATE},
+			"store without append": {StoreFlags: os.O_RDWR | os.O_CREATE},
+			"truncate":             {IndexFlags: os.O_RDWR | os.O_CREATE | os.O_TRUNC},
+			"exclusive":            {StoreFlags: os.O_RDWR | os.O_CREATE | os.O_APPEND | os.O_EXCL},
+			"non-permission mode":  {FileMode: os.ModeDir | 0755},
+		} {
+			c := c
+			c.Segment.Options = opts
+			_, err := NewSegment(t.TempDir(), 0, c)
+			require.ErrorIs(t, err, ErrInvalidSegmentOptions, name)
+		}
+	})
+}
+
+func TestSegmentLegacyStore(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.RebuildIndexOnError = true
+
+	// un segmento escrito antes de los checksums, sin índice
+	var legacy []byte
+	for i := uint64(0); i < 3; i++ {
+		value, err := proto.Marshal(&log_v1.Record{Value: []byte("hello world"), Offset: 16 + i})
+		require.NoError(t, err)
+		legacy = enc.AppendUint64(legacy, uint64(len(value)))
+		legacy = append(legacy, value...)
+	}
+	name := path.Join(dir, "00000000000000000016")
+	require.NoError(t, os.WriteFile(name+".store", legacy, 0644))
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.NextOffset())
+	require.NoError(t, s.Verify())
+	off, err := s.Append(&log_v1.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+	require.NoError(t, s.Close())
+
+	// al reabrirlo sigue siendo legible con el formato anterior
+	s, err = NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, byte(storeVersionLegacy), s.store.version)
+	for off := uint64(16); off < 20; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+}
+
+func TestSegmentVerifyChecksum(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(&log_v1.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Sync())
+	require.NoError(t, s.Verify())
+
+	// se cambia un byte del valor del registro 1 sin tocar su longitud
+	_, pos, err := s.index.Read(1)
+	require.NoError(t, err)
+	f, err := os.OpenFile(s.store.Name(), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(pos+lenWidth+crcWidth+2))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = s.Read(1)
+	var corrupt ErrCorruptRecord
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, pos, corrupt.Pos)
+	err = s.Verify()
+	require.ErrorIs(t, err, ErrCorruptStore)
+	require.Contains(t, err.Error(), "offset 1")
+}
+
+func TestSegmentReadChecksOffset(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(&log_v1.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// la entrada de 17 apunta al registro de 18
+	_, pos, err := s.index.Read(2)
+	require.NoError(t, err)
+	at := indexHeaderWidth + entWidth + offWidth
+	enc.PutUint64(s.index.mmap[at:at+posWidth], pos)
+
+	_, err = s.Read(17)
+	require.ErrorIs(t, err, ErrCorruptIndex)
+	require.Contains(t, err.Error(), "offset 17")
+	_, err = s.ReadRange(16, 19, 10)
+	require.ErrorIs(t, err, ErrCorruptIndex)
+
+	got, err := s.Read(18)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), got.Value)
+}
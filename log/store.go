@@ -2,12 +2,20 @@ package log
 
 // Este archivo maneja el almacenamiento físico de los registros en el sistema de archivos.
 
-
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/tysonmote/gommap"
 )
 
 var (
@@ -16,82 +24,451 @@ var (
 
 const (
 	lenWidth = 8 // Define el ancho del campo de longitud en bytes
+	crcWidth = 4 // Ancho del checksum CRC32C de cada registro
+)
+
+// Versiones del formato del store. Los stores nuevos empiezan con un
+// encabezado de storeHeaderWidth bytes: storeMagic seguido de un byte con la
+// versión. Los de storeVersionCRC tienen sólo el byte de la versión, y los
+// anteriores no tienen encabezado: su primer byte es el más alto del prefijo de
+// longitud del primer registro, que siempre es cero.
+const (
+	storeVersionLegacy = 0 // Sin encabezado; cada registro es len | valor
+	storeVersionCRC    = 1 // Byte de versión; cada registro es len | crc32c | valor
+	storeVersionMagic  = 2 // storeMagic y byte de versión; registros como storeVersionCRC
+	storeHeaderWidth   = 8 // Ancho del encabezado de los stores nuevos
+	crcHeaderWidth     = 1 // Ancho del encabezado de los stores storeVersionCRC
 )
 
-// Store representa el almacenamiento de registros en un archivo.
+// storeMagic identifica un archivo como store. Su primer byte no es una
+// versión de las que se escribían sin magic, así que no se confunde con ellas.
+var storeMagic = [storeHeaderWidth - 1]byte{'D', 'A', 'T', 'I', 'L', 'O', 'G'}
+
+// storeBufferSize es cuántos bytes de registros junta el store antes de
+// escribirlos en el archivo.
+const storeBufferSize = 4096
+
+// crcTable es la tabla de CRC32C (Castagnoli) con la que se calcula el
+// checksum de cada registro.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptRecord indica que el registro que empieza en la posición Pos del
+// store está dañado: su valor no coincide con su checksum o su prefijo de
+// longitud apunta más allá del final del store. Coincide con ErrCorruptStore en
+// errors.Is.
+type ErrCorruptRecord struct {
+	Pos    uint64
+	Reason string // Qué se encontró; vacío es un checksum que no coincide
+}
+
+func (e ErrCorruptRecord) Error() string {
+	reason := e.Reason
+	if reason == "" {
+		reason = "checksum mismatch"
+	}
+	return fmt.Sprintf("log: corrupt record at store position %d: %s", e.Pos, reason)
+}
+
+// Is hace que errors.Is(err, ErrCorruptStore) también detecte un checksum que
+// no coincide.
+func (e ErrCorruptRecord) Is(target error) bool {
+	return target == ErrCorruptStore
+}
+
+// ErrOutOfBounds indica una lectura en una posición Pos donde no empieza
+// ningún registro posible: antes del primero o desde Size, el tamaño lógico del
+// store. Suele venir de un índice desactualizado.
+type ErrOutOfBounds struct {
+	Pos  uint64
+	Size uint64
+}
+
+func (e ErrOutOfBounds) Error() string {
+	return fmt.Sprintf("log: store position %d out of bounds, size is %d", e.Pos, e.Size)
+}
+
+// ErrDiskFull indica que Append no pudo escribir porque el disco está lleno
+// (ENOSPC). El registro no se agregó y el store queda como antes del Append;
+// lo que ya estaba en el buffer se escribe en el próximo Flush.
+var ErrDiskFull = errors.New("log: disk full")
+
+// Store representa el almacenamiento de registros en un archivo. mu protege
+// el buffer de escritura y size; las lecturas de bytes que ya llegaron al
+// archivo no lo toman, así un disco lento para leer no frena los Append.
 type Store struct {
-	*os.File               // Archivo donde se almacenan los registros
-	mu       sync.Mutex    // Mutex para proteger el acceso concurrente
-	buf      *bufio.Writer // Buffer para escritura eficiente
-	size     uint64        // Tamaño actual del archivo en bytes
+	*os.File            // Archivo donde se almacenan los registros
+	mu       sync.Mutex // Mutex para proteger el buffer y size
+	// buf son los últimos bytes de size, que todavía no están en el archivo.
+	// A diferencia de un bufio.Writer, si una escritura falla conserva lo que
+	// no se escribió, así un disco lleno no pierde registros ya agregados.
+	buf  []byte
+	size uint64 // Tamaño actual del archivo en bytes
+
+	// flushed es hasta dónde size ya está en el archivo, size menos lo que
+	// queda en buf. Se actualiza con el lock tomado y se lee sin él.
+	flushed atomic.Uint64
+
+	// preallocated indica que el archivo se reservó más grande que size; la
+	// cola del archivo son ceros y Close lo recorta a size.
+	preallocated bool
+	// flags son los flags extra, como os.O_SYNC, con los que se abrió el
+	// archivo; Defragment los mantiene al reabrirlo.
+	flags int
+
+	version byte   // Versión del formato, de storeVersionLegacy a storeVersionMagic
+	start   uint64 // Posición del primer registro, después del encabezado
+
+	// mapping es el archivo mapeado en memoria con mapFile, del que se leen
+	// los bytes que cubre en vez de hacer una llamada al sistema por lectura.
+	// mapMu evita que se desmapee durante una lectura.
+	mapMu   sync.RWMutex
+	mapping gommap.MMap
 }
 
-// newStore crea una nueva instancia de Store a partir de un archivo dado.
+// newStore crea una nueva instancia de Store a partir de un archivo dado. Un
+// archivo vacío recibe el encabezado con la versión actual; uno sin encabezado
+// se lee con el formato anterior, sin checksums.
 func newStore(f *os.File) (*Store, error) {
 	file_info, err := f.Stat() // Obtiene información del archivo
 	if err != nil {
 		return nil, err // Retorna error si falla
 	}
-	return &Store{
-		File: f,                        // Asigna el archivo al Store
-		buf:  bufio.NewWriter(f),       // Crea un nuevo buffer para el archivo
-		size: uint64(file_info.Size()), // Asigna el tamaño del archivo al Store
-	}, nil // Retorna la instancia de Store
+	s := &Store{
+		File: f,                                // Asigna el archivo al Store
+		buf:  make([]byte, 0, storeBufferSize), // Crea un nuevo buffer para el archivo
+		size: uint64(file_info.Size()),         // Asigna el tamaño del archivo al Store
+	}
+	if err := s.readHeader(); err != nil {
+		return nil, err
+	}
+	// Todo lo que hay está en el archivo
+	s.flushed.Store(s.size)
+	return s, nil // Retorna la instancia de Store
+}
+
+// readHeader detecta la versión del formato del store, escribiendo el
+// encabezado si el archivo está vacío. Un archivo que no empieza con storeMagic
+// ni con una versión anterior no es un store y retorna ErrCorruptStore.
+func (s *Store) readHeader() error {
+	if s.size == 0 {
+		header := append(storeMagic[:], storeVersionMagic)
+		if _, err := s.File.Write(header); err != nil {
+			return err
+		}
+		s.version, s.start, s.size = storeVersionMagic, storeHeaderWidth, storeHeaderWidth
+		return nil
+	}
+	header := make([]byte, min(s.size, storeHeaderWidth))
+	if _, err := s.File.ReadAt(header, 0); err != nil {
+		return err
+	}
+	switch {
+	case header[0] == storeVersionLegacy:
+		s.version, s.start = storeVersionLegacy, 0 // El byte es parte del primer registro
+	case header[0] == storeVersionCRC:
+		s.version, s.start = storeVersionCRC, crcHeaderWidth
+	case len(header) == storeHeaderWidth && bytes.Equal(header[:len(storeMagic)], storeMagic[:]):
+		version := header[len(storeMagic)]
+		if version != storeVersionMagic {
+			return fmt.Errorf("%w: unknown store format version %d", ErrCorruptStore, version)
+		}
+		s.version, s.start = version, storeHeaderWidth
+	default:
+		return fmt.Errorf("%w: not a store file, header is %q", ErrCorruptStore, header)
+	}
+	return nil
+}
+
+// Version retorna la versión del formato del store: 0 para los archivos sin
+// encabezado, que no tienen checksums, y 1 o más para los que lo tienen.
+func (s *Store) Version() byte {
+	return s.version
+}
+
+// frameWidth retorna los bytes que ocupa el encabezado de cada registro: el
+// prefijo de longitud y, desde storeVersionCRC, el checksum.
+func (s *Store) frameWidth() uint64 {
+	if s.version == storeVersionLegacy {
+		return lenWidth
+	}
+	return lenWidth + crcWidth
+}
+
+// checkRecord compara el valor del registro en pos con el checksum de su
+// encabezado frame. Los stores sin checksums no se comprueban.
+func (s *Store) checkRecord(pos uint64, frame, value []byte) error {
+	if s.version == storeVersionLegacy {
+		return nil
+	}
+	if crc32.Checksum(value, crcTable) != enc.Uint32(frame[lenWidth:]) {
+		return ErrCorruptRecord{Pos: pos}
+	}
+	return nil
+}
+
+// framePool guarda buffers para leer el encabezado de cada registro sin asignar
+// memoria en cada lectura.
+var framePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, lenWidth+crcWidth)
+		return &b
+	},
 }
 
 // Read lee un registro desde el Store basado en el offset dado.
 func (s *Store) Read(in uint64) (out []byte, err error) {
-	if err := s.buf.Flush(); err != nil { // Vacía el buffer al archivo
+	return s.ReadInto(in, nil) // Asigna un buffer nuevo para el valor
+}
+
+// ReadInto lee el registro en el offset dado usando dst como buffer para el valor
+// cuando tiene capacidad suficiente, así el llamante puede reutilizarlo entre
+// lecturas. Devuelve el slice con el valor leído. Una posición fuera del store
+// retorna ErrOutOfBounds y un registro que no entra en el store,
+// ErrCorruptRecord.
+func (s *Store) ReadInto(in uint64, dst []byte) (out []byte, err error) {
+	framePtr := framePool.Get().(*[]byte) // Toma un buffer para el encabezado del registro
+	defer framePool.Put(framePtr)         // Lo devuelve al pool al terminar
+	frame := (*framePtr)[:s.frameWidth()]
+
+	value_size, err := s.readFrame(in, frame) // Lee el tamaño del valor y su checksum
+	if err != nil {
 		return nil, err // Retorna error si falla
 	}
 
-	value_size_bytes := make([]byte, lenWidth) // Crea un buffer para el tamaño del valor
+	if uint64(cap(dst)) < value_size {
+		dst = make([]byte, value_size) // Crea un buffer para el valor si dst no alcanza
+	}
+	value := dst[:value_size]
 
-	if _, err := s.File.ReadAt(value_size_bytes, int64(in)); err != nil { // Lee el tamaño del valor desde el archivo
+	if _, err := s.readAt(value, in+uint64(len(frame))); err != nil { // Lee el valor desde el archivo
 		return nil, err // Retorna error si falla
 	}
+	if err := s.checkRecord(in, frame, value); err != nil {
+		return nil, err // El valor cambió desde que se escribió
+	}
 
-	value_size := enc.Uint64(value_size_bytes) // Decodifica el tamaño del valor
+	return value, nil // Retorna el valor leído
+}
 
-	value := make([]byte, value_size) // Crea un buffer para el valor
+// ErrInvalidRange indica que ReadRange pidió bytes fuera del valor del registro.
+var ErrInvalidRange = errors.New("log: range out of record value")
 
-	if _, err := s.File.ReadAt(value, int64(in+lenWidth)); err != nil { // Lee el valor desde el archivo
-		return nil, err // Retorna error si falla
+// ReadRange lee length bytes del valor del registro en pos, desde offset dentro
+// del valor, sin leer el resto; sirve para mirar un encabezado de un registro
+// grande. Como no lee el valor completo no puede comprobar su checksum. Si el
+// rango no entra en el valor retorna ErrInvalidRange.
+func (s *Store) ReadRange(pos uint64, offset, length int) ([]byte, error) {
+	framePtr := framePool.Get().(*[]byte)
+	defer framePool.Put(framePtr)
+	frame := (*framePtr)[:s.frameWidth()]
+	value_size, err := s.readFrame(pos, frame)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || uint64(offset)+uint64(length) > value_size {
+		return nil, fmt.Errorf("%w: %d bytes at %d of a %d byte value", ErrInvalidRange, length, offset, value_size)
 	}
+	b := make([]byte, length)
+	if _, err := s.readAt(b, pos+uint64(len(frame))+uint64(offset)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 
-	return value, nil // Retorna el valor leído
+// readFrame lee en frame el encabezado del registro en in y retorna el tamaño
+// de su valor, comprobando que el registro entre en el store y que su valor ya
+// esté en el archivo.
+func (s *Store) readFrame(in uint64, frame []byte) (uint64, error) {
+	// Más allá de size sólo hay bytes reservados o de otro registro a medias
+	size, err := s.readable(in + uint64(len(frame)))
+	if err != nil {
+		return 0, err
+	}
+	if in < s.start || in >= size {
+		return 0, ErrOutOfBounds{Pos: in, Size: size}
+	}
+	if in+uint64(len(frame)) > size {
+		return 0, ErrCorruptRecord{Pos: in, Reason: "frame past end of store"}
+	}
+	if _, err := s.readAt(frame, in); err != nil {
+		return 0, err
+	}
+	value_size := enc.Uint64(frame) // Decodifica el tamaño del valor
+	if value_size > size-in-uint64(len(frame)) {
+		size, err = s.readable(size + 1) // Puede ser que el resto siga en el buffer
+		if err != nil {
+			return 0, err
+		}
+	}
+	if value_size > size-in-uint64(len(frame)) {
+		// Un prefijo de basura no debe pedir un buffer más grande que el store
+		return 0, ErrCorruptRecord{Pos: in, Reason: fmt.Sprintf("length %d past end of store", value_size)}
+	}
+	return value_size, nil
 }
 
 // ReadAt lee datos desde el Store en una posición específica.
 func (s *Store) ReadAt(p []byte, off int64) (int, error) {
-	s.mu.Lock()                           // Bloquea el mutex para acceso exclusivo
-	defer s.mu.Unlock()                   // Desbloquea el mutex al salir de la función
-	if err := s.buf.Flush(); err != nil { // Vacía el buffer al archivo
+	if _, err := s.readable(uint64(off) + uint64(len(p))); err != nil { // Vacía el buffer si hace falta
 		return 0, err // Retorna error si falla
 	}
-	return s.File.ReadAt(p, int64(off)) // Lee datos desde el archivo en la posición especificada
+	return s.readAt(p, uint64(off)) // Lee datos desde el archivo en la posición especificada
 }
 
-// Append agrega un nuevo registro al Store.
+// readAt es File.ReadAt, pero copia los bytes del mapeo si lo cubre. Quien lo
+// llama debe asegurar con readable que estén en el archivo.
+func (s *Store) readAt(p []byte, off uint64) (int, error) {
+	s.mapMu.RLock()
+	if off+uint64(len(p)) <= uint64(len(s.mapping)) {
+		n := copy(p, s.mapping[off:]) // El llamante recibe una copia, no memoria del mapeo
+		s.mapMu.RUnlock()
+		return n, nil
+	}
+	s.mapMu.RUnlock()
+	return s.File.ReadAt(p, int64(off))
+}
+
+// mapFile mapea el archivo en memoria en solo lectura para que las lecturas
+// copien del mapeo. El mapeo cubre el archivo como está, así que sirve para un
+// store que ya no recibe Append, como el de un segmento sellado. Si no se puede
+// mapear, por ejemplo porque el archivo está vacío, las lecturas siguen usando
+// el archivo.
+func (s *Store) mapFile() {
+	if _, err := s.flushedSize(); err != nil {
+		return // Sin vaciar el buffer el mapeo no tendría los últimos registros
+	}
+	mapping, err := gommap.Map(s.File.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return
+	}
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+	if s.mapping != nil {
+		s.mapping.UnsafeUnmap()
+	}
+	s.mapping = mapping
+}
+
+// unmap quita el mapeo de mapFile, esperando a las lecturas que lo usan.
+// Después las lecturas vuelven al archivo.
+func (s *Store) unmap() error {
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+	if s.mapping == nil {
+		return nil
+	}
+	err := s.mapping.UnsafeUnmap()
+	s.mapping = nil
+	return err
+}
+
+// readable asegura que los bytes hasta end, si el store los tiene, estén en el
+// archivo, y retorna hasta dónde se pueden leer. Sólo toma el lock para vaciar
+// el buffer cuando end pasa de lo que ya se vació.
+func (s *Store) readable(end uint64) (uint64, error) {
+	if flushed := s.flushed.Load(); end <= flushed {
+		return flushed, nil
+	}
+	return s.flushedSize()
+}
+
+// flushedSize vacía el buffer al archivo y retorna el tamaño del store.
+func (s *Store) flushedSize() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+	return s.size, nil
+}
+
+// flush vacía el buffer al archivo. Si la escritura falla a mitad, lo escrito
+// sale del buffer y el resto queda para reintentar. Quien lo llama debe tener
+// s.mu.
+func (s *Store) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	n, err := s.File.Write(s.buf)
+	s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+	if cap(s.buf) > storeBufferSize && len(s.buf) == 0 {
+		s.buf = make([]byte, 0, storeBufferSize) // No retiene el buffer de un registro grande
+	}
+	s.flushed.Store(s.size - uint64(len(s.buf)))
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", ErrDiskFull, err)
+	}
+	return err
+}
+
+// Append agrega un nuevo registro al Store. El registro queda en el buffer
+// hasta que se llene o hasta el próximo Flush, Sync, Close o lectura, así
+// varios Append seguidos llegan al archivo en una sola escritura. Si la
+// escritura falla, el registro no se agrega y size no cambia; con el disco
+// lleno el error es ErrDiskFull.
 func (s *Store) Append(value []byte) (bytes uint64, off uint64, err error) {
 	s.mu.Lock()         // Bloquea el mutex para acceso exclusivo
 	defer s.mu.Unlock() // Desbloquea el mutex al salir de la función
 
-	if err := s.buf.Flush(); err != nil { // Vacía el buffer al archivo
-		return 0, 0, err // Retorna error si falla
+	bytes = s.frameWidth() + uint64(len(value))
+	if len(s.buf) > 0 && uint64(len(s.buf))+bytes > storeBufferSize {
+		if err := s.flush(); err != nil { // Lo pendiente se escribe antes, sin el registro nuevo
+			return 0, 0, err // Retorna error si falla
+		}
+	}
+
+	off = s.size                                        // Asigna el offset actual
+	s.buf = enc.AppendUint64(s.buf, uint64(len(value))) // Escribe el tamaño del valor en el buffer
+	if s.version != storeVersionLegacy {
+		s.buf = enc.AppendUint32(s.buf, crc32.Checksum(value, crcTable)) // Escribe el checksum del valor
 	}
+	s.buf = append(s.buf, value...) // Escribe el valor en el buffer
+	s.size += bytes                 // Incrementa el tamaño del Store
 
-	off = s.size                                                         // Asigna el offset actual
-	if err := binary.Write(s.buf, enc, uint64(len(value))); err != nil { // Escribe el tamaño del valor en el buffer
-		return 0, 0, err // Retorna error si falla
+	if len(s.buf) >= storeBufferSize {
+		if err := s.flush(); err != nil {
+			if rerr := s.revert(off); rerr != nil {
+				return 0, 0, errors.Join(err, rerr)
+			}
+			return 0, 0, err // Retorna error si falla
+		}
 	}
-	if err := binary.Write(s.buf, enc, value); err != nil { // Escribe el valor en el buffer
-		return 0, 0, err // Retorna error si falla
+	return bytes, off, nil // Retorna el número de bytes escritos y el offset
+}
+
+// revert quita el registro en off, el último, después de que no se pudo
+// escribir. Si una parte llegó al archivo la corta. Quien lo llama debe tener
+// s.mu.
+func (s *Store) revert(off uint64) error {
+	flushed := s.flushed.Load()
+	if flushed <= off { // El registro sigue entero en el buffer
+		s.buf = s.buf[:off-flushed]
+		s.size = off
+		return nil
 	}
+	s.buf = s.buf[:0] // Lo anterior al registro ya está en el archivo
+	s.size = off
+	s.flushed.Store(off)
+	return s.cut(off, flushed)
+}
 
-	s.size += lenWidth + uint64(len(value)) // Incrementa el tamaño del Store
+// Flush escribe en el archivo los registros que quedan en el buffer, sin
+// fsync. Después de Flush el archivo tiene todo lo agregado hasta el momento.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
 
-	return uint64(lenWidth) + uint64(len(value)), off, nil // Retorna el número de bytes escritos y el offset
+// Sync vacía el buffer al archivo y hace fsync, así lo escrito sobrevive a una
+// caída del sistema.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil { // Vacía el buffer al archivo
+		return err // Retorna error si falla
+	}
+	return s.File.Sync() // Fuerza el archivo a disco
 }
 
 // Remove elimina el archivo del Store.
@@ -104,8 +481,164 @@ func (s *Store) Remove() error {
 
 // Close cierra el Store vaciando el buffer y cerrando el archivo.
 func (s *Store) Close() error {
-	if err := s.buf.Flush(); err != nil { // Vacía el buffer al archivo
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	if err := s.Flush(); err != nil { // Vacía el buffer al archivo
 		return err // Retorna error si falla
 	}
+	if s.preallocated {
+		if err := s.File.Truncate(int64(s.size)); err != nil { // Quita la cola reservada, como hace el índice
+			return err
+		}
+	}
 	return s.File.Close() // Cierra el archivo y retorna error si falla
 }
+
+// preallocate reserva n bytes para el archivo del store sin cambiar su tamaño
+// lógico, y ubica la posición de escritura al final de los datos. El archivo no
+// debe estar abierto con O_APPEND, porque las escrituras irían después de la cola.
+func (s *Store) preallocate(n uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.File.Seek(int64(s.size), io.SeekStart); err != nil {
+		return err
+	}
+	s.preallocated = true
+	fi, err := s.File.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(fi.Size()) >= n {
+		return nil // Ya está reservado, por ejemplo tras una caída
+	}
+	return allocate(s.File, int64(n))
+}
+
+// Truncate descarta los registros del store desde la posición size en adelante.
+// Un store con la cola reservada conserva el tamaño del archivo: los bytes
+// descartados se ponen en cero, que es como empieza la cola.
+func (s *Store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size >= s.size {
+		return nil // No hay nada que descartar
+	}
+	if err := s.unmap(); err != nil { // El mapeo no debe cubrir bytes que ya no están
+		return err
+	}
+	if err := s.flush(); err != nil { // Escribe lo pendiente antes de cortar el archivo
+		return err
+	}
+	s.flushed.Store(size) // Las lecturas desde size vuelven a tomar el lock
+	if err := s.cut(size, s.size); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// cut descarta del archivo los bytes entre size y end, el final de lo escrito.
+// Quien lo llama debe tener s.mu y el buffer vacío.
+func (s *Store) cut(size, end uint64) error {
+	if s.preallocated {
+		if _, err := s.File.WriteAt(make([]byte, end-size), int64(size)); err != nil {
+			return err
+		}
+		_, err := s.File.Seek(int64(size), io.SeekStart) // La próxima escritura va en size
+		return err
+	}
+	return s.File.Truncate(int64(size))
+}
+
+// Defragment reescribe el store dejando sólo los registros cuya posición está en
+// keepOffsets, en el mismo orden. Copia los registros a un archivo .tmp, lo
+// sincroniza y lo renombra sobre el store, así una caída deja el archivo viejo o
+// el nuevo completo. Las posiciones de los registros cambian, por lo que quien lo
+// llama debe reconstruir el índice, y no puede haber lecturas en curso porque
+// cambia el archivo. Retorna el tamaño nuevo del store.
+func (s *Store) Defragment(keepOffsets map[uint64]struct{}) (newSize uint64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil { // Vacía el buffer al archivo
+		return 0, err
+	}
+	if err := s.unmap(); err != nil { // El mapeo es del archivo que se reemplaza
+		return 0, err
+	}
+	name := s.File.Name()
+	fi, err := s.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm()) // Conserva los permisos del store
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name()) // Descarta la copia incompleta; el store no cambió
+		}
+	}()
+	w := bufio.NewWriter(tmp)
+	header := make([]byte, s.start) // La copia conserva el formato del original
+	if _, err = s.File.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return 0, err
+	}
+	newSize = s.start
+	r := bufio.NewReader(io.NewSectionReader(s.File, int64(s.start), int64(s.size-s.start)))
+	prefix := make([]byte, s.frameWidth()) // Los registros se copian con su encabezado tal cual
+	for pos := s.start; pos < s.size; {
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return 0, err
+		}
+		n := enc.Uint64(prefix)
+		if n > s.size-pos-uint64(len(prefix)) {
+			return 0, fmt.Errorf("%w: record at position %d is past the end of the store", ErrCorruptStore, pos)
+		}
+		if _, ok := keepOffsets[pos]; ok {
+			if _, err := w.Write(prefix); err != nil {
+				return 0, err
+			}
+			if _, err := io.CopyN(w, r, int64(n)); err != nil {
+				return 0, err
+			}
+			newSize += uint64(len(prefix)) + n
+		} else if _, err := r.Discard(int(n)); err != nil {
+			return 0, err
+		}
+		pos += uint64(len(prefix)) + n
+	}
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	if err = tmp.Sync(); err != nil { // El contenido debe estar en disco antes de renombrar
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return 0, err
+	}
+	tmp.Close()
+	flags := os.O_RDWR | os.O_APPEND
+	if s.preallocated {
+		flags = os.O_RDWR // El archivo nuevo no tiene cola reservada, pero se escribe igual que antes
+	}
+	flags |= s.flags &^ (os.O_CREATE | os.O_APPEND | os.O_RDWR)
+	f, err := os.OpenFile(name, flags, 0644) // Se reabre para que Name siga siendo el del store
+	if err != nil {
+		return 0, err
+	}
+	if _, err = f.Seek(int64(newSize), io.SeekStart); err != nil {
+		f.Close()
+		return 0, err
+	}
+	s.File.Close() // El archivo viejo ya no tiene nombre
+	s.File = f
+	s.size = newSize
+	s.flushed.Store(newSize)
+	return newSize, nil
+}
@@ -1,7 +1,15 @@
 package log
 
 import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
 	"os"
+	"path"
+	"runtime"
+	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -9,7 +17,7 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + uint64(lenWidth)
+	width = uint64(len(write)) + lenWidth + crcWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -33,13 +41,13 @@ func testAppend(t *testing.T, s *Store) {
 	for i := uint64(1); i < 4; i++ {
 		n, pos, err := s.Append(write)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, width*i)
+		require.Equal(t, pos+n, storeHeaderWidth+width*i)
 	}
 }
 
 func testRead(t *testing.T, s *Store) {
 	t.Helper()
-	var pos uint64
+	pos := uint64(storeHeaderWidth)
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(pos)
 		require.NoError(t, err)
@@ -50,22 +58,649 @@ func testRead(t *testing.T, s *Store) {
 
 func testReadAt(t *testing.T, s *Store) {
 	t.Helper()
-	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+	for i, off := uint64(1), int64(storeHeaderWidth); i < 4; i++ {
+		b := make([]byte, lenWidth+crcWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, lenWidth+crcWidth, n)
 		off += int64(n)
 
 		size := enc.Uint64(b)
+		sum := enc.Uint32(b[lenWidth:])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
 		require.Equal(t, int(size), n)
+		require.Equal(t, crc32.Checksum(b, crcTable), sum)
 		off += int64(n)
 	}
 }
 
+func TestStoreReadInto(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_into_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+
+	buf := make([]byte, 0, 64)
+	pos := uint64(storeHeaderWidth)
+	for i := uint64(1); i < 4; i++ {
+		read, err := s.ReadInto(pos, buf)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+		require.Equal(t, &buf[:1][0], &read[0]) // reutiliza el buffer del llamante
+		pos += width
+	}
+
+	// un buffer sin capacidad suficiente se reemplaza
+	read, err := s.ReadInto(storeHeaderWidth, make([]byte, 0, 1))
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func TestStoreChecksum(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_checksum_test")
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	_, first, err := s.Append(write)
+	require.NoError(t, err)
+	_, second, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Sync())
+
+	// un bit cambiado en el valor del segundo registro
+	b := make([]byte, 1)
+	_, err = s.File.ReadAt(b, int64(second+lenWidth+crcWidth+3))
+	require.NoError(t, err)
+	_, err = s.File.WriteAt([]byte{b[0] ^ 0x10}, int64(second+lenWidth+crcWidth+3))
+	require.NoError(t, err)
+
+	read, err := s.Read(first)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, err = s.Read(second)
+	var corrupt ErrCorruptRecord
+	require.ErrorAs(t, err, &corrupt)
+	require.Equal(t, second, corrupt.Pos)
+	require.ErrorIs(t, err, ErrCorruptStore)
+}
+
+func TestStoreLegacyFormat(t *testing.T) {
+	// un store de antes de los checksums: sin encabezado, cada registro es len | valor
+	var legacy []byte
+	for _, value := range []string{"first", "second"} {
+		legacy = enc.AppendUint64(legacy, uint64(len(value)))
+		legacy = append(legacy, value...)
+	}
+	name := path.Join(t.TempDir(), "legacy.store")
+	require.NoError(t, os.WriteFile(name, legacy, 0644))
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.Equal(t, byte(storeVersionLegacy), s.version)
+	require.Equal(t, uint64(lenWidth), s.frameWidth())
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), read)
+	read, err = s.Read(lenWidth + 5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), read)
+
+	// los registros nuevos siguen el formato del archivo
+	n, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(legacy)), pos)
+	require.Equal(t, uint64(lenWidth)+uint64(len(write)), n)
+	require.NoError(t, s.Close())
+
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, legacy, b[:len(legacy)])
+	require.Equal(t, write, b[pos+lenWidth:])
+}
+
+func TestStoreUnknownVersion(t *testing.T) {
+	name := path.Join(t.TempDir(), "future.store")
+	require.NoError(t, os.WriteFile(name, []byte{storeVersionCRC + 1, 0, 0}, 0644))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = newStore(f)
+	require.ErrorIs(t, err, ErrCorruptStore)
+}
+
+func TestStoreHeader(t *testing.T) {
+	name := path.Join(t.TempDir(), "new.store")
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.Equal(t, byte(storeVersionMagic), s.Version())
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(storeHeaderWidth), pos)
+	require.NoError(t, s.Close())
+
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, storeMagic[:], b[:len(storeMagic)])
+	require.Equal(t, byte(storeVersionMagic), b[len(storeMagic)])
+
+	// al reabrirlo se detecta el encabezado y la copia de Defragment lo conserva
+	f, err = os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	require.Equal(t, byte(storeVersionMagic), s.Version())
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, err = s.Defragment(map[uint64]struct{}{pos: {}})
+	require.NoError(t, err)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.NoError(t, s.Close())
+	b2, err := os.ReadFile(name)
+	require.NoError(t, err)
+	require.Equal(t, b, b2)
+}
+
+func TestStoreVersionByteFormat(t *testing.T) {
+	// los stores de antes del magic empiezan con el byte de la versión
+	old := []byte{storeVersionCRC}
+	old = enc.AppendUint64(old, uint64(len(write)))
+	old = enc.AppendUint32(old, crc32.Checksum(write, crcTable))
+	old = append(old, write...)
+	name := path.Join(t.TempDir(), "crc.store")
+	require.NoError(t, os.WriteFile(name, old, 0644))
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, byte(storeVersionCRC), s.Version())
+	read, err := s.Read(crcHeaderWidth)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(old)), pos)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func TestStoreBadMagic(t *testing.T) {
+	for name, header := range map[string][]byte{
+		"corrupted magic": append([]byte("DATIL0G"), storeVersionMagic),
+		"unknown version": append(storeMagic[:], storeVersionMagic+1),
+		"short file":      []byte("DATI"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "bad.store")
+			require.NoError(t, os.WriteFile(file, header, 0644))
+			f, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND, 0644)
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = newStore(f)
+			require.ErrorIs(t, err, ErrCorruptStore)
+		})
+	}
+}
+
+func TestStoreReadBounds(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_read_bounds_test")
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	records := make(map[uint64][]byte) // Valor de cada registro por su posición
+	for i := 0; i < 50; i++ {
+		value := []byte(fmt.Sprintf("record %d", i))
+		_, pos, err := s.Append(value)
+		require.NoError(t, err)
+		records[pos] = value
+	}
+	// una cola de basura que el store no cuenta, como una preasignación
+	require.NoError(t, s.Flush())
+	_, err = s.File.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	require.NoError(t, err)
+
+	_, err = s.Read(s.size)
+	require.Equal(t, ErrOutOfBounds{Pos: s.size, Size: s.size}, err)
+	_, err = s.Read(0)
+	require.Equal(t, ErrOutOfBounds{Pos: 0, Size: s.size}, err)
+	_, err = s.Read(s.size - 1)
+	require.ErrorIs(t, err, ErrCorruptStore)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		pos := uint64(rng.Int63n(int64(s.size) + 64))
+		if i%10 == 0 {
+			pos = rng.Uint64() // posiciones de un índice con basura
+		}
+		read, err := s.Read(pos)
+		if value, ok := records[pos]; ok {
+			require.NoError(t, err)
+			require.Equal(t, value, read)
+			continue
+		}
+		var outOfBounds ErrOutOfBounds
+		if !errors.As(err, &outOfBounds) {
+			require.ErrorIs(t, err, ErrCorruptStore, "position %d", pos)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(10<<20))
+}
+
+func TestStoreReadRange(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_read_range_test")
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+	value := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(value)
+	_, pos, err := s.Append(value)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+
+	read, err := s.ReadRange(pos, 0, 16) // el encabezado del registro
+	require.NoError(t, err)
+	require.Equal(t, value[:16], read)
+	read, err = s.ReadRange(pos, 1000, 24)
+	require.NoError(t, err)
+	require.Equal(t, value[1000:1024], read)
+	read, err = s.ReadRange(pos, len(value)-8, 8)
+	require.NoError(t, err)
+	require.Equal(t, value[len(value)-8:], read)
+
+	// sólo se asigna el rango pedido
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 10; i++ {
+		_, err := s.ReadRange(pos, i*100, 64)
+		require.NoError(t, err)
+	}
+	runtime.ReadMemStats(&after)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(value)))
+
+	_, err = s.ReadRange(pos, len(value)-8, 9)
+	require.ErrorIs(t, err, ErrInvalidRange)
+	_, err = s.ReadRange(pos, -1, 8)
+	require.ErrorIs(t, err, ErrInvalidRange)
+	_, err = s.ReadRange(s.size, 0, 1)
+	require.Equal(t, ErrOutOfBounds{Pos: s.size, Size: s.size}, err)
+}
+
+func TestStoreReadAfterAppend(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_read_after_append_test")
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// el registro queda en el buffer, no en el archivo
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	_, size, err := openFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(storeHeaderWidth), size)
+
+	// pero una lectura lo ve enseguida
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	for i := 0; i < 10; i++ {
+		value := []byte(fmt.Sprintf("record %d", i))
+		_, pos, err := s.Append(value)
+		require.NoError(t, err)
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, value, read)
+	}
+
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Flush())
+	_, size, err = openFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(s.size), size)
+}
+
+func TestStoreDiskFull(t *testing.T) {
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("/dev/full not available")
+	}
+	defer full.Close()
+	f, err := os.CreateTemp(t.TempDir(), "store_disk_full_test")
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// registros agregados que todavía están en el buffer
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	size := s.size
+
+	// con el disco lleno, un registro que no entra en el buffer falla sin
+	// cambiar el store, tanto si hay algo pendiente como si no
+	s.File = full
+	large := make([]byte, storeBufferSize)
+	_, _, err = s.Append(large)
+	require.ErrorIs(t, err, ErrDiskFull)
+	require.ErrorIs(t, err, syscall.ENOSPC)
+	require.Equal(t, size, s.size)
+	require.ErrorIs(t, s.Flush(), ErrDiskFull)
+
+	// al liberarse espacio los registros pendientes se escriben y los nuevos
+	// siguen donde terminaban
+	s.File = f
+	require.NoError(t, s.Flush())
+	for _, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	_, pos, err := s.Append(large)
+	require.NoError(t, err)
+	require.Equal(t, size, pos)
+
+	// un registro grande que falla sin nada pendiente tampoco deja rastros
+	size = s.size
+	s.File = full
+	_, _, err = s.Append(large)
+	require.ErrorIs(t, err, ErrDiskFull)
+	require.Equal(t, size, s.size)
+	s.File = f
+	_, pos, err = s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, size, pos)
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, fileSize, err := openFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(s.size), fileSize)
+}
+
+func BenchmarkStoreAppend(b *testing.B) {
+	value := make([]byte, 100)
+	for name, flush := range map[string]bool{
+		"buffered":        false,
+		"flush each time": true, // lo que hacía Append antes de dejar de vaciar el buffer
+	} {
+		b.Run(name, func(b *testing.B) {
+			f, err := os.CreateTemp(b.TempDir(), "store_append_bench")
+			require.NoError(b, err)
+			s, err := newStore(f)
+			require.NoError(b, err)
+			defer s.Close()
+			b.SetBytes(int64(len(value)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.Append(value); err != nil {
+					b.Fatal(err)
+				}
+				if flush {
+					if err := s.Flush(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			if err := s.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkStoreRead(b *testing.B) {
+	s := benchmarkStore(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Read(storeHeaderWidth); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStoreReadInto(b *testing.B) {
+	s := benchmarkStore(b)
+	buf := make([]byte, 0, len(write))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ReadInto(storeHeaderWidth, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkStore(b *testing.B) *Store {
+	f, err := os.CreateTemp(b.TempDir(), "store_bench")
+	require.NoError(b, err)
+	s, err := newStore(f)
+	require.NoError(b, err)
+	b.Cleanup(func() { s.Close() })
+	_, _, err = s.Append(write)
+	require.NoError(b, err)
+	return s
+}
+
+func TestStoreConcurrentReadAppend(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_concurrent_test")
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// los lectores leen registros viejos, vaciados, y recién agregados, en el buffer
+	var mu sync.Mutex
+	var positions []uint64
+	values := make(map[uint64][]byte)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				mu.Lock()
+				if len(positions) == 0 {
+					mu.Unlock()
+					continue
+				}
+				pos := positions[len(positions)-1]
+				if rng.Intn(2) == 0 {
+					pos = positions[rng.Intn(len(positions))]
+				}
+				want := values[pos]
+				mu.Unlock()
+				read, err := s.Read(pos)
+				require.NoError(t, err)
+				require.Equal(t, want, read)
+			}
+		}(int64(i))
+	}
+	for i := 0; i < 2000; i++ {
+		value := []byte(fmt.Sprintf("record %d", i))
+		_, pos, err := s.Append(value)
+		require.NoError(t, err)
+		mu.Lock()
+		positions = append(positions, pos)
+		values[pos] = value
+		mu.Unlock()
+		if i%100 == 0 {
+			require.NoError(t, s.Flush())
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// BenchmarkStoreReadWhileAppending lee registros viejos desde varias goroutines
+// mientras otra agrega registros sin parar.
+func BenchmarkStoreReadWhileAppending(b *testing.B) {
+	f, err := os.CreateTemp(b.TempDir(), "store_concurrent_bench")
+	require.NoError(b, err)
+	s, err := newStore(f)
+	require.NoError(b, err)
+	b.Cleanup(func() { s.Close() })
+	value := make([]byte, 256)
+	var positions []uint64
+	for i := 0; i < 1000; i++ {
+		_, pos, err := s.Append(value)
+		require.NoError(b, err)
+		positions = append(positions, pos)
+	}
+	require.NoError(b, s.Flush())
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, _, err := s.Append(value); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	b.SetBytes(int64(len(value)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 0, len(value))
+		for i := 0; pb.Next(); i++ {
+			if _, err := s.ReadInto(positions[i%len(positions)], buf); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
+
+func TestStoreDefragment(t *testing.T) {
+	f, err := os.CreateTemp("", "store_defragment_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	keep := make(map[uint64]struct{})
+	var want [][]byte
+	for i := 0; i < 10; i++ {
+		value := []byte(fmt.Sprintf("record %d", i))
+		_, pos, err := s.Append(value)
+		require.NoError(t, err)
+		if i%2 == 0 {
+			keep[pos] = struct{}{}
+			want = append(want, value)
+		}
+	}
+	name := s.Name()
+
+	size, err := s.Defragment(keep)
+	require.NoError(t, err)
+	require.Equal(t, s.size, size)
+	require.Equal(t, name, s.Name())
+	_, err = os.Stat(name + ".tmp")
+	require.True(t, os.IsNotExist(err))
+
+	// los registros conservados quedan contiguos y en el mismo orden
+	pos := uint64(storeHeaderWidth)
+	for _, value := range want {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, value, read)
+		pos += lenWidth + crcWidth + uint64(len(value))
+	}
+	require.Equal(t, size, pos)
+
+	// el store sigue aceptando registros al final
+	_, pos, err = s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, size, pos)
+	require.NoError(t, s.Close())
+	_, fileSize, err := openFile(name)
+	require.NoError(t, err)
+	require.Equal(t, int64(size+width), fileSize)
+}
+
+// BenchmarkStoreDefragment lee los registros que quedan de un store con la mitad
+// de los registros descartados, antes y después de defragmentarlo.
+func BenchmarkStoreDefragment(b *testing.B) {
+	f, err := os.CreateTemp(b.TempDir(), "store_defragment_bench")
+	require.NoError(b, err)
+	s, err := newStore(f)
+	require.NoError(b, err)
+	b.Cleanup(func() { s.Close() })
+	value := make([]byte, 256)
+	keep := make(map[uint64]struct{})
+	var sparse []uint64
+	for i := 0; i < 10000; i++ {
+		_, pos, err := s.Append(value)
+		require.NoError(b, err)
+		if i%2 == 0 {
+			keep[pos] = struct{}{}
+			sparse = append(sparse, pos)
+		}
+	}
+	read := func(b *testing.B, positions []uint64) {
+		buf := make([]byte, 0, len(value))
+		b.SetBytes(int64(len(value)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := s.ReadInto(positions[i%len(positions)], buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("sparse", func(b *testing.B) { read(b, sparse) })
+	_, err = s.Defragment(keep)
+	require.NoError(b, err)
+	dense := make([]uint64, len(sparse))
+	for i := range dense {
+		dense[i] = storeHeaderWidth + uint64(i)*(lenWidth+crcWidth+uint64(len(value)))
+	}
+	b.Run("defragmented", func(b *testing.B) { read(b, dense) })
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
 	require.NoError(t, err)
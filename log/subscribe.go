@@ -0,0 +1,59 @@
+package log
+
+// Este archivo publica los registros del log en un canal, para los consumers
+// que prefieren recibir registros a recorrer el log con un Iterator.
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	api "github.com/dati/api/v1"
+)
+
+// Subscribe publica en el canal de registros, en orden, los registros desde
+// startOffset, incluidos los que se agreguen después. El canal tiene lugar para
+// bufSize registros. Un error de lectura se envía al canal de errores y termina
+// la suscripción; si el log se cierra se envía io.EOF. Al terminar, o cuando ctx
+// termina, se cierran los dos canales. Cada llamada tiene sus propios canales.
+func (l *Log) Subscribe(ctx context.Context, startOffset uint64, bufSize int) (<-chan *api.Record, <-chan error) {
+	records := make(chan *api.Record, bufSize)
+	errs := make(chan error, 1) // Con lugar para el error final, así no se pierde si nadie lo espera
+	l.mu.RLock()
+	done := l.done // El de este log abierto; Reset crea otro
+	l.mu.RUnlock()
+	go func() {
+		defer close(records)
+		defer close(errs)
+		it := l.NewIterator(startOffset)
+		for {
+			// El canal se pide antes de leer para no perderse un Append intermedio.
+			appended := l.Watch()
+			record, err := it.Next()
+			if err == io.EOF {
+				select {
+				case <-ctx.Done():
+					return
+				case <-done:
+					errs <- io.EOF
+					return
+				case <-appended:
+				}
+				continue
+			}
+			if errors.Is(err, ErrLogClosed) {
+				err = io.EOF
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case records <- record:
+			}
+		}
+	}()
+	return records, errs
+}
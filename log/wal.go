@@ -0,0 +1,200 @@
+package log
+
+// Este archivo implementa el write-ahead log opcional de los segmentos, que
+// guarda cada registro antes de escribirlo en el store y el índice para
+// rehacerlo si el proceso cae entre las dos escrituras.
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+// Operaciones de las entradas del WAL.
+const (
+	walAppend = 1 // Registro que se va a agregar: offset relativo | valor del store
+	walCommit = 2 // El último walAppend ya está en el store y el índice: offset relativo
+)
+
+// Cada entrada del WAL es op | len | payload | crc32c, con el checksum de todo
+// lo anterior, así una entrada escrita a medias se reconoce y se descarta.
+const (
+	walOpWidth     = 1
+	walHeaderWidth = walOpWidth + lenWidth
+	walRelWidth    = 4 // Ancho del offset relativo al principio del payload
+)
+
+// wal es el write-ahead log del segmento activo. Sólo tiene las entradas desde
+// el último Sync del segmento; al sellarlo o cerrarlo se borra.
+type wal struct {
+	file *os.File
+	size int64 // Fin de la última entrada
+	last int64 // Principio de la última entrada walAppend, para rollback
+}
+
+// walPath retorna la ruta del WAL del segmento.
+func (s *Segment) walPath() string {
+	return path.Join(s.dir, s.fileName()+".wal")
+}
+
+// openWAL crea un WAL vacío en name, reemplazando uno anterior que ya se
+// recuperó.
+func openWAL(name string, perm os.FileMode) (*wal, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{file: f}, nil
+}
+
+// begin guarda en el WAL el valor que se va a agregar con el offset relativo
+// rel y espera a que llegue a disco.
+func (w *wal) begin(rel uint32, value []byte) error {
+	payload := enc.AppendUint32(make([]byte, 0, walRelWidth+len(value)), rel)
+	if err := w.write(walAppend, append(payload, value...)); err != nil {
+		return err
+	}
+	return datasync(w.file)
+}
+
+// commit marca el último begin como escrito en el store y el índice. No
+// sincroniza: si la marca se pierde, al recuperar se encuentra el registro ya
+// escrito y no se rehace.
+func (w *wal) commit(rel uint32) error {
+	return w.write(walCommit, enc.AppendUint32(nil, rel))
+}
+
+// rollback quita el último begin, cuyo registro no se escribió.
+func (w *wal) rollback() error {
+	if err := w.file.Truncate(w.last); err != nil {
+		return err
+	}
+	w.size = w.last
+	return nil
+}
+
+// reset vacía el WAL; quien lo llama ya llevó el store y el índice a disco.
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.size, w.last = 0, 0
+	return nil
+}
+
+// remove cierra y borra el WAL.
+func (w *wal) remove() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.file.Name())
+}
+
+func (w *wal) write(op byte, payload []byte) error {
+	entry := make([]byte, 0, walHeaderWidth+len(payload)+crcWidth)
+	entry = append(entry, op)
+	entry = enc.AppendUint64(entry, uint64(len(payload)))
+	entry = append(entry, payload...)
+	entry = enc.AppendUint32(entry, crc32.Checksum(entry, crcTable))
+	if _, err := w.file.WriteAt(entry, w.size); err != nil {
+		return err
+	}
+	if op == walAppend {
+		w.last = w.size
+	}
+	w.size += int64(len(entry))
+	return nil
+}
+
+// walPending retorna el registro del último walAppend del WAL en name si no
+// tiene su walCommit. Descarta una entrada final escrita a medias. Sin WAL
+// retorna ok en false.
+func walPending(name string) (rel uint32, value []byte, ok bool, err error) {
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	for len(b) >= walHeaderWidth+crcWidth {
+		n := enc.Uint64(b[walOpWidth:])
+		if n > uint64(len(b)-walHeaderWidth-crcWidth) {
+			break // El proceso cayó escribiendo la entrada
+		}
+		end := walHeaderWidth + int(n)
+		if crc32.Checksum(b[:end], crcTable) != enc.Uint32(b[end:]) || n < walRelWidth {
+			break
+		}
+		payload := b[walHeaderWidth:end]
+		switch b[0] {
+		case walAppend:
+			rel, value, ok = enc.Uint32(payload), payload[walRelWidth:], true
+		case walCommit:
+			if ok && enc.Uint32(payload) == rel {
+				ok = false
+			}
+		}
+		b = b[end+crcWidth:]
+	}
+	return rel, value, ok, nil
+}
+
+// recoverWAL rehace el registro que el WAL tiene sin confirmar, si el proceso
+// cayó antes de escribirlo en el store o en el índice. Si ya está escrito lo
+// deja como está; si quedó a medias descarta lo escrito y lo vuelve a agregar.
+// Se llama al abrir el segmento, con el índice abierto para escritura y antes
+// de validarlo contra el store.
+func (s *Segment) recoverWAL() error {
+	rel, value, ok, err := walPending(s.walPath())
+	if err != nil || !ok {
+		return err
+	}
+	lastRel, pos, err := s.index.Read(-1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	end := s.store.start // Fin del último registro indexado
+	if err == io.EOF && rel != 0 {
+		// Un índice vacío para un registro que no es el primero es uno que se
+		// descartó por corrupto; el store se reindexa sin tocarlo.
+		return nil
+	}
+	if err == nil {
+		switch {
+		case lastRel > rel:
+			return nil // El índice ya siguió después del registro
+		case lastRel == rel && s.storeHas(pos, value):
+			return nil // Sólo faltó la marca
+		case lastRel == rel:
+			s.index.size -= entWidth // La entrada apunta a un registro que no llegó al store
+		}
+		if _, pos, err = s.index.Read(-1); err == nil {
+			size := make([]byte, lenWidth)
+			if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+				return err
+			}
+			end = pos + s.store.frameWidth() + enc.Uint64(size)
+		} else if err != io.EOF {
+			return err
+		}
+	}
+	if err := s.store.Truncate(end); err != nil { // Descarta los bytes del registro a medias
+		return err
+	}
+	if _, pos, err = s.store.Append(value); err != nil {
+		return err
+	}
+	if err := s.store.Flush(); err != nil {
+		return err
+	}
+	return s.index.Write(rel, pos)
+}
+
+// storeHas indica si el store tiene en pos un registro completo con value.
+func (s *Segment) storeHas(pos uint64, value []byte) bool {
+	got, err := s.store.Read(pos)
+	return err == nil && bytes.Equal(got, value)
+}
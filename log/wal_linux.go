@@ -0,0 +1,12 @@
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+// datasync lleva a disco los datos del archivo con fdatasync, sin esperar a
+// los metadatos que no hacen falta para leerlos, como la fecha de modificación.
+func datasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package log
+
+import (
+	"os"
+)
+
+// datasync lleva a disco el archivo. Sin fdatasync hace fsync, que también
+// escribe los metadatos.
+func datasync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,178 @@
+package log
+
+// Este archivo avisa de cada Append a sistemas externos con un POST HTTP, sin
+// que tengan que consultar el log.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// WebhookConfig es un endpoint que recibe un WebhookEvent por cada registro
+// agregado con Append.
+type WebhookConfig struct {
+	URL string
+	// Secret firma el cuerpo de cada POST con HMAC-SHA256 en el header
+	// X-Signature-256, como "sha256=" seguido de la firma en hexadecimal.
+	Secret string
+	// MaxRetries es cuántas veces se reintenta un POST fallido, esperando
+	// webhookBackoff y el doble en cada reintento. En cero no se reintenta.
+	MaxRetries int
+	// TimeoutSeconds es el tiempo máximo de cada POST; en cero se usa
+	// DefaultWebhookTimeout.
+	TimeoutSeconds int
+}
+
+// WebhookEvent es el cuerpo JSON de cada POST de un webhook.
+type WebhookEvent struct {
+	Offset     uint64    `json:"offset"`
+	RecordSize int       `json:"record_size"` // Bytes del registro serializado
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+const (
+	// DefaultWebhookTimeout es el tiempo máximo de un POST con TimeoutSeconds en cero.
+	DefaultWebhookTimeout = 10 * time.Second
+	// webhookQueueSize es cuántos eventos esperan entrega antes de descartarse.
+	webhookQueueSize = 1024
+	// webhookBackoff es la espera antes del primer reintento.
+	webhookBackoff = 100 * time.Millisecond
+)
+
+// webhookDispatcher entrega los eventos encolados por Append desde una
+// goroutine, para que un endpoint lento no frene las escrituras.
+type webhookDispatcher struct {
+	webhooks []WebhookConfig
+	client   *http.Client
+	logger   *slog.Logger
+	events   chan WebhookEvent
+	cancel   context.CancelFunc // Corta la entrega en curso y termina la goroutine
+	stopped  chan struct{}      // Se cierra cuando terminó la goroutine
+}
+
+// startWebhooks arranca la entrega de eventos si hay Webhooks configurados.
+func (l *Log) startWebhooks() {
+	if len(l.Config.Webhooks) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &webhookDispatcher{
+		webhooks: l.Config.Webhooks,
+		client:   &http.Client{},
+		logger:   l.logger,
+		events:   make(chan WebhookEvent, webhookQueueSize),
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+	}
+	l.webhooks.Store(d)
+	go d.run(ctx)
+}
+
+// stopWebhooks detiene la entrega de eventos y espera a que termine. Los
+// eventos que seguían en la cola se pierden.
+func (l *Log) stopWebhooks() {
+	if d := l.webhooks.Swap(nil); d != nil {
+		d.cancel()
+		<-d.stopped
+	}
+}
+
+// enqueueWebhook encola el evento del registro agregado en off. Si la cola está
+// llena lo descarta en vez de bloquear el Append.
+func (l *Log) enqueueWebhook(record *api.Record, off uint64) {
+	d := l.webhooks.Load()
+	if d == nil {
+		return
+	}
+	event := WebhookEvent{
+		Offset:     off,
+		RecordSize: proto.Size(record),
+		Timestamp:  time.Unix(0, record.Timestamp).UTC(),
+	}
+	select {
+	case d.events <- event:
+	default:
+		l.logger.Warn("webhook queue full, event dropped", slog.Uint64("offset", off))
+	}
+}
+
+func (d *webhookDispatcher) run(ctx context.Context) {
+	defer close(d.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-d.events:
+			body, err := json.Marshal(event)
+			if err != nil {
+				d.logger.Error("encode webhook event failed", slog.Any("error", err))
+				continue
+			}
+			for _, w := range d.webhooks {
+				if err := d.deliver(ctx, w, body); err != nil && ctx.Err() == nil {
+					d.logger.Error("webhook delivery failed",
+						slog.String("url", w.URL),
+						slog.Uint64("offset", event.Offset),
+						slog.Any("error", err),
+					)
+				}
+			}
+		}
+	}
+}
+
+// deliver hace el POST de body a w, reintentando con backoff exponencial hasta
+// MaxRetries veces.
+func (d *webhookDispatcher) deliver(ctx context.Context, w WebhookConfig, body []byte) error {
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	timeout := time.Duration(w.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err := d.post(ctx, w.URL, signature, body, timeout)
+		if err == nil || attempt >= w.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (d *webhookDispatcher) post(ctx context.Context, url, signature string, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-256", signature)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("log: webhook responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+
+	api "github.com/dati/api/v1"
+	"github.com/dati/log"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultAdminAddr is where the admin server listens unless configured
+// otherwise; logserver takes its port from config.DefaultAdminPort. It is a
+// different port from the Log service so it can be firewalled on its own.
+const DefaultAdminAddr = ":8081"
+
+const adminAction = "admin"
+
+// AdminLog is the log managed through the admin service. *log.Log
+// implements it.
+type AdminLog interface {
+	Stats() log.LogStats
+	CompactByKey() error
+	Rotate() (uint64, error)
+	Truncate(lowest uint64) error
+	SetSegmentLimits(maxStoreBytes, maxIndexBytes uint64) (uint64, uint64)
+	DiffRange(other *log.Log, startOffset, endOffset uint64) ([]log.DiffEntry, error)
+}
+
+type AdminConfig struct {
+	Log AdminLog
+	// Authorizer, when set, must allow the "admin" action for the client's
+	// subject. When nil any client with a certificate the server trusts is
+	// an admin, so the admin server should use credentials whose ClientCAs
+	// hold only the admin CA.
+	Authorizer Authorizer
+	// Replica is the copy of Log that DiffLogs compares it with, for example
+	// a follower's log restored from a snapshot. When nil DiffLogs fails with
+	// FailedPrecondition.
+	Replica *log.Log
+}
+
+var _ api.AdminServiceServer = (*adminServer)(nil)
+
+type adminServer struct {
+	api.UnimplementedAdminServiceServer
+	*AdminConfig
+	logger *slog.Logger
+}
+
+// NewAdminServer returns a gRPC server with only the admin service
+// registered. Every call requires a client certificate, so pass grpc.Creds
+// built with config.SetupTLSConfig and Server set to true.
+func NewAdminServer(config *AdminConfig, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	srv := &adminServer{
+		AdminConfig: config,
+		logger:      slog.Default().With(slog.String("service", "admin")),
+	}
+	opts = append(opts, grpc.StreamInterceptor(
+		grpc_middleware.ChainStreamServer(
+			grpc_auth.StreamServerInterceptor(authenticate),
+		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+		grpc_auth.UnaryServerInterceptor(authenticate),
+		srv.authorize,
+	)))
+	gsrv := grpc.NewServer(opts...)
+	api.RegisterAdminServiceServer(gsrv, srv)
+	return gsrv, nil
+}
+
+// authorize checks every admin call against the Authorizer, if any.
+func (s *adminServer) authorize(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if s.Authorizer != nil {
+		if err := s.Authorizer.Authorize(subject(ctx), objectWildcard, adminAction); err != nil {
+			return nil, err
+		}
+	}
+	s.logger.Info("admin call",
+		slog.String("method", info.FullMethod),
+		slog.String("subject", subject(ctx)),
+	)
+	return handler(ctx, req)
+}
+
+func (s *adminServer) GetStats(ctx context.Context, req *api.GetStatsRequest) (*api.LogStats, error) {
+	stats := s.Log.Stats()
+	return &api.LogStats{
+		RecordCount:    stats.RecordCount,
+		StoreSizeBytes: stats.StoreSizeBytes,
+		IndexSizeBytes: stats.IndexSizeBytes,
+		SegmentCount:   stats.SegmentCount,
+		LowestOffset:   stats.LowestOffset,
+		HighestOffset:  stats.HighestOffset,
+	}, nil
+}
+
+func (s *adminServer) TriggerCompaction(ctx context.Context, req *api.CompactionRequest) (*api.CompactionResult, error) {
+	before := s.Log.Stats()
+	if err := s.Log.CompactByKey(); err != nil {
+		s.logger.Error("compaction failed", slog.Any("error", err))
+		return nil, err
+	}
+	after := s.Log.Stats()
+	return &api.CompactionResult{
+		RecordsBefore:    before.RecordCount,
+		RecordsAfter:     after.RecordCount,
+		StoreBytesBefore: before.StoreSizeBytes,
+		StoreBytesAfter:  after.StoreSizeBytes,
+	}, nil
+}
+
+func (s *adminServer) RotateSegment(ctx context.Context, req *api.RotateRequest) (*api.RotateResponse, error) {
+	base, err := s.Log.Rotate()
+	if err != nil {
+		s.logger.Error("rotate failed", slog.Any("error", err))
+		return nil, err
+	}
+	return &api.RotateResponse{BaseOffset: base}, nil
+}
+
+func (s *adminServer) TruncateToOffset(ctx context.Context, req *api.TruncateRequest) (*api.TruncateResponse, error) {
+	// An offset past the end would only keep the active segment, which is
+	// more likely a typo than what the operator meant.
+	if highest := s.Log.Stats().HighestOffset; req.Offset > highest {
+		return nil, status.Errorf(codes.InvalidArgument, "offset %d is past the highest offset %d", req.Offset, highest)
+	}
+	if err := s.Log.Truncate(req.Offset); err != nil {
+		s.logger.Error("truncate failed", slog.Any("error", err))
+		return nil, err
+	}
+	return &api.TruncateResponse{LowestOffset: s.Log.Stats().LowestOffset}, nil
+}
+
+func (s *adminServer) SetConfig(ctx context.Context, req *api.ConfigPatch) (*api.ConfigResponse, error) {
+	maxStore, maxIndex := s.Log.SetSegmentLimits(req.MaxStoreBytes, req.MaxIndexBytes)
+	return &api.ConfigResponse{
+		MaxStoreBytes: maxStore,
+		MaxIndexBytes: maxIndex,
+	}, nil
+}
+
+func (s *adminServer) DiffLogs(ctx context.Context, req *api.DiffRequest) (*api.DiffReport, error) {
+	if s.Replica == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no replica configured to diff against")
+	}
+	end := req.EndOffset
+	if end == 0 {
+		end = math.MaxUint64
+	}
+	entries, err := s.Log.DiffRange(s.Replica, req.StartOffset, end)
+	report := &api.DiffReport{Truncated: errors.Is(err, log.ErrDiffLimit)}
+	if err != nil && !report.Truncated {
+		s.logger.Error("diff failed", slog.Any("error", err))
+		return nil, err
+	}
+	for _, e := range entries {
+		report.Entries = append(report.Entries, &api.DiffEntry{
+			Offset:      e.Offset,
+			LeaderCrc:   e.LeaderCRC,
+			FollowerCrc: e.FollowerCRC,
+			Diverges:    e.Diverges,
+		})
+	}
+	return report, nil
+}
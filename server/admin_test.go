@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	api "github.com/dati/api/v1"
+	"github.com/dati/auth"
+	tlsconfig "github.com/dati/config"
+	"github.com/dati/log"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// setupAdmin starts an admin server with config and returns a client that
+// authenticates as root.
+func setupAdmin(t *testing.T, config *AdminConfig) api.AdminServiceClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLS, err := tlsconfig.SetupTLSConfig(tlsconfig.TLSConfig{
+		CertFile: tlsconfig.ServerCertFile,
+		KeyFile:  tlsconfig.ServerKeyFile,
+		CAFile:   tlsconfig.CAFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	server, err := NewAdminServer(config, grpc.Creds(credentials.NewTLS(serverTLS)))
+	require.NoError(t, err)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	clientTLS, err := tlsconfig.SetupTLSConfig(tlsconfig.TLSConfig{
+		CertFile: tlsconfig.RootClientCertFile,
+		KeyFile:  tlsconfig.RootClientKeyFile,
+		CAFile:   tlsconfig.CAFile,
+	})
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return api.NewAdminServiceClient(conn)
+}
+
+func TestAdminServer(t *testing.T) {
+	ctx := context.Background()
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	client := setupAdmin(t, &AdminConfig{Log: clog})
+
+	for i := 0; i < 3; i++ {
+		_, err := clog.Append(&api.Record{Key: []byte("k"), Value: []byte("v")})
+		require.NoError(t, err)
+	}
+	stats, err := client.GetStats(ctx, &api.GetStatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), stats.RecordCount)
+	require.Equal(t, uint64(1), stats.SegmentCount)
+	require.Equal(t, uint64(2), stats.HighestOffset)
+
+	rotated, err := client.RotateSegment(ctx, &api.RotateRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), rotated.BaseOffset)
+	// the new active segment is empty, so rotating again is a no-op
+	rotated, err = client.RotateSegment(ctx, &api.RotateRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), rotated.BaseOffset)
+
+	compacted, err := client.TriggerCompaction(ctx, &api.CompactionRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), compacted.RecordsBefore)
+	require.Equal(t, uint64(1), compacted.RecordsAfter)
+	require.Less(t, compacted.StoreBytesAfter, compacted.StoreBytesBefore)
+
+	cfg, err := client.SetConfig(ctx, &api.ConfigPatch{MaxIndexBytes: 4096})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), cfg.MaxStoreBytes)
+	require.Equal(t, uint64(4096), cfg.MaxIndexBytes)
+
+	_, err = clog.Append(&api.Record{Value: []byte("v")})
+	require.NoError(t, err)
+	truncated, err := client.TruncateToOffset(ctx, &api.TruncateRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), truncated.LowestOffset)
+	for off := uint64(0); off < 3; off++ {
+		_, err := clog.Read(off)
+		require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	}
+	_, err = clog.Read(3)
+	require.NoError(t, err)
+
+	// truncating past the end is rejected and keeps the log as it was
+	_, err = client.TruncateToOffset(ctx, &api.TruncateRequest{Offset: 100})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	stats, err = client.GetStats(ctx, &api.GetStatsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), stats.LowestOffset)
+	require.Equal(t, uint64(3), stats.HighestOffset)
+}
+
+func TestAdminServerAuthorizer(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	// the test policy grants root produce and consume, but not admin
+	client := setupAdmin(t, &AdminConfig{
+		Log:        clog,
+		Authorizer: auth.New(tlsconfig.ACLModelFile, tlsconfig.ACLPolicyFile),
+	})
+	_, err = client.GetStats(context.Background(), &api.GetStatsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestAdminServerDiffLogs(t *testing.T) {
+	ctx := context.Background()
+	leader, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer leader.Close()
+	client := setupAdmin(t, &AdminConfig{Log: leader})
+	_, err = client.DiffLogs(ctx, &api.DiffRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	c := log.Config{MaxDiffEntries: 2}
+	leader, err = log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer leader.Close()
+	follower, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer follower.Close()
+	for i := 0; i < 5; i++ {
+		record := &api.Record{Value: []byte("same"), Timestamp: 1}
+		if i >= 2 {
+			record.Value = []byte("leader")
+		}
+		_, err := leader.Append(record)
+		require.NoError(t, err)
+		if i < 4 {
+			_, err = follower.Append(&api.Record{Value: []byte("same"), Timestamp: 1})
+			require.NoError(t, err)
+		}
+	}
+	client = setupAdmin(t, &AdminConfig{Log: leader, Replica: follower})
+
+	report, err := client.DiffLogs(ctx, &api.DiffRequest{StartOffset: 0, EndOffset: 2})
+	require.NoError(t, err)
+	require.False(t, report.Truncated)
+	require.Len(t, report.Entries, 1)
+	require.Equal(t, uint64(2), report.Entries[0].Offset)
+	require.True(t, report.Entries[0].Diverges)
+	require.NotEqual(t, report.Entries[0].LeaderCrc, report.Entries[0].FollowerCrc)
+
+	// offsets 2, 3 and 4 differ, but the leader returns at most two
+	report, err = client.DiffLogs(ctx, &api.DiffRequest{StartOffset: 1})
+	require.NoError(t, err)
+	require.True(t, report.Truncated)
+	require.Len(t, report.Entries, 2)
+	require.Equal(t, uint64(3), report.Entries[1].Offset)
+}
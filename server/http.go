@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// OffsetLog is what the HTTP handler needs to report on the log. *log.Log
+// implements it.
+type OffsetLog interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	Count() (uint64, error)
+}
+
+// Offsets is the body of GET /offsets. Highest is null while the log has no
+// records, since offset 0 would otherwise read as a record.
+type Offsets struct {
+	Lowest  uint64  `json:"lowest"`
+	Highest *uint64 `json:"highest"`
+}
+
+// HTTPOption configures the handler returned by NewHTTPHandler.
+type HTTPOption func(*httpHandler)
+
+// WithPingInterval sets how long a record stream may stay idle before the
+// server pings the client. It defaults to DefaultPingInterval.
+func WithPingInterval(d time.Duration) HTTPOption {
+	return func(h *httpHandler) {
+		h.pingInterval = d
+	}
+}
+
+// WithShutdown closes every open record stream once ctx is done. Pass the
+// context canceled on server shutdown: http.Server.Shutdown doesn't wait for
+// or close WebSocket connections.
+func WithShutdown(ctx context.Context) HTTPOption {
+	return func(h *httpHandler) {
+		h.ctx = ctx
+	}
+}
+
+// WithMaxBodyBytes limits request bodies to n bytes with MaxBodyBytes. It
+// defaults to DefaultMaxBodyBytes; zero or less means no limit.
+func WithMaxBodyBytes(n int64) HTTPOption {
+	return func(h *httpHandler) {
+		h.maxBodyBytes = n
+	}
+}
+
+// WithMetrics serves m at GET /metrics.
+func WithMetrics(m *Metrics) HTTPOption {
+	return func(h *httpHandler) {
+		h.metrics = m
+	}
+}
+
+type httpHandler struct {
+	ctx          context.Context
+	pingInterval time.Duration
+	metrics      *Metrics
+	maxBodyBytes int64
+}
+
+// DefaultMaxBodyBytes is the request body limit of NewHTTPHandler.
+const DefaultMaxBodyBytes = 1 << 20
+
+// MaxBodyBytes returns middleware that rejects request bodies over limit
+// bytes with 413 and a JSON error. A body that declares a larger
+// Content-Length is rejected before the handler runs; any other body is cut
+// off by http.MaxBytesReader, and the handler's read fails with
+// *http.MaxBytesError once it passes the limit.
+func MaxBodyBytes(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				writeBodyTooLarge(w, limit)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeBodyTooLarge answers a request whose body is over limit bytes.
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close") // The rest of the body is left unread
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": fmt.Sprintf("request body larger than %d bytes", limit),
+	})
+}
+
+// NewHTTPHandler returns a handler for monitoring the log without gRPC:
+//
+//	GET /health          200 if the log answers, 503 otherwise
+//	GET /offsets         the log's Offsets as JSON
+//	GET /stats           the log's LogStats as JSON, only if log is a StatsLog
+//	GET /record/{offset} the record as JSON, only if log is a RecordLog; a
+//	                     negative offset counts back from the end, -1 being
+//	                     the last record
+//	GET /record/stream   a WebSocket of StreamFrames from ?startOffset=N,
+//	                     only if log is a RecordLog
+//	GET /metrics         Prometheus metrics, only WithMetrics
+//
+// Request bodies are limited to DefaultMaxBodyBytes unless WithMaxBodyBytes
+// says otherwise.
+func NewHTTPHandler(log OffsetLog, opts ...HTTPOption) http.Handler {
+	h := &httpHandler{
+		ctx:          context.Background(),
+		pingInterval: DefaultPingInterval,
+		maxBodyBytes: DefaultMaxBodyBytes,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := log.LowestOffset(); err != nil {
+			slog.Error("health check failed", slog.Any("error", err))
+			http.Error(w, "log unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /offsets", func(w http.ResponseWriter, r *http.Request) {
+		offsets, err := readOffsets(log)
+		if err != nil {
+			slog.Error("read offsets failed", slog.Any("error", err))
+			http.Error(w, "log unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(offsets)
+	})
+	if log, ok := log.(StatsLog); ok {
+		mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(log.Stats())
+		})
+	}
+	if log, ok := log.(RecordLog); ok {
+		mux.HandleFunc("GET /record/{offset}", getRecord(log))
+		mux.HandleFunc("GET /record/stream", h.streamRecords(log))
+	}
+	if h.metrics != nil {
+		mux.Handle("GET /metrics", h.metrics)
+	}
+	if h.maxBodyBytes > 0 {
+		return MaxBodyBytes(h.maxBodyBytes)(mux)
+	}
+	return mux
+}
+
+// getRecord serves the record at the offset path value. A negative offset is
+// resolved against HighestOffset; one that falls before LowestOffset, or any
+// offset on an empty log, is 404.
+func getRecord(log RecordLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rel, err := strconv.ParseInt(r.PathValue("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		offsets, err := readOffsets(log)
+		if err != nil {
+			slog.Error("read offsets failed", slog.Any("error", err))
+			http.Error(w, "log unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if offsets.Highest == nil {
+			http.Error(w, "log is empty", http.StatusNotFound)
+			return
+		}
+		off := uint64(rel)
+		if rel < 0 {
+			back := uint64(-(rel + 1)) // -1 is the last record; avoids overflowing on MinInt64
+			if back > *offsets.Highest-offsets.Lowest {
+				http.Error(w, "offset out of range", http.StatusNotFound)
+				return
+			}
+			off = *offsets.Highest - back
+		}
+		record, err := log.Read(off)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) || errors.As(err, &api.ErrRecordDeleted{}) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("read record failed", slog.Uint64("offset", off), slog.Any("error", err))
+			http.Error(w, "log unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		value, err := protojson.Marshal(record)
+		if err != nil {
+			slog.Error("marshal record failed", slog.Any("error", err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(value)
+	}
+}
+
+func readOffsets(log OffsetLog) (*Offsets, error) {
+	lowest, err := log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	offsets := &Offsets{Lowest: lowest}
+	count, err := log.Count()
+	if err != nil || count == 0 {
+		return offsets, err
+	}
+	highest, err := log.HighestOffset()
+	if err != nil {
+		return nil, err
+	}
+	offsets.Highest = &highest
+	return offsets, nil
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"github.com/dati/log"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPHandler(clog))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/health")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	getOffsets := func() map[string]any {
+		res, err := http.Get(srv.URL + "/offsets")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		return body
+	}
+
+	// an empty log has no highest offset
+	require.Equal(t, map[string]any{"lowest": 0.0, "highest": nil}, getOffsets())
+
+	for i := 0; i < 3; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Equal(t, map[string]any{"lowest": 0.0, "highest": 2.0}, getOffsets())
+
+	res, err = http.Get(srv.URL + "/stats")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var stats log.LogStats
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+	res.Body.Close()
+	require.Equal(t, uint64(3), stats.RecordCount)
+	require.Equal(t, uint64(1), stats.SegmentCount)
+	require.Equal(t, uint64(2), stats.HighestOffset)
+	require.NotZero(t, stats.StoreSizeBytes)
+	require.False(t, stats.NewestTimestamp.IsZero())
+
+	res, err = http.Post(srv.URL+"/offsets", "application/json", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+// brokenLog fails every call.
+type brokenLog struct{}
+
+func (brokenLog) LowestOffset() (uint64, error)  { return 0, errors.New("broken") }
+func (brokenLog) HighestOffset() (uint64, error) { return 0, errors.New("broken") }
+func (brokenLog) Count() (uint64, error)         { return 0, errors.New("broken") }
+
+func TestHTTPHandlerUnavailable(t *testing.T) {
+	h := NewHTTPHandler(brokenLog{})
+	for _, path := range []string{"/health", "/offsets"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code, path)
+	}
+}
+
+func TestHTTPGetRecord(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPHandler(clog))
+	defer srv.Close()
+
+	get := func(offset string) *http.Response {
+		res, err := http.Get(srv.URL + "/record/" + offset)
+		require.NoError(t, err)
+		return res
+	}
+	requireStatus := func(offset string, code int) {
+		res := get(offset)
+		res.Body.Close()
+		require.Equal(t, code, res.StatusCode, offset)
+	}
+	requireRecord := func(offset string, want uint64) {
+		res := get(offset)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode, offset)
+		require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		record := &api.Record{}
+		require.NoError(t, protojson.Unmarshal(body, record))
+		require.Equal(t, want, record.Offset, offset)
+		require.Equal(t, fmt.Sprintf("record %d", want), string(record.Value))
+	}
+
+	// an empty log has no record, not even the last one
+	requireStatus("-1", http.StatusNotFound)
+	requireStatus("0", http.StatusNotFound)
+
+	for i := 0; i < 3; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	requireRecord("1", 1)
+	requireRecord("-1", 2)
+	requireRecord("-3", 0)
+	requireStatus("-4", http.StatusNotFound)
+	requireStatus("-9223372036854775808", http.StatusNotFound)
+	requireStatus("3", http.StatusNotFound)
+	requireStatus("x", http.StatusBadRequest)
+
+	// the stream route is still matched before {offset}
+	requireStatus("stream", http.StatusBadRequest)
+}
+
+func TestHTTPRecordStream(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	srv := httptest.NewServer(NewHTTPHandler(clog,
+		WithPingInterval(50*time.Millisecond),
+		WithShutdown(ctx),
+	))
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	dial := func(startOffset uint64) *websocket.Conn {
+		url := fmt.Sprintf("ws%s/record/stream?startOffset=%d",
+			strings.TrimPrefix(srv.URL, "http"), startOffset)
+		ws, err := websocket.Dial(url, "", srv.URL)
+		require.NoError(t, err)
+		return ws
+	}
+	receive := func(ws *websocket.Conn) StreamFrame {
+		require.NoError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var frame StreamFrame
+		require.NoError(t, websocket.JSON.Receive(ws, &frame))
+		return frame
+	}
+	requireRecord := func(frame StreamFrame, off uint64) {
+		require.Equal(t, frameRecord, frame.Type)
+		require.Equal(t, off, *frame.Offset)
+		record := &api.Record{}
+		require.NoError(t, protojson.Unmarshal(frame.Record, record))
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+
+	ws := dial(1)
+	defer ws.Close()
+	requireRecord(receive(ws), 1)
+	requireRecord(receive(ws), 2)
+
+	// idle streams are pinged with the last offset sent
+	ping := receive(ws)
+	require.Equal(t, framePing, ping.Type)
+	require.Equal(t, uint64(2), *ping.Offset)
+
+	// new appends are pushed to open streams
+	_, err = clog.Append(&api.Record{
+		Value:   []byte("record 3"),
+		Headers: map[string]string{"trace-id": "abc"},
+	})
+	require.NoError(t, err)
+	frame := receive(ws)
+	for frame.Type == framePing {
+		frame = receive(ws)
+	}
+	requireRecord(frame, 3)
+	// headers go out as a JSON object
+	var record struct{ Headers map[string]string }
+	require.NoError(t, json.Unmarshal(frame.Record, &record))
+	require.Equal(t, map[string]string{"trace-id": "abc"}, record.Headers)
+
+	// a client resumes from the offset after the last one it saw
+	resumed := dial(*frame.Offset)
+	defer resumed.Close()
+	requireRecord(receive(resumed), 3)
+
+	// shutting down closes every open stream
+	shutdown()
+	for _, ws := range []*websocket.Conn{ws, resumed} {
+		require.NoError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+		var frame StreamFrame
+		for err == nil {
+			err = websocket.JSON.Receive(ws, &frame)
+		}
+		require.ErrorIs(t, err, io.EOF)
+		err = nil
+	}
+
+	res, err := http.Get(srv.URL + "/record/stream?startOffset=nope")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	metrics := NewMetrics(clog)
+	srv, err := newgrpcServer(&Config{
+		CommitLog:  clog,
+		Authorizer: allowAll{},
+		Metrics:    metrics,
+	})
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), subjectContextKey{}, "root")
+	_, err = srv.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+	require.NoError(t, err)
+	_, err = srv.ProduceBatch(ctx, &api.BatchProduceRequest{Records: []*api.Record{
+		{Value: []byte("hello")},
+		{Value: []byte("world")},
+	}})
+	require.NoError(t, err)
+	_, err = srv.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	hsrv := httptest.NewServer(NewHTTPHandler(clog, WithMetrics(metrics)))
+	defer hsrv.Close()
+	res, err := http.Get(hsrv.URL + "/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain"))
+
+	// every sample line is "name[{labels}] value"; keep the last sample of
+	// each name, which for histograms is the +Inf bucket
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	samples := map[string]string{}
+	types := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if fields := strings.Fields(line); strings.HasPrefix(line, "# TYPE ") {
+			types[fields[2]] = fields[3]
+		} else if !strings.HasPrefix(line, "#") {
+			require.Len(t, fields, 2, line)
+			name, _, _ := strings.Cut(fields[0], "{")
+			samples[name] = fields[1]
+		}
+	}
+	require.Equal(t, map[string]string{
+		"log_records_total":           "counter",
+		"log_store_bytes":             "gauge",
+		"log_segment_count":           "gauge",
+		"log_append_duration_seconds": "histogram",
+		"log_read_duration_seconds":   "histogram",
+	}, types)
+	require.Equal(t, "3", samples["log_records_total"])
+	require.Equal(t, fmt.Sprint(clog.Stats().StoreSizeBytes), samples["log_store_bytes"])
+	require.Equal(t, fmt.Sprint(clog.Stats().SegmentCount), samples["log_segment_count"])
+	require.Equal(t, "2", samples["log_append_duration_seconds_bucket"])
+	require.Equal(t, "2", samples["log_append_duration_seconds_count"])
+	require.Equal(t, "1", samples["log_read_duration_seconds_count"])
+
+	// without WithMetrics there is no endpoint
+	hsrv = httptest.NewServer(NewHTTPHandler(clog))
+	defer hsrv.Close()
+	res, err = http.Get(hsrv.URL + "/metrics")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	var readErr error
+	handler := MaxBodyBytes(8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+		var maxErr *http.MaxBytesError
+		if errors.As(readErr, &maxErr) {
+			writeBodyTooLarge(w, maxErr.Limit)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	post := func(body io.Reader) *http.Response {
+		res, err := http.Post(srv.URL, "application/json", body)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := post(strings.NewReader("{}"))
+	res.Body.Close()
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.NoError(t, readErr)
+
+	// a declared Content-Length over the limit never reaches the handler
+	readErr = nil
+	res = post(strings.NewReader(`{"value": "hello world"}`))
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var body map[string]string
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	require.Equal(t, "request body larger than 8 bytes", body["error"])
+	require.NoError(t, readErr)
+
+	// a chunked body is cut off while the handler reads it
+	res = post(io.MultiReader(strings.NewReader(`{"value": `), strings.NewReader(`"hello world"}`)))
+	res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	var maxErr *http.MaxBytesError
+	require.ErrorAs(t, readErr, &maxErr)
+}
+
+func TestHTTPHandlerMaxBodyBytes(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPHandler(clog, WithMaxBodyBytes(16)))
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/offsets", "application/json", strings.NewReader(strings.Repeat("x", 17)))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
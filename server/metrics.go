@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dati/log"
+)
+
+// StatsLog is what Metrics reads its gauges from, and what NewHTTPHandler
+// serves at GET /stats. *log.Log implements it.
+type StatsLog interface {
+	Stats() log.LogStats
+}
+
+// durationBuckets are the upper bounds, in seconds, of the duration
+// histograms. Appends and reads usually take microseconds, so they start well
+// below Prometheus' default buckets.
+var durationBuckets = []float64{
+	0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005,
+	0.01, 0.025, 0.05, 0.1, 0.25, 1,
+}
+
+// Metrics collects the log metrics and serves them in the Prometheus text
+// exposition format. Each server gets its own Metrics, so tests never share
+// state through a global registry. Set it as Config.Metrics so the gRPC
+// server times its appends and reads, and serve it with WithMetrics.
+type Metrics struct {
+	log StatsLog
+
+	mu             sync.Mutex
+	records        uint64
+	appendDuration histogram
+	readDuration   histogram
+}
+
+// NewMetrics returns the metrics for log.
+func NewMetrics(log StatsLog) *Metrics {
+	return &Metrics{
+		log:            log,
+		appendDuration: newHistogram(),
+		readDuration:   newHistogram(),
+	}
+}
+
+// appended records a successful append of n records that began at start. It
+// does nothing on a nil Metrics so callers don't have to check.
+func (m *Metrics) appended(start time.Time, n int) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records += uint64(n)
+	m.appendDuration.observe(d)
+}
+
+// read records a read that began at start.
+func (m *Metrics) read(start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readDuration.observe(d)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes every metric to w in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	stats := m.log.Stats()
+	m.mu.Lock()
+	records := m.records
+	appendDuration := m.appendDuration.clone()
+	readDuration := m.readDuration.clone()
+	m.mu.Unlock()
+
+	e := &expositionWriter{w: w}
+	e.metric("log_records_total", "counter", "Records appended to the log.", float64(records))
+	e.metric("log_store_bytes", "gauge", "Bytes used by the segment stores.", float64(stats.StoreSizeBytes))
+	e.metric("log_segment_count", "gauge", "Open segments.", float64(stats.SegmentCount))
+	e.histogram("log_append_duration_seconds", "Time spent appending to the log.", appendDuration)
+	e.histogram("log_read_duration_seconds", "Time spent reading from the log.", readDuration)
+	return e.n, e.err
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] observations fell in (bucket i-1, bucket i]
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() histogram {
+	return histogram{counts: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, le := range durationBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) clone() histogram {
+	c := *h
+	c.counts = append([]uint64(nil), h.counts...)
+	return c
+}
+
+// expositionWriter keeps the first write error so the metrics can be written
+// without checking each line.
+type expositionWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (e *expositionWriter) printf(format string, args ...any) {
+	if e.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(e.w, format, args...)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *expositionWriter) header(name, kind, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (e *expositionWriter) metric(name, kind, help string, v float64) {
+	e.header(name, kind, help)
+	e.printf("%s %s\n", name, formatFloat(v))
+}
+
+func (e *expositionWriter) histogram(name, help string, h histogram) {
+	e.header(name, "histogram", help)
+	// Prometheus buckets are cumulative.
+	var cumulative uint64
+	for i, le := range durationBuckets {
+		cumulative += h.counts[i]
+		e.printf("%s_bucket{le=%q} %d\n", name, formatFloat(le), cumulative)
+	}
+	e.printf("%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	e.printf("%s_sum %s\n", name, formatFloat(h.sum))
+	e.printf("%s_count %d\n", name, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
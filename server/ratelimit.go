@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "github.com/dati/api/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Per-client limiters not used for staleLimiterAge are dropped by a sweep that
+// runs at most once every limiterSweepInterval.
+const (
+	staleLimiterAge      = time.Minute
+	limiterSweepInterval = time.Minute
+)
+
+const (
+	rateLimitExceededDesc        = "rate limit exceeded"
+	produceRateLimitExceededDesc = "produce rate limit exceeded"
+)
+
+// WithRateLimit limits the RPCs the server accepts to rps per second with
+// bursts of up to burst, shared by all clients. Calls over the limit fail with
+// codes.ResourceExhausted.
+func WithRateLimit(rps float64, burst int) Option {
+	return Option{apply: func(s *grpcServer) {
+		bucket := newTokenBucket(rps, burst)
+		s.limiter = func(string, time.Time) bool {
+			return bucket.allow(time.Now())
+		}
+	}}
+}
+
+// WithPerClientRateLimit is like WithRateLimit but gives each client IP its own
+// limit of rps per second with bursts of up to burst.
+func WithPerClientRateLimit(rps float64, burst int) Option {
+	return Option{apply: func(s *grpcServer) {
+		clients := &clientLimiters{rps: rps, burst: burst}
+		s.limiter = clients.allow
+	}}
+}
+
+// WithProduceRateLimit limits the records each client produces to rps per
+// second with bursts of up to burst. Clients are told apart by the subject of
+// their certificate, so it holds for a client behind any number of addresses.
+// Produce and ProduceBatch calls take one token each, as does every message of
+// a ProduceStream. A call over the limit fails with codes.ResourceExhausted,
+// which also ends a ProduceStream.
+func WithProduceRateLimit(rps float64, burst int) Option {
+	return Option{apply: func(s *grpcServer) {
+		clients := &clientLimiters{rps: rps, burst: burst}
+		s.produceLimiter = clients.allow
+	}}
+}
+
+// tokenBucket holds up to burst tokens and refills at rate tokens per second.
+// Every call takes one token.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rps float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// clientLimiters keeps one tokenBucket per client, by IP or subject.
+type clientLimiters struct {
+	rps       float64
+	burst     int
+	buckets   sync.Map // client IP -> *clientBucket
+	lastSweep atomic.Int64
+}
+
+type clientBucket struct {
+	*tokenBucket
+	seen atomic.Int64 // UnixNano of the last call from the client
+}
+
+func (c *clientLimiters) allow(client string, now time.Time) bool {
+	c.sweep(now)
+	v, ok := c.buckets.Load(client)
+	if !ok {
+		v, _ = c.buckets.LoadOrStore(client, &clientBucket{
+			tokenBucket: newTokenBucket(c.rps, c.burst),
+		})
+	}
+	bucket := v.(*clientBucket)
+	bucket.seen.Store(now.UnixNano())
+	return bucket.allow(now)
+}
+
+// sweep drops the buckets of clients idle for staleLimiterAge. A client that
+// comes back starts with a full bucket, which is what its idle bucket held anyway.
+func (c *clientLimiters) sweep(now time.Time) {
+	last := c.lastSweep.Load()
+	if now.UnixNano()-last < int64(limiterSweepInterval) ||
+		!c.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	c.buckets.Range(func(key, v any) bool {
+		if now.UnixNano()-v.(*clientBucket).seen.Load() > int64(staleLimiterAge) {
+			c.buckets.Delete(key)
+		}
+		return true
+	})
+}
+
+// clientIP returns the IP of the peer that sent the RPC, or its full address
+// if it has no port.
+func clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func (s *grpcServer) rateLimitUnary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	if !s.limiter(clientIP(ctx), time.Now()) {
+		return nil, status.Error(codes.ResourceExhausted, rateLimitExceededDesc)
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) rateLimitStream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if !s.limiter(clientIP(stream.Context()), time.Now()) {
+		return status.Error(codes.ResourceExhausted, rateLimitExceededDesc)
+	}
+	return handler(srv, stream)
+}
+
+// produceLimitUnary runs after authentication, so the subject is known.
+func (s *grpcServer) produceLimitUnary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	switch info.FullMethod {
+	case api.Log_Produce_FullMethodName, api.Log_ProduceBatch_FullMethodName:
+		if !s.produceLimiter(subject(ctx), time.Now()) {
+			return nil, status.Error(codes.ResourceExhausted, produceRateLimitExceededDesc)
+		}
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) produceLimitStream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler,
+) error {
+	if info.FullMethod != api.Log_ProduceStream_FullMethodName {
+		return handler(srv, stream)
+	}
+	client := subject(stream.Context())
+	return handler(srv, &limitedStream{
+		ServerStream: stream,
+		allow: func() bool {
+			return s.produceLimiter(client, time.Now())
+		},
+	})
+}
+
+// limitedStream takes a token for every message received on the stream.
+type limitedStream struct {
+	grpc.ServerStream
+	allow func() bool
+}
+
+func (l *limitedStream) RecvMsg(m interface{}) error {
+	if err := l.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if !l.allow() {
+		return status.Error(codes.ResourceExhausted, produceRateLimitExceededDesc)
+	}
+	return nil
+}
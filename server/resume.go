@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultResumeTokenTTL is how long a resume token stays valid unless
+// WithResumeTokenTTL says otherwise.
+const DefaultResumeTokenTTL = 10 * time.Minute
+
+// WithResumeTokenSecret makes Consume and ConsumeStream return a resume token
+// with every record, signed with secret. A client that reconnects sends the
+// last token it got and the server continues from the next offset. Every
+// server that may receive the token needs the same secret.
+func WithResumeTokenSecret(secret []byte) Option {
+	return Option{apply: func(s *grpcServer) {
+		s.resumeSecret = secret
+	}}
+}
+
+// WithResumeTokenTTL sets how long a resume token is accepted after it was
+// issued. It defaults to DefaultResumeTokenTTL.
+func WithResumeTokenTTL(ttl time.Duration) Option {
+	return Option{apply: func(s *grpcServer) {
+		s.resumeTTL = ttl
+	}}
+}
+
+// A resume token is base64url(payload) "." base64url(HMAC-SHA256(payload)),
+// where payload is the last sent offset and the issue time in Unix
+// nanoseconds, 8 bytes each, followed by the consumer ID.
+const resumePayloadHeader = 16
+
+// resumeToken returns the token to resume after offset, or "" when resume
+// tokens are disabled.
+func (s *grpcServer) resumeToken(ctx context.Context, offset uint64) string {
+	if s.resumeSecret == nil {
+		return ""
+	}
+	payload := make([]byte, resumePayloadHeader, resumePayloadHeader+len(subject(ctx)))
+	binary.BigEndian.PutUint64(payload[:8], offset)
+	binary.BigEndian.PutUint64(payload[8:16], uint64(time.Now().UnixNano()))
+	payload = append(payload, subject(ctx)...)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(s.signResume(payload))
+}
+
+func (s *grpcServer) signResume(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.resumeSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// resume points req at the offset after the one in its resume token, if it
+// has one. Tokens that are forged, expired or issued to another consumer are
+// rejected with Unauthenticated.
+func (s *grpcServer) resume(ctx context.Context, req *api.ConsumeRequest) error {
+	if req.ResumeToken == "" {
+		return nil
+	}
+	if s.resumeSecret == nil {
+		return status.Error(codes.FailedPrecondition, "resume tokens are disabled")
+	}
+	invalid := status.Error(codes.Unauthenticated, "invalid resume token")
+	encPayload, encSig, ok := strings.Cut(req.ResumeToken, ".")
+	if !ok {
+		return invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil || len(payload) < resumePayloadHeader {
+		return invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, s.signResume(payload)) {
+		return invalid
+	}
+	if string(payload[resumePayloadHeader:]) != subject(ctx) {
+		return status.Error(codes.Unauthenticated, "resume token was issued to another consumer")
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:16])))
+	if time.Since(issued) > s.resumeTTL {
+		return status.Error(codes.Unauthenticated, "resume token expired")
+	}
+	req.Offset = binary.BigEndian.Uint64(payload[:8]) + 1
+	return nil
+}
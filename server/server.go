@@ -2,8 +2,15 @@ package server
 
 import (
 	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
 
 	api "github.com/dati/api/v1"
+	"github.com/dati/log"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
@@ -12,13 +19,47 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
+	// CommitLog is the log served. Wrap a *log.Log with log.NewCircuitBreaker
+	// to fail produces fast with Unavailable while its disk keeps failing.
 	CommitLog  CommitLog
 	Authorizer Authorizer
+	// MaxBatchBytes limits the total serialized size of the records in a
+	// ProduceBatch request. Zero means no limit.
+	MaxBatchBytes int
+	// MaxBatchRecords caps the records returned by a single ConsumeRange
+	// call. Zero uses defaultMaxBatchRecords.
+	MaxBatchRecords int
+	// ProducerLog, when set, persists the last sequence committed by each
+	// producer so idempotent produces survive restarts.
+	ProducerLog CommitLog
+	// Metrics, when set, times the server's appends and reads.
+	Metrics *Metrics
+	// MaxInflightProduces caps the ProduceStream appends running at once
+	// across all streams. A stream that can't get a slot stops receiving
+	// until one frees up. Zero means no limit.
+	MaxInflightProduces int
+	// MaxMessageBytes is the largest request message the server accepts, set
+	// with grpc.MaxRecvMsgSize; larger requests, such as an oversized Produce,
+	// fail with ResourceExhausted. Zero keeps gRPC's default of 4 MiB.
+	MaxMessageBytes int
 }
 
+const defaultMaxBatchRecords = 1000
+
+// ConsumeStream polls commit logs that don't implement watcher, waiting
+// between minStreamBackoff and maxStreamBackoff while the log has no new records.
+const (
+	minStreamBackoff = 10 * time.Millisecond
+	maxStreamBackoff = 500 * time.Millisecond
+)
+
+// streamBuffer is how many records a ConsumeStream subscription reads ahead of Send.
+const streamBuffer = 16
+
 const (
 	objectWildcard = "*"
 	produceAction  = "produce"
@@ -30,27 +71,136 @@ var _ api.LogServer = (*grpcServer)(nil)
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	logger *slog.Logger
+
+	producersMu sync.Mutex
+	producers   map[string]*api.ProducerSequence
+
+	// limiter reports whether an RPC from client may run; nil means no limit.
+	limiter func(client string, now time.Time) bool
+	// produceLimiter reports whether the subject client may produce a record;
+	// nil means no limit.
+	produceLimiter func(client string, now time.Time) bool
+
+	// inflight holds a token per ProduceStream append in progress; nil when
+	// MaxInflightProduces is zero. creditsChanged is closed and replaced
+	// whenever a token is taken or returned.
+	inflight       chan struct{}
+	creditsMu      sync.Mutex
+	creditsChanged chan struct{}
+
+	// certs serves the TLS credentials set by WithTLSCredentialsWatcher; nil
+	// when they come from grpc.Creds.
+	certs *certWatcher
+
+	// resumeSecret signs resume tokens; nil disables them.
+	resumeSecret []byte
+	resumeTTL    time.Duration
+}
+
+// Option configures the grpcServer. It is also a grpc.ServerOption so it can
+// be passed to NewGRPCServer alongside the regular grpc options.
+type Option struct {
+	grpc.EmptyServerOption
+	apply func(*grpcServer)
+}
+
+// WithLogger sets the structured logger used by the server.
+func WithLogger(logger *slog.Logger) Option {
+	return Option{apply: func(s *grpcServer) {
+		s.logger = logger
+	}}
 }
 
-func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+func newgrpcServer(config *Config, opts ...Option) (srv *grpcServer, err error) {
 	srv = &grpcServer{
-		Config: config,
+		Config:    config,
+		logger:    slog.Default(),
+		producers: make(map[string]*api.ProducerSequence),
+		resumeTTL: DefaultResumeTokenTTL,
+	}
+	for _, opt := range opts {
+		opt.apply(srv)
+	}
+	if config.MaxInflightProduces > 0 {
+		srv.inflight = make(chan struct{}, config.MaxInflightProduces)
+		srv.creditsChanged = make(chan struct{})
+	}
+	if err := srv.loadProducers(); err != nil {
+		return nil, err
 	}
 	return srv, nil
 }
 
+// loadProducers replays ProducerLog so the latest entry for each producer
+// wins.
+func (s *grpcServer) loadProducers() error {
+	if s.ProducerLog == nil {
+		return nil
+	}
+	for off := uint64(0); ; off++ {
+		record, err := s.ProducerLog.Read(off)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seq := &api.ProducerSequence{}
+		if err := proto.Unmarshal(record.Value, seq); err != nil {
+			return err
+		}
+		s.producers[seq.ProducerId] = seq
+	}
+}
+
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
-	opts = append(opts, grpc.StreamInterceptor(
-		grpc_middleware.ChainStreamServer(
-			grpc_auth.StreamServerInterceptor(authenticate),
-		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-		grpc_auth.UnaryServerInterceptor(authenticate),
-	)))
-	gsrv := grpc.NewServer(opts...)
-	srv, err := newgrpcServer(config)
+	var srvOpts []Option
+	grpcOpts := opts[:0:0]
+	for _, opt := range opts {
+		if o, ok := opt.(Option); ok {
+			srvOpts = append(srvOpts, o)
+			continue
+		}
+		grpcOpts = append(grpcOpts, opt)
+	}
+	srv, err := newgrpcServer(config, srvOpts...)
 	if err != nil {
 		return nil, err
 	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_auth.StreamServerInterceptor(authenticate),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpc_auth.UnaryServerInterceptor(authenticate),
+	}
+	if srv.limiter != nil {
+		// Rejected calls never reach authentication.
+		streamInterceptors = append([]grpc.StreamServerInterceptor{srv.rateLimitStream}, streamInterceptors...)
+		unaryInterceptors = append([]grpc.UnaryServerInterceptor{srv.rateLimitUnary}, unaryInterceptors...)
+	}
+	if srv.produceLimiter != nil {
+		streamInterceptors = append(streamInterceptors, srv.produceLimitStream)
+		unaryInterceptors = append(unaryInterceptors, srv.produceLimitUnary)
+	}
+	if srv.certs != nil {
+		srv.certs.logger = srv.logger
+		creds, err := srv.certs.credentials()
+		if err != nil {
+			return nil, err
+		}
+		grpcOpts = append(grpcOpts, grpc.Creds(creds))
+	}
+	if config.MaxMessageBytes > 0 {
+		// Options passed by the caller come later and win.
+		grpcOpts = append([]grpc.ServerOption{grpc.MaxRecvMsgSize(config.MaxMessageBytes)}, grpcOpts...)
+	}
+	opts = append(grpcOpts, grpc.StreamInterceptor(
+		grpc_middleware.ChainStreamServer(streamInterceptors...),
+	), grpc.UnaryInterceptor(
+		grpc_middleware.ChainUnaryServer(unaryInterceptors...),
+	))
+	gsrv := grpc.NewServer(opts...)
 	api.RegisterLogServer(gsrv, srv)
 	return gsrv, nil
 }
@@ -64,13 +214,120 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	); err != nil {
 		return nil, err
 	}
+	if req.ProducerId != "" {
+		return s.produceSequenced(req)
+	}
+	start := time.Now()
 	offset, err := s.CommitLog.Append(req.Record)
 	if err != nil {
-		return nil, err
+		s.logger.Error("produce failed", slog.Any("error", err))
+		return nil, appendError(err)
 	}
+	s.Metrics.appended(start, 1)
+	s.logger.Debug("produced record", slog.Uint64("offset", offset))
 	return &api.ProduceResponse{Offset: offset}, nil
 }
 
+// produceSequenced appends req only if its sequence number follows the last
+// one committed by the producer. A retry of the last sequence returns the
+// offset it was stored at without appending it again. A producer's first
+// sequence number is 0.
+func (s *grpcServer) produceSequenced(req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	s.producersMu.Lock()
+	defer s.producersMu.Unlock()
+	last, ok := s.producers[req.ProducerId]
+	next := int64(0)
+	if ok {
+		if req.SequenceNumber == last.SequenceNumber {
+			s.logger.Debug("duplicate produce",
+				slog.String("producer", req.ProducerId),
+				slog.Int64("sequence", req.SequenceNumber),
+			)
+			return &api.ProduceResponse{Offset: last.Offset}, nil
+		}
+		next = last.SequenceNumber + 1
+	}
+	if req.SequenceNumber != next {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"producer %q sent sequence %d, expected %d",
+			req.ProducerId,
+			req.SequenceNumber,
+			next,
+		)
+	}
+	start := time.Now()
+	offset, err := s.CommitLog.Append(req.Record)
+	if err != nil {
+		s.logger.Error("produce failed", slog.Any("error", err))
+		return nil, appendError(err)
+	}
+	s.Metrics.appended(start, 1)
+	s.logger.Debug("produced record", slog.Uint64("offset", offset))
+	seq := &api.ProducerSequence{
+		ProducerId:     req.ProducerId,
+		SequenceNumber: req.SequenceNumber,
+		Offset:         offset,
+	}
+	// The record is already in the log, so remember the sequence even if
+	// persisting it fails; a retry is then answered from memory.
+	s.producers[req.ProducerId] = seq
+	if s.ProducerLog != nil {
+		value, err := proto.Marshal(seq)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = s.ProducerLog.Append(&api.Record{Value: value}); err != nil {
+			s.logger.Error("persist producer sequence failed", slog.Any("error", err))
+			return nil, err
+		}
+	}
+	return &api.ProduceResponse{Offset: offset}, nil
+}
+
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.BatchProduceRequest) (*api.BatchProduceResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.MaxBatchBytes > 0 {
+		var size int
+		for _, record := range req.Records {
+			size += proto.Size(record)
+		}
+		if size > s.MaxBatchBytes {
+			return nil, status.Errorf(
+				codes.ResourceExhausted,
+				"batch of %d bytes exceeds the limit of %d bytes",
+				size,
+				s.MaxBatchBytes,
+			)
+		}
+	}
+	start := time.Now()
+	offsets, err := s.CommitLog.AppendBatch(req.Records)
+	if err != nil {
+		s.logger.Error("produce batch failed", slog.Any("error", err))
+		return nil, appendError(err)
+	}
+	s.Metrics.appended(start, len(offsets))
+	s.logger.Debug("produced batch", slog.Int("records", len(offsets)))
+	return &api.BatchProduceResponse{Offsets: offsets}, nil
+}
+
+// appendError returns the error a client gets for a failed append. A write
+// rejected by an open log.CircuitBreaker is Unavailable, so clients back off
+// and retry instead of treating it as an unknown failure.
+func appendError(err error) error {
+	if errors.Is(err, log.ErrCircuitOpen) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
@@ -79,11 +336,97 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	); err != nil {
 		return nil, err
 	}
+	if err := s.resume(ctx, req); err != nil {
+		return nil, err
+	}
+	start := time.Now()
 	record, err := s.CommitLog.Read(req.Offset)
+	s.Metrics.read(start)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ConsumeResponse{Record: record}, nil
+	s.logger.Debug("consumed record", slog.Uint64("offset", req.Offset))
+	return &api.ConsumeResponse{
+		Record:      record,
+		ResumeToken: s.resumeToken(ctx, req.Offset),
+	}, nil
+}
+
+func (s *grpcServer) ConsumeRange(ctx context.Context, req *api.ConsumeRangeRequest) (*api.ConsumeRangeResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	if req.EndOffset < req.StartOffset {
+		return nil, status.Errorf(
+			codes.InvalidArgument,
+			"end offset %d is before start offset %d",
+			req.EndOffset,
+			req.StartOffset,
+		)
+	}
+	return s.readRange(req.StartOffset, req.EndOffset, s.maxBatchRecords())
+}
+
+// ConsumeBatch returns up to MaxRecords records from Offset, stopping at the
+// end of the log. MaxRecords is capped like a ConsumeRange page.
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (*api.ConsumeBatchResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+	max := s.maxBatchRecords()
+	if req.MaxRecords > 0 && int(req.MaxRecords) < max {
+		max = int(req.MaxRecords)
+	}
+	res, err := s.readRange(req.Offset, math.MaxUint64, max)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ConsumeBatchResponse{Records: res.Records}, nil
+}
+
+func (s *grpcServer) maxBatchRecords() int {
+	if s.MaxBatchRecords <= 0 {
+		return defaultMaxBatchRecords
+	}
+	return s.MaxBatchRecords
+}
+
+// readRange reads up to max records in [start, end), skipping deleted ones,
+// with ReadRange when the commit log has it and one Read per offset otherwise.
+func (s *grpcServer) readRange(start, end uint64, max int) (*api.ConsumeRangeResponse, error) {
+	defer s.Metrics.read(time.Now())
+	if r, ok := s.CommitLog.(rangeReader); ok {
+		records, next, err := r.ReadRange(start, end, max)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ConsumeRangeResponse{Records: records, NextOffset: next}, nil
+	}
+	res := &api.ConsumeRangeResponse{NextOffset: start}
+	for res.NextOffset < end && len(res.Records) < max {
+		record, err := s.CommitLog.Read(res.NextOffset)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			break
+		}
+		if errors.As(err, &api.ErrRecordDeleted{}) {
+			res.NextOffset++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Records = append(res.Records, record)
+		res.NextOffset++
+	}
+	return res, nil
 }
 
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
@@ -92,30 +435,137 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 		if err != nil {
 			return err
 		}
+		// Until a token frees up the stream isn't read, so the producer's
+		// sends back up into the transport's flow control.
+		if err = s.acquireProduce(stream.Context()); err != nil {
+			return err
+		}
 		res, err := s.Produce(stream.Context(), req)
+		if err == nil {
+			err = stream.Send(res)
+		}
+		s.releaseProduce()
 		if err != nil {
 			return err
 		}
-		if err = stream.Send(res); err != nil {
-			return err
+	}
+}
+
+// ProduceStreamCredits streams the free ProduceStream slots, sending the
+// current count first and then every change.
+func (s *grpcServer) ProduceStreamCredits(req *api.CreditsRequest, stream api.Log_ProduceStreamCreditsServer) error {
+	if err := s.Authorizer.Authorize(
+		subject(stream.Context()),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return err
+	}
+	if s.inflight == nil {
+		return status.Error(codes.FailedPrecondition, "produce flow control is disabled")
+	}
+	last := int32(-1)
+	for {
+		credits, changed := s.credits()
+		if credits != last {
+			if err := stream.Send(&api.CreditsResponse{Credits: credits}); err != nil {
+				return err
+			}
+			last = credits
 		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+func (s *grpcServer) acquireProduce(ctx context.Context) error {
+	if s.inflight == nil {
+		return nil
+	}
+	select {
+	case s.inflight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+	s.creditsUpdated()
+	return nil
+}
+
+func (s *grpcServer) releaseProduce() {
+	if s.inflight == nil {
+		return
+	}
+	<-s.inflight
+	s.creditsUpdated()
+}
+
+func (s *grpcServer) creditsUpdated() {
+	s.creditsMu.Lock()
+	defer s.creditsMu.Unlock()
+	close(s.creditsChanged)
+	s.creditsChanged = make(chan struct{})
+}
+
+// credits returns the free slots and a channel closed on the next change.
+func (s *grpcServer) credits() (int32, <-chan struct{}) {
+	s.creditsMu.Lock()
+	defer s.creditsMu.Unlock()
+	return int32(cap(s.inflight) - len(s.inflight)), s.creditsChanged
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	// The token only picks the first offset; Consume then sees plain offsets.
+	if err := s.resume(stream.Context(), req); err != nil {
+		return err
+	}
+	req.ResumeToken = ""
+	if sub, ok := s.CommitLog.(subscriber); ok {
+		return s.consumeSubscription(stream, req, sub)
+	}
+	w, watchable := s.CommitLog.(watcher)
+	backoff := minStreamBackoff
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
 		default:
+			// Grab the watch channel before reading so an append that lands
+			// between the read and the wait still wakes us up.
+			var appended <-chan struct{}
+			if watchable {
+				appended = w.Watch()
+			}
 			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
+			if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+				// Logs that can't signal appends are polled with a growing
+				// backoff so an idle stream doesn't burn a core.
+				var retry <-chan time.Time
+				if !watchable {
+					retry = time.After(backoff)
+					if backoff *= 2; backoff > maxStreamBackoff {
+						backoff = maxStreamBackoff
+					}
+				}
+				select {
+				case <-stream.Context().Done():
+					return nil
+				case <-appended:
+				case <-retry:
+				}
 				continue
-			default:
+			}
+			if errors.As(err, &api.ErrRecordDeleted{}) {
+				// Deleted records are skipped, not an end of stream.
+				req.Offset++
+				continue
+			}
+			if err != nil {
 				return err
 			}
+			backoff = minStreamBackoff
 			if err = stream.Send(res); err != nil {
 				return err
 			}
@@ -124,11 +574,65 @@ func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_Consu
 	}
 }
 
+// consumeSubscription drives ConsumeStream from the log's own subscription,
+// which already skips deleted records and waits for appends at the end.
+func (s *grpcServer) consumeSubscription(stream api.Log_ConsumeStreamServer, req *api.ConsumeRequest, sub subscriber) error {
+	ctx := stream.Context()
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	records, errs := sub.Subscribe(ctx, req.Offset, streamBuffer)
+	for record := range records {
+		if err := stream.Send(&api.ConsumeResponse{
+			Record:      record,
+			ResumeToken: s.resumeToken(ctx, record.Offset),
+		}); err != nil {
+			return err
+		}
+	}
+	// The record channel closes once the subscription is over.
+	switch err := <-errs; {
+	case err == nil:
+		return nil // The client went away.
+	case errors.Is(err, io.EOF):
+		return status.Error(codes.Unavailable, "log closed")
+	default:
+		return err
+	}
+}
+
+// CommitLog is the log the server produces to and consumes from. *log.Log
+// implements it, and tests can pass an in-memory implementation instead.
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) ([]uint64, error)
 	Read(uint64) (*api.Record, error)
 }
 
+// watcher is implemented by commit logs that can signal new appends, letting
+// ConsumeStream block at the end of the log instead of polling it.
+type watcher interface {
+	Watch() <-chan struct{}
+}
+
+// subscriber is implemented by commit logs that publish their records on a
+// channel, letting ConsumeStream forward them instead of reading each offset.
+type subscriber interface {
+	Subscribe(ctx context.Context, startOffset uint64, bufSize int) (<-chan *api.Record, <-chan error)
+}
+
+// rangeReader is implemented by commit logs that can read a page of records
+// in one call, letting ConsumeRange skip the per-offset Read loop.
+type rangeReader interface {
+	ReadRange(start, end uint64, limit int) ([]*api.Record, uint64, error)
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
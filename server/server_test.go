@@ -1,15 +1,25 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	api "github.com/dati/api/v1"
 	"github.com/dati/auth"
+	logclient "github.com/dati/client"
 	tlsconfig "github.com/dati/config"
 	"github.com/dati/log"
+	"github.com/dati/log/memlog"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
@@ -29,6 +39,7 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
 		"test all endpoints from an unauthorized user":        testUnauthorized,
+		"produce batch succeeds":                              testProduceBatch,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -41,7 +52,7 @@ func TestServer(t *testing.T) {
 // END: intro
 
 // START: setup
-func setupTest(t *testing.T, fn func(*Config)) (
+func setupTest(t testing.TB, fn func(*Config), opts ...grpc.ServerOption) (
 	rootClient api.LogClient,
 	nobodyClient api.LogClient,
 	config *Config,
@@ -109,7 +120,7 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	if fn != nil {
 		fn(config)
 	}
-	server, err := NewGRPCServer(config, grpc.Creds(serverCreds))
+	server, err := NewGRPCServer(config, append(opts, grpc.Creds(serverCreds))...)
 	require.NoError(t, err)
 
 	go func() {
@@ -131,7 +142,8 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	ctx := context.Background()
 
 	want := &api.Record{
-		Value: []byte("hello world"),
+		Value:   []byte("hello world"),
+		Headers: map[string]string{"event-type": "greeting"},
 	}
 
 	produce, err := client.Produce(
@@ -148,6 +160,7 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	require.NoError(t, err)
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	require.Equal(t, want.Headers, consume.Record.Headers)
 }
 
 // END: produceconsume
@@ -226,14 +239,474 @@ func testProduceConsumeStream(
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			// the log stamps each record with the time it was appended
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 	}
 }
 
+func testProduceBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	res, err := client.ProduceBatch(ctx, &api.BatchProduceRequest{
+		Records: records,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, res.Offsets)
+
+	for i, off := range res.Offsets {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		require.NoError(t, err)
+		require.Equal(t, records[i].Value, consume.Record.Value)
+	}
+}
+
+func TestProduceBatchLimit(t *testing.T) {
+	client, nobodyClient, _, teardown := setupTest(t, func(config *Config) {
+		config.MaxBatchBytes = 32
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.ProduceBatch(ctx, &api.BatchProduceRequest{
+		Records: []*api.Record{{Value: []byte("hello world")}},
+	})
+	require.NoError(t, err)
+
+	_, err = client.ProduceBatch(ctx, &api.BatchProduceRequest{
+		Records: []*api.Record{
+			{Value: []byte("hello world")},
+			{Value: []byte("hello world")},
+			{Value: []byte("hello world")},
+		},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = nobodyClient.ProduceBatch(ctx, &api.BatchProduceRequest{
+		Records: []*api.Record{{Value: []byte("hello world")}},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestProduceCircuitOpen(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		// An index too small for any entry fails every append, like a full disk.
+		var c log.Config
+		c.Segment.MaxIndexBytes = 1
+		clog, err := log.NewLog(t.TempDir(), c)
+		require.NoError(t, err)
+		config.CommitLog = log.NewCircuitBreaker(clog, log.CircuitBreakerConfig{
+			MaxFailures:          1,
+			HalfOpenWaitDuration: time.Hour,
+		})
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Error(t, err)
+	require.NotEqual(t, codes.Unavailable, status.Code(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = client.ProduceBatch(ctx, &api.BatchProduceRequest{
+		Records: []*api.Record{{Value: []byte("hello world")}},
+	})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.MaxMessageBytes = 1024
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, 2048)},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestRateLimit(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"shared":     WithRateLimit(1, 10),
+		"per client": WithPerClientRateLimit(1, 10),
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, _, _, teardown := setupTest(t, nil, opt)
+			defer teardown()
+
+			var wg sync.WaitGroup
+			codesSeen := make(chan codes.Code, 100)
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := client.Produce(context.Background(), &api.ProduceRequest{
+						Record: &api.Record{Value: []byte("hello world")},
+					})
+					codesSeen <- status.Code(err)
+				}()
+			}
+			wg.Wait()
+			close(codesSeen)
+			counts := make(map[codes.Code]int)
+			for code := range codesSeen {
+				counts[code]++
+			}
+			require.NotZero(t, counts[codes.OK])
+			require.NotZero(t, counts[codes.ResourceExhausted])
+			require.Equal(t, 100, counts[codes.OK]+counts[codes.ResourceExhausted])
+		})
+	}
+}
+
+func TestProduceRateLimit(t *testing.T) {
+	client, nobodyClient, _, teardown := setupTest(t, nil, WithProduceRateLimit(1, 5))
+	defer teardown()
+	ctx := context.Background()
+
+	counts := make(map[codes.Code]int)
+	for i := 0; i < 20; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		counts[status.Code(err)]++
+	}
+	require.NotZero(t, counts[codes.OK])
+	require.NotZero(t, counts[codes.ResourceExhausted])
+	require.Equal(t, 20, counts[codes.OK]+counts[codes.ResourceExhausted])
+
+	_, err := client.ProduceBatch(ctx, &api.BatchProduceRequest{
+		Records: []*api.Record{{Value: []byte("hello world")}},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// other clients keep their own limit, and reads aren't limited
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+}
+
+func TestClientLimitersSweep(t *testing.T) {
+	c := &clientLimiters{rps: 1, burst: 1}
+	now := time.Now()
+	require.True(t, c.allow("10.0.0.1", now))
+	require.False(t, c.allow("10.0.0.1", now))
+	require.True(t, c.allow("10.0.0.2", now))
+
+	// only the client that kept calling survives the next sweep
+	later := now.Add(staleLimiterAge / 2)
+	c.allow("10.0.0.2", later)
+	c.allow("10.0.0.2", now.Add(staleLimiterAge+time.Second))
+	_, ok := c.buckets.Load("10.0.0.1")
+	require.False(t, ok)
+	_, ok = c.buckets.Load("10.0.0.2")
+	require.True(t, ok)
+}
+
+func TestProduceIdempotent(t *testing.T) {
+	producerLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer producerLog.Close()
+	client, _, config, teardown := setupTest(t, func(config *Config) {
+		config.ProducerLog = producerLog
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	req := &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("hello world")},
+		ProducerId:     "producer-1",
+		SequenceNumber: 0,
+	}
+	first, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+
+	// a retransmission returns the original offset without appending again
+	retry, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset, retry.Offset)
+	_, err = config.CommitLog.Read(first.Offset + 1)
+	require.Error(t, err)
+
+	req.SequenceNumber = 2
+	_, err = client.Produce(ctx, req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	req.SequenceNumber = 1
+	second, err := client.Produce(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, first.Offset+1, second.Offset)
+
+	// a restarted server picks the sequences back up from the producer log
+	srv, err := newgrpcServer(&Config{ProducerLog: producerLog})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), srv.producers["producer-1"].SequenceNumber)
+	require.Equal(t, second.Offset, srv.producers["producer-1"].Offset)
+}
+
+func TestConsumeRange(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.MaxBatchRecords = 2
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.ConsumeRange(ctx, &api.ConsumeRangeRequest{
+		StartOffset: 1,
+		EndOffset:   10,
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, uint64(1), res.Records[0].Offset)
+	require.Equal(t, uint64(3), res.NextOffset)
+
+	records, err := logclient.FetchAll(ctx, client, 1, 4)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	for i, record := range records {
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i+1)), record.Value)
+	}
+
+	// past the end of the log the pages just stop
+	records, err = logclient.FetchAll(ctx, client, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+
+	_, err = client.ConsumeRange(ctx, &api.ConsumeRangeRequest{
+		StartOffset: 4,
+		EndOffset:   2,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestConsumeBatch(t *testing.T) {
+	client, nobody, config, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	// asking for more records than the log has stops at the end
+	res, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{MaxRecords: 100})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 50)
+	for i, record := range res.Records {
+		require.Equal(t, uint64(i), record.Offset)
+	}
+
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 45, MaxRecords: 3})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 3)
+	require.Equal(t, []byte("record 45"), res.Records[0].Value)
+
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 50, MaxRecords: 10})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+
+	// logs without ReadRange are read one offset at a time
+	config.CommitLog = pollingLog{config.CommitLog}
+	res, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 40, MaxRecords: 100})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 10)
+
+	_, err = nobody.ConsumeBatch(ctx, &api.ConsumeBatchRequest{MaxRecords: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestConsumeStreamIdle(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	// while the log is empty the stream should wait, not spin
+	before := cpuTime(t)
+	time.Sleep(300 * time.Millisecond)
+	used := cpuTime(t) - before
+	require.Less(t, used, 100*time.Millisecond)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), res.Record.Value)
+}
+
+type allowAll struct{}
+
+func (allowAll) Authorize(subject, object, action string) error {
+	return nil
+}
+
+func TestServerMemLog(t *testing.T) {
+	// the server is called directly, without a listener or a log on disk
+	srv, err := newgrpcServer(&Config{
+		CommitLog:  memlog.NewInMemoryLog(0),
+		Authorizer: allowAll{},
+	})
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), subjectContextKey{}, "root")
+
+	for i, value := range []string{"first", "second"} {
+		produce, err := srv.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), produce.Offset)
+
+		consume, err := srv.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), consume.Record.Value)
+		require.Equal(t, produce.Offset, consume.Record.Offset)
+	}
+
+	_, err = srv.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, want, status.Code(err))
+}
+
+// pollingLog hides the log's Watch method so ConsumeStream has to poll it.
+type pollingLog struct {
+	CommitLog
+}
+
+func TestConsumeStreamPolling(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = pollingLog{c.CommitLog}
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	// without Watch the stream backs off between reads instead of spinning
+	before := cpuTime(t)
+	time.Sleep(300 * time.Millisecond)
+	used := cpuTime(t) - before
+	require.Less(t, used, 100*time.Millisecond)
+
+	for _, value := range []string{"first", "second"} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), res.Record.Value)
+	}
+}
+
+// cpuTime returns the user plus system CPU time used by the test process.
+func cpuTime(t *testing.T) time.Duration {
+	var usage syscall.Rusage
+	require.NoError(t, syscall.Getrusage(syscall.RUSAGE_SELF, &usage))
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func BenchmarkProduce(b *testing.B) {
+	const batchSize = 1000
+	value := []byte("hello world")
+	for _, n := range []int{10_000, 100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("single/%d", n), func(b *testing.B) {
+			client, _, _, teardown := setupTest(b, benchmarkLog(b))
+			defer teardown()
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < n; j++ {
+					_, err := client.Produce(ctx, &api.ProduceRequest{
+						Record: &api.Record{Value: value},
+					})
+					require.NoError(b, err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("batch/%d", n), func(b *testing.B) {
+			client, _, _, teardown := setupTest(b, benchmarkLog(b))
+			defer teardown()
+			ctx := context.Background()
+			records := make([]*api.Record, batchSize)
+			for i := range records {
+				records[i] = &api.Record{Value: value}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < n; j += batchSize {
+					_, err := client.ProduceBatch(ctx, &api.BatchProduceRequest{
+						Records: records,
+					})
+					require.NoError(b, err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkLog swaps the test log for one with segments big enough to hold
+// every record the benchmark produces.
+func benchmarkLog(b *testing.B) func(*Config) {
+	return func(config *Config) {
+		c := log.Config{}
+		c.Segment.MaxStoreBytes = 1 << 30
+		c.Segment.MaxIndexBytes = 1 << 30
+		clog, err := log.NewLog(b.TempDir(), c)
+		require.NoError(b, err)
+		config.CommitLog = clog
+	}
+}
+
 func testUnauthorized(
 	t *testing.T, _, client api.LogClient, config *Config,
 ) {
@@ -262,3 +735,211 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+// syncBuffer lets the server goroutines and the test share the log output.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServerLogger(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+	}))
+	client, _, _, teardown := setupTest(t, nil, WithLogger(logger))
+	defer teardown()
+
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+
+	require.Contains(t, out.String(), "msg=\"produced record\" offset=0")
+	require.Contains(t, out.String(), "msg=\"consumed record\" offset=0")
+}
+
+// blockingLog holds every Append until unblock is closed.
+type blockingLog struct {
+	CommitLog
+	appends chan struct{}
+	unblock chan struct{}
+}
+
+func (l blockingLog) Append(record *api.Record) (uint64, error) {
+	l.appends <- struct{}{}
+	<-l.unblock
+	return l.CommitLog.Append(record)
+}
+
+func TestProduceStreamCredits(t *testing.T) {
+	blocking := blockingLog{
+		appends: make(chan struct{}, 10),
+		unblock: make(chan struct{}),
+	}
+	client, _, _, teardown := setupTest(t, func(c *Config) {
+		blocking.CommitLog = c.CommitLog
+		c.CommitLog = blocking
+		c.MaxInflightProduces = 1
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	credits, err := client.ProduceStreamCredits(ctx, &api.CreditsRequest{})
+	require.NoError(t, err)
+	requireCredits := func(want int32) {
+		res, err := credits.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Credits)
+	}
+	requireCredits(1)
+
+	produce := func(value string) api.Log_ProduceStreamClient {
+		stream, err := client.ProduceStream(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		}))
+		return stream
+	}
+
+	// the first producer takes the only slot and blocks in Append
+	first := produce("first")
+	<-blocking.appends
+	requireCredits(0)
+
+	// the second producer waits for the slot instead of appending
+	second := produce("second")
+	select {
+	case <-blocking.appends:
+		t.Fatal("second producer appended while the semaphore was full")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(blocking.unblock)
+	for i, stream := range []api.Log_ProduceStreamClient{first, second} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	<-blocking.appends
+
+	// once both are done every slot is free again
+	for {
+		res, err := credits.Recv()
+		require.NoError(t, err)
+		if res.Credits == 1 {
+			break
+		}
+	}
+}
+
+func TestProduceStreamCreditsDisabled(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	credits, err := client.ProduceStreamCredits(context.Background(), &api.CreditsRequest{})
+	require.NoError(t, err)
+	_, err = credits.Recv()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestConsumeStreamResume(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil,
+		WithResumeTokenSecret([]byte("server secret")),
+		WithResumeTokenTTL(time.Second),
+	)
+	defer teardown()
+
+	for i := 0; i < 4; i++ {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))},
+		})
+		require.NoError(t, err)
+	}
+
+	// the consumer reads two records and then its connection drops
+	ctx, drop := context.WithCancel(context.Background())
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	var token string
+	for i := 0; i < 2; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+		require.NotEmpty(t, res.ResumeToken)
+		token = res.ResumeToken
+	}
+	drop()
+
+	// reconnecting with the last token resumes after the last record seen,
+	// whatever offset the request carries
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{ResumeToken: token})
+	require.NoError(t, err)
+	for i := 2; i < 4; i++ {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), res.Record.Value)
+	}
+
+	// unary Consume honors tokens too
+	res, err := client.Consume(context.Background(), &api.ConsumeRequest{Offset: 3, ResumeToken: token})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+
+	resumeErr := func(token string) error {
+		stream, err := client.ConsumeStream(context.Background(), &api.ConsumeRequest{ResumeToken: token})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		return err
+	}
+	// a token with a tampered offset is rejected
+	encPayload, sig, _ := strings.Cut(token, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	require.NoError(t, err)
+	payload[7]++
+	forged := base64.RawURLEncoding.EncodeToString(payload) + "." + sig
+	require.Equal(t, codes.Unauthenticated, status.Code(resumeErr(forged)))
+	require.Equal(t, codes.Unauthenticated, status.Code(resumeErr("garbage")))
+
+	// and so is an expired one
+	time.Sleep(time.Second)
+	err = resumeErr(token)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Contains(t, err.Error(), "expired")
+}
+
+func TestConsumeResumeDisabled(t *testing.T) {
+	client, _, _, teardown := setupTest(t, nil)
+	defer teardown()
+
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	res, err := client.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	require.Empty(t, res.ResumeToken)
+
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{ResumeToken: "token"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// DefaultPingInterval is how long a record stream may stay idle before the
+// server sends a ping.
+const DefaultPingInterval = 15 * time.Second
+
+// RecordLog is what GET /record/stream needs on top of OffsetLog. *log.Log
+// implements it; logs that also implement Watch are followed without polling.
+type RecordLog interface {
+	OffsetLog
+	Read(uint64) (*api.Record, error)
+}
+
+// StreamFrame is a JSON frame sent over GET /record/stream. Record frames carry
+// the record and its offset. Ping frames carry the offset of the last record
+// sent, or no offset if none was sent yet; a client that reconnects with
+// startOffset=offset+1 resumes where it left off.
+type StreamFrame struct {
+	Type   string          `json:"type"`
+	Offset *uint64         `json:"offset,omitempty"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+const (
+	frameRecord = "record"
+	framePing   = "ping"
+)
+
+// streamRecords upgrades the request to a WebSocket and streams the log from
+// startOffset, the query parameter, which defaults to 0.
+func (h *httpHandler) streamRecords(log RecordLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var start uint64
+		if s := r.URL.Query().Get("startOffset"); s != "" {
+			off, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid startOffset", http.StatusBadRequest)
+				return
+			}
+			start = off
+		}
+		// The stream is read-only, so any origin may subscribe to it.
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			if err := h.stream(ws, log, start); err != nil {
+				slog.Error("record stream failed", slog.Any("error", err))
+			}
+		}}.ServeHTTP(w, r)
+	}
+}
+
+func (h *httpHandler) stream(ws *websocket.Conn, log RecordLog, next uint64) error {
+	ctx, cancel := context.WithCancel(h.ctx)
+	defer cancel()
+	// The client never sends anything we act on, but reading is how we
+	// notice that it went away.
+	go func() {
+		defer cancel()
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	w, watchable := log.(watcher)
+	ping := time.NewTicker(h.pingInterval)
+	defer ping.Stop()
+	var last *uint64
+	backoff := minStreamBackoff
+	for {
+		var appended <-chan struct{}
+		if watchable {
+			appended = w.Watch()
+		}
+		record, err := log.Read(next)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			// Offsets below the lowest were truncated away and will never
+			// come back, so jump ahead instead of waiting for them.
+			if lowest, err := log.LowestOffset(); err == nil && next < lowest {
+				next = lowest
+				continue
+			}
+			var retry <-chan time.Time
+			if !watchable {
+				retry = time.After(backoff)
+				if backoff *= 2; backoff > maxStreamBackoff {
+					backoff = maxStreamBackoff
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ping.C:
+				if err := websocket.JSON.Send(ws, StreamFrame{Type: framePing, Offset: last}); err != nil {
+					return nil
+				}
+			case <-appended:
+			case <-retry:
+			}
+			continue
+		}
+		if errors.As(err, &api.ErrRecordDeleted{}) {
+			next++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		backoff = minStreamBackoff
+		value, err := protojson.Marshal(record)
+		if err != nil {
+			return err
+		}
+		offset := next
+		if err := websocket.JSON.Send(ws, StreamFrame{Type: frameRecord, Offset: &offset, Record: value}); err != nil {
+			// The client disconnected.
+			return nil
+		}
+		last = &offset
+		next++
+		ping.Reset(h.pingInterval)
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// WithTLSCredentialsWatcher serves mutual TLS with the certificate and key in
+// certFile and keyFile, accepting client certificates signed by a CA in
+// caFile. The files are read again at most once per interval, on the first
+// handshake after it passes, so certificates rotated on disk are used without
+// restarting the server; connections already open keep their certificate.
+//
+// caFile may also hold PEM "X509 CRL" blocks, and client certificates they
+// revoke are rejected. A reload that fails, for example on a half-written
+// file, is logged and the server keeps the last files that loaded.
+//
+// It replaces grpc.Creds: don't pass both.
+func WithTLSCredentialsWatcher(certFile, keyFile, caFile string, interval time.Duration) Option {
+	return Option{apply: func(s *grpcServer) {
+		s.certs = &certWatcher{
+			certFile: certFile,
+			keyFile:  keyFile,
+			caFile:   caFile,
+			interval: interval,
+		}
+	}}
+}
+
+// certWatcher hands out the TLS config for each handshake, reloading it when
+// the files change.
+type certWatcher struct {
+	certFile, keyFile, caFile string
+	interval                  time.Duration
+	logger                    *slog.Logger
+
+	mu      sync.RWMutex
+	config  *tls.Config
+	files   [3][]byte           // Contents of certFile, keyFile and caFile in config
+	revoked map[string]struct{} // Serial numbers revoked by the CRLs in caFile
+	checked time.Time           // When the files were last read
+}
+
+// credentials loads the files and returns the transport credentials that use
+// them.
+func (w *certWatcher) credentials() (credentials.TransportCredentials, error) {
+	if err := w.reload(time.Now()); err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		GetConfigForClient: w.configForClient,
+	}), nil
+}
+
+func (w *certWatcher) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	now := time.Now()
+	w.mu.RLock()
+	due := now.Sub(w.checked) >= w.interval
+	w.mu.RUnlock()
+	if due {
+		if err := w.reload(now); err != nil {
+			w.logger.Error("reload TLS credentials failed", slog.Any("error", err))
+		}
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.config, nil
+}
+
+// reload reads the files and, if any changed, builds a new config from them.
+func (w *certWatcher) reload(now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.config != nil && now.Sub(w.checked) < w.interval {
+		return nil // Another handshake reloaded them first
+	}
+	w.checked = now
+	var files [3][]byte
+	for i, name := range []string{w.certFile, w.keyFile, w.caFile} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files[i] = b
+	}
+	if w.config != nil && bytes.Equal(files[0], w.files[0]) &&
+		bytes.Equal(files[1], w.files[1]) && bytes.Equal(files[2], w.files[2]) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(files[0], files[1])
+	if err != nil {
+		return err
+	}
+	cas, revoked, err := parseCAFile(files[2])
+	if err != nil {
+		return fmt.Errorf("%s: %w", w.caFile, err)
+	}
+	w.config = &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		ClientCAs:             cas,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		NextProtos:            []string{"h2"}, // credentials.NewTLS only sets it on the outer config
+		VerifyPeerCertificate: w.verifyNotRevoked,
+	}
+	if w.files[0] != nil {
+		w.logger.Info("reloaded TLS credentials", slog.String("cert", w.certFile))
+	}
+	w.files, w.revoked = files, revoked
+	return nil
+}
+
+// verifyNotRevoked rejects a client certificate revoked by a CRL in caFile.
+func (w *certWatcher) verifyNotRevoked(_ [][]byte, chains [][]*x509.Certificate) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, chain := range chains {
+		if _, ok := w.revoked[chain[0].SerialNumber.String()]; ok {
+			return fmt.Errorf("certificate %s is revoked", chain[0].SerialNumber)
+		}
+	}
+	return nil
+}
+
+// parseCAFile returns the certificates in b as a pool and the serial numbers
+// revoked by its CRLs. Each CRL must be signed by one of the certificates.
+func parseCAFile(b []byte) (*x509.CertPool, map[string]struct{}, error) {
+	pool := x509.NewCertPool()
+	var certs []*x509.Certificate
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			pool.AddCert(cert)
+			certs = append(certs, cert)
+		case "X509 CRL":
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			crls = append(crls, crl)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no CA certificate found")
+	}
+	revoked := make(map[string]struct{})
+	for _, crl := range crls {
+		if !signedByAny(crl, certs) {
+			return nil, nil, fmt.Errorf("CRL from %s is not signed by a CA in the file", crl.Issuer)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[entry.SerialNumber.String()] = struct{}{}
+		}
+	}
+	return pool, revoked, nil
+}
+
+func signedByAny(crl *x509.RevocationList, certs []*x509.Certificate) bool {
+	for _, cert := range certs {
+		if crl.CheckSignatureFrom(cert) == nil {
+			return true
+		}
+	}
+	return false
+}
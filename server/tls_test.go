@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/dati/api/v1"
+	"github.com/dati/auth"
+	tlsconfig "github.com/dati/config"
+	"github.com/dati/log"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestTLSCredentialsWatcher(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server-key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	ca, caKey := newTestCert(t, nil, nil, "ca", time.Hour)
+	writePEM(t, caFile, "CERTIFICATE", ca.Raw)
+	expiresAt := time.Now().Add(2 * time.Second)
+	writeServerCert(t, certFile, keyFile, ca, caKey, time.Until(expiresAt))
+	client, clientKey := newTestCert(t, ca, caKey, "root", time.Hour)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	server, err := NewGRPCServer(&Config{
+		CommitLog:  clog,
+		Authorizer: auth.New(tlsconfig.ACLModelFile, tlsconfig.ACLPolicyFile),
+	}, WithTLSCredentialsWatcher(certFile, keyFile, caFile, 100*time.Millisecond))
+	require.NoError(t, err)
+	go server.Serve(l)
+	defer server.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	produce := func() error {
+		conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(
+			credentials.NewTLS(&tls.Config{
+				Certificates: []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}},
+				RootCAs:      roots,
+			}),
+		))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = api.NewLogClient(conn).Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		return err
+	}
+	require.NoError(t, produce())
+
+	// the certificate rotates on disk and the server picks it up once the
+	// original one has expired
+	writeServerCert(t, certFile, keyFile, ca, caKey, time.Hour)
+	time.Sleep(time.Until(expiresAt) + 200*time.Millisecond)
+	require.NoError(t, produce())
+
+	// a CRL in the CA file revokes the client certificate
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(1),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: client.SerialNumber, RevocationTime: time.Now()},
+		},
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, ca, caKey)
+	require.NoError(t, err)
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})...)
+	require.NoError(t, os.WriteFile(caFile, b, 0644))
+	time.Sleep(200 * time.Millisecond)
+	require.Error(t, produce())
+}
+
+// newTestCert creates a certificate for cn valid for ttl, signed by parent, or
+// a self-signed CA when parent is nil.
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, cn string, ttl time.Duration) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func writeServerCert(t *testing.T, certFile, keyFile string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, ttl time.Duration) {
+	t.Helper()
+	cert, key := newTestCert(t, ca, caKey, "server", ttl)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	writePEM(t, certFile, "CERTIFICATE", cert.Raw)
+}
+
+func writePEM(t *testing.T, name, blockType string, der []byte) {
+	t.Helper()
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(name, b, 0644))
+}